@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	"github.com/moonkev/flexds/pkg/flexds"
+)
+
+// problemCounter is a slog handler counting the records logged through it that fail a dry run: errors,
+// and warnings about rejected or ignored configuration such as skipped routes. Other warnings can
+// describe deliberate settings, like disabled upstream TLS verification, and only count when strict.
+type problemCounter struct {
+	slog.Handler
+	strict bool
+	count  *atomic.Int64
+}
+
+func newProblemCounter(handler slog.Handler, strict bool) problemCounter {
+	return problemCounter{Handler: handler, strict: strict, count: &atomic.Int64{}}
+}
+
+func (h problemCounter) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.Handler.Enabled(ctx, level)
+}
+
+func (h problemCounter) Handle(ctx context.Context, r slog.Record) error {
+	if isProblem(r, h.strict) {
+		h.count.Add(1)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h problemCounter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return problemCounter{Handler: h.Handler.WithAttrs(attrs), strict: h.strict, count: h.count}
+}
+
+func (h problemCounter) WithGroup(name string) slog.Handler {
+	return problemCounter{Handler: h.Handler.WithGroup(name), strict: h.strict, count: h.count}
+}
+
+// isProblem reports whether a record fails a dry run
+func isProblem(r slog.Record, strict bool) bool {
+	switch {
+	case r.Level >= slog.LevelError:
+		return true
+	case r.Level < slog.LevelWarn:
+		return false
+	case strict:
+		return true
+	}
+	invalid := false
+	r.Attrs(func(attr slog.Attr) bool {
+		invalid = attr.Key == telemetry.InvalidConfigKey
+		return !invalid
+	})
+	return invalid
+}
+
+// runDryRun prints the snapshot built from one round of discovery to stdout, returning the exit code:
+// 1 if the snapshot can't be built or a problem was logged along the way
+func runDryRun(controlPlane *flexds.ControlPlane, timeout time.Duration, problems problemCounter) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := controlPlane.DryRun(ctx, os.Stdout); err != nil {
+		slog.Error("dry run failed", "error", err)
+		return 1
+	}
+	if n := problems.count.Load(); n > 0 {
+		slog.Error(fmt.Sprintf("dry run logged %d errors or configuration problems, see above", n))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/moonkev/flexds/internal/common/telemetry"
+)
+
+func TestProblemCounter(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		want   int64
+	}{
+		{name: "default", want: 2},
+		{name: "strict", strict: true, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := newProblemCounter(slog.NewTextHandler(io.Discard, nil), tt.strict)
+			logger := slog.New(problems)
+
+			logger.Info("Snapshot pushed")
+			logger.Warn("Upstream TLS certificate verification disabled", "service", "orders")
+			logger.Warn("Skipping misconfigured route", "service", "orders", telemetry.InvalidConfigKey, "route")
+			logger.Error("Failed to build TCP listener", "service", "orders")
+
+			if got := problems.count.Load(); got != tt.want {
+				t.Errorf("counted %d problems, want %d", got, tt.want)
+			}
+		})
+	}
+}
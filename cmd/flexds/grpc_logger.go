@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// grpcLogger routes gRPC's logging through slog instead of gRPC's own stderr logger. gRPC logs
+// connection lifecycle events at info, which are logged at debug here to keep the default output quiet.
+type grpcLogger struct{}
+
+func (grpcLogger) Info(args ...any)                 { slog.Debug(fmt.Sprint(args...)) }
+func (grpcLogger) Infoln(args ...any)               { slog.Debug(sprintln(args...)) }
+func (grpcLogger) Infof(format string, args ...any) { slog.Debug(fmt.Sprintf(format, args...)) }
+func (grpcLogger) Warning(args ...any)              { slog.Warn(fmt.Sprint(args...)) }
+func (grpcLogger) Warningln(args ...any)            { slog.Warn(sprintln(args...)) }
+func (grpcLogger) Warningf(format string, args ...any) {
+	slog.Warn(fmt.Sprintf(format, args...))
+}
+func (grpcLogger) Error(args ...any)                 { slog.Error(fmt.Sprint(args...)) }
+func (grpcLogger) Errorln(args ...any)               { slog.Error(sprintln(args...)) }
+func (grpcLogger) Errorf(format string, args ...any) { slog.Error(fmt.Sprintf(format, args...)) }
+func (grpcLogger) Fatal(args ...any)                 { slog.Error(fmt.Sprint(args...)); os.Exit(1) }
+func (grpcLogger) Fatalln(args ...any)               { slog.Error(sprintln(args...)); os.Exit(1) }
+func (grpcLogger) Fatalf(format string, args ...any) {
+	slog.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// V reports whether gRPC's verbose logging is enabled, only its default verbosity is logged
+func (grpcLogger) V(l int) bool { return l <= 0 }
+
+// sprintln formats like fmt.Sprintln, without the trailing newline
+func sprintln(args ...any) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
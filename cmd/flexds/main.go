@@ -2,63 +2,254 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
-	"fmt"
 	"log/slog"
-	"net/http"
+	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"slices"
+	"strconv"
 	"syscall"
 	"time"
 
-	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
-	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 	"github.com/moonkev/flexds/internal/common/config"
-	"github.com/moonkev/flexds/internal/common/telemetry"
+	"github.com/moonkev/flexds/internal/common/types"
 	"github.com/moonkev/flexds/internal/discovery"
 	"github.com/moonkev/flexds/internal/discovery/consul"
+	"github.com/moonkev/flexds/internal/discovery/consul/watcher"
+	"github.com/moonkev/flexds/internal/discovery/git"
 	"github.com/moonkev/flexds/internal/discovery/marathon"
+	"github.com/moonkev/flexds/internal/discovery/replay"
 	"github.com/moonkev/flexds/internal/discovery/yaml"
 	"github.com/moonkev/flexds/internal/xds"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/moonkev/flexds/pkg/flexds"
+	"google.golang.org/grpc/grpclog"
 )
 
 func main() {
 
 	var adsPort = 18000
 	var adminPort = 19005
+	var adminBindAddress = ""
+	var adminGzip = false
 	var logLevel = config.LogLevelFlag(slog.LevelInfo)
 	var consulDiscovery = false
 	var consulAddr = "http://localhost:8500"
+	var consulToken = ""
+	var consulTokenFile = ""
+	var consulScheme = ""
+	var consulDatacenters config.StringSliceFlag
+	var consulRequiredTags config.StringSliceFlag
+	var consulDebounceInterval = watcher.DefaultDebounceInterval
+	var consulBatchSize = watcher.DefaultBatchSize
+	var consulBatchTimeout = watcher.DefaultBatchTimeout
+	var consulAddressPolicy = consul.AddressPolicyService
+	var consulCaFile = ""
+	var consulCertFile = ""
+	var consulKeyFile = ""
+	var consulTlsSkipVerify = false
 	var watcherStrategy = "immediate"
 	var yamlDiscovery = false
 	var yamlFile = ""
 	var marathonDiscovery = false
 	var marathonAddr = "http://localhost:8080"
 	var marathonCredsPath = ""
+	var marathonTokenPath = ""
+	var marathonTokenType = marathon.AuthTokenTypeDcos
 	var marathonPollInterval = 30 * time.Second
-	var listenerPorts config.Uint32SliceFlag = []uint32{18080}
+	var marathonEventStream = false
+	var marathonRequireHealthCheck = false
+	var gitDiscovery = false
+	var replayFile = ""
+	var gitConfig = git.Config{Path: "services.yaml", Interval: time.Minute}
+	var listenerPorts config.Uint32SliceFlag
+	var listenAddressValue = ""
+	var http10ListenerPorts config.Uint32SliceFlag
+	var http10DefaultHost = ""
+	var absoluteUrlListenerPorts config.Uint32SliceFlag
+	var escapedSlashesAction = ""
+	var discoveryLoaders config.StringSliceFlag
+	var cacheMode = "snapshot"
+	var restXds = false
+	var vhostRetryOn = ""
+	var vhostNumRetries uint
+	var vhostCorsAllowOrigins config.StringSliceFlag
+	var vhostCorsAllowMethods = ""
+	var vhostCorsAllowHeaders = ""
+	var vhostCorsMaxAge = ""
+	var vhostCorsAllowCredentials = false
+	var upstreamCaFile = "/etc/ssl/certs/ca-certificates.crt"
+	var adsTLS xds.TLSConfig
+	var nodeAllowlistFile = ""
+	var minPushInterval time.Duration
+	var resourceTTL time.Duration
+	var snapshotSizeWarn = 3 << 20
+	var snapshotSizeLimit = 0
+	var aggregatorDebounce time.Duration
+	var grpcReflection = false
+	var dnsResolverType = ""
+	var dnsResolvers config.StringSliceFlag
+	var dnsFailureRefreshBase time.Duration
+	var dnsFailureRefreshMax time.Duration
+	var dnsJitter time.Duration
+	var serviceDefaults xds.ServiceDefaults
+	var clusterNamePolicyValue = ""
+	var statPrefix = ""
+	var generateRequestId config.OptionalBoolFlag
+	var preserveExternalRequestId = false
+	var requestIdPackTraceReason config.OptionalBoolFlag
+	var requestIdTraceSampling config.OptionalBoolFlag
+	var scopedRoutesHeader = ""
+	var grpcWeb = false
+	var accessLog xds.AccessLogOptions
+	var configFile = ""
+	var dryRun = false
+	var dryRunTimeout = 30 * time.Second
+	var dryRunStrict = false
 
+	flag.StringVar(&configFile, "config", "", "YAML file setting any of these flags by name, e.g. 'ads-port: 18000', overridden by flags and environment variables")
 	flag.IntVar(&adsPort, "ads-port", adsPort, "ADS gRPC port")
+	flag.StringVar(&adsTLS.CertFile, "ads-tls-cert", "", "certificate file for serving ADS over TLS (default: plaintext)")
+	flag.StringVar(&adsTLS.KeyFile, "ads-tls-key", "", "private key file for the ADS TLS certificate")
+	flag.StringVar(&adsTLS.ClientCAFile, "ads-tls-client-ca", "", "CA file used to require and verify Envoy client certificates on the ADS port (mTLS)")
+	flag.StringVar(&nodeAllowlistFile, "node-allowlist-file", "", "file listing the Envoy node ids allowed to fetch configuration, one per line, reloaded on SIGHUP (default: all nodes)")
 	flag.IntVar(&adminPort, "admin-port", adminPort, "admin port")
+	flag.StringVar(&adminBindAddress, "admin-bind-address", "", "IP address the admin server binds to, e.g. 127.0.0.1 to only serve local clients (default: all interfaces)")
+	flag.BoolVar(&adminGzip, "admin-gzip", false, "gzip the JSON responses of the admin endpoints for clients that accept it")
 	flag.Var(&logLevel, "log-level", "log level: debug, info, warn, error (default: info)")
+	flag.Var(&discoveryLoaders, "discovery", "comma-separated list of discovery loaders to enable: consul, yaml, marathon, git, replay, or any registered loader")
 	flag.BoolVar(&consulDiscovery, "consul", false, "Use Consul for service discovery")
 	flag.StringVar(&consulAddr, "consul-addr", consulAddr, "consul HTTP address (host:port)")
-	flag.StringVar(&watcherStrategy, "consul-watcher-strategy", watcherStrategy, "consul watcher strategy: immediate, debounce, or batch")
+	flag.StringVar(&consulToken, "consul-token", "", "consul ACL token, prefer -consul-token-file to keep it out of process arguments (default: $CONSUL_HTTP_TOKEN)")
+	flag.StringVar(&consulTokenFile, "consul-token-file", "", "file containing the consul ACL token, re-read when it changes")
+	flag.Var(&consulDatacenters, "consul-datacenters", "comma-separated list of consul datacenters to aggregate services from, names are prefixed with '<datacenter>_' when more than one is given (default: the agent's datacenter)")
+	flag.Var(&consulRequiredTags, "consul-required-tags", "comma-separated list of tags, only services with an instance carrying all of them are discovered, e.g. envoy-enabled (default: all services)")
+	flag.StringVar(&consulAddressPolicy, "consul-address-policy", consulAddressPolicy, "instance address used for endpoints: service (service address, else node address), node, or a tagged address name such as lan_ipv4 (falling back to service)")
+	flag.StringVar(&consulScheme, "consul-scheme", "", "scheme used to reach consul: http or https (default: the scheme of -consul-addr, otherwise http)")
+	flag.StringVar(&consulCaFile, "consul-ca-file", "", "CA file used to verify consul's certificate over https (default: the system bundle)")
+	flag.StringVar(&consulCertFile, "consul-cert-file", "", "client certificate presented to consul over https, requires -consul-key-file")
+	flag.StringVar(&consulKeyFile, "consul-key-file", "", "private key of the consul client certificate")
+	flag.BoolVar(&consulTlsSkipVerify, "consul-tls-skip-verify", false, "skip verification of consul's certificate (insecure)")
+	flag.StringVar(&watcherStrategy, "consul-watcher-strategy", watcherStrategy, "consul watcher strategy: immediate, debounce, batch, or health (a blocking health query per service, refetching only services that changed)")
+	flag.DurationVar(&consulDebounceInterval, "consul-debounce-interval", consulDebounceInterval, "quiet period after the last catalog change before the debounce strategy applies it")
+	flag.IntVar(&consulBatchSize, "consul-batch-size", consulBatchSize, "catalog changes that make the batch strategy apply a batch early")
+	flag.DurationVar(&consulBatchTimeout, "consul-batch-timeout", consulBatchTimeout, "time after the first catalog change at which the batch strategy applies the batch")
 	flag.BoolVar(&yamlDiscovery, "yaml", false, "Use YAML file for service discovery")
 	flag.StringVar(&yamlFile, "yaml-file", "", "path to YAML configuration file (required when discovery=yaml)")
 	flag.BoolVar(&marathonDiscovery, "marathon", false, "Use Marathon for service discovery")
 	flag.StringVar(&marathonAddr, "marathon-addr", marathonAddr, "marathon HTTP address")
 	flag.StringVar(&marathonCredsPath, "marathon-creds-path", "", "path to file containing marathon credentials (username:password)")
+	flag.StringVar(&marathonTokenPath, "marathon-token-path", "", "path to file containing a marathon auth token, sent instead of -marathon-creds-path basic auth")
+	flag.StringVar(&marathonTokenType, "marathon-token-type", marathonTokenType, "authorization header format of -marathon-token-path: dcos (token=<token>) or bearer (Bearer <token>)")
 	flag.DurationVar(&marathonPollInterval, "marathon-poll-interval", marathonPollInterval, "interval between marathon service polls (default: 30s)")
+	flag.BoolVar(&marathonRequireHealthCheck, "marathon-require-health-check", false, "drop marathon apps that define no health check instead of treating their running tasks as healthy")
+	flag.BoolVar(&marathonEventStream, "marathon-event-stream", false, "follow marathon's event stream for near real-time updates instead of polling, polling every -marathon-poll-interval while the stream is down")
+	flag.BoolVar(&gitDiscovery, "git", false, "Use YAML files from a Git repository for service discovery")
+	flag.StringVar(&replayFile, "replay-file", "", "build the snapshot from a discovery state recorded from /services/raw instead of live discovery")
+	flag.StringVar(&gitConfig.RepoURL, "git-repo", "", "URL of the Git repository holding the YAML service definitions")
+	flag.StringVar(&gitConfig.Ref, "git-ref", "", "branch, tag or commit to load (default: the remote's default branch)")
+	flag.StringVar(&gitConfig.Path, "git-path", gitConfig.Path, "YAML file, or directory of YAML files, within the Git repository")
+	flag.DurationVar(&gitConfig.Interval, "git-poll-interval", gitConfig.Interval, "interval between Git repository polls")
+	flag.StringVar(&gitConfig.WorkDir, "git-workdir", "", "directory for the Git checkout (default: a temporary directory)")
+	flag.StringVar(&gitConfig.CredentialsFilePath, "git-creds-path", "", "path to file containing HTTPS credentials for the Git repository (username:password)")
+	flag.StringVar(&gitConfig.SSHKeyPath, "git-ssh-key", "", "path to the SSH private key for the Git repository")
 	flag.Var(&listenerPorts, "listener-ports", "comma-separated list of listener ports (default: 18080)")
+	flag.StringVar(&listenAddressValue, "listen-address", "", "IP address Envoy listeners bind to, e.g. 127.0.0.1 or :: (default: 0.0.0.0)")
+	flag.Var(&http10ListenerPorts, "http10-listener-ports", "comma-separated list of listener ports that accept HTTP/1.0 requests")
+	flag.StringVar(&http10DefaultHost, "http10-default-host", "", "host used for HTTP/1.0 requests without a Host header")
+	flag.Var(&absoluteUrlListenerPorts, "absolute-url-listener-ports", "comma-separated list of listener ports that accept absolute-form request URLs")
+	flag.StringVar(&escapedSlashesAction, "path-with-escaped-slashes-action", "", "handling of escaped slashes in request paths: keep, reject, unescape-and-redirect, or unescape-and-forward (default: Envoy's default)")
+	flag.StringVar(&vhostRetryOn, "vhost-retry-on", "", "retry conditions applied to every virtual host, e.g. 5xx,connect-failure (default: no retries)")
+	flag.UintVar(&vhostNumRetries, "vhost-num-retries", 0, "number of retries for the virtual host retry policy (default: Envoy's default)")
+	flag.Var(&vhostCorsAllowOrigins, "vhost-cors-allow-origins", "comma-separated list of origins allowed by the virtual host CORS policy (default: no CORS policy)")
+	flag.StringVar(&vhostCorsAllowMethods, "vhost-cors-allow-methods", "", "value of the Access-Control-Allow-Methods header for the virtual host CORS policy")
+	flag.StringVar(&vhostCorsAllowHeaders, "vhost-cors-allow-headers", "", "value of the Access-Control-Allow-Headers header for the virtual host CORS policy")
+	flag.StringVar(&vhostCorsMaxAge, "vhost-cors-max-age", "", "value of the Access-Control-Max-Age header for the virtual host CORS policy")
+	flag.BoolVar(&vhostCorsAllowCredentials, "vhost-cors-allow-credentials", false, "allow credentials in the virtual host CORS policy")
+	flag.StringVar(&cacheMode, "cache-mode", cacheMode, "xDS cache implementation: snapshot, or linear to send only changed resources (linear serves every node the same services)")
+	flag.StringVar(&upstreamCaFile, "upstream-ca-file", upstreamCaFile, "CA bundle, as a path on the Envoy host, used to verify TLS upstreams that don't set tls_ca_file or tls_ca_pem")
+	flag.StringVar(&dnsResolverType, "dns-resolver", "", "DNS resolver used by clusters: cares, getaddrinfo, or apple (default: Envoy's default)")
+	flag.Var(&dnsResolvers, "dns-resolvers", "comma-separated list of nameserver addresses (ip or ip:port) for the cares resolver (default: the system's nameservers)")
+	flag.DurationVar(&dnsFailureRefreshBase, "dns-failure-refresh-base", 0, "initial DNS refresh interval after a failed resolution (default: the cluster's refresh rate)")
+	flag.DurationVar(&dnsFailureRefreshMax, "dns-failure-refresh-max", 0, "maximum DNS refresh interval after repeated failed resolutions (default: 10x the base interval)")
+	flag.DurationVar(&dnsJitter, "dns-jitter", 0, "random jitter added to each DNS refresh, spreading out resolutions")
+	flag.DurationVar(&serviceDefaults.ConnectTimeout, "default-connect-timeout", 2*time.Second, "upstream connect timeout of services without a connect_timeout")
+	flag.DurationVar(&serviceDefaults.DnsRefreshRate, "default-dns-refresh-rate", 0, "fixed DNS refresh interval of services without a dns_refresh_rate (default: honor the record TTL)")
+	flag.StringVar(&serviceDefaults.LbPolicy, "default-lb-policy", "round_robin", "load balancing policy of services without an lb_policy: round_robin, least_request, ring_hash, maglev, or random")
+	flag.DurationVar(&aggregatorDebounce, "aggregator-debounce", 0, "wait until discovery updates from all loaders pause for this long before rebuilding the snapshot, e.g. 200ms (default: rebuild on every update)")
+	flag.DurationVar(&minPushInterval, "min-push-interval", 0, "minimum time between snapshot pushes, coalescing discovery changes in between (default: push every change)")
+	flag.DurationVar(&resourceTTL, "resource-ttl", 0, "TTL of every xDS resource, refreshed by heartbeats so Envoy drops the configuration once flexds is gone, e.g. 5m (requires -cache-mode snapshot, default: no TTL)")
+	flag.StringVar(&clusterNamePolicyValue, "cluster-name-policy", "", "how cluster names are derived from service names: none, sanitize (replace characters other than letters, digits, '_' and '-' with '_'), or sanitize-lowercase (default: none)")
+	flag.StringVar(&statPrefix, "stat-prefix", "", "stat prefix of the HTTP connection manager on every listener (default: ingress_http)")
+	flag.StringVar(&scopedRoutesHeader, "scoped-routes-header", "", "serve one route configuration per service route_scope through scoped routes, selected by the value of this request header, e.g. x-tenant (default: disabled)")
+	flag.StringVar(&accessLog.Path, "access-log", "", "write access logs of every HTTP listener to stdout, stderr, or this file path on the Envoy host (default: no access log)")
+	flag.StringVar(&accessLog.Format, "access-log-format", "", "Envoy format string of -access-log entries, e.g. '[%START_TIME%] %REQ(:METHOD)% %REQ(:PATH)% %RESPONSE_CODE%' (default: Envoy's default format)")
+	flag.StringVar(&accessLog.GrpcCluster, "access-log-grpc-cluster", "", "send access logs to the gRPC access log service behind this Envoy cluster, defined in the Envoy bootstrap")
+	flag.BoolVar(&grpcWeb, "grpc-web", false, "add the gRPC-Web filter to every listener, instead of only those serving services with grpc_web metadata")
+	flag.IntVar(&snapshotSizeWarn, "snapshot-size-warn", snapshotSizeWarn, "log a warning when the marshaled resources of one type in a snapshot exceed this many bytes (0 disables)")
+	flag.IntVar(&snapshotSizeLimit, "snapshot-size-limit", 0, "reject snapshots whose marshaled resources of one type exceed this many bytes, keeping the previous snapshot, e.g. 4194304 for gRPC's default message limit (default: no limit)")
+	flag.Var(&generateRequestId, "generate-request-id", "generate an x-request-id header for requests without one (default: Envoy's default, true)")
+	flag.BoolVar(&preserveExternalRequestId, "preserve-external-request-id", false, "keep the x-request-id sent by edge clients instead of replacing it")
+	flag.Var(&requestIdPackTraceReason, "request-id-pack-trace-reason", "encode the trace sampling decision in the generated x-request-id UUID (default: Envoy's default, true)")
+	flag.Var(&requestIdTraceSampling, "request-id-trace-sampling", "sample traces by x-request-id (default: Envoy's default, true)")
+	flag.BoolVar(&grpcReflection, "grpc-reflection", false, "register gRPC server reflection on the ADS port for debugging with grpcurl")
+	flag.BoolVar(&restXds, "rest-xds", false, "also serve xDS as REST-JSON on the admin port for Envoys that can't use gRPC (requires -cache-mode snapshot)")
+	flag.BoolVar(&dryRun, "dry-run", false, "load every discovery source once, print the resulting snapshot as JSON to stdout and exit, non-zero if the build failed or logged errors or invalid configuration")
+	flag.DurationVar(&dryRunTimeout, "dry-run-timeout", dryRunTimeout, "time the discovery loaders have to report their services in -dry-run mode")
+	flag.BoolVar(&dryRunStrict, "dry-run-strict", false, "in -dry-run mode, also exit non-zero on any logged warning")
 	flag.Parse()
+	if err := config.ApplyEnv(flag.CommandLine, "FLEXDS_"); err != nil {
+		slog.Error("invalid environment variable", "error", err)
+		os.Exit(1)
+	}
+	if configFile != "" {
+		file, err := config.LoadFile(configFile)
+		if err != nil {
+			slog.Error("failed to load config file", "error", err)
+			os.Exit(1)
+		}
+		if err := file.Apply(flag.CommandLine); err != nil {
+			slog.Error("failed to apply config file", "file", configFile, "error", err)
+			os.Exit(1)
+		}
+	}
+	// List flags append to their value, so the default is only filled in when none was given
+	if len(listenerPorts) == 0 {
+		listenerPorts = []uint32{18080}
+	}
+
+	// Replaying a recorded state bypasses live discovery
+	if replayFile != "" {
+		if len(discoveryLoaders) > 0 || consulDiscovery || yamlDiscovery || marathonDiscovery || gitDiscovery {
+			slog.Warn("replay-file is set, ignoring the other discovery loaders")
+		}
+		discoveryLoaders = []string{"replay"}
+		consulDiscovery, yamlDiscovery, marathonDiscovery, gitDiscovery = false, false, false, false
+	}
+
+	// The per-loader flags are shorthands for -discovery
+	if consulDiscovery {
+		discoveryLoaders = append(discoveryLoaders, "consul")
+	}
+	if yamlDiscovery {
+		discoveryLoaders = append(discoveryLoaders, "yaml")
+	}
+	if marathonDiscovery {
+		discoveryLoaders = append(discoveryLoaders, "marathon")
+	}
+	if gitDiscovery {
+		discoveryLoaders = append(discoveryLoaders, "git")
+	}
+	slices.Sort(discoveryLoaders)
+	discoveryLoaders = slices.Compact(discoveryLoaders)
+	consulDiscovery = slices.Contains(discoveryLoaders, "consul")
+	yamlDiscovery = slices.Contains(discoveryLoaders, "yaml")
+	marathonDiscovery = slices.Contains(discoveryLoaders, "marathon")
+	gitDiscovery = slices.Contains(discoveryLoaders, "git")
 
 	// Validate flags
-	if !consulDiscovery && !yamlDiscovery && !marathonDiscovery {
-		slog.Error("at least one discovery mode must be enabled: -consul|-yaml|-marathon")
+	if len(discoveryLoaders) == 0 {
+		slog.Error("at least one discovery mode must be enabled: -discovery or -consul|-yaml|-marathon|-git|-replay-file")
 		os.Exit(1)
 	}
 
@@ -72,119 +263,240 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Configure structured logging
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel.Level()}))
-	slog.SetDefault(logger)
+	if marathonCredsPath != "" && marathonTokenPath != "" {
+		slog.Error("marathon-creds-path and marathon-token-path are mutually exclusive")
+		os.Exit(1)
+	}
 
-	// Initialize metrics
-	telemetry.InitMetrics()
+	if slices.Contains(discoveryLoaders, "replay") && replayFile == "" {
+		slog.Error("replay-file must be specified when using replay discovery mode")
+		os.Exit(1)
+	}
 
-	// Create snapshot cache
-	snapshotCache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
-	xdsConfig := xds.Config{
-		Cache:         snapshotCache,
-		ListenerPorts: listenerPorts,
+	if consulScheme != "" && consulScheme != "http" && consulScheme != "https" {
+		slog.Error("consul-scheme must be http or https", "scheme", consulScheme)
+		os.Exit(1)
 	}
-	snapshotManager := xds.NewSnapshotManager(xdsConfig)
-	aggregator := discovery.NewDiscoveredServiceAggregator(snapshotManager)
 
-	// Create XDS server
-	slog.Info("creating XDS server")
-	callbacks := &xds.ServerCallbacks{Cache: snapshotCache}
-	adsServer := serverv3.NewServer(context.Background(), snapshotCache, callbacks)
-	slog.Info("XDS server created")
+	if (consulCertFile == "") != (consulKeyFile == "") {
+		slog.Error("consul-cert-file and consul-key-file must be specified together")
+		os.Exit(1)
+	}
 
-	// Set up context and channels
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
+	if adminBindAddress != "" && adminBindAddress != "localhost" && net.ParseIP(adminBindAddress) == nil {
+		slog.Error("admin-bind-address must be an IP address or localhost", "address", adminBindAddress)
+		os.Exit(1)
+	}
 
-	// Start gRPC server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		xds.RunGRPC(ctx, adsServer, adsPort)
-	}()
+	if gitDiscovery && gitConfig.RepoURL == "" {
+		slog.Error("git-repo must be specified when using git discovery mode")
+		os.Exit(1)
+	}
 
-	// Set up admin/metrics HTTP server
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("ok")) })
+	// Register the built-in discovery loaders alongside any registered by third-party packages
+	builtinLoaders := []discovery.Loader{
+		consul.NewLoader(&consul.Config{
+			ConsulAddr:       consulAddr,
+			WaitTimeSec:      2,
+			WatcherStrategy:  watcherStrategy,
+			DebounceInterval: consulDebounceInterval,
+			BatchSize:        consulBatchSize,
+			BatchTimeout:     consulBatchTimeout,
+			Datacenters:      consulDatacenters,
+			RequiredTags:     consulRequiredTags,
+			AddressPolicy:    consulAddressPolicy,
+			Token:            consulToken,
+			TokenFile:        consulTokenFile,
 
-	admin := &http.Server{Addr: fmt.Sprintf(":%d", adminPort), Handler: mux}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		slog.Info("starting admin http server", "port", adminPort)
-		if err := admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			slog.Error("admin server failed", "error", err)
+			Scheme:             consulScheme,
+			CAFile:             consulCaFile,
+			CertFile:           consulCertFile,
+			KeyFile:            consulKeyFile,
+			InsecureSkipVerify: consulTlsSkipVerify,
+		}),
+		yaml.NewLoader(yaml.Config{ConfigPath: yamlFile}),
+		marathon.NewLoader(marathon.Config{
+			URL:                 marathonAddr,
+			CredentialsFilePath: marathonCredsPath,
+			AuthTokenFilePath:   marathonTokenPath,
+			AuthTokenType:       marathonTokenType,
+			Interval:            marathonPollInterval,
+			UseEventStream:      marathonEventStream,
+			RequireHealthCheck:  marathonRequireHealthCheck,
+		}),
+		git.NewLoader(gitConfig),
+		replay.NewLoader(replay.Config{FilePath: replayFile}),
+	}
+	for _, loader := range builtinLoaders {
+		if err := discovery.Register(loader); err != nil {
+			slog.Error("failed to register discovery loader", "error", err)
 			os.Exit(1)
 		}
-	}()
-
-	if consulDiscovery {
-		consulConfig := &consul.Config{
-			ConsulAddr:      consulAddr,
-			WaitTimeSec:     2,
-			WatcherStrategy: watcherStrategy,
+	}
+	var loaders []discovery.Loader
+	for _, name := range discoveryLoaders {
+		loader, ok := discovery.Lookup(name)
+		if !ok {
+			slog.Error("unknown discovery loader", "loader", name, "registered", discovery.Registered())
+			os.Exit(1)
 		}
+		loaders = append(loaders, loader)
+	}
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			consul.StartWatcher(ctx, consulAddr, consulConfig, aggregator)
-		}()
+	if !adsTLS.Enabled() && (adsTLS.KeyFile != "" || adsTLS.ClientCAFile != "") {
+		slog.Error("ads-tls-key and ads-tls-client-ca require ads-tls-cert")
+		os.Exit(1)
 	}
 
-	if yamlDiscovery {
-		yamlConfig := yaml.Config{ConfigPath: yamlFile}
-		if err := yaml.LoadConfig(yamlConfig, aggregator); err != nil {
-			slog.Error("failed to load YAML config", "error", err)
-			os.Exit(1)
-		}
+	if dnsFailureRefreshMax > 0 && dnsFailureRefreshMax < dnsFailureRefreshBase {
+		slog.Error("dns-failure-refresh-max must not be less than dns-failure-refresh-base")
+		os.Exit(1)
+	}
+	if dnsFailureRefreshMax > 0 && dnsFailureRefreshBase == 0 {
+		slog.Error("dns-failure-refresh-max requires dns-failure-refresh-base")
+		os.Exit(1)
+	}
+	dnsResolver, err := xds.BuildDnsResolverConfig(dnsResolverType, dnsResolvers)
+	if err != nil {
+		slog.Error("invalid dns resolver configuration", "error", err)
+		os.Exit(1)
 	}
 
-	if marathonDiscovery {
-		marathonConfig := marathon.Config{
-			URL:                 marathonAddr,
-			CredentialsFilePath: marathonCredsPath,
-			Interval:            marathonPollInterval,
-		}
-		if err := marathon.LoadConfig(ctx, marathonConfig, aggregator); err != nil {
-			slog.Error("failed to load marathon config", "error", err)
-			os.Exit(1)
+	listenAddress, err := xds.ParseListenAddress(listenAddressValue)
+	if err != nil {
+		slog.Error("invalid listen-address", "error", err)
+		os.Exit(1)
+	}
+
+	pathWithEscapedSlashesAction, err := xds.ParsePathWithEscapedSlashesAction(escapedSlashesAction)
+	if err != nil {
+		slog.Error("invalid path-with-escaped-slashes-action", "error", err)
+		os.Exit(1)
+	}
+
+	clusterNamePolicy, err := xds.ParseClusterNamePolicy(clusterNamePolicyValue)
+	if err != nil {
+		slog.Error("invalid cluster-name-policy", "error", err)
+		os.Exit(1)
+	}
+
+	// Configure structured logging, on stderr for dry runs which print the snapshot to stdout
+	var logHandler slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel.Level()})
+	var problems problemCounter
+	if dryRun {
+		problems = newProblemCounter(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel.Level()}), dryRunStrict)
+		logHandler = problems
+	}
+	slog.SetDefault(slog.New(logHandler))
+	grpclog.SetLoggerV2(grpcLogger{})
+
+	// Per-listener HTTP/1.1 options
+	listenerOptions := make(map[uint32]xds.ListenerOptions)
+	for _, port := range http10ListenerPorts {
+		opts := listenerOptions[port]
+		opts.AcceptHttp10 = true
+		opts.DefaultHostForHttp10 = http10DefaultHost
+		listenerOptions[port] = opts
+	}
+	for _, port := range absoluteUrlListenerPorts {
+		opts := listenerOptions[port]
+		opts.AllowAbsoluteUrl = true
+		listenerOptions[port] = opts
+	}
+
+	// Virtual host wide policies, routes can override them
+	var vhostRetry *types.RetryPolicy
+	if vhostRetryOn != "" {
+		vhostRetry = &types.RetryPolicy{RetryOn: vhostRetryOn, NumRetries: uint32(vhostNumRetries)}
+	}
+	var vhostCors *types.CorsPolicy
+	if len(vhostCorsAllowOrigins) > 0 {
+		vhostCors = &types.CorsPolicy{
+			AllowOrigins:     vhostCorsAllowOrigins,
+			AllowMethods:     vhostCorsAllowMethods,
+			AllowHeaders:     vhostCorsAllowHeaders,
+			MaxAge:           vhostCorsMaxAge,
+			AllowCredentials: vhostCorsAllowCredentials,
 		}
 	}
 
-	// Wait for a shutdown signal
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	xdsConfig := xds.Config{
+		ListenerPorts:   listenerPorts,
+		ListenAddress:   listenAddress,
+		ListenerOptions: listenerOptions,
+
+		PathWithEscapedSlashesAction: pathWithEscapedSlashesAction,
+		VirtualHostRetry:             vhostRetry,
+		VirtualHostCors:              vhostCors,
+		GrpcWeb:                      grpcWeb,
+		UpstreamCaFile:               upstreamCaFile,
+		MinPushInterval:              minPushInterval,
+		ResourceTTL:                  resourceTTL,
+		SnapshotSizeWarn:             snapshotSizeWarn,
+		SnapshotSizeLimit:            snapshotSizeLimit,
+		DnsResolver:                  dnsResolver,
+		DnsFailureRefreshBase:        dnsFailureRefreshBase,
+		DnsFailureRefreshMax:         dnsFailureRefreshMax,
+		DnsJitter:                    dnsJitter,
+		Defaults:                     serviceDefaults,
+		ClusterNamePolicy:            clusterNamePolicy,
+		StatPrefix:                   statPrefix,
+		AccessLog:                    accessLog,
+		RequestId: xds.RequestIdOptions{
+			Generate:            generateRequestId.Value,
+			PreserveExternal:    preserveExternalRequestId,
+			PackTraceReason:     requestIdPackTraceReason.Value,
+			UseForTraceSampling: requestIdTraceSampling.Value,
+		},
+	}
+	if scopedRoutesHeader != "" {
+		xdsConfig.ScopedRoutes = &xds.ScopedRoutesOptions{Header: scopedRoutesHeader}
+	}
+
+	controlPlane, err := flexds.New(flexds.Config{
+		Xds:       xdsConfig,
+		CacheMode: cacheMode,
 
-	<-stop
-	slog.Info("shutdown signal received, shutting down services")
-	cancel()
+		AdsPort:           adsPort,
+		AdsTLS:            adsTLS,
+		GrpcReflection:    grpcReflection,
+		NodeAllowlistFile: nodeAllowlistFile,
 
-	// Wait for all goroutines with a timeout
-	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+		AdminAddress: net.JoinHostPort(adminBindAddress, strconv.Itoa(adminPort)),
+		AdminGzip:    adminGzip,
+		RestXds:      restXds,
 
-	shutdownCtx, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel2()
+		AggregatorDebounce: aggregatorDebounce,
+		Loaders:            loaders,
+	})
+	if err != nil {
+		slog.Error("failed to create control plane", "error", err)
+		os.Exit(1)
+	}
 
-	select {
-	case <-done:
-		slog.Info("all services stopped gracefully")
-	case <-shutdownCtx.Done():
-		slog.Warn("shutdown timeout exceeded, forcing exit")
+	if dryRun {
+		os.Exit(runDryRun(controlPlane, dryRunTimeout, problems))
 	}
 
-	// Graceful shutdown of the HTTP admin server
-	shutdownCtx2, cancel3 := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel3()
-	if err := admin.Shutdown(shutdownCtx2); err != nil {
-		slog.Error("admin server shutdown error", "error", err)
+	// SIGHUP reloads the node allowlist and the discovery sources
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			slog.Info("SIGHUP received, reloading configuration")
+			if err := controlPlane.ReloadNodeAllowlist(); err != nil {
+				slog.Error("failed to reload node allowlist, keeping the previous one", "error", err)
+			}
+			controlPlane.Reload()
+		}
+	}()
+
+	// Run until a shutdown signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := controlPlane.Run(ctx); err != nil {
+		slog.Error("control plane failed", "error", err)
+		os.Exit(1)
 	}
 
 	slog.Info("exiting")
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/moonkev/flexds/internal/common/config"
+)
+
+// TestConfigFileCoversFlags fails when a flag can't be set from the config file, as happens when a
+// flag is added without its config.File field
+func TestConfigFileCoversFlags(t *testing.T) {
+	// main registers its flags on flag.CommandLine, -h then stops it in flag.Parse before it does anything else
+	commandLine, args := flag.CommandLine, os.Args
+	t.Cleanup(func() {
+		flag.CommandLine, os.Args = commandLine, args
+	})
+	flag.CommandLine = flag.NewFlagSet("flexds", flag.PanicOnError)
+	flag.CommandLine.SetOutput(io.Discard)
+	os.Args = []string{"flexds", "-h"}
+	func() {
+		defer func() {
+			if r := recover(); r != flag.ErrHelp {
+				t.Fatalf("got %v from main, want it stopped by -h", r)
+			}
+		}()
+		main()
+	}()
+
+	keys := make(map[string]bool)
+	fileType := reflect.TypeFor[config.File]()
+	for i := range fileType.NumField() {
+		name, _, _ := strings.Cut(fileType.Field(i).Tag.Get("yaml"), ",")
+		keys[name] = true
+	}
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		// The config file can't name itself
+		if f.Name != "config" && !keys[f.Name] {
+			t.Errorf("flag -%s has no config.File field", f.Name)
+		}
+		delete(keys, f.Name)
+	})
+	for key := range keys {
+		t.Errorf("config file key %s has no flag", key)
+	}
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvName returns the environment variable backing a flag: the prefix followed by the flag name
+// upper-cased with '-' replaced by '_', e.g. FLEXDS_ADS_PORT for -ads-port with prefix FLEXDS_.
+func EnvName(prefix, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// ApplyEnv sets every flag of fs that wasn't given on the command line from its environment variable,
+// named by EnvName, so a flag always wins over the environment. Values are parsed like command line
+// values: FLEXDS_ADS_PORT=18001 is -ads-port 18001, FLEXDS_CONSUL=true is -consul, and list flags take a
+// comma-separated list. Call it after fs.Parse; empty variables are ignored.
+func ApplyEnv(fs *flag.FlagSet, prefix string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		name := EnvName(prefix, f.Name)
+		value := os.Getenv(name)
+		if value == "" {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("FLEXDS_", "consul-tls-skip-verify"); got != "FLEXDS_CONSUL_TLS_SKIP_VERIFY" {
+		t.Errorf("got %s, want FLEXDS_CONSUL_TLS_SKIP_VERIFY", got)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("flexds", flag.ContinueOnError)
+	adsPort := fs.Int("ads-port", 18000, "")
+	adminPort := fs.Int("admin-port", 19005, "")
+	statPrefix := fs.String("stat-prefix", "ingress", "")
+	consul := fs.Bool("consul", false, "")
+	var listenerPorts Uint32SliceFlag
+	fs.Var(&listenerPorts, "listener-ports", "")
+	if err := fs.Parse([]string{"-ads-port", "18001"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("FLEXDS_ADS_PORT", "18002")
+	t.Setenv("FLEXDS_ADMIN_PORT", "19006")
+	t.Setenv("FLEXDS_STAT_PREFIX", "")
+	t.Setenv("FLEXDS_CONSUL", "true")
+	t.Setenv("FLEXDS_LISTENER_PORTS", "18080,18443")
+	if err := ApplyEnv(fs, "FLEXDS_"); err != nil {
+		t.Fatal(err)
+	}
+	if *adsPort != 18001 {
+		t.Errorf("got ads-port %d, want the command line's 18001", *adsPort)
+	}
+	if *adminPort != 19006 {
+		t.Errorf("got admin-port %d, want the environment's 19006", *adminPort)
+	}
+	if *statPrefix != "ingress" {
+		t.Errorf("got stat-prefix %q, want the default kept for an empty variable", *statPrefix)
+	}
+	if !*consul {
+		t.Error("got consul false, want true")
+	}
+	if !slices.Equal(listenerPorts, Uint32SliceFlag{18080, 18443}) {
+		t.Errorf("got listener-ports %v, want [18080 18443]", listenerPorts)
+	}
+}
+
+func TestApplyEnvInvalidValue(t *testing.T) {
+	fs := flag.NewFlagSet("flexds", flag.ContinueOnError)
+	fs.Int("ads-port", 18000, "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("FLEXDS_ADS_PORT", "eighteen-thousand")
+	err := ApplyEnv(fs, "FLEXDS_")
+	if err == nil || !strings.Contains(err.Error(), "FLEXDS_ADS_PORT") {
+		t.Errorf("got error %v, want the invalid FLEXDS_ADS_PORT reported", err)
+	}
+}
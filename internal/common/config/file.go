@@ -0,0 +1,185 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// File is the application configuration file given with -config. Its keys are the names of the
+// command line flags they set, e.g.
+//
+//	ads-port: 18000
+//	consul: true
+//	consul-datacenters: [dc1, dc2]
+//	listener-ports: [18080, 18443]
+//	aggregator-debounce: 200ms
+//
+// Keys left out keep the flag's default. Unset fields are nil, so a file can also set a flag to its zero value.
+type File struct {
+	LogLevel      *string   `yaml:"log-level"`
+	DryRun        *bool     `yaml:"dry-run"`
+	DryRunTimeout *Duration `yaml:"dry-run-timeout"`
+	DryRunStrict  *bool     `yaml:"dry-run-strict"`
+
+	// ADS and admin servers
+	AdsPort           *int    `yaml:"ads-port"`
+	AdsTlsCert        *string `yaml:"ads-tls-cert"`
+	AdsTlsKey         *string `yaml:"ads-tls-key"`
+	AdsTlsClientCa    *string `yaml:"ads-tls-client-ca"`
+	NodeAllowlistFile *string `yaml:"node-allowlist-file"`
+	GrpcReflection    *bool   `yaml:"grpc-reflection"`
+	AdminPort         *int    `yaml:"admin-port"`
+	AdminBindAddress  *string `yaml:"admin-bind-address"`
+	AdminGzip         *bool   `yaml:"admin-gzip"`
+	RestXds           *bool   `yaml:"rest-xds"`
+
+	// Discovery
+	Discovery          []string  `yaml:"discovery"`
+	AggregatorDebounce *Duration `yaml:"aggregator-debounce"`
+	ReplayFile         *string   `yaml:"replay-file"`
+
+	Consul                 *bool     `yaml:"consul"`
+	ConsulAddr             *string   `yaml:"consul-addr"`
+	ConsulToken            *string   `yaml:"consul-token"`
+	ConsulTokenFile        *string   `yaml:"consul-token-file"`
+	ConsulDatacenters      []string  `yaml:"consul-datacenters"`
+	ConsulRequiredTags     []string  `yaml:"consul-required-tags"`
+	ConsulAddressPolicy    *string   `yaml:"consul-address-policy"`
+	ConsulScheme           *string   `yaml:"consul-scheme"`
+	ConsulCaFile           *string   `yaml:"consul-ca-file"`
+	ConsulCertFile         *string   `yaml:"consul-cert-file"`
+	ConsulKeyFile          *string   `yaml:"consul-key-file"`
+	ConsulTlsSkipVerify    *bool     `yaml:"consul-tls-skip-verify"`
+	ConsulWatcherStrategy  *string   `yaml:"consul-watcher-strategy"`
+	ConsulDebounceInterval *Duration `yaml:"consul-debounce-interval"`
+	ConsulBatchSize        *int      `yaml:"consul-batch-size"`
+	ConsulBatchTimeout     *Duration `yaml:"consul-batch-timeout"`
+
+	Yaml     *bool   `yaml:"yaml"`
+	YamlFile *string `yaml:"yaml-file"`
+
+	Marathon                   *bool     `yaml:"marathon"`
+	MarathonAddr               *string   `yaml:"marathon-addr"`
+	MarathonCredsPath          *string   `yaml:"marathon-creds-path"`
+	MarathonTokenPath          *string   `yaml:"marathon-token-path"`
+	MarathonTokenType          *string   `yaml:"marathon-token-type"`
+	MarathonPollInterval       *Duration `yaml:"marathon-poll-interval"`
+	MarathonRequireHealthCheck *bool     `yaml:"marathon-require-health-check"`
+	MarathonEventStream        *bool     `yaml:"marathon-event-stream"`
+
+	Git             *bool     `yaml:"git"`
+	GitRepo         *string   `yaml:"git-repo"`
+	GitRef          *string   `yaml:"git-ref"`
+	GitPath         *string   `yaml:"git-path"`
+	GitPollInterval *Duration `yaml:"git-poll-interval"`
+	GitWorkdir      *string   `yaml:"git-workdir"`
+	GitCredsPath    *string   `yaml:"git-creds-path"`
+	GitSshKey       *string   `yaml:"git-ssh-key"`
+
+	// Listeners and routing
+	ListenerPorts                []uint32 `yaml:"listener-ports"`
+	ListenAddress                *string  `yaml:"listen-address"`
+	Http10ListenerPorts          []uint32 `yaml:"http10-listener-ports"`
+	Http10DefaultHost            *string  `yaml:"http10-default-host"`
+	AbsoluteUrlListenerPorts     []uint32 `yaml:"absolute-url-listener-ports"`
+	PathWithEscapedSlashesAction *string  `yaml:"path-with-escaped-slashes-action"`
+	StatPrefix                   *string  `yaml:"stat-prefix"`
+	ScopedRoutesHeader           *string  `yaml:"scoped-routes-header"`
+	GrpcWeb                      *bool    `yaml:"grpc-web"`
+	AccessLog                    *string  `yaml:"access-log"`
+	AccessLogFormat              *string  `yaml:"access-log-format"`
+	AccessLogGrpcCluster         *string  `yaml:"access-log-grpc-cluster"`
+	GenerateRequestId            *bool    `yaml:"generate-request-id"`
+	PreserveExternalRequestId    *bool    `yaml:"preserve-external-request-id"`
+	RequestIdPackTraceReason     *bool    `yaml:"request-id-pack-trace-reason"`
+	RequestIdTraceSampling       *bool    `yaml:"request-id-trace-sampling"`
+
+	VhostRetryOn              *string  `yaml:"vhost-retry-on"`
+	VhostNumRetries           *uint    `yaml:"vhost-num-retries"`
+	VhostCorsAllowOrigins     []string `yaml:"vhost-cors-allow-origins"`
+	VhostCorsAllowMethods     *string  `yaml:"vhost-cors-allow-methods"`
+	VhostCorsAllowHeaders     *string  `yaml:"vhost-cors-allow-headers"`
+	VhostCorsMaxAge           *string  `yaml:"vhost-cors-max-age"`
+	VhostCorsAllowCredentials *bool    `yaml:"vhost-cors-allow-credentials"`
+
+	// Clusters and snapshots
+	UpstreamCaFile        *string   `yaml:"upstream-ca-file"`
+	DnsResolver           *string   `yaml:"dns-resolver"`
+	DnsResolvers          []string  `yaml:"dns-resolvers"`
+	DnsFailureRefreshBase *Duration `yaml:"dns-failure-refresh-base"`
+	DnsFailureRefreshMax  *Duration `yaml:"dns-failure-refresh-max"`
+	DnsJitter             *Duration `yaml:"dns-jitter"`
+	DefaultConnectTimeout *Duration `yaml:"default-connect-timeout"`
+	DefaultDnsRefreshRate *Duration `yaml:"default-dns-refresh-rate"`
+	DefaultLbPolicy       *string   `yaml:"default-lb-policy"`
+	ClusterNamePolicy     *string   `yaml:"cluster-name-policy"`
+	CacheMode             *string   `yaml:"cache-mode"`
+	MinPushInterval       *Duration `yaml:"min-push-interval"`
+	ResourceTTL           *Duration `yaml:"resource-ttl"`
+	SnapshotSizeWarn      *int      `yaml:"snapshot-size-warn"`
+	SnapshotSizeLimit     *int      `yaml:"snapshot-size-limit"`
+}
+
+// LoadFile reads and parses a configuration file, rejecting unknown keys
+func LoadFile(path string) (*File, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{}
+	if err := yaml.UnmarshalStrict(raw, file); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return file, nil
+}
+
+// Apply sets the flags of fs the file configures, except those already set on the command line or
+// by ApplyEnv, so both take precedence over the file. Call it after fs.Parse and ApplyEnv.
+func (f *File) Apply(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		given[fl.Name] = true
+	})
+
+	v := reflect.ValueOf(f).Elem()
+	for i := range v.NumField() {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		field := v.Field(i)
+		if field.IsNil() || given[name] {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("config file key %q has no matching flag", name)
+		}
+		if err := fs.Set(name, formatFileValue(field)); err != nil {
+			return fmt.Errorf("invalid config file value for %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// formatFileValue renders a File field as a command line value, lists as comma-separated values
+func formatFileValue(field reflect.Value) string {
+	if field.Kind() == reflect.Slice {
+		values := make([]string, field.Len())
+		for i := range values {
+			values[i] = fmt.Sprint(field.Index(i).Interface())
+		}
+		return strings.Join(values, ",")
+	}
+	switch value := field.Elem().Interface().(type) {
+	case Duration:
+		return time.Duration(value).String()
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a config file to a temporary directory and returns its path
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "flexds.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileApplyPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("flexds", flag.ContinueOnError)
+	adsPort := fs.Int("ads-port", 18000, "")
+	adminPort := fs.Int("admin-port", 19005, "")
+	statPrefix := fs.String("stat-prefix", "", "")
+	if err := fs.Parse([]string{"-ads-port", "18001"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FLEXDS_ADMIN_PORT", "19006")
+	if err := ApplyEnv(fs, "FLEXDS_"); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := LoadFile(writeFile(t, "ads-port: 18002\nadmin-port: 19007\nstat-prefix: edge\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *adsPort != 18001 {
+		t.Errorf("got ads-port %d, want the command line's 18001", *adsPort)
+	}
+	if *adminPort != 19006 {
+		t.Errorf("got admin-port %d, want the environment's 19006", *adminPort)
+	}
+	if *statPrefix != "edge" {
+		t.Errorf("got stat-prefix %q, want the file's edge", *statPrefix)
+	}
+}
+
+func TestFileApplyValues(t *testing.T) {
+	fs := flag.NewFlagSet("flexds", flag.ContinueOnError)
+	var datacenters StringSliceFlag
+	var listenerPorts Uint32SliceFlag
+	var generateRequestId, requestIdTraceSampling OptionalBoolFlag
+	fs.Var(&datacenters, "consul-datacenters", "")
+	fs.Var(&listenerPorts, "listener-ports", "")
+	fs.Var(&generateRequestId, "generate-request-id", "")
+	fs.Var(&requestIdTraceSampling, "request-id-trace-sampling", "")
+	consul := fs.Bool("consul", false, "")
+	debounce := fs.Duration("aggregator-debounce", 0, "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := LoadFile(writeFile(t, `consul: true
+consul-datacenters: [dc1, dc2]
+listener-ports: [18080, 18443]
+generate-request-id: false
+aggregator-debounce: 200ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if !*consul {
+		t.Error("got consul false, want true")
+	}
+	if !slices.Equal(datacenters, StringSliceFlag{"dc1", "dc2"}) {
+		t.Errorf("got consul-datacenters %v, want [dc1 dc2]", datacenters)
+	}
+	if !slices.Equal(listenerPorts, Uint32SliceFlag{18080, 18443}) {
+		t.Errorf("got listener-ports %v, want [18080 18443]", listenerPorts)
+	}
+	if generateRequestId.Value == nil || *generateRequestId.Value {
+		t.Errorf("got generate-request-id %q, want an explicit false", generateRequestId.String())
+	}
+	if requestIdTraceSampling.Value != nil {
+		t.Errorf("got request-id-trace-sampling %q, want it left unset", requestIdTraceSampling.String())
+	}
+	if *debounce != 200*time.Millisecond {
+		t.Errorf("got aggregator-debounce %s, want 200ms", *debounce)
+	}
+}
+
+func TestLoadFileRejectsUnknownKeys(t *testing.T) {
+	_, err := LoadFile(writeFile(t, "ads-port: 18000\nads-prot: 18001\n"))
+	if err == nil || !strings.Contains(err.Error(), "ads-prot") {
+		t.Errorf("got error %v, want the unknown key ads-prot rejected", err)
+	}
+}
+
+func TestFileApplyWithoutFlag(t *testing.T) {
+	fs := flag.NewFlagSet("flexds", flag.ContinueOnError)
+	port := 18000
+	file := &File{AdsPort: &port}
+	if err := file.Apply(fs); err == nil || !strings.Contains(err.Error(), "ads-port") {
+		t.Errorf("got error %v, want ads-port reported as having no flag", err)
+	}
+}
@@ -63,3 +63,50 @@ func (f *LogLevelFlag) Set(value string) error {
 func (f *LogLevelFlag) Level() slog.Level {
 	return slog.Level(*f)
 }
+
+// StringSliceFlag implements flag.Value for a comma-separated list of strings
+type StringSliceFlag []string
+
+func (f *StringSliceFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, ",")
+}
+
+func (f *StringSliceFlag) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		*f = append(*f, part)
+	}
+	return nil
+}
+
+// OptionalBoolFlag implements flag.Value for a boolean that is unset unless given on the command line
+type OptionalBoolFlag struct {
+	Value *bool
+}
+
+func (f *OptionalBoolFlag) String() string {
+	if f == nil || f.Value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*f.Value)
+}
+
+func (f *OptionalBoolFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean value %q: %w", value, err)
+	}
+	f.Value = &v
+	return nil
+}
+
+// IsBoolFlag allows the flag to be given without a value, meaning true
+func (f *OptionalBoolFlag) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,69 @@
+// Package secrets re-reads secret files such as credentials and certificates so that
+// rotated secrets are picked up without restarting flexds.
+package secrets
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAge bounds how long cached contents are trusted when the file's
+// modification time and size look unchanged
+const DefaultMaxAge = 5 * time.Minute
+
+// File caches the contents of a secret file. Read re-reads it whenever its modification
+// time or size changes, and at least every maxAge in case a rotation preserved both.
+type File struct {
+	path   string
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	data    []byte
+	modTime time.Time
+	size    int64
+	readAt  time.Time
+}
+
+func NewFile(path string, maxAge time.Duration) *File {
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	return &File{path: path, maxAge: maxAge}
+}
+
+// Path returns the path of the secret file
+func (f *File) Path() string {
+	return f.path
+}
+
+// Read returns the current contents of the file, re-reading it from disk if it changed
+func (f *File) Read() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat secret file %s: %w", f.path, err)
+	}
+
+	if f.data != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size && time.Since(f.readAt) < f.maxAge {
+		return f.data, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret file %s: %w", f.path, err)
+	}
+	if f.data != nil && string(data) != string(f.data) {
+		slog.Info("Secret file changed, using new contents", "path", f.path)
+	}
+
+	f.data = data
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.readAt = time.Now()
+	return data, nil
+}
@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileRereadsChangedContents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds")
+	write := func(contents string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(f *File, want string) {
+		t.Helper()
+		data, err := f.Read()
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if string(data) != want {
+			t.Errorf("Read = %q, want %q", data, want)
+		}
+	}
+
+	modTime := time.Now().Add(-time.Hour)
+	write("user:old", modTime)
+	f := NewFile(path, time.Hour)
+	read(f, "user:old")
+
+	// A rotation changes the modification time
+	write("user:new", modTime.Add(time.Minute))
+	read(f, "user:new")
+
+	// A rotation preserving the modification time and size is picked up once maxAge passes
+	write("user:abc", modTime.Add(time.Minute))
+	read(f, "user:new")
+	f.readAt = time.Now().Add(-2 * time.Hour)
+	read(f, "user:abc")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(); err == nil {
+		t.Error("Read of a removed file succeeded")
+	}
+}
@@ -0,0 +1,6 @@
+package telemetry
+
+// InvalidConfigKey is the log attribute marking records about configuration that was rejected or
+// ignored, valued with what it applied to, e.g. "route" for a skipped route. A dry run fails when
+// such a record is logged, unlike other warnings, which may describe deliberate settings.
+const InvalidConfigKey = "invalid"
@@ -1,6 +1,8 @@
 package telemetry
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -12,16 +14,101 @@ var (
 			Help: "Total number of snapshots pushed to the cache",
 		},
 	)
-	MetricServicesDiscovered = prometheus.NewGauge(
+	MetricSnapshotsSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "flexds_snapshots_skipped_total",
+			Help: "Total number of snapshot pushes skipped because no resources changed",
+		},
+	)
+	MetricSnapshotsTooLarge = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "flexds_snapshot_too_large_total",
+			Help: "Total number of snapshots rejected for exceeding the size limit",
+		},
+	)
+	MetricSnapshotBuildSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "flexds_snapshot_build_seconds",
+			Help:    "Time taken to build and push a snapshot",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+	MetricResources = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "flexds_resources_total",
+			Help: "Number of resources of each type in the last built snapshot",
+		},
+		[]string{"type"},
+	)
+	MetricServicesDiscovered = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "flexds_services_discovered",
-			Help: "Number of services discovered from Consul",
+			Help: "Number of services discovered, by the loader that reported them",
+		},
+		[]string{"loader"},
+	)
+	MetricDiscoveryUpdates = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flexds_discovery_updates_total",
+			Help: "Total number of service updates reported to the aggregator, by loader",
 		},
+		[]string{"loader"},
+	)
+	MetricDiscoveryErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flexds_discovery_errors_total",
+			Help: "Total number of errors loading services, by loader",
+		},
+		[]string{"loader"},
+	)
+	MetricActiveStreams = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "flexds_active_streams",
+			Help: "Number of open xDS streams, by protocol variant (sotw or delta)",
+		},
+		[]string{"stream"},
+	)
+	MetricStreamRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flexds_stream_requests_total",
+			Help: "Total number of discovery requests received on xDS streams, by resource type",
+		},
+		[]string{"type_url"},
+	)
+	MetricNacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flexds_nacks_total",
+			Help: "Total number of configuration updates rejected by Envoy",
+		},
+		[]string{"type_url"},
+	)
+	MetricDnsClusterErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "flexds_dns_cluster_errors_total",
+			Help: "Total number of Envoy rejections caused by DNS resolution failures",
+		},
+		[]string{"cluster"},
 	)
 )
 
-// InitMetrics registers Prometheus metrics
+var initMetrics sync.Once
+
+// InitMetrics registers Prometheus metrics, only the first call has any effect
 func InitMetrics() {
+	initMetrics.Do(registerMetrics)
+}
+
+func registerMetrics() {
 	prometheus.MustRegister(MetricSnapshotsPushed)
+	prometheus.MustRegister(MetricSnapshotsSkipped)
+	prometheus.MustRegister(MetricSnapshotsTooLarge)
+	prometheus.MustRegister(MetricSnapshotBuildSeconds)
+	prometheus.MustRegister(MetricResources)
 	prometheus.MustRegister(MetricServicesDiscovered)
+	prometheus.MustRegister(MetricDiscoveryUpdates)
+	prometheus.MustRegister(MetricDiscoveryErrors)
+	prometheus.MustRegister(MetricActiveStreams)
+	prometheus.MustRegister(MetricStreamRequests)
+	prometheus.MustRegister(MetricNacks)
+	prometheus.MustRegister(MetricDnsClusterErrors)
 }
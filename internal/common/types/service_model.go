@@ -6,27 +6,177 @@ import "time"
 type ServiceInstance struct {
 	Address string
 	Port    int
+	Weight  uint32 // relative load balancing weight, unweighted when zero
+
+	// Locality and failover priority, instances sharing them are grouped together.
+	// Priority 0 receives traffic first, higher priorities only when lower ones are unhealthy.
+	Region   string
+	Zone     string
+	Priority uint32
+
+	// HealthCheckPort is the port active health checks probe when it differs from the traffic port,
+	// e.g. a sidecar's health endpoint. Zero probes the traffic port.
+	HealthCheckPort uint32
+}
+
+// OutlierDetection configures passive ejection of misbehaving endpoints.
+// Zero-valued fields fall back to Envoy's defaults.
+type OutlierDetection struct {
+	Consecutive5xx     uint32
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionPercent uint32
+}
+
+// TcpKeepalive configures keepalive probes on upstream connections.
+// Zero-valued fields fall back to the operating system's defaults.
+type TcpKeepalive struct {
+	Probes   uint32        // unanswered probes before the connection is dropped
+	Time     time.Duration // idle time before the first probe, whole seconds
+	Interval time.Duration // time between probes, whole seconds
+}
+
+// CorsPolicy configures the CORS headers Envoy adds for browser clients
+type CorsPolicy struct {
+	AllowOrigins       []string // exact origins
+	AllowOriginRegexes []string // RE2 origin patterns
+	AllowMethods       string
+	AllowHeaders       string
+	ExposeHeaders      string
+	MaxAge             string // seconds, as a string per Envoy's API
+	AllowCredentials   bool
+}
+
+// GrpcJsonTranscoder exposes a gRPC service to REST clients by transcoding JSON requests
+type GrpcJsonTranscoder struct {
+	DescriptorFile string   // path, on the control plane host, of the proto descriptor set (protoc --descriptor_set_out)
+	Services       []string // fully-qualified gRPC service names to transcode, e.g. "shop.v1.CartService"
+}
+
+// JwtProvider validates the JWTs presented to a service's routes, against a remote or an inline JWKS
+type JwtProvider struct {
+	Issuer    string   // required "iss" claim, any issuer when empty
+	Audiences []string // accepted "aud" claims, any audience when empty
+	JwksUri   string   // URL the JWKS is fetched from
+	LocalJwks string   // inline JWKS, used instead of JwksUri
+}
+
+// RetryPolicy configures upstream retries for a route
+type RetryPolicy struct {
+	RetryOn       string // Envoy retry conditions, e.g. "5xx,connect-failure"
+	NumRetries    uint32
+	PerTryTimeout time.Duration // timeout of each attempt, the route timeout when zero
+	BackOffBase   time.Duration // base interval between retries, Envoy's default when zero
+	BackOffMax    time.Duration // cap on the back-off interval, 10x the base when zero
+}
+
+// WeightedCluster is one cluster of a route splitting traffic by weight, e.g. for canaries
+type WeightedCluster struct {
+	Name   string
+	Weight uint32
+}
+
+// RedirectAction answers a route's requests with a redirect instead of proxying them.
+// Empty fields keep that part of the request URL.
+type RedirectAction struct {
+	Scheme       string // e.g. "https" to force HTTPS
+	Host         string
+	Port         uint32
+	Path         string // replaces the whole path
+	ResponseCode uint32 // 301 (default), 302, 303, 307, or 308
+}
+
+// DirectResponse answers a route's requests with a fixed response without involving any upstream,
+// e.g. a maintenance page
+type DirectResponse struct {
+	Status uint32 // HTTP status code, 200 to 599
+	Body   string // inline response body, empty for none
 }
 
 // RoutePattern defines a single routing rule for a service
 type RoutePattern struct {
 	Name             string
-	MatchType        string // "path", "header", or "both"
-	PathPrefix       string
+	Action           string          // "route" (default) proxies to the cluster, "redirect" answers with Redirect, "direct_response" with DirectResponse
+	Redirect         *RedirectAction // set with the "redirect" action
+	DirectResponse   *DirectResponse // set with the "direct_response" action
+	Cors             *CorsPolicy     // overrides the virtual host CORS policy for this route
+	MatchType        string          // "path", "header", "both", "regex", or "exact"
+	PathPrefix       string          // the whole path with the "exact" match type
+	PathRegex        string          // RE2 regex the whole path must match with the "regex" match type, PathPrefix when empty
 	HeaderName       string
 	HeaderValue      string
+	HeaderMatchType  string // how HeaderValue is matched: "exact" (default), "prefix", "suffix", "regex", or "present" (any value)
 	PrefixRewrite    string // legacy: simple string rewrite
 	RegexRewrite     string // regex pattern to match for rewriting
 	RegexReplacement string // what to replace the regex match with
+	HostRewrite      string // literal Host header sent upstream, the client's Host when empty
+	AutoHostRewrite  bool   // send the upstream's DNS name as the Host header
 	Hosts            []string
+	HashHeader       string            // request header hashed for session affinity with ring_hash/maglev
+	Retry            *RetryPolicy      // no retries when nil
+	WeightedClusters []WeightedCluster // split traffic across these clusters instead of the service's own
+	TotalWeight      uint32            // weights are fractions of this total when set, which they must sum to
+	ClusterHeader    string            // route to the cluster named in this request header instead of the service's own
+	MirrorCluster    string            // service a copy of the requests is sent to, responses are ignored
+	MirrorPercent    uint32            // percentage of requests mirrored, all when zero
+	Timeout          time.Duration     // upstream request timeout, Envoy's default of 15s when zero
+	IdleTimeout      time.Duration     // stream idle timeout, the connection manager's default when zero
+	// Limits for long-lived (e.g. gRPC streaming) requests, both unset when zero
+	MaxStreamDuration    time.Duration // maximum duration of a stream, regardless of activity
+	GrpcTimeoutHeaderMax time.Duration // honor the client's grpc-timeout header, capped at this value
+	// Redirect Envoy-generated 401s (e.g. from an auth filter) for this route to this login URL
+	UnauthorizedRedirect string
 }
 
+// HealthCheck configures active HTTP health checking of a service's instances.
+// Zero-valued fields fall back to the snapshot manager defaults.
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	UnhealthyThreshold uint32
+}
+
+// ProtocolTCP marks a service proxied at L4 with tcp_proxy instead of routed over HTTP
+const ProtocolTCP = "tcp"
+
 // DiscoveredService represents a service with its instances and routing configuration
 type DiscoveredService struct {
-	Name           string
-	EnableHTTP2    bool
-	EnableTLS      bool
-	DnsRefreshRate time.Duration
-	Instances      []ServiceInstance
-	Routes         []RoutePattern // Routing patterns for this service
+	Name            string
+	Protocol        string // ProtocolTCP proxies connections on ListenerPorts to the cluster, HTTP otherwise
+	EnableHTTP2     bool
+	EnableTLS       bool
+	GrpcWeb         bool                // Translate gRPC-Web requests from browsers to gRPC, adding the grpc_web filter to the listeners serving the service
+	GrpcJson        *GrpcJsonTranscoder // Transcode JSON requests to the service's gRPC methods, disabled when nil
+	Jwt             *JwtProvider        // Require a valid JWT on the service's routes, disabled when nil
+	DnsRefreshRate  time.Duration
+	DnsLookupFamily string            // v4 (default), v6, auto (IPv6 falling back to IPv4), v4_preferred, or all
+	ConnectTimeout  time.Duration     // Upstream connect timeout, the fleet-wide default when zero
+	Draining        bool              // Keep the cluster but stop routing new requests to it
+	NodeIds         []string          // Envoy node ids this service is served to, all nodes when empty
+	ListenerPorts   []uint32          // Listener ports serving this service's routes, all listeners when empty; for TCP services the ports of their own listeners
+	RouteScope      string            // Scope key selecting this service's route table when scoped routes are enabled, every scope when empty
+	HealthCheck     *HealthCheck      // Active health checking, disabled when nil
+	LbPolicy        string            // round_robin (default), least_request, ring_hash, maglev, or random
+	Outlier         *OutlierDetection // Outlier detection, disabled when nil
+	TcpKeepalive    *TcpKeepalive     // Keepalive on upstream connections, disabled when nil
+
+	// Percentage of healthy hosts below which Envoy ignores health and balances across all hosts,
+	// Envoy's default of 50 when nil and never when 0
+	HealthyPanicThreshold *float64
+
+	// Upstream certificate validation, only used when EnableTLS is set
+	TlsCaFile          string   // CA bundle path, the control plane's default bundle when empty
+	TlsCaPem           string   // Inline PEM CA bundle, takes precedence over TlsCaFile
+	TlsSubjectAltNames []string // DNS SANs accepted in the upstream certificate, any when empty
+	TlsInsecure        bool     // Skip certificate verification entirely (ACCEPT_UNTRUSTED)
+	Sni                string   // SNI sent to the upstream, derived from the instances or service name when empty
+	TlsClientCertFile  string   // Client certificate presented to the upstream for mTLS, requires TlsClientKeyFile
+	TlsClientKeyFile   string   // Private key of the client certificate
+
+	IgnoreEndpointWeights bool // Treat all instances equally even when they carry weights
+	// Resolve each instance to a single endpoint using the first DNS address (LOGICAL_DNS) instead of one endpoint per address
+	AllAddressesInSingleEndpoint bool
+	Instances                    []ServiceInstance
+	Routes                       []RoutePattern // Routing patterns for this service
 }
@@ -1,37 +1,176 @@
 package discovery
 
 import (
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/moonkev/flexds/internal/common/telemetry"
 	"github.com/moonkev/flexds/internal/common/types"
 	"github.com/moonkev/flexds/internal/xds"
 )
 
 type DiscoveredServiceAggregator struct {
+	mu                   sync.Mutex
 	discoveredServiceMap map[string][]*types.DiscoveredService
 	snapshotManager      *xds.SnapshotManager
+
+	debounce      time.Duration
+	debounceTimer *time.Timer
+	lastUpdate    time.Time
+	reportHook    func(loaderId string, err error)
+}
+
+// AggregatorOption configures optional DiscoveredServiceAggregator behavior
+type AggregatorOption func(*DiscoveredServiceAggregator)
+
+// WithDebounce delays snapshot rebuilds until no update has arrived for the given window,
+// coalescing updates from several loaders into one rebuild. Zero rebuilds on every update.
+func WithDebounce(window time.Duration) AggregatorOption {
+	return func(a *DiscoveredServiceAggregator) {
+		a.debounce = window
+	}
+}
+
+// WithReportHook calls hook after every report of a loader, with a nil error for UpdateServices and the
+// reported error for ReportError. It runs on the loader's goroutine and must not block.
+func WithReportHook(hook func(loaderId string, err error)) AggregatorOption {
+	return func(a *DiscoveredServiceAggregator) {
+		a.reportHook = hook
+	}
 }
 
-func NewDiscoveredServiceAggregator(snapshotManager *xds.SnapshotManager) *DiscoveredServiceAggregator {
-	return &DiscoveredServiceAggregator{
+// NewDiscoveredServiceAggregator creates an aggregator pushing to snapshotManager. With a nil manager it
+// only collects the loaders' services, without building snapshots.
+func NewDiscoveredServiceAggregator(snapshotManager *xds.SnapshotManager, opts ...AggregatorOption) *DiscoveredServiceAggregator {
+	a := &DiscoveredServiceAggregator{
 		discoveredServiceMap: make(map[string][]*types.DiscoveredService),
 		snapshotManager:      snapshotManager,
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
+// UpdateServices replaces the services reported by the given loader and rebuilds the snapshot.
+// Loaders run in their own goroutines, so the map update and the snapshot build are serialized.
+// With a debounce window the rebuild happens once the window passes without further updates,
+// always from the latest services of every loader.
 func (a *DiscoveredServiceAggregator) UpdateServices(loaderId string, services []*types.DiscoveredService) error {
+	if a.reportHook != nil {
+		defer a.reportHook(loaderId, nil)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	a.discoveredServiceMap[loaderId] = services
+	a.lastUpdate = time.Now()
+
+	telemetry.MetricDiscoveryUpdates.WithLabelValues(loaderId).Inc()
+	telemetry.MetricServicesDiscovered.WithLabelValues(loaderId).Set(float64(len(services)))
 
-	aggregateLen := 0
-	for _, svcList := range a.discoveredServiceMap {
-		aggregateLen += len(svcList)
+	if a.debounce > 0 {
+		if a.debounceTimer == nil {
+			a.debounceTimer = time.AfterFunc(a.debounce, a.rebuild)
+		} else {
+			a.debounceTimer.Reset(a.debounce)
+		}
+		return nil
 	}
+	a.pushSnapshot()
+	return nil
+}
 
-	aggregatedServices := make([]*types.DiscoveredService, 0, aggregateLen)
+// ReportError records a failed discovery attempt of the given loader. Unlike UpdateServices with an
+// empty list, which removes the loader's services, the services it last reported are kept, so a
+// transient registry failure doesn't drop the routes and endpoints they back.
+func (a *DiscoveredServiceAggregator) ReportError(loaderId string, err error) {
+	a.mu.Lock()
+	previous := len(a.discoveredServiceMap[loaderId])
+	a.mu.Unlock()
 
-	for _, svcList := range a.discoveredServiceMap {
-		aggregateLen += len(svcList)
-		aggregatedServices = append(aggregatedServices, svcList...)
+	slog.Error("discovery failed, keeping the previous services", "loader", loaderId, "services", previous, "error", err)
+	telemetry.MetricDiscoveryErrors.WithLabelValues(loaderId).Inc()
+	if a.reportHook != nil {
+		a.reportHook(loaderId, err)
 	}
+}
 
-	a.snapshotManager.BuildAndPushSnapshot(aggregatedServices)
-	return nil
+// rebuild pushes the aggregated services once the debounce window has passed
+func (a *DiscoveredServiceAggregator) rebuild() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pushSnapshot()
+}
+
+// pushSnapshot aggregates the services of every loader and pushes them, a.mu must be held
+func (a *DiscoveredServiceAggregator) pushSnapshot() {
+	if a.snapshotManager == nil {
+		return
+	}
+	a.snapshotManager.BuildAndPushSnapshot(mergeServices(a.discoveredServiceMap))
+}
+
+// mergeServices flattens the services of every loader, combining services of the same name into one so
+// they don't produce duplicate clusters. Loaders are visited in order of their ids: the instances and
+// routes of every definition are combined, HTTP/2 is enabled if any definition enables it, and every
+// other setting comes from the first definition. The loaders' services are left unmodified.
+func mergeServices(servicesByLoader map[string][]*types.DiscoveredService) []*types.DiscoveredService {
+	var merged []*types.DiscoveredService
+	index := make(map[string]int)
+	combined := make(map[string]bool)
+
+	for _, loaderId := range slices.Sorted(maps.Keys(servicesByLoader)) {
+		for _, svc := range servicesByLoader[loaderId] {
+			i, ok := index[svc.Name]
+			if !ok {
+				index[svc.Name] = len(merged)
+				merged = append(merged, svc)
+				continue
+			}
+
+			slog.Debug("merging service defined more than once", "service", svc.Name, "loader", loaderId)
+			if !combined[svc.Name] {
+				// The first definition still belongs to its loader, merge into a copy
+				first := *merged[i]
+				first.Instances = slices.Clone(first.Instances)
+				first.Routes = slices.Clone(first.Routes)
+				merged[i] = &first
+				combined[svc.Name] = true
+			}
+			merged[i].Instances = append(merged[i].Instances, svc.Instances...)
+			merged[i].Routes = append(merged[i].Routes, svc.Routes...)
+			merged[i].EnableHTTP2 = merged[i].EnableHTTP2 || svc.EnableHTTP2
+		}
+	}
+	return merged
+}
+
+// Services returns the services of every loader merged as they are pushed to the snapshot
+func (a *DiscoveredServiceAggregator) Services() []*types.DiscoveredService {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return mergeServices(a.discoveredServiceMap)
+}
+
+// LastUpdate returns when a loader last reported its services, zero before the first report
+func (a *DiscoveredServiceAggregator) LastUpdate() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastUpdate
+}
+
+// Snapshot returns a copy of the services currently reported by each loader, keyed by loader id
+func (a *DiscoveredServiceAggregator) Snapshot() map[string][]*types.DiscoveredService {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	snapshot := make(map[string][]*types.DiscoveredService, len(a.discoveredServiceMap))
+	for loaderId, services := range a.discoveredServiceMap {
+		snapshot[loaderId] = slices.Clone(services)
+	}
+	return snapshot
 }
@@ -0,0 +1,179 @@
+package discovery
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	"github.com/moonkev/flexds/internal/common/types"
+	"github.com/moonkev/flexds/internal/xds"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestAggregator(opts ...AggregatorOption) *DiscoveredServiceAggregator {
+	snapshots := xds.NewSnapshotManager(xds.Config{
+		Cache:         cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil),
+		ListenerPorts: []uint32{18080},
+	})
+	return NewDiscoveredServiceAggregator(snapshots, opts...)
+}
+
+func testService(name string, addresses ...string) *types.DiscoveredService {
+	svc := &types.DiscoveredService{
+		Name:   name,
+		Routes: []types.RoutePattern{{Name: name, PathPrefix: "/" + name, Hosts: []string{"*"}}},
+	}
+	for _, address := range addresses {
+		svc.Instances = append(svc.Instances, types.ServiceInstance{Address: address, Port: 8080})
+	}
+	return svc
+}
+
+func TestUpdateServicesConcurrentLoaders(t *testing.T) {
+	agg := newTestAggregator()
+
+	const loaders, updates = 8, 20
+	var wg sync.WaitGroup
+	for l := range loaders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loaderId := fmt.Sprintf("loader-%d", l)
+			for u := range updates {
+				svc := testService(fmt.Sprintf("svc-%d", l), fmt.Sprintf("10.0.%d.%d", l, u))
+				if err := agg.UpdateServices(loaderId, []*types.DiscoveredService{svc}); err != nil {
+					t.Errorf("UpdateServices(%s): %v", loaderId, err)
+				}
+				_ = agg.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+
+	snapshot := agg.Snapshot()
+	if len(snapshot) != loaders {
+		t.Fatalf("got services of %d loaders, want %d", len(snapshot), loaders)
+	}
+	for l := range loaders {
+		services := snapshot[fmt.Sprintf("loader-%d", l)]
+		if len(services) != 1 || services[0].Instances[0].Address != fmt.Sprintf("10.0.%d.%d", l, updates-1) {
+			t.Errorf("loader-%d: got %+v, want its last update", l, services)
+		}
+	}
+	if got := len(agg.Services()); got != loaders {
+		t.Errorf("got %d aggregated services, want %d", got, loaders)
+	}
+}
+
+func TestServicesSumsAcrossLoaders(t *testing.T) {
+	agg := newTestAggregator()
+
+	// The second update of each loader replaces its first, the total follows the latest counts
+	for _, counts := range []map[string]int{
+		{"consul": 3, "yaml": 2, "marathon": 4},
+		{"consul": 1, "yaml": 5, "marathon": 0},
+	} {
+		want := 0
+		for loaderId, count := range counts {
+			var services []*types.DiscoveredService
+			for i := range count {
+				services = append(services, testService(fmt.Sprintf("%s-%d", loaderId, i), "10.0.0.1"))
+			}
+			if err := agg.UpdateServices(loaderId, services); err != nil {
+				t.Fatal(err)
+			}
+			want += count
+		}
+		if got := len(agg.Services()); got != want {
+			t.Errorf("got %d aggregated services after updates %v, want %d", got, counts, want)
+		}
+	}
+}
+
+func TestDebounceCoalescesLoaderUpdates(t *testing.T) {
+	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
+	snapshots := xds.NewSnapshotManager(xds.Config{Cache: cache, ListenerPorts: []uint32{18080}})
+	agg := NewDiscoveredServiceAggregator(snapshots, WithDebounce(100*time.Millisecond))
+	pushes := func() float64 { return testutil.ToFloat64(telemetry.MetricSnapshotsPushed) }
+	before := pushes()
+
+	if err := agg.UpdateServices("consul", []*types.DiscoveredService{testService("orders", "10.0.0.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agg.UpdateServices("yaml", []*types.DiscoveredService{testService("users", "10.0.1.1")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := pushes() - before; got != 0 {
+		t.Fatalf("pushed %v snapshots within the debounce window, want 0", got)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if got := pushes() - before; got != 1 {
+		t.Errorf("pushed %v snapshots after the debounce window, want 1", got)
+	}
+	snap, err := cache.GetSnapshot(xds.ReferenceNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusters := snap.GetResources(resource.ClusterType); clusters["orders"] == nil || clusters["users"] == nil {
+		t.Errorf("pushed clusters %v, want orders and users from both loaders", slices.Sorted(maps.Keys(clusters)))
+	}
+}
+
+func TestOverlappingServicesFromTwoLoaders(t *testing.T) {
+	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
+	snapshots := xds.NewSnapshotManager(xds.Config{Cache: cache, ListenerPorts: []uint32{18080}})
+	agg := NewDiscoveredServiceAggregator(snapshots)
+
+	fromConsul := testService("payments", "10.0.0.1")
+	fromYaml := testService("payments", "10.0.1.1")
+	fromYaml.Routes[0].PathPrefix = "/pay"
+	fromYaml.EnableHTTP2 = true
+	if err := agg.UpdateServices("consul", []*types.DiscoveredService{fromConsul, testService("orders", "10.0.0.2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agg.UpdateServices("yaml", []*types.DiscoveredService{fromYaml}); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := cache.GetSnapshot(xds.ReferenceNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusters := snap.GetResources(resource.ClusterType); len(clusters) != 2 || clusters["payments"] == nil || clusters["orders"] == nil {
+		t.Fatalf("pushed clusters %v, want one payments and one orders", slices.Sorted(maps.Keys(clusters)))
+	}
+	assignment, ok := snap.GetResources(resource.EndpointType)["payments"].(*endpoint.ClusterLoadAssignment)
+	if !ok {
+		t.Fatal("no endpoints pushed for payments")
+	}
+	var addresses []string
+	for _, locality := range assignment.GetEndpoints() {
+		for _, lb := range locality.GetLbEndpoints() {
+			addresses = append(addresses, lb.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+		}
+	}
+	if slices.Sort(addresses); !slices.Equal(addresses, []string{"10.0.0.1", "10.0.1.1"}) {
+		t.Errorf("payments endpoints %v, want the instances of both loaders", addresses)
+	}
+
+	// Instances and routes are combined, HTTP/2 is enabled by either definition, the loaders' own services stay as reported
+	for _, svc := range agg.Services() {
+		if svc.Name != "payments" {
+			continue
+		}
+		if len(svc.Routes) != 2 || !svc.EnableHTTP2 {
+			t.Errorf("merged payments has %d routes and HTTP/2 %v, want 2 routes with HTTP/2", len(svc.Routes), svc.EnableHTTP2)
+		}
+	}
+	if len(fromConsul.Instances) != 1 || len(fromConsul.Routes) != 1 || fromConsul.EnableHTTP2 {
+		t.Errorf("merging modified the consul loader's service: %+v", fromConsul)
+	}
+}
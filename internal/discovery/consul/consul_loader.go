@@ -2,142 +2,296 @@ package consul
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/moonkev/flexds/internal/common/secrets"
 	"github.com/moonkev/flexds/internal/common/telemetry"
 	"github.com/moonkev/flexds/internal/common/types"
 	"github.com/moonkev/flexds/internal/discovery"
 	"github.com/moonkev/flexds/internal/discovery/consul/watcher"
+	"github.com/moonkev/flexds/internal/discovery/metadata"
 )
 
 // Config Config holds the application configuration
 type Config struct {
 	ConsulAddr      string
 	WaitTimeSec     int
-	WatcherStrategy string // "immediate", "debounce", or "batch"
+	WatcherStrategy string // "immediate", "debounce", "batch", or "health"
+
+	// Tuning of the debounce and batch strategies, the watcher package defaults when zero
+	DebounceInterval time.Duration
+	BatchSize        int
+	BatchTimeout     time.Duration
+
+	// Datacenters to watch, the agent's local datacenter when empty. With more than one, service
+	// names are prefixed with "<datacenter>_" so services of the same name don't collide.
+	Datacenters []string
+
+	// ACL token sent with every request. TokenFile takes precedence and is re-read when it changes,
+	// keeping the token out of process arguments. Consul's CONSUL_HTTP_TOKEN applies when both are empty.
+	Token     string
+	TokenFile string
+
+	// Scheme is "http" or "https", taken from ConsulAddr when it has one and plaintext http otherwise
+	Scheme string
+	// TLS settings for https, the system CA bundle and no client certificate by default
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+
+	// RequiredTags limits discovery to services with at least one instance carrying all of these tags
+	RequiredTags []string
+
+	// AddressPolicy selects each instance's address: "service" (default) prefers the service address
+	// over the node address, "node" always uses the node address, and any other value names a tagged
+	// address (e.g. "lan_ipv4") looked up on the service, then the node, before falling back to "service".
+	// A service tagged address with a port replaces the service port.
+	AddressPolicy string
+}
+
+// Address policies other than a tagged address name
+const (
+	AddressPolicyService = "service"
+	AddressPolicyNode    = "node"
+)
+
+// Loader adapts the Consul watcher to the discovery.Loader interface
+type Loader struct {
+	cfg *Config
+}
+
+func NewLoader(cfg *Config) *Loader {
+	return &Loader{cfg: cfg}
+}
+
+func (l *Loader) Name() string {
+	return "consul"
+}
+
+// Start watches Consul until the context is cancelled
+func (l *Loader) Start(ctx context.Context, aggregator *discovery.DiscoveredServiceAggregator) error {
+	StartWatcher(ctx, l.cfg.ConsulAddr, l.cfg, aggregator)
+	return nil
 }
 
 type HeaderRoundTripper struct {
-	Rt http.RoundTripper
+	Rt        http.RoundTripper
+	TokenFile *secrets.File // ACL token file read for every request, optional
 }
 
 func (h *HeaderRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+	if h.TokenFile != nil {
+		token, err := h.TokenFile.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read consul token file: %w", err)
+		}
+		req.Header.Set("X-Consul-Token", strings.TrimSpace(string(token)))
+	}
 	return h.Rt.RoundTrip(req)
 }
 
-func NewClient(addr string) (*consulapi.Client, error) {
+func NewClient(addr string, cfg *Config) (*consulapi.Client, error) {
+	// DefaultConfig picks up CONSUL_HTTP_TOKEN, which an explicit token overrides
 	consulCfg := consulapi.DefaultConfig()
 	consulCfg.Address = addr
+	if cfg.Token != "" {
+		consulCfg.Token = cfg.Token
+	}
+
+	if cfg.Scheme != "" {
+		consulCfg.Scheme = cfg.Scheme
+	}
+	if cfg.CAFile != "" {
+		consulCfg.TLSConfig.CAFile = cfg.CAFile
+	}
+	if cfg.CertFile != "" {
+		consulCfg.TLSConfig.CertFile = cfg.CertFile
+	}
+	if cfg.KeyFile != "" {
+		consulCfg.TLSConfig.KeyFile = cfg.KeyFile
+	}
+	if cfg.InsecureSkipVerify {
+		consulCfg.TLSConfig.InsecureSkipVerify = true
+	}
+
+	// The api client only applies TLSConfig to clients it creates itself, so it's set on the transport here
+	tlsConfig, err := consulapi.SetupTLSConfig(&consulCfg.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consul TLS configuration: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
 
-	consulCfg.HttpClient = &http.Client{
-		Transport: &HeaderRoundTripper{Rt: http.DefaultTransport},
+	rt := &HeaderRoundTripper{Rt: transport}
+	if cfg.TokenFile != "" {
+		rt.TokenFile = secrets.NewFile(cfg.TokenFile, secrets.DefaultMaxAge)
+		consulCfg.Token = ""
 	}
+	consulCfg.HttpClient = &http.Client{Transport: rt}
 	return consulapi.NewClient(consulCfg)
 }
 
 // StartWatcher watches for changes in the Consul service catalog using the configured watcher strategy
-// selected strategy can be "immediate", "debounce", or "batch"
+// selected strategy can be "immediate", "debounce", "batch", or "health"
 func StartWatcher(ctx context.Context, addr string, cfg *Config, aggregator *discovery.DiscoveredServiceAggregator) {
 
-	client, err := NewClient(addr)
+	client, err := NewClient(addr, cfg)
 	if err != nil {
 		slog.Error("failed to create consul client", "error", err)
+		telemetry.MetricDiscoveryErrors.WithLabelValues("consul_loader").Inc()
 		return
 	}
 
+	if len(cfg.Datacenters) == 0 {
+		watchDatacenter(ctx, client, cfg, "", "consul_loader", "", aggregator)
+		return
+	}
+
+	// Each datacenter reports to the aggregator as its own loader, which merges them
+	var wg sync.WaitGroup
+	for _, dc := range cfg.Datacenters {
+		namePrefix := ""
+		if len(cfg.Datacenters) > 1 {
+			namePrefix = dc + "_"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchDatacenter(ctx, client, cfg, dc, "consul_loader_"+dc, namePrefix, aggregator)
+		}()
+	}
+	wg.Wait()
+}
+
+// watchDatacenter watches the catalog of a single datacenter until the context is cancelled,
+// reporting its services under loaderId with namePrefix prepended to their names
+func watchDatacenter(ctx context.Context, client *consulapi.Client, cfg *Config, dc string, loaderId string, namePrefix string,
+	aggregator *discovery.DiscoveredServiceAggregator) {
+
+	queryOpts := &consulapi.QueryOptions{Datacenter: dc}
+
+	// Convert a service's passing entries to the discovery model, nil when the service is skipped
+	buildService := func(svc string, entries []*consulapi.ServiceEntry) *types.DiscoveredService {
+		if len(entries) == 0 {
+			slog.Warn("Service has no healthy instances", "service", svc, "datacenter", dc)
+			return nil
+		}
+		if !slices.ContainsFunc(entries, func(e *consulapi.ServiceEntry) bool { return hasTags(e.Service.Tags, cfg.RequiredTags) }) {
+			slog.Debug("Skipping service without required tags", "service", svc, "datacenter", dc, "tags", cfg.RequiredTags)
+			return nil
+		}
+
+		// Sort entries by Service.ModifyIndex in reverse order (highest first)
+		// This ensures we use metadata from the most recently modified service instance
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Service.ModifyIndex > entries[j].Service.ModifyIndex
+		})
+		latestEntryMeta := entries[0].Service.Meta
+
+		// Convert Consul entries to discovery model
+		instances := make([]types.ServiceInstance, 0, len(entries))
+		for _, e := range entries {
+			addr, port := selectAddress(e, cfg.AddressPolicy)
+			if addr == "" {
+				continue
+			}
+			inst := types.ServiceInstance{
+				Address: addr,
+				Port:    port,
+			}
+			// The node's locality applies unless the instance's own metadata overrides it
+			if e.Node != nil {
+				inst.Region = e.Node.Datacenter
+				if region := e.Node.Meta["region"]; region != "" {
+					inst.Region = region
+				}
+				inst.Zone = e.Node.Meta["zone"]
+			}
+			// Only passing entries are fetched, so their passing weight applies
+			if e.Service.Weights.Passing > 0 {
+				inst.Weight = uint32(e.Service.Weights.Passing)
+			}
+			metadata.ApplyInstanceOptions(e.Service.Service, &inst, e.Service.Meta)
+			if inst.HealthCheckPort == 0 {
+				inst.HealthCheckPort = checkPort(e)
+			}
+			instances = append(instances, inst)
+		}
+		// Parse routes from the most recently modified entry's metadata
+		name := namePrefix + svc
+		routes := ParseServiceRoutes(name, latestEntryMeta)
+
+		ds := &types.DiscoveredService{
+			Name:      name,
+			Instances: instances,
+			Routes:    routes,
+		}
+		metadata.ApplyServiceOptions(ds, latestEntryMeta)
+		return ds
+	}
+
 	// Create the service change handler that will be called when services change
 	handler := func(services []string) error {
-		slog.Debug("processing consul services", "count", len(services))
-		telemetry.MetricServicesDiscovered.Set(float64(len(services)))
+		slog.Debug("processing consul services", "datacenter", dc, "count", len(services))
 
 		var discoveredServices []*types.DiscoveredService
 
 		for _, svc := range services {
-			entries, _, err := client.Health().Service(svc, "", true, nil)
+			entries, _, err := client.Health().Service(svc, "", true, queryOpts.WithContext(ctx))
 			if err != nil {
-				slog.Error("Failed fetching healthy entries", "service", svc, "error", err)
-				continue
+				// A partial update would drop the service, fail so the watcher retries the whole list instead
+				return fmt.Errorf("failed fetching healthy entries of %s: %w", svc, err)
 			}
-			if len(entries) == 0 {
-				slog.Warn("Service has no healthy instances", "service", svc)
-				continue
+			if ds := buildService(svc, entries); ds != nil {
+				discoveredServices = append(discoveredServices, ds)
 			}
+		}
 
-			// Sort entries by Service.ModifyIndex in reverse order (highest first)
-			// This ensures we use metadata from the most recently modified service instance
-			sort.Slice(entries, func(i, j int) bool {
-				return entries[i].Service.ModifyIndex > entries[j].Service.ModifyIndex
-			})
-			latestEntryMeta := entries[0].Service.Meta
-
-			// Convert Consul entries to discovery model
-			instances := make([]types.ServiceInstance, 0, len(entries))
-			for _, e := range entries {
-				addr := e.Service.Address
-				if addr == "" {
-					addr = e.Node.Address
-				}
-				if addr == "" {
-					continue
-				}
-				instances = append(instances, types.ServiceInstance{
-					Address: addr,
-					Port:    e.Service.Port,
-				})
-			}
-			var enableHttp2 bool
-			var enableTLS bool
-			var dnsRefreshRate time.Duration
-
-			// Check explicit http2 metadata setting from the most recently modified entry
-			if len(entries) > 0 {
-				if val, ok := latestEntryMeta["http2"]; ok && val == "true" {
-					enableHttp2 = true
-				}
-				if val, ok := latestEntryMeta["tls"]; ok && val == "true" {
-					enableTLS = true
-				}
-				if val, ok := latestEntryMeta["dns_refresh_rate"]; ok {
-					parsed, err := time.ParseDuration(val)
-					if err != nil {
-						slog.Warn("Invalid dns_refresh_rate value, using default", "value", val, "error", err)
-					} else {
-						dnsRefreshRate = parsed
-					}
-				}
-			}
+		return aggregator.UpdateServices(loaderId, discoveredServices)
+	}
 
-			// Parse routes from the most recently modified entry's metadata
-			var routes []types.RoutePattern
-			if len(entries) > 0 {
-				headEntry := entries[0]
-				routes = ParseServiceRoutes(headEntry.Service.Service, entries[0].Service.Meta)
-			}
+	// The health strategy fetches each service's entries itself, only the changed ones
+	entriesHandler := func(entries map[string][]*consulapi.ServiceEntry) error {
+		slog.Debug("processing consul services", "datacenter", dc, "count", len(entries))
 
-			discoveredServices = append(discoveredServices, &types.DiscoveredService{
-				Name:           svc,
-				Instances:      instances,
-				Routes:         routes,
-				EnableHTTP2:    enableHttp2,
-				EnableTLS:      enableTLS,
-				DnsRefreshRate: dnsRefreshRate,
-			})
+		var discoveredServices []*types.DiscoveredService
+		for _, svc := range slices.Sorted(maps.Keys(entries)) {
+			if ds := buildService(svc, entries[svc]); ds != nil {
+				discoveredServices = append(discoveredServices, ds)
+			}
 		}
 
-		return aggregator.UpdateServices("consul_loader", discoveredServices)
+		return aggregator.UpdateServices(loaderId, discoveredServices)
 	}
 
 	// Create the appropriate watcher based on a configured strategy
 	watcherCfg := &watcher.WatcherConfig{
-		Client:      client,
-		WaitTimeSec: cfg.WaitTimeSec,
-		Handler:     handler,
+		Client:           client,
+		WaitTimeSec:      cfg.WaitTimeSec,
+		Datacenter:       dc,
+		DebounceInterval: cfg.DebounceInterval,
+		BatchSize:        cfg.BatchSize,
+		BatchTimeout:     cfg.BatchTimeout,
+		Handler:          handler,
+		EntriesHandler:   entriesHandler,
+		OnError: func(err error) {
+			aggregator.ReportError(loaderId, err)
+		},
 	}
 
 	// Get the watcher strategy from config (default to "immediate")
@@ -147,10 +301,79 @@ func StartWatcher(ctx context.Context, addr string, cfg *Config, aggregator *dis
 	}
 
 	w := watcher.NewWatcher(strategy, watcherCfg)
-	slog.Info("Starting consul watch", "strategy", strategy)
+	slog.Info("Starting consul watch", "strategy", strategy, "datacenter", dc)
 
 	// Watch blocks until context is cancelled
 	if err := w.Watch(ctx); err != nil {
-		slog.Error("consul watch error", "error", err)
+		slog.Error("consul watch error", "datacenter", dc, "error", err)
+	}
+}
+
+// selectAddress returns the instance address and port chosen by the address policy, with an empty
+// address when it has none. A service tagged address brings its own port when it sets one.
+func selectAddress(entry *consulapi.ServiceEntry, policy string) (string, int) {
+	port := entry.Service.Port
+	switch policy {
+	case "", AddressPolicyService:
+	case AddressPolicyNode:
+		return entry.Node.Address, port
+	default:
+		if tagged, ok := entry.Service.TaggedAddresses[policy]; ok && tagged.Address != "" {
+			if tagged.Port != 0 {
+				port = tagged.Port
+			}
+			return tagged.Address, port
+		}
+		if tagged := entry.Node.TaggedAddresses[policy]; tagged != "" {
+			return tagged, port
+		}
+	}
+	if entry.Service.Address != "" {
+		return entry.Service.Address, port
+	}
+	return entry.Node.Address, port
+}
+
+// hasTags reports whether tags contains every required tag
+func hasTags(tags []string, required []string) bool {
+	for _, tag := range required {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPort returns the port probed by the instance's HTTP, TCP or gRPC check when it differs from
+// the service port, or zero when the checks probe the service port or have no usable target
+func checkPort(entry *consulapi.ServiceEntry) uint32 {
+	for _, check := range entry.Checks {
+		if check.ServiceID != entry.Service.ID {
+			continue
+		}
+		target := check.Definition.HTTP
+		if target == "" {
+			target = check.Definition.TCP
+		}
+		if target == "" {
+			// gRPC check targets are host:port, optionally followed by /service
+			target, _, _ = strings.Cut(check.Definition.GRPC, "/")
+		}
+		if target == "" {
+			continue
+		}
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			target = u.Host
+		}
+		_, portStr, err := net.SplitHostPort(target)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 32)
+		if err != nil || int(port) == entry.Service.Port {
+			continue
+		}
+		return uint32(port)
 	}
+	return 0
 }
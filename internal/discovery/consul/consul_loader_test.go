@@ -0,0 +1,47 @@
+package consul
+
+import (
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestSelectAddress(t *testing.T) {
+	entry := &consulapi.ServiceEntry{
+		Node: &consulapi.Node{
+			Address:         "10.0.0.1",
+			TaggedAddresses: map[string]string{"lan_ipv4": "10.0.0.2", "wan": "203.0.113.1"},
+		},
+		Service: &consulapi.AgentService{
+			Address: "172.16.0.1",
+			Port:    9090,
+			TaggedAddresses: map[string]consulapi.ServiceAddress{
+				"lan_ipv4": {Address: "172.16.0.2", Port: 8080},
+				"virtual":  {Address: "240.0.0.1"},
+			},
+		},
+	}
+	noServiceAddress := &consulapi.ServiceEntry{Node: entry.Node, Service: &consulapi.AgentService{Port: 9090}}
+
+	tests := []struct {
+		policy   string
+		entry    *consulapi.ServiceEntry
+		want     string
+		wantPort int
+	}{
+		{policy: "", entry: entry, want: "172.16.0.1", wantPort: 9090},
+		{policy: AddressPolicyService, entry: entry, want: "172.16.0.1", wantPort: 9090},
+		{policy: AddressPolicyService, entry: noServiceAddress, want: "10.0.0.1", wantPort: 9090},
+		{policy: AddressPolicyNode, entry: entry, want: "10.0.0.1", wantPort: 9090},
+		{policy: "lan_ipv4", entry: entry, want: "172.16.0.2", wantPort: 8080},
+		{policy: "lan_ipv4", entry: noServiceAddress, want: "10.0.0.2", wantPort: 9090},
+		{policy: "virtual", entry: entry, want: "240.0.0.1", wantPort: 9090},
+		{policy: "wan", entry: entry, want: "203.0.113.1", wantPort: 9090},
+		{policy: "lan_ipv6", entry: entry, want: "172.16.0.1", wantPort: 9090},
+	}
+	for _, tt := range tests {
+		if got, port := selectAddress(tt.entry, tt.policy); got != tt.want || port != tt.wantPort {
+			t.Errorf("selectAddress(%q) with service address %q = %s:%d, want %s:%d", tt.policy, tt.entry.Service.Address, got, port, tt.want, tt.wantPort)
+		}
+	}
+}
@@ -6,17 +6,51 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/moonkev/flexds/internal/common/telemetry"
 	"github.com/moonkev/flexds/internal/common/types"
+	"github.com/moonkev/flexds/internal/discovery/metadata"
 )
 
 // ParseServiceRoutes reads service metadata to generate multiple routing patterns.
 // Supported metadata keys format: route_N_fieldname where N is a number (1, 2, 3...)
 // For each route N:
-//   - route_N_match_type: "path", "header", or "both" (default: "path")
-//   - route_N_path_prefix: path prefix to match (e.g., "/api/v1/services/py-web")
+//   - route_N_action: "route" to proxy to the service, "redirect" or "direct_response" (default: "route")
+//   - route_N_redirect_scheme, route_N_redirect_host, route_N_redirect_port, route_N_redirect_path: parts of the
+//     request URL replaced by the "redirect" action (e.g., "https" to force HTTPS)
+//   - route_N_redirect_code: redirect status code, 301, 302, 303, 307 or 308 (default: 301)
+//   - route_N_direct_response_status, route_N_direct_response_body: status code and inline body the
+//     "direct_response" action answers with (e.g., "503" and a maintenance page)
+//   - route_N_match_type: "path", "header", "both", "regex", or "exact" (default: "path")
+//   - route_N_path_prefix: path prefix to match (e.g., "/api/v1/services/py-web"), the whole path with "exact"
+//   - route_N_path_regex: RE2 regex the whole path must match with the "regex" match type (e.g., "/users/\d+/profile")
 //   - route_N_header_name: header name to match (e.g., "X-Service")
 //   - route_N_header_value: header value to match (e.g., "py-web")
+//   - route_N_header_match_type: "exact", "prefix", "suffix", "regex", or "present" (default: "exact")
 //   - route_N_prefix_rewrite: what to rewrite the matched prefix to (e.g., "/")
+//   - route_N_host_rewrite: Host header sent upstream instead of the client's (e.g., "api.vendor.com")
+//   - route_N_auto_host_rewrite: "true" to send the upstream's DNS name as the Host header
+//   - route_N_hosts: comma-separated domains served by this route (default: "*")
+//   - route_N_hash_header: request header hashed for session affinity with ring_hash/maglev
+//   - route_N_weighted_clusters: split traffic by weight as name:weight pairs (e.g., "svc-v1:90,svc-v2:10")
+//   - route_N_total_weight: total the weighted cluster weights must sum to (default: their sum)
+//   - route_N_cluster_header: route to the cluster named in this request header
+//   - route_N_mirror_cluster: service a copy of the requests is sent to, ignoring its responses
+//   - route_N_mirror_percent: percentage of requests mirrored, 0 to 100 (default: 100)
+//   - route_N_timeout: upstream request timeout (e.g., "30s", default: Envoy's default of 15s)
+//   - route_N_idle_timeout: stream idle timeout (e.g., "5m")
+//   - route_N_max_stream_duration: maximum duration of a stream regardless of activity (e.g., "1h")
+//   - route_N_grpc_timeout_header_max: honor the client's grpc-timeout header up to this duration (e.g., "30s")
+//   - route_N_unauthorized_redirect: login URL that 401s generated by Envoy's auth filters redirect to
+//   - route_N_retry_on: Envoy retry conditions (e.g., "5xx,connect-failure"), enables retries
+//   - route_N_num_retries: number of retries, a non-negative integer (default: Envoy's default of 1)
+//   - route_N_per_try_timeout: timeout of each attempt (e.g., "2s")
+//   - route_N_retry_backoff_base: base retry back-off interval (e.g., "25ms")
+//   - route_N_retry_backoff_max: maximum retry back-off interval (e.g., "250ms")
+//   - route_N_cors_allow_origins: comma-separated exact origins allowed by the route's CORS policy, enables it
+//   - route_N_cors_allow_origin_regexes: comma-separated RE2 origin patterns, also enables the CORS policy
+//   - route_N_cors_allow_methods, route_N_cors_allow_headers, route_N_cors_expose_headers, route_N_cors_max_age:
+//     values of the matching Access-Control-* response headers
+//   - route_N_cors_allow_credentials: "true" to allow credentials
 //
 // ParseServiceRoutes reads service metadata to generate multiple routing patterns
 func ParseServiceRoutes(svc string, meta map[string]string) []types.RoutePattern {
@@ -60,15 +94,30 @@ func ParseServiceRoutes(svc string, meta map[string]string) []types.RoutePattern
 		if v, ok := routeConfig["match_type"]; ok {
 			rp.MatchType = v
 		}
+		if v, ok := routeConfig["action"]; ok {
+			rp.Action = v
+			switch v {
+			case "redirect":
+				rp.Redirect = parseRedirectAction(svc, routeConfig)
+			case "direct_response":
+				rp.DirectResponse = parseDirectResponse(svc, routeConfig)
+			}
+		}
 		if v, ok := routeConfig["header_name"]; ok {
 			rp.HeaderName = v
 		}
 		if v, ok := routeConfig["header_value"]; ok {
 			rp.HeaderValue = v
 		}
+		if v, ok := routeConfig["header_match_type"]; ok {
+			rp.HeaderMatchType = v
+		}
 		if v, ok := routeConfig["path_prefix"]; ok {
 			rp.PathPrefix = v
 		}
+		if v, ok := routeConfig["path_regex"]; ok {
+			rp.PathRegex = v
+		}
 		// Support legacy prefix_rewrite
 		if v, ok := routeConfig["prefix_rewrite"]; ok {
 			rp.PrefixRewrite = v
@@ -80,6 +129,68 @@ func ParseServiceRoutes(svc string, meta map[string]string) []types.RoutePattern
 		if v, ok := routeConfig["regex_replacement"]; ok {
 			rp.RegexReplacement = v
 		}
+		if v, ok := routeConfig["host_rewrite"]; ok {
+			rp.HostRewrite = v
+		}
+		if v, ok := routeConfig["auto_host_rewrite"]; ok && v == "true" {
+			rp.AutoHostRewrite = true
+		}
+		if v, ok := routeConfig["hash_header"]; ok {
+			rp.HashHeader = v
+		}
+		if v, ok := routeConfig["weighted_clusters"]; ok {
+			rp.WeightedClusters = parseWeightedClusters(svc, v)
+		}
+		if v, ok := routeConfig["total_weight"]; ok {
+			if parsed, ok := metadata.ParseUint32(svc, "total_weight", v); ok {
+				rp.TotalWeight = parsed
+			}
+		}
+		if v, ok := routeConfig["cluster_header"]; ok {
+			rp.ClusterHeader = v
+		}
+		if v, ok := routeConfig["mirror_cluster"]; ok {
+			rp.MirrorCluster = v
+		}
+		if v, ok := routeConfig["mirror_percent"]; ok {
+			if parsed, ok := metadata.ParseUint32(svc, "mirror_percent", v); ok {
+				rp.MirrorPercent = parsed
+			}
+		}
+		if v, ok := routeConfig["timeout"]; ok {
+			if parsed, ok := metadata.ParseDuration(svc, "timeout", v); ok {
+				rp.Timeout = parsed
+			}
+		}
+		if v, ok := routeConfig["idle_timeout"]; ok {
+			if parsed, ok := metadata.ParseDuration(svc, "idle_timeout", v); ok {
+				rp.IdleTimeout = parsed
+			}
+		}
+		if v, ok := routeConfig["max_stream_duration"]; ok {
+			if parsed, ok := metadata.ParseDuration(svc, "max_stream_duration", v); ok {
+				rp.MaxStreamDuration = parsed
+			}
+		}
+		if v, ok := routeConfig["grpc_timeout_header_max"]; ok {
+			if parsed, ok := metadata.ParseDuration(svc, "grpc_timeout_header_max", v); ok {
+				rp.GrpcTimeoutHeaderMax = parsed
+			}
+		}
+		if v, ok := routeConfig["unauthorized_redirect"]; ok {
+			rp.UnauthorizedRedirect = v
+		}
+		if v, ok := routeConfig["retry_on"]; ok && v != "" {
+			rp.Retry = parseRetryPolicy(svc, v, routeConfig)
+		}
+		if hasCorsPolicy(routeConfig) {
+			rp.Cors = parseCorsPolicy(routeConfig)
+		}
+		if v, ok := routeConfig["hosts"]; ok {
+			if hosts := metadata.SplitList(v); len(hosts) > 0 {
+				rp.Hosts = hosts
+			}
+		}
 
 		routes = append(routes, rp)
 		slog.Debug("Parse route",
@@ -94,3 +205,96 @@ func ParseServiceRoutes(svc string, meta map[string]string) []types.RoutePattern
 
 	return routes
 }
+
+// parseRedirectAction reads the redirect settings of a single route
+func parseRedirectAction(svc string, routeConfig map[string]string) *types.RedirectAction {
+	redirect := &types.RedirectAction{
+		Scheme: routeConfig["redirect_scheme"],
+		Host:   routeConfig["redirect_host"],
+		Path:   routeConfig["redirect_path"],
+	}
+	if v, ok := routeConfig["redirect_port"]; ok {
+		if parsed, ok := metadata.ParseUint32(svc, "redirect_port", v); ok {
+			redirect.Port = parsed
+		}
+	}
+	if v, ok := routeConfig["redirect_code"]; ok {
+		if parsed, ok := metadata.ParseUint32(svc, "redirect_code", v); ok {
+			redirect.ResponseCode = parsed
+		}
+	}
+	return redirect
+}
+
+// hasCorsPolicy reports whether the route allows any origin, which enables its CORS policy
+func hasCorsPolicy(routeConfig map[string]string) bool {
+	return routeConfig["cors_allow_origins"] != "" || routeConfig["cors_allow_origin_regexes"] != ""
+}
+
+// parseCorsPolicy reads the CORS settings of a single route
+func parseCorsPolicy(routeConfig map[string]string) *types.CorsPolicy {
+	return &types.CorsPolicy{
+		AllowOrigins:       metadata.SplitList(routeConfig["cors_allow_origins"]),
+		AllowOriginRegexes: metadata.SplitList(routeConfig["cors_allow_origin_regexes"]),
+		AllowMethods:       routeConfig["cors_allow_methods"],
+		AllowHeaders:       routeConfig["cors_allow_headers"],
+		ExposeHeaders:      routeConfig["cors_expose_headers"],
+		MaxAge:             routeConfig["cors_max_age"],
+		AllowCredentials:   routeConfig["cors_allow_credentials"] == "true",
+	}
+}
+
+// parseDirectResponse reads the direct response settings of a single route
+func parseDirectResponse(svc string, routeConfig map[string]string) *types.DirectResponse {
+	response := &types.DirectResponse{Body: routeConfig["direct_response_body"]}
+	if v, ok := routeConfig["direct_response_status"]; ok {
+		if parsed, ok := metadata.ParseUint32(svc, "direct_response_status", v); ok {
+			response.Status = parsed
+		}
+	}
+	return response
+}
+
+// parseRetryPolicy reads the retry settings of a single route
+func parseRetryPolicy(svc string, retryOn string, routeConfig map[string]string) *types.RetryPolicy {
+	retry := &types.RetryPolicy{RetryOn: retryOn}
+	if v, ok := routeConfig["num_retries"]; ok {
+		if parsed, ok := metadata.ParseUint32(svc, "num_retries", v); ok {
+			retry.NumRetries = parsed
+		}
+	}
+	if v, ok := routeConfig["per_try_timeout"]; ok {
+		if parsed, ok := metadata.ParseDuration(svc, "per_try_timeout", v); ok {
+			retry.PerTryTimeout = parsed
+		}
+	}
+	if v, ok := routeConfig["retry_backoff_base"]; ok {
+		if parsed, ok := metadata.ParseDuration(svc, "retry_backoff_base", v); ok {
+			retry.BackOffBase = parsed
+		}
+	}
+	if v, ok := routeConfig["retry_backoff_max"]; ok {
+		if parsed, ok := metadata.ParseDuration(svc, "retry_backoff_max", v); ok {
+			retry.BackOffMax = parsed
+		}
+	}
+	return retry
+}
+
+// parseWeightedClusters reads name:weight pairs, skipping malformed entries
+func parseWeightedClusters(svc string, value string) []types.WeightedCluster {
+	var weighted []types.WeightedCluster
+	for _, entry := range metadata.SplitList(value) {
+		name, weightStr, found := strings.Cut(entry, ":")
+		if !found {
+			slog.Warn("Invalid weighted cluster entry, expected name:weight", "service", svc, "entry", entry, telemetry.InvalidConfigKey, "metadata")
+			continue
+		}
+		weight, ok := metadata.ParseUint32(svc, "weighted_clusters", strings.TrimSpace(weightStr))
+		if !ok {
+			continue
+		}
+		weighted = append(weighted, types.WeightedCluster{Name: strings.TrimSpace(name), Weight: weight})
+	}
+	return weighted
+}
@@ -0,0 +1,41 @@
+package watcher
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Retry delays after failed Consul fetches
+const (
+	backoffBase = 1 * time.Second
+	backoffMax  = 30 * time.Second
+)
+
+// backoff computes exponentially growing, jittered delays between retries of a failing Consul fetch,
+// so a Consul outage isn't met with a request every second from every watch
+type backoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
+}
+
+// newBackoff creates a backoff starting at one second and capped at thirty
+func newBackoff() *backoff {
+	return &backoff{base: backoffBase, max: backoffMax}
+}
+
+// next records a failure and returns the delay before the next attempt. The delay doubles with each
+// consecutive failure up to the cap, and is then randomized to between half and all of that value.
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.failures < 32 && b.base<<b.failures < b.max {
+		delay = b.base << b.failures
+	}
+	b.failures++
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// reset starts over from the base delay, called after a successful fetch
+func (b *backoff) reset() {
+	b.failures = 0
+}
@@ -0,0 +1,72 @@
+package watcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestBackoffGrowsAndResets(t *testing.T) {
+	b := newBackoff()
+
+	// The jittered delay is between half and all of a ceiling that doubles with each failure up to the cap
+	for failure := range 8 {
+		ceiling := min(backoffBase<<failure, backoffMax)
+		delay := b.next()
+		if delay < ceiling/2 || delay > ceiling {
+			t.Errorf("failure %d: delay %v, want between %v and %v", failure+1, delay, ceiling/2, ceiling)
+		}
+	}
+
+	b.reset()
+	if delay := b.next(); delay < backoffBase/2 || delay > backoffBase {
+		t.Errorf("delay after a success = %v, want between %v and %v", delay, backoffBase/2, backoffBase)
+	}
+}
+
+func TestWatchersStopDuringBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "consul is down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strategy := range []string{"immediate", "debounce"} {
+		t.Run(strategy, func(t *testing.T) {
+			t.Parallel()
+			failures := make(chan error, 10)
+			w := NewWatcher(strategy, &WatcherConfig{
+				Client:      client,
+				WaitTimeSec: 1,
+				Handler:     func([]string) error { return nil },
+				OnError:     func(err error) { failures <- err },
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- w.Watch(ctx) }()
+
+			// The second failure backs off for at least a second
+			for range 2 {
+				select {
+				case <-failures:
+				case <-time.After(5 * time.Second):
+					cancel()
+					t.Fatal("fetch failures were not reported")
+				}
+			}
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(500 * time.Millisecond):
+				t.Fatal("watcher kept backing off after its context was cancelled")
+			}
+		})
+	}
+}
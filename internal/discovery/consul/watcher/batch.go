@@ -4,8 +4,6 @@ import (
 	"context"
 	"log/slog"
 	"time"
-
-	consulapi "github.com/hashicorp/consul/api"
 )
 
 // BatchWatcher applies updates when batch size reached or timeout expires
@@ -24,11 +22,14 @@ func NewBatchWatcher(cfg *WatcherConfig, maxBatchSize int, batchTimeout time.Dur
 	}
 }
 
-// Watch starts watching Consul and applies batched updates
+// Watch starts watching Consul and applies batched updates. The blocking catalog query runs in its
+// own goroutine so the batch timer fires on time even while a query is waiting for changes.
 func (w *BatchWatcher) Watch(ctx context.Context) error {
-	var lastIndex uint64
 	var batchCount int
 	var services []string
+	retry := newBackoff()
+
+	changes := watchCatalog(ctx, w.cfg)
 
 	batchTimer := time.NewTimer(0)
 	batchTimer.Stop()
@@ -43,43 +44,10 @@ func (w *BatchWatcher) Watch(ctx context.Context) error {
 		case <-batchTimer.C:
 			if batchCount > 0 {
 				slog.Info("Batch timeout, applying changes", "changes", batchCount, "services", len(services))
-				if err := w.cfg.Handler(services); err != nil {
-					slog.Error("handler error", "error", err)
-				}
-				batchCount = 0
-				batchTimer.Stop()
-			}
-
-		default:
-			queryOpts := &consulapi.QueryOptions{
-				WaitIndex: lastIndex,
-				WaitTime:  time.Duration(w.cfg.WaitTimeSec) * time.Second,
-			}
-			queryOpts = queryOpts.WithContext(ctx)
-
-			serviceMapping, meta, err := w.cfg.Client.Catalog().Services(queryOpts)
-			if err != nil {
-				if ctx.Err() != nil {
-					slog.Info("Stopping batch watcher, context cancelled")
-					batchTimer.Stop()
-					return nil
-				}
-				slog.Error("Failed to fetch services", "error", err)
-				time.Sleep(1 * time.Second)
-				continue
+				w.applyBatch(services, &batchCount, batchTimer, retry)
 			}
 
-			if meta.LastIndex == lastIndex {
-				continue
-			}
-
-			lastIndex = meta.LastIndex
-
-			// Extract service names from the map keys
-			services = make([]string, 0, len(serviceMapping))
-			for serviceName := range serviceMapping {
-				services = append(services, serviceName)
-			}
+		case services = <-changes:
 			batchCount++
 
 			slog.Info("Change detected", "batchCount", batchCount, "maxBatchSize", w.maxBatchSize)
@@ -87,18 +55,26 @@ func (w *BatchWatcher) Watch(ctx context.Context) error {
 			if batchCount >= w.maxBatchSize {
 				// Batch is full - apply immediately
 				slog.Info("Batch limit reached, applying snapshot")
-				if err := w.cfg.Handler(services); err != nil {
-					slog.Error("Error processing batch", "error", err)
-				}
-				batchCount = 0
 				batchTimer.Stop()
-			} else {
-				// Start timer if not already running
-				if batchCount == 1 {
-					slog.Info("Starting batch timer", "timeout", w.batchTimeout)
-					batchTimer.Reset(w.batchTimeout)
-				}
+				w.applyBatch(services, &batchCount, batchTimer, retry)
+			} else if batchCount == 1 {
+				// Start timer on the first change of a batch
+				slog.Info("Starting batch timer", "timeout", w.batchTimeout)
+				batchTimer.Reset(w.batchTimeout)
 			}
 		}
 	}
 }
+
+// applyBatch calls the handler with the batched services and clears the batch. When the handler fails
+// the batch is kept and the timer retries it after a backoff, or sooner if it fills up.
+func (w *BatchWatcher) applyBatch(services []string, batchCount *int, batchTimer *time.Timer, retry *backoff) {
+	if err := w.cfg.Handler(services); err != nil {
+		slog.Error("Error processing batch", "error", err)
+		w.cfg.reportError(err)
+		batchTimer.Reset(retry.next())
+		return
+	}
+	retry.reset()
+	*batchCount = 0
+}
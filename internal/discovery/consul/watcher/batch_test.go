@@ -0,0 +1,55 @@
+package watcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestBatchWatcherFlushesSingleChangeAfterTimeout(t *testing.T) {
+	// The first catalog query returns one change, every later query blocks until the watch ends
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "5")
+		_, _ = w.Write([]byte(`{"orders":[]}`))
+	}))
+	defer srv.Close()
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const batchTimeout = 200 * time.Millisecond
+	flushed := make(chan []string, 1)
+	w := NewWatcher("batch", &WatcherConfig{
+		Client:       client,
+		WaitTimeSec:  10,
+		BatchSize:    5,
+		BatchTimeout: batchTimeout,
+		Handler:      func(services []string) error { flushed <- services; return nil },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	go func() { _ = w.Watch(ctx) }()
+
+	select {
+	case services := <-flushed:
+		if elapsed := time.Since(start); elapsed < batchTimeout {
+			t.Errorf("flushed after %v, before the batch timeout of %v", elapsed, batchTimeout)
+		}
+		if !slices.Equal(services, []string{"orders"}) {
+			t.Errorf("flushed services %v, want [orders]", services)
+		}
+	case <-time.After(5 * batchTimeout):
+		t.Fatal("a single change was not flushed after the batch timeout")
+	}
+}
@@ -0,0 +1,65 @@
+package watcher
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// watchCatalog runs the blocking catalog query in its own goroutine until the context is cancelled,
+// sending the service names on the returned channel whenever the catalog index changes. Watchers
+// select on it alongside their timers, so a timer fires on time even while a query is blocking.
+func watchCatalog(ctx context.Context, cfg *WatcherConfig) <-chan []string {
+	changes := make(chan []string)
+
+	go func() {
+		var lastIndex uint64
+		retry := newBackoff()
+
+		for ctx.Err() == nil {
+			queryOpts := &consulapi.QueryOptions{
+				WaitIndex:  lastIndex,
+				WaitTime:   time.Duration(cfg.WaitTimeSec) * time.Second,
+				Datacenter: cfg.Datacenter,
+			}
+			queryOpts = queryOpts.WithContext(ctx)
+
+			serviceMapping, meta, err := cfg.Client.Catalog().Services(queryOpts)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("Failed to fetch services", "error", err)
+				cfg.reportError(err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(retry.next()):
+				}
+				continue
+			}
+
+			retry.reset()
+			if meta.LastIndex == lastIndex {
+				continue
+			}
+			lastIndex = meta.LastIndex
+
+			// Extract service names from the map keys
+			services := make([]string, 0, len(serviceMapping))
+			for serviceName := range serviceMapping {
+				services = append(services, serviceName)
+			}
+
+			select {
+			case changes <- services:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changes
+}
@@ -4,8 +4,6 @@ import (
 	"context"
 	"log/slog"
 	"time"
-
-	consulapi "github.com/hashicorp/consul/api"
 )
 
 // DebounceWatcher batches rapid changes with a debounce timer
@@ -22,12 +20,15 @@ func NewDebounceWatcher(cfg *WatcherConfig, debounceInterval time.Duration) *Deb
 	}
 }
 
-// Watch starts watching Consul and applies updates with debouncing
+// Watch starts watching Consul and applies updates with debouncing. The blocking catalog query runs in
+// its own goroutine so the debounce timer fires on time even while a query is waiting for changes.
 func (w *DebounceWatcher) Watch(ctx context.Context) error {
-	var lastIndex uint64
+	retry := newBackoff()
 	var pendingUpdate bool
 	var latestServices []string
 
+	changes := watchCatalog(ctx, w.cfg)
+
 	debounceTimer := time.NewTimer(0)
 	debounceTimer.Stop()
 
@@ -43,41 +44,17 @@ func (w *DebounceWatcher) Watch(ctx context.Context) error {
 			slog.Info("Debounce timer fired, applying batched update", "services", len(latestServices))
 			pendingUpdate = false
 			if err := w.cfg.Handler(latestServices); err != nil {
+				// Apply the same services again after a backoff, unless a newer change replaces them first
 				slog.Error("handler error", "error", err)
-			}
-
-		default:
-			queryOpts := &consulapi.QueryOptions{
-				WaitIndex: lastIndex,
-				WaitTime:  time.Duration(w.cfg.WaitTimeSec) * time.Second,
-			}
-			queryOpts = queryOpts.WithContext(ctx)
-
-			serviceMapping, meta, err := w.cfg.Client.Catalog().Services(queryOpts)
-			if err != nil {
-				if ctx.Err() != nil {
-					slog.Info("Stopping debounce watcher, context cancelled")
-					debounceTimer.Stop()
-					return nil
-				}
-				slog.Error("Failed to fetch services", "error", err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-
-			if meta.LastIndex == lastIndex {
+				w.cfg.reportError(err)
+				pendingUpdate = true
+				debounceTimer.Reset(retry.next())
 				continue
 			}
+			retry.reset()
 
-			slog.Info("Detected change", "lastIndex", lastIndex, "newIndex", meta.LastIndex)
-			lastIndex = meta.LastIndex
-
-			// Extract service names from the map keys
-			latestServices = make([]string, 0, len(serviceMapping))
-			for serviceName := range serviceMapping {
-				latestServices = append(latestServices, serviceName)
-			}
-
+		case latestServices = <-changes:
+			slog.Info("Detected change", "services", len(latestServices))
 			if !pendingUpdate {
 				// First change detected - start debounce timer
 				slog.Info("Starting debounce timer", "interval", w.debounceInterval)
@@ -0,0 +1,52 @@
+package watcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestDebounceWatcherFiresWhileQueryBlocks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			// Block like Consul for the whole wait time, the catalog doesn't change again
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		w.Write([]byte(`{"orders":[]}`))
+	}))
+	defer srv.Close()
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := make(chan []string, 1)
+	w := NewWatcher("debounce", &WatcherConfig{
+		Client:           client,
+		WaitTimeSec:      30,
+		DebounceInterval: 100 * time.Millisecond,
+		Handler: func(services []string) error {
+			calls <- services
+			return nil
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Watch(ctx)
+
+	select {
+	case services := <-calls:
+		if !slices.Equal(services, []string{"orders"}) {
+			t.Errorf("got %v, want [orders]", services)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the debounce timer waited for the blocking catalog query instead of firing after its interval")
+	}
+}
@@ -0,0 +1,207 @@
+package watcher
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// HealthWatcher keeps a blocking health query per service with its own index, so a change to one
+// service only refetches that service's instances. The catalog is still watched to learn which
+// services exist, but catalog changes no longer refetch every service.
+type HealthWatcher struct {
+	cfg             *WatcherConfig
+	serviceWaitTime time.Duration
+	mu              sync.Mutex
+	entries         map[string][]*consulapi.ServiceEntry // Latest passing entries of each watched service
+	watches         map[string]context.CancelFunc
+	changed         chan struct{}
+
+	// Services of the first catalog response still waiting for their first health result, nil until
+	// that response. The handler only runs once all of them have one, so it never sees a partial list.
+	initial map[string]bool
+	synced  bool
+}
+
+// NewHealthWatcher creates a new per-service health watcher, which reports through cfg.EntriesHandler.
+// Each service's health query blocks for up to serviceWaitTime.
+func NewHealthWatcher(cfg *WatcherConfig, serviceWaitTime time.Duration) *HealthWatcher {
+	return &HealthWatcher{
+		cfg:             cfg,
+		serviceWaitTime: serviceWaitTime,
+		entries:         make(map[string][]*consulapi.ServiceEntry),
+		watches:         make(map[string]context.CancelFunc),
+		changed:         make(chan struct{}, 1),
+	}
+}
+
+// Watch starts watching the catalog and each of its services, calling the handler with the entries of
+// every service whenever one of them changes. Changes arriving while the handler runs are coalesced.
+// The first call waits until every service in the first catalog response has reported its entries.
+func (w *HealthWatcher) Watch(ctx context.Context) error {
+	go w.watchCatalog(ctx)
+	retry := newBackoff()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("stopping health watcher, context cancelled")
+			return nil
+		case <-w.changed:
+			w.mu.Lock()
+			if !w.synced {
+				w.mu.Unlock()
+				continue
+			}
+			entries := maps.Clone(w.entries)
+			w.mu.Unlock()
+			if err := w.cfg.EntriesHandler(entries); err != nil {
+				// Retry with the latest entries after a backoff, changes meanwhile are coalesced into it
+				slog.Error("handler error", "error", err)
+				w.cfg.reportError(err)
+				select {
+				case <-ctx.Done():
+					slog.Info("stopping health watcher, context cancelled")
+					return nil
+				case <-time.After(retry.next()):
+				}
+				w.notify()
+				continue
+			}
+			retry.reset()
+		}
+	}
+}
+
+// checkSynced marks the watcher synced once every service of the first catalog response has a health
+// result, reporting whether it just did. w.mu must be held.
+func (w *HealthWatcher) checkSynced() bool {
+	if w.synced || w.initial == nil || len(w.initial) > 0 {
+		return false
+	}
+	w.synced = true
+	return true
+}
+
+// notify signals the handler loop without blocking, a pending signal already covers this change
+func (w *HealthWatcher) notify() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// watchCatalog starts a health watch for each new service and stops those of removed services
+func (w *HealthWatcher) watchCatalog(ctx context.Context) {
+	var lastIndex uint64
+	retry := newBackoff()
+
+	for ctx.Err() == nil {
+		queryOpts := &consulapi.QueryOptions{
+			WaitIndex:  lastIndex,
+			WaitTime:   time.Duration(w.cfg.WaitTimeSec) * time.Second,
+			Datacenter: w.cfg.Datacenter,
+		}
+		serviceMapping, meta, err := w.cfg.Client.Catalog().Services(queryOpts.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("error fetching services", "error", err)
+			w.cfg.reportError(err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry.next()):
+			}
+			continue
+		}
+		retry.reset()
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		w.mu.Lock()
+		if w.initial == nil {
+			w.initial = make(map[string]bool, len(serviceMapping))
+			for serviceName := range serviceMapping {
+				w.initial[serviceName] = true
+			}
+		}
+		removed := false
+		for serviceName, cancel := range w.watches {
+			if _, ok := serviceMapping[serviceName]; !ok {
+				slog.Debug("stopping service health watch", "service", serviceName)
+				cancel()
+				delete(w.watches, serviceName)
+				delete(w.initial, serviceName)
+				if _, ok := w.entries[serviceName]; ok {
+					delete(w.entries, serviceName)
+					removed = true
+				}
+			}
+		}
+		for serviceName := range serviceMapping {
+			if _, ok := w.watches[serviceName]; !ok {
+				slog.Debug("starting service health watch", "service", serviceName)
+				serviceCtx, cancel := context.WithCancel(ctx)
+				w.watches[serviceName] = cancel
+				go w.watchService(serviceCtx, serviceName)
+			}
+		}
+		synced := w.checkSynced()
+		w.mu.Unlock()
+
+		if removed || synced {
+			w.notify()
+		}
+	}
+}
+
+// watchService blocks on the passing instances of a single service, recording them on every change
+func (w *HealthWatcher) watchService(ctx context.Context, serviceName string) {
+	var lastIndex uint64
+	retry := newBackoff()
+
+	for ctx.Err() == nil {
+		queryOpts := &consulapi.QueryOptions{
+			WaitIndex:  lastIndex,
+			WaitTime:   w.serviceWaitTime,
+			Datacenter: w.cfg.Datacenter,
+		}
+		entries, meta, err := w.cfg.Client.Health().Service(serviceName, "", true, queryOpts.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("error fetching service health", "service", serviceName, "error", err)
+			w.cfg.reportError(err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry.next()):
+			}
+			continue
+		}
+		retry.reset()
+		if meta.LastIndex == lastIndex {
+			continue
+		}
+		lastIndex = meta.LastIndex
+
+		w.mu.Lock()
+		// The service may have been removed from the catalog while the query was in flight
+		if ctx.Err() == nil {
+			w.entries[serviceName] = entries
+			delete(w.initial, serviceName)
+			w.checkSynced()
+		}
+		w.mu.Unlock()
+		w.notify()
+	}
+}
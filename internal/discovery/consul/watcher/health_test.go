@@ -0,0 +1,191 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// fakeCatalog serves Consul's catalog and health endpoints. The catalog lists services until
+// removeService is closed, then stops listing removed. Blocking queries block until their request ends.
+type fakeCatalog struct {
+	services       []string
+	removed        string
+	removeService  chan struct{}
+	removedDone    chan struct{} // Closed when the removed service's blocking health query is cancelled
+	delayed        string        // Service whose first health query only answers once releaseDelayed is closed
+	releaseDelayed chan struct{}
+
+	mu         sync.Mutex
+	healthWait []string // The wait parameter of every health query
+}
+
+func (f *fakeCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	index := r.URL.Query().Get("index")
+	if serviceName, ok := strings.CutPrefix(r.URL.Path, "/v1/health/service/"); ok {
+		f.mu.Lock()
+		f.healthWait = append(f.healthWait, r.URL.Query().Get("wait"))
+		f.mu.Unlock()
+		if index != "" {
+			<-r.Context().Done()
+			if serviceName == f.removed {
+				close(f.removedDone)
+			}
+			return
+		}
+		if f.delayed != "" && serviceName == f.delayed {
+			select {
+			case <-f.releaseDelayed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		fmt.Fprintf(w, `[{"Node":{"Address":"10.0.0.1"},"Service":{"Service":%q,"Port":8080}}]`, serviceName)
+		return
+	}
+
+	services := f.services
+	switch index {
+	case "":
+		w.Header().Set("X-Consul-Index", "1")
+	case "1":
+		select {
+		case <-f.removeService:
+		case <-r.Context().Done():
+			return
+		}
+		services = slices.DeleteFunc(slices.Clone(services), func(s string) bool { return s == f.removed })
+		w.Header().Set("X-Consul-Index", "2")
+	default:
+		<-r.Context().Done()
+		return
+	}
+	catalog := make([]string, 0, len(services))
+	for _, s := range services {
+		catalog = append(catalog, fmt.Sprintf("%q:[]", s))
+	}
+	fmt.Fprintf(w, "{%s}", strings.Join(catalog, ","))
+}
+
+func TestHealthWatcherAddsAndRemovesServiceWatches(t *testing.T) {
+	catalog := &fakeCatalog{
+		services:      []string{"orders", "users"},
+		removed:       "users",
+		removeService: make(chan struct{}),
+		removedDone:   make(chan struct{}),
+	}
+	srv := httptest.NewServer(catalog)
+	defer srv.Close()
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reported := make(chan []string, 10)
+	w := NewWatcher("health", &WatcherConfig{
+		Client:      client,
+		WaitTimeSec: 2,
+		EntriesHandler: func(entries map[string][]*consulapi.ServiceEntry) error {
+			names := make([]string, 0, len(entries))
+			for name := range entries {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			reported <- names
+			return nil
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Watch(ctx) }()
+
+	waitForServices := func(want ...string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case names := <-reported:
+				if slices.Equal(names, want) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("services %v were not reported", want)
+			}
+		}
+	}
+
+	waitForServices("orders", "users")
+	close(catalog.removeService)
+	waitForServices("orders")
+	select {
+	case <-catalog.removedDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("health watch of the removed service was not stopped")
+	}
+
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	if len(catalog.healthWait) == 0 {
+		t.Fatal("no health queries were made")
+	}
+	for _, wait := range catalog.healthWait {
+		if wait != "300000ms" {
+			t.Errorf("health query wait = %q, want Consul's maximum of 5m", wait)
+		}
+	}
+}
+
+func TestHealthWatcherWaitsForEveryInitialService(t *testing.T) {
+	catalog := &fakeCatalog{
+		services:       []string{"orders", "payments", "users"},
+		removeService:  make(chan struct{}),
+		delayed:        "payments",
+		releaseDelayed: make(chan struct{}),
+	}
+	srv := httptest.NewServer(catalog)
+	defer srv.Close()
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reported := make(chan []string, 10)
+	w := NewWatcher("health", &WatcherConfig{
+		Client:      client,
+		WaitTimeSec: 2,
+		EntriesHandler: func(entries map[string][]*consulapi.ServiceEntry) error {
+			reported <- slices.Sorted(maps.Keys(entries))
+			return nil
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Watch(ctx) }()
+
+	// orders and users answer right away, but reporting them alone would drop payments
+	select {
+	case names := <-reported:
+		t.Fatalf("handler called with %v before payments reported its first health result", names)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	close(catalog.releaseDelayed)
+	select {
+	case names := <-reported:
+		if want := []string{"orders", "payments", "users"}; !slices.Equal(names, want) {
+			t.Errorf("handler called with %v, want %v", names, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called once every service reported")
+	}
+}
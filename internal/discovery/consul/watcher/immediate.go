@@ -21,6 +21,7 @@ func NewImmediateWatcher(cfg *WatcherConfig) *ImmediateWatcher {
 // Watch starts watching Consul and immediately applies updates
 func (w *ImmediateWatcher) Watch(ctx context.Context) error {
 	var lastIndex uint64
+	retry := newBackoff()
 
 	for {
 		select {
@@ -31,8 +32,9 @@ func (w *ImmediateWatcher) Watch(ctx context.Context) error {
 		}
 
 		queryOpts := &consulapi.QueryOptions{
-			WaitIndex: lastIndex,
-			WaitTime:  time.Duration(w.cfg.WaitTimeSec) * time.Second,
+			WaitIndex:  lastIndex,
+			WaitTime:   time.Duration(w.cfg.WaitTimeSec) * time.Second,
+			Datacenter: w.cfg.Datacenter,
 		}
 		queryOpts = queryOpts.WithContext(ctx)
 
@@ -43,16 +45,22 @@ func (w *ImmediateWatcher) Watch(ctx context.Context) error {
 				return nil
 			}
 			slog.Error("error fetching services", "error", err)
-			time.Sleep(1 * time.Second)
+			w.cfg.reportError(err)
+			select {
+			case <-ctx.Done():
+				slog.Info("stopping immediate watcher, context cancelled")
+				return nil
+			case <-time.After(retry.next()):
+			}
 			continue
 		}
 
 		if meta.LastIndex == lastIndex {
+			retry.reset()
 			continue
 		}
 
 		slog.Info("detected change", "lastIndex", lastIndex, "newIndex", meta.LastIndex)
-		lastIndex = meta.LastIndex
 
 		// Extract service names from the map keys
 		svcList := make([]string, 0, len(serviceMapping))
@@ -60,8 +68,19 @@ func (w *ImmediateWatcher) Watch(ctx context.Context) error {
 			svcList = append(svcList, serviceName)
 		}
 
+		// The index only advances once the handler succeeds, so a failed change is fetched and handled again
 		if err := w.cfg.Handler(svcList); err != nil {
 			slog.Error("handler error", "error", err)
+			w.cfg.reportError(err)
+			select {
+			case <-ctx.Done():
+				slog.Info("stopping immediate watcher, context cancelled")
+				return nil
+			case <-time.After(retry.next()):
+			}
+			continue
 		}
+		retry.reset()
+		lastIndex = meta.LastIndex
 	}
 }
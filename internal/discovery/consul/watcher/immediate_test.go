@@ -0,0 +1,77 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestImmediateWatcherRetriesFailedHandler(t *testing.T) {
+	var mu sync.Mutex
+	var indexes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		indexes = append(indexes, r.URL.Query().Get("index"))
+		mu.Unlock()
+		if r.URL.Query().Get("index") == "7" {
+			// Block like Consul until the watch is cancelled, the catalog no longer changes
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "7")
+		w.Write([]byte(`{"orders":[]}`))
+	}))
+	defer srv.Close()
+	client, err := consulapi.NewClient(&consulapi.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := make(chan []string, 10)
+	failures := make(chan error, 10)
+	var handled int
+	w := NewWatcher("immediate", &WatcherConfig{
+		Client:      client,
+		WaitTimeSec: 1,
+		Handler: func(services []string) error {
+			calls <- services
+			if handled++; handled == 1 {
+				return errors.New("consul health is unavailable")
+			}
+			return nil
+		},
+		OnError: func(err error) { failures <- err },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Watch(ctx)
+
+	for i := range 2 {
+		select {
+		case services := <-calls:
+			if !slices.Equal(services, []string{"orders"}) {
+				t.Errorf("call %d: got %v, want [orders]", i+1, services)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the handler was called %d times, want a retry after the failure", i)
+		}
+	}
+	if len(failures) != 1 {
+		t.Errorf("got %d reported errors, want the handler failure", len(failures))
+	}
+
+	// The failed change is fetched again from the old index, only a success advances it
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"", "", "7"}; !slices.Equal(indexes, want) {
+		t.Errorf("got query indexes %q, want %q", indexes, want)
+	}
+}
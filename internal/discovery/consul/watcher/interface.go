@@ -11,6 +11,10 @@ import (
 // ServiceChangeHandler is called when services change
 type ServiceChangeHandler func(services []string) error
 
+// ServiceEntriesHandler is called with the passing entries of every service, keyed by service name,
+// by watchers that already fetched them
+type ServiceEntriesHandler func(entries map[string][]*consulapi.ServiceEntry) error
+
 // ConsulWatcher defines the interface for watching Consul service changes
 type ConsulWatcher interface {
 	// Watch starts watching Consul for service changes
@@ -20,19 +24,63 @@ type ConsulWatcher interface {
 
 // WatcherConfig holds shared configuration for all watchers
 type WatcherConfig struct {
-	Client      *consulapi.Client
-	Cache       cachev3.SnapshotCache
-	WaitTimeSec int
-	Handler     ServiceChangeHandler
+	Client         *consulapi.Client
+	Cache          cachev3.SnapshotCache
+	WaitTimeSec    int
+	Datacenter     string // Datacenter whose catalog is watched, the agent's own when empty
+	Handler        ServiceChangeHandler
+	EntriesHandler ServiceEntriesHandler // Used by the health strategy instead of Handler
+	OnError        func(err error)       // Called when fetching the service catalog or health, or a handler, fails, optional
+
+	// Strategy tuning, the defaults below apply when unset
+	DebounceInterval time.Duration // Quiet period of the debounce strategy
+	BatchSize        int           // Changes that flush a batch early in the batch strategy
+	BatchTimeout     time.Duration // Time after the first change at which the batch strategy flushes
+	ServiceWaitTime  time.Duration // How long the health strategy's per-service queries block, unlike WaitTimeSec of the catalog
+}
+
+// Strategy tuning defaults
+const (
+	DefaultDebounceInterval = 500 * time.Millisecond
+	DefaultBatchSize        = 5
+	DefaultBatchTimeout     = 1 * time.Second
+	// DefaultServiceWaitTime is Consul's maximum blocking query time. A service's instances rarely change,
+	// so its query should block as long as possible instead of returning every few seconds.
+	DefaultServiceWaitTime = 5 * time.Minute
+)
+
+// reportError passes a failed fetch or handler call to the OnError callback, if any
+func (cfg *WatcherConfig) reportError(err error) {
+	if cfg.OnError != nil {
+		cfg.OnError(err)
+	}
 }
 
 // NewWatcher creates a watcher with the specified strategy
 func NewWatcher(strategy string, cfg *WatcherConfig) ConsulWatcher {
 	switch strategy {
 	case "debounce":
-		return NewDebounceWatcher(cfg, 500*time.Millisecond)
+		debounceInterval := cfg.DebounceInterval
+		if debounceInterval <= 0 {
+			debounceInterval = DefaultDebounceInterval
+		}
+		return NewDebounceWatcher(cfg, debounceInterval)
 	case "batch":
-		return NewBatchWatcher(cfg, 5, 1*time.Second)
+		batchSize := cfg.BatchSize
+		if batchSize <= 0 {
+			batchSize = DefaultBatchSize
+		}
+		batchTimeout := cfg.BatchTimeout
+		if batchTimeout <= 0 {
+			batchTimeout = DefaultBatchTimeout
+		}
+		return NewBatchWatcher(cfg, batchSize, batchTimeout)
+	case "health":
+		serviceWaitTime := cfg.ServiceWaitTime
+		if serviceWaitTime <= 0 {
+			serviceWaitTime = DefaultServiceWaitTime
+		}
+		return NewHealthWatcher(cfg, serviceWaitTime)
 	case "immediate":
 		fallthrough
 	default:
@@ -0,0 +1,226 @@
+// Package git loads YAML service definitions from a Git repository, polling it for new commits.
+package git
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/moonkev/flexds/internal/common/secrets"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	"github.com/moonkev/flexds/internal/common/types"
+	"github.com/moonkev/flexds/internal/discovery"
+	"github.com/moonkev/flexds/internal/discovery/yaml"
+)
+
+type Config struct {
+	RepoURL  string
+	Ref      string // branch, tag or commit to check out, the remote's default branch when empty
+	Path     string // YAML file, or directory of YAML files, within the repository
+	Interval time.Duration
+	WorkDir  string // checkout directory, a temporary directory when empty
+
+	// Optional authentication
+	CredentialsFilePath string // username:password used for HTTPS basic auth
+	SSHKeyPath          string // private key used for SSH remotes
+}
+
+// Loader adapts the Git poller to the discovery.Loader interface
+type Loader struct {
+	cfg    Config
+	reload discovery.ReloadSignal
+}
+
+func NewLoader(cfg Config) *Loader {
+	return &Loader{cfg: cfg, reload: discovery.NewReloadSignal()}
+}
+
+func (l *Loader) Name() string {
+	return "git"
+}
+
+// Start polls the repository until the context is cancelled
+func (l *Loader) Start(ctx context.Context, aggregator *discovery.DiscoveredServiceAggregator) error {
+	return poll(ctx, l.cfg, aggregator, l.reload)
+}
+
+// Reload fetches the ref without waiting for the next poll and reloads the services even if the commit is unchanged
+func (l *Loader) Reload() {
+	l.reload.Reload()
+}
+
+// LoadConfig fetches the configured ref every interval and reloads the services whenever it
+// points to a new commit. Fetch and parse failures are logged and retried on the next poll,
+// keeping the services from the last good commit.
+func LoadConfig(ctx context.Context, config Config, aggregator *discovery.DiscoveredServiceAggregator) error {
+	return poll(ctx, config, aggregator, nil)
+}
+
+// poll is LoadConfig, also fetching and reloading the services on a signal on reload
+func poll(ctx context.Context, config Config, aggregator *discovery.DiscoveredServiceAggregator, reload discovery.ReloadSignal) error {
+	workDir := config.WorkDir
+	if workDir == "" {
+		tmpDir, err := os.MkdirTemp("", "flexds-git-")
+		if err != nil {
+			return fmt.Errorf("failed to create git work directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		workDir = tmpDir
+	}
+
+	repo := &repository{dir: workDir, url: config.RepoURL, sshKeyPath: config.SSHKeyPath}
+	if config.CredentialsFilePath != "" {
+		repo.creds = secrets.NewFile(config.CredentialsFilePath, secrets.DefaultMaxAge)
+	}
+	if err := repo.init(ctx); err != nil {
+		telemetry.MetricDiscoveryErrors.WithLabelValues("git_loader").Inc()
+		return err
+	}
+
+	ref := config.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var lastCommit string
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-reload:
+			slog.Info("Reloading git repository", "repo", config.RepoURL, "ref", ref)
+			lastCommit = ""
+			timer.Reset(0)
+		case <-timer.C:
+			timer.Reset(config.Interval)
+
+			commit, err := repo.fetch(ctx, ref)
+			if err != nil {
+				aggregator.ReportError("git_loader", fmt.Errorf("failed to fetch %s at %s: %w", config.RepoURL, ref, err))
+				continue
+			}
+			if commit == lastCommit {
+				slog.Debug("git repository unchanged", "repo", config.RepoURL, "commit", commit)
+				continue
+			}
+			lastCommit = commit
+
+			services, err := loadServices(filepath.Join(workDir, config.Path))
+			if err != nil {
+				aggregator.ReportError("git_loader", fmt.Errorf("failed to load services from %s at commit %s: %w", config.RepoURL, commit, err))
+				continue
+			}
+			slog.Info("Loaded services from git repository", "repo", config.RepoURL, "commit", commit, "count", len(services))
+			if err := aggregator.UpdateServices("git_loader", services); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// loadServices parses the YAML file at path, or every .yaml/.yml file when path is a directory
+func loadServices(path string) ([]*types.DiscoveredService, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		slices.Sort(files)
+	}
+
+	var services []*types.DiscoveredService
+	for _, file := range files {
+		rawYaml, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := yaml.ParseServices(rawYaml)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		services = append(services, parsed...)
+	}
+	return services, nil
+}
+
+// repository runs git commands against a local checkout of the remote
+type repository struct {
+	dir        string
+	url        string
+	creds      *secrets.File
+	sshKeyPath string
+}
+
+func (r *repository) init(ctx context.Context) error {
+	if err := os.MkdirAll(r.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create git work directory: %w", err)
+	}
+	_, err := r.run(ctx, "init", "--quiet")
+	return err
+}
+
+// fetch checks out the latest commit of ref and returns its hash
+func (r *repository) fetch(ctx context.Context, ref string) (string, error) {
+	if _, err := r.run(ctx, "fetch", "--quiet", "--depth", "1", r.url, ref); err != nil {
+		return "", err
+	}
+	if _, err := r.run(ctx, "checkout", "--quiet", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	return r.run(ctx, "rev-parse", "HEAD")
+}
+
+// run executes a git command in the checkout, passing credentials through the environment
+// so they don't show up in the process list
+func (r *repository) run(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if r.creds != nil {
+		credsBytes, err := r.creds.Read()
+		if err != nil {
+			return "", fmt.Errorf("failed to read credentials file: %w", err)
+		}
+		auth := base64.StdEncoding.EncodeToString(bytes.TrimSpace(credsBytes))
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+	}
+	if r.sshKeyPath != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_SSH_COMMAND=ssh -i %q -o IdentitiesOnly=yes", r.sshKeyPath))
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
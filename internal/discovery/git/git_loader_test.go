@@ -0,0 +1,100 @@
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/moonkev/flexds/internal/discovery"
+	"github.com/moonkev/flexds/internal/xds"
+)
+
+// gitCmd runs a git command in dir, failing the test on error
+func gitCmd(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=flexds", "GIT_AUTHOR_EMAIL=flexds@example.com",
+		"GIT_COMMITTER_NAME=flexds", "GIT_COMMITTER_EMAIL=flexds@example.com")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+}
+
+// waitForServices waits until the aggregator holds the named services reported by the git loader
+func waitForServices(t *testing.T, agg *discovery.DiscoveredServiceAggregator, names ...string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reported []string
+		for _, svc := range agg.Snapshot()["git_loader"] {
+			reported = append(reported, svc.Name)
+		}
+		if slices.Equal(reported, names) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("git loader reported %v, want %v", reported, names)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLoaderReconcilesOnNewCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	remote := filepath.Join(t.TempDir(), "services.git")
+	gitCmd(t, t.TempDir(), "init", "--quiet", "--bare", remote)
+	clone := t.TempDir()
+	gitCmd(t, clone, "clone", "--quiet", remote, ".")
+
+	commit := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(clone, "services.yaml"), []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		gitCmd(t, clone, "add", "services.yaml")
+		gitCmd(t, clone, "commit", "--quiet", "-m", "Update services")
+		gitCmd(t, clone, "push", "--quiet", "origin", "HEAD")
+	}
+	const orders = `
+- name: orders
+  instances: [{host: 10.0.0.1, port: 8080}]
+  routes: [{path_prefix: /orders}]
+`
+	commit(orders)
+
+	snapshots := xds.NewSnapshotManager(xds.Config{
+		Cache:         cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil),
+		ListenerPorts: []uint32{18080},
+	})
+	agg := discovery.NewDiscoveredServiceAggregator(snapshots)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewLoader(Config{RepoURL: remote, Path: "services.yaml", Interval: 50 * time.Millisecond, WorkDir: t.TempDir()}).Start(ctx, agg)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	}()
+
+	waitForServices(t, agg, "orders")
+
+	commit(orders + `
+- name: billing
+  instances: [{host: 10.0.0.2, port: 8080}]
+  routes: [{path_prefix: /billing}]
+`)
+	waitForServices(t, agg, "orders", "billing")
+}
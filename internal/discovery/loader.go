@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Loader is a discovery backend that reports the services it finds to the aggregator
+type Loader interface {
+	// Name is the unique name the loader is registered and selected by
+	Name() string
+	// Start runs the loader, reporting services through the aggregator.
+	// Long-running loaders block until the context is cancelled.
+	Start(ctx context.Context, aggregator *DiscoveredServiceAggregator) error
+}
+
+// Reloader is implemented by loaders that can re-read their source on demand, such as on SIGHUP
+type Reloader interface {
+	// Reload requests a new load without waiting for it
+	Reload()
+}
+
+// ReloadSignal triggers the reloads of a Reloader, coalescing requests made while one is pending
+type ReloadSignal chan struct{}
+
+func NewReloadSignal() ReloadSignal {
+	return make(ReloadSignal, 1)
+}
+
+func (r ReloadSignal) Reload() {
+	select {
+	case r <- struct{}{}:
+	default:
+	}
+}
+
+// loaderFunc adapts a start function to the Loader interface
+type loaderFunc struct {
+	name  string
+	start func(ctx context.Context, aggregator *DiscoveredServiceAggregator) error
+}
+
+// NewLoaderFunc returns a Loader with the given name that runs start, letting function-based
+// loaders such as yaml.LoadConfig be registered without a type of their own
+func NewLoaderFunc(name string, start func(ctx context.Context, aggregator *DiscoveredServiceAggregator) error) Loader {
+	return &loaderFunc{name: name, start: start}
+}
+
+func (l *loaderFunc) Name() string {
+	return l.name
+}
+
+func (l *loaderFunc) Start(ctx context.Context, aggregator *DiscoveredServiceAggregator) error {
+	return l.start(ctx, aggregator)
+}
+
+// Registry holds the discovery loaders available for selection by name
+type Registry struct {
+	mu      sync.RWMutex
+	loaders map[string]Loader
+}
+
+func NewRegistry() *Registry {
+	return &Registry{loaders: make(map[string]Loader)}
+}
+
+// Register adds a loader to the registry, failing if the name is already taken
+func (r *Registry) Register(loader Loader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := loader.Name()
+	if _, exists := r.loaders[name]; exists {
+		return fmt.Errorf("discovery loader %q is already registered", name)
+	}
+	r.loaders[name] = loader
+	return nil
+}
+
+// Lookup returns the loader registered under the given name
+func (r *Registry) Lookup(name string) (Loader, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	loader, ok := r.loaders[name]
+	return loader, ok
+}
+
+// Names returns the sorted names of all registered loaders
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.loaders))
+	for name := range r.loaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var defaultRegistry = NewRegistry()
+
+// Register adds a loader to the default registry, typically from the init function of a third-party package
+func Register(loader Loader) error {
+	return defaultRegistry.Register(loader)
+}
+
+// Lookup returns the loader registered under the given name in the default registry
+func Lookup(name string) (Loader, bool) {
+	return defaultRegistry.Lookup(name)
+}
+
+// Registered returns the sorted names of all loaders in the default registry
+func Registered() []string {
+	return defaultRegistry.Names()
+}
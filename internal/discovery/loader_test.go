@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/moonkev/flexds/internal/common/types"
+)
+
+// fakeLoader reports a fixed set of services once
+type fakeLoader struct {
+	name     string
+	services []*types.DiscoveredService
+}
+
+func (l *fakeLoader) Name() string {
+	return l.name
+}
+
+func (l *fakeLoader) Start(ctx context.Context, aggregator *DiscoveredServiceAggregator) error {
+	return aggregator.UpdateServices(l.name, l.services)
+}
+
+func TestRegistryDrivesFakeLoader(t *testing.T) {
+	registry := NewRegistry()
+	fake := &fakeLoader{name: "fake", services: []*types.DiscoveredService{testService("orders", "10.0.0.1")}}
+	if err := registry.Register(fake); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := registry.Register(&fakeLoader{name: "fake"}); err == nil {
+		t.Error("registering a second loader named fake succeeded")
+	}
+	if names := registry.Names(); !slices.Equal(names, []string{"fake"}) {
+		t.Errorf("Names() = %v, want [fake]", names)
+	}
+
+	loader, ok := registry.Lookup("fake")
+	if !ok {
+		t.Fatal("Lookup(fake) found nothing")
+	}
+	if _, ok := registry.Lookup("missing"); ok {
+		t.Error("Lookup(missing) found a loader")
+	}
+
+	agg := newTestAggregator()
+	if err := loader.Start(context.Background(), agg); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	services := agg.Snapshot()["fake"]
+	if len(services) != 1 || services[0].Name != "orders" {
+		t.Errorf("aggregator has %v for the fake loader, want the orders service", services)
+	}
+}
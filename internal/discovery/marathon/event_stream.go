@@ -0,0 +1,176 @@
+package marathon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/moonkev/flexds/internal/discovery"
+)
+
+// Marathon event bus events that change the apps' services
+const (
+	eventStatusUpdate      = "status_update_event"
+	eventAppTerminated     = "app_terminated_event"
+	eventDeploymentSuccess = "deployment_success"
+)
+
+// maxEventSize bounds a single event on the stream, deployment events embed whole app definitions
+const maxEventSize = 16 << 20
+
+// marathonEvent holds the fields flexds needs from the events it subscribes to
+type marathonEvent struct {
+	EventType string `json:"eventType"`
+	AppId     string `json:"appId"`
+}
+
+// eventWatcher keeps the latest state of every app, updated from the event stream
+type eventWatcher struct {
+	config     Config
+	creds      *auth
+	aggregator *discovery.DiscoveredServiceAggregator
+	apps       map[string]marathonApp
+}
+
+// watchEvents reloads every app, then follows the event stream until it disconnects or an event can't
+// be applied. After a failed reload, a disconnect or a failed event it waits Interval before reloading
+// again, so Marathon is still polled while the stream is unavailable and an app an event failed to
+// refetch doesn't stay stale. A signal on reload ends the wait early.
+func watchEvents(ctx context.Context, config Config, creds *auth, aggregator *discovery.DiscoveredServiceAggregator, reload discovery.ReloadSignal) error {
+	w := &eventWatcher{config: config, creds: creds, aggregator: aggregator}
+	for {
+		if err := w.reload(ctx); err != nil {
+			aggregator.ReportError("marathon_loader", fmt.Errorf("failed to load Marathon config: %w", err))
+		} else if err := w.stream(ctx); err != nil && ctx.Err() == nil {
+			aggregator.ReportError("marathon_loader", fmt.Errorf("marathon event stream ended, reloading every %s until it reconnects: %w", config.Interval, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-reload:
+			slog.Info("Reloading Marathon config")
+		case <-time.After(config.Interval):
+		}
+	}
+}
+
+// reload replaces the known apps with a full fetch and pushes their services
+func (w *eventWatcher) reload(ctx context.Context) error {
+	slog.Debug("loading Marathon config")
+	apps, err := fetchApps(ctx, w.config, w.creds)
+	if err != nil {
+		return err
+	}
+	w.apps = make(map[string]marathonApp, len(apps))
+	for _, app := range apps {
+		w.apps[app.ID] = app
+	}
+	return w.push()
+}
+
+// push converts the known apps, ordered by id, and hands their services to the aggregator
+func (w *eventWatcher) push() error {
+	apps := make([]marathonApp, 0, len(w.apps))
+	for _, id := range slices.Sorted(maps.Keys(w.apps)) {
+		apps = append(apps, w.apps[id])
+	}
+	return w.aggregator.UpdateServices("marathon_loader", convertToDiscoveredServices(apps, w.config.RequireHealthCheck))
+}
+
+// stream subscribes to the event bus and applies events until the stream ends or the context is cancelled
+func (w *eventWatcher) stream(ctx context.Context) error {
+	path := fmt.Sprintf("/v2/events?event_type=%s&event_type=%s&event_type=%s",
+		eventStatusUpdate, eventAppTerminated, eventDeploymentSuccess)
+	req, err := newRequest(ctx, w.config, w.creds, path)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// No client timeout, the stream stays open until Marathon or the context closes it
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Marathon event stream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("marathon event stream returned status %d", resp.StatusCode)
+	}
+	slog.Info("Following Marathon event stream")
+
+	// Server-sent events are "data:" lines terminated by a blank line
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxEventSize)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(value, " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		if err := w.handleEvent(ctx, data.String()); err != nil {
+			return err
+		}
+		data.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("marathon event stream closed")
+}
+
+// handleEvent refetches the app an event is about, or every app after a deployment, and pushes the
+// resulting services. A failure ends the stream, the reload that follows catches up.
+func (w *eventWatcher) handleEvent(ctx context.Context, data string) error {
+	var event marathonEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		slog.Warn("Ignoring malformed Marathon event", "error", err)
+		return nil
+	}
+
+	var err error
+	switch event.EventType {
+	case eventDeploymentSuccess:
+		// Deployments can add, scale and remove several apps at once
+		slog.Debug("Marathon deployment succeeded, reloading all apps")
+		err = w.reload(ctx)
+	case eventStatusUpdate, eventAppTerminated:
+		if event.AppId == "" {
+			return nil
+		}
+		slog.Debug("Marathon app changed, refetching it", "event", event.EventType, "app", event.AppId)
+		err = w.refetch(ctx, event.AppId)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply Marathon %s of app %q: %w", event.EventType, event.AppId, err)
+	}
+	return nil
+}
+
+// refetch updates a single app, dropping it when it no longer exists, and pushes the services
+func (w *eventWatcher) refetch(ctx context.Context, appId string) error {
+	app, err := fetchApp(ctx, w.config, w.creds, appId)
+	if err != nil {
+		return err
+	}
+	if app == nil {
+		delete(w.apps, appId)
+	} else {
+		w.apps[app.ID] = *app
+	}
+	return w.push()
+}
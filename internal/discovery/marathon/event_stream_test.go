@@ -0,0 +1,182 @@
+package marathon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moonkev/flexds/internal/discovery"
+)
+
+// fakeMarathon serves the apps and event stream of a single app, /orders, with a configurable
+// number of running tasks. Events sent on events are streamed to the connected client.
+type fakeMarathon struct {
+	mu        sync.Mutex
+	tasks     int
+	failApp   bool // The single app endpoint fails, as if Marathon were briefly unavailable
+	streamUp  bool
+	appsLoads int // Requests for every app
+	events    chan string
+}
+
+func (f *fakeMarathon) app() marathonApp {
+	app := marathonApp{ID: "/orders", PortDefinitions: []marathonPortDefinition{{Name: "http"}}}
+	for i := range f.tasks {
+		app.Tasks = append(app.Tasks, marathonTask{ID: fmt.Sprintf("orders.%d", i), Host: "agent-1", Ports: []int{31001 + i}, State: "TASK_RUNNING"})
+	}
+	return app
+}
+
+func (f *fakeMarathon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/events" {
+		f.serveEvents(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/v2/apps":
+		f.appsLoads++
+		json.NewEncoder(w).Encode(marathonResponse{Apps: []marathonApp{f.app()}})
+	case "/v2/apps/orders":
+		if f.failApp {
+			http.Error(w, "leader election in progress", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(marathonAppResponse{App: f.app()})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeMarathon) serveEvents(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	streamUp := f.streamUp
+	f.mu.Unlock()
+	if !streamUp {
+		http.Error(w, "event stream disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case data := <-f.events:
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// set changes the fake's state under its lock
+func (f *fakeMarathon) set(change func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change()
+}
+
+// send streams an event to the connected client
+func (f *fakeMarathon) send(t *testing.T, data string) {
+	t.Helper()
+	select {
+	case f.events <- data:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event stream was not connected")
+	}
+}
+
+// startEventWatch follows the fake's apps through watchEvents until the test ends, returning the
+// aggregator they are reported to and a channel of the errors reported
+func startEventWatch(t *testing.T, f *fakeMarathon, interval time.Duration) (*discovery.DiscoveredServiceAggregator, <-chan error) {
+	srv := httptest.NewServer(f)
+	errs := make(chan error, 10)
+	aggregator := discovery.NewDiscoveredServiceAggregator(nil, discovery.WithReportHook(func(_ string, err error) {
+		if err != nil {
+			errs <- err
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = watchEvents(ctx, Config{URL: srv.URL, Interval: interval, UseEventStream: true}, nil, aggregator, nil)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		srv.Close()
+	})
+	return aggregator, errs
+}
+
+// waitForInstances waits until the orders service has the given number of instances
+func waitForInstances(t *testing.T, aggregator *discovery.DiscoveredServiceAggregator, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		services := aggregator.Services()
+		if len(services) == 1 && len(services[0].Instances) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got services %+v, want mesos_orders_http with %d instances", services, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventStreamRefetchesChangedApp(t *testing.T) {
+	f := &fakeMarathon{tasks: 1, streamUp: true, events: make(chan string)}
+	aggregator, errs := startEventWatch(t, f, time.Hour)
+	waitForInstances(t, aggregator, 1)
+
+	f.send(t, `not json`)
+	f.set(func() { f.tasks = 2 })
+	f.send(t, `{"eventType":"status_update_event","appId":"/orders","taskStatus":"TASK_RUNNING"}`)
+	waitForInstances(t, aggregator, 2)
+
+	f.set(func() {
+		if f.appsLoads != 1 {
+			t.Errorf("every app was loaded %d times, want only the initial load and a refetch of /orders", f.appsLoads)
+		}
+	})
+	if len(errs) > 0 {
+		t.Errorf("got error %v, want a malformed event to be ignored", <-errs)
+	}
+}
+
+func TestEventStreamReloadsAfterFailedRefetch(t *testing.T) {
+	f := &fakeMarathon{tasks: 1, streamUp: true, events: make(chan string)}
+	aggregator, errs := startEventWatch(t, f, 100*time.Millisecond)
+	waitForInstances(t, aggregator, 1)
+
+	// The refetch fails, the full reload after the interval still picks up the new task
+	f.set(func() { f.tasks, f.failApp = 2, true })
+	f.send(t, `{"eventType":"status_update_event","appId":"/orders","taskStatus":"TASK_RUNNING"}`)
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed refetch was not reported")
+	}
+	waitForInstances(t, aggregator, 2)
+}
+
+func TestEventStreamDownPollsApps(t *testing.T) {
+	f := &fakeMarathon{tasks: 1, events: make(chan string)}
+	aggregator, _ := startEventWatch(t, f, 50*time.Millisecond)
+	waitForInstances(t, aggregator, 1)
+
+	f.set(func() { f.tasks = 3 })
+	waitForInstances(t, aggregator, 3)
+}
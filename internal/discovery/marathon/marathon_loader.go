@@ -7,30 +7,194 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/moonkev/flexds/internal/common/secrets"
 	"github.com/moonkev/flexds/internal/common/types"
 	"github.com/moonkev/flexds/internal/discovery"
+	"github.com/moonkev/flexds/internal/discovery/metadata"
 )
 
 type Config struct {
 	URL                 string
-	CredentialsFilePath string
+	CredentialsFilePath string // File holding username:password for basic auth
 	Interval            time.Duration
+
+	// AuthTokenFilePath is a file holding a token sent in the Authorization header instead of basic
+	// auth, as "token=<token>" for DC/OS or "Bearer <token>" depending on AuthTokenType ("dcos", the
+	// default, or "bearer"). It can't be combined with CredentialsFilePath.
+	AuthTokenFilePath string
+	AuthTokenType     string
+
+	// UseEventStream follows Marathon's /v2/events stream instead of polling every Interval, refetching
+	// apps as their tasks change. While the stream is down, apps are reloaded every Interval until it reconnects.
+	UseEventStream bool
+
+	// RequireHealthCheck drops apps that define no Marathon health check. By default their running
+	// tasks are considered healthy.
+	RequireHealthCheck bool
+}
+
+// Loader adapts the Marathon poller to the discovery.Loader interface
+type Loader struct {
+	cfg    Config
+	reload discovery.ReloadSignal
+}
+
+func NewLoader(cfg Config) *Loader {
+	return &Loader{cfg: cfg, reload: discovery.NewReloadSignal()}
+}
+
+func (l *Loader) Name() string {
+	return "marathon"
+}
+
+// Start polls Marathon until the context is cancelled
+func (l *Loader) Start(ctx context.Context, aggregator *discovery.DiscoveredServiceAggregator) error {
+	return poll(ctx, l.cfg, aggregator, l.reload)
+}
+
+// Reload fetches the apps without waiting for the next poll. With the event stream connected,
+// which keeps the apps current, it only takes effect once the stream is down.
+func (l *Loader) Reload() {
+	l.reload.Reload()
 }
 
 type marathonResponse struct {
 	Apps []marathonApp `json:"apps"`
 }
 
+type marathonAppResponse struct {
+	App marathonApp `json:"app"`
+}
+
 type marathonApp struct {
 	ID              string                   `json:"id"`
 	Ports           []int                    `json:"ports"`
 	PortDefinitions []marathonPortDefinition `json:"portDefinitions"`
 	Tasks           []marathonTask           `json:"tasks"`
 	Labels          map[string]string        `json:"labels"`
+	HealthChecks    []json.RawMessage        `json:"healthChecks"`
+	Container       *marathonContainer       `json:"container"`
+	Networks        []marathonNetwork        `json:"networks"`
+	IPAddress       *json.RawMessage         `json:"ipAddress"` // IP-per-task before Marathon 1.5
+}
+
+type marathonContainer struct {
+	PortMappings []marathonPortMapping `json:"portMappings"`
+	Docker       *struct {
+		Network      string                `json:"network"`      // HOST, BRIDGE or USER before Marathon 1.5
+		PortMappings []marathonPortMapping `json:"portMappings"` // Location before Marathon 1.5
+	} `json:"docker"`
+}
+
+type marathonPortMapping struct {
+	Name          string            `json:"name"`
+	ContainerPort int               `json:"containerPort"`
+	Labels        map[string]string `json:"labels"`
+}
+
+type marathonNetwork struct {
+	Mode string `json:"mode"`
+}
+
+// Marathon network modes, named as in Marathon 1.5+ app definitions
+const (
+	networkModeHost      = "host"
+	networkModeBridge    = "container/bridge"
+	networkModeContainer = "container"
+)
+
+// networkMode returns the app's network mode, translating the pre-1.5 Docker network and IP-per-task settings
+func (a *marathonApp) networkMode() string {
+	if len(a.Networks) > 0 {
+		return a.Networks[0].Mode
+	}
+	if a.Container != nil && a.Container.Docker != nil {
+		switch a.Container.Docker.Network {
+		case "BRIDGE":
+			return networkModeBridge
+		case "USER":
+			return networkModeContainer
+		}
+	}
+	if a.IPAddress != nil {
+		return networkModeContainer
+	}
+	return networkModeHost
+}
+
+// portMappings returns the app's container port mappings, wherever the app definition's version puts them
+func (a *marathonApp) portMappings() []marathonPortMapping {
+	if a.Container == nil {
+		return nil
+	}
+	if len(a.Container.PortMappings) == 0 && a.Container.Docker != nil {
+		return a.Container.Docker.PortMappings
+	}
+	return a.Container.PortMappings
+}
+
+// servicePorts returns the ports the app exposes as services: its port definitions, or its container
+// port mappings for container networked apps, which have no port definitions
+func (a *marathonApp) servicePorts() []marathonPortDefinition {
+	if len(a.PortDefinitions) > 0 {
+		return a.PortDefinitions
+	}
+	mappings := a.portMappings()
+	ports := make([]marathonPortDefinition, 0, len(mappings))
+	for _, mapping := range mappings {
+		ports = append(ports, marathonPortDefinition{Name: mapping.Name, Labels: mapping.Labels})
+	}
+	return ports
+}
+
+// taskEndpoint returns the address and port serving the task's port at portIndex (see taskPortIndex):
+//   - container networking: the task's own IPv4 address and the mapping's container port, falling back
+//     to the host port when the mapping has no container port
+//   - bridge networking: the agent's host name and the host port, the task IP being local to the agent
+//   - host networking: the task's IPv4 address, else the agent's host name, and the host port
+//
+// It reports false when the task has no such port.
+func (a *marathonApp) taskEndpoint(task marathonTask, portIndex int) (string, int, bool) {
+	mode := a.networkMode()
+	if mode == networkModeContainer {
+		mappings := a.portMappings()
+		if ip := taskIPv4(task); ip != "" && portIndex < len(mappings) && mappings[portIndex].ContainerPort > 0 {
+			return ip, mappings[portIndex].ContainerPort, true
+		}
+	}
+	if portIndex >= len(task.Ports) {
+		return "", 0, false
+	}
+	if mode == networkModeBridge {
+		return task.Host, task.Ports[portIndex], true
+	}
+	return getTaskAddress(task), task.Ports[portIndex], true
+}
+
+// taskPortIndex returns the index in the tasks' ports of the named port definition. Tasks are assigned
+// one port per container port mapping when the app has them (e.g. Docker BRIDGE networking), otherwise
+// one per port definition, so the name is looked up in whichever applies. The definition's own index
+// is used when the name isn't found.
+func (a *marathonApp) taskPortIndex(portIndex int, name string) int {
+	var names []string
+	for _, mapping := range a.portMappings() {
+		names = append(names, mapping.Name)
+	}
+	if len(names) == 0 {
+		for _, portDef := range a.PortDefinitions {
+			names = append(names, portDef.Name)
+		}
+	}
+	if name != "" {
+		if i := slices.Index(names, name); i >= 0 {
+			return i
+		}
+	}
+	return portIndex
 }
 
 type marathonPortDefinition struct {
@@ -46,6 +210,8 @@ type marathonTask struct {
 	Ports              []int                        `json:"ports"`
 	HealthCheckResults []marathonHealthCheckResults `json:"healthCheckResults"`
 	State              string                       `json:"state"`
+	Region             string                       `json:"region"` // fault domain of the task's agent
+	Zone               string                       `json:"zone"`
 }
 
 type marathonIPAddress struct {
@@ -57,8 +223,16 @@ type marathonHealthCheckResults struct {
 	Alive bool `json:"alive"`
 }
 
-func (t *marathonTask) IsHealthy() bool {
-	if t.State != "TASK_RUNNING" || len(t.HealthCheckResults) == 0 {
+// IsHealthy reports whether the task is running and passing a health check. Tasks of apps without
+// health checks only need to be running, unless requireHealthCheck is set.
+func (t *marathonTask) IsHealthy(healthChecked bool, requireHealthCheck bool) bool {
+	if t.State != "TASK_RUNNING" {
+		return false
+	}
+	if !healthChecked {
+		return !requireHealthCheck
+	}
+	if len(t.HealthCheckResults) == 0 {
 		return false
 	}
 	for _, result := range t.HealthCheckResults {
@@ -69,80 +243,184 @@ func (t *marathonTask) IsHealthy() bool {
 	return false
 }
 
+// Authorization header formats of AuthTokenType
+const (
+	AuthTokenTypeDcos   = "dcos"
+	AuthTokenTypeBearer = "bearer"
+)
+
+// auth authenticates Marathon requests from a credentials or token file, re-read as it changes
+type auth struct {
+	file      *secrets.File
+	tokenType string // Empty for username:password basic auth
+}
+
+// newAuth validates the configured authentication, returning nil when none is configured
+func newAuth(config Config) (*auth, error) {
+	switch {
+	case config.CredentialsFilePath != "" && config.AuthTokenFilePath != "":
+		return nil, fmt.Errorf("marathon credentials file and auth token file are mutually exclusive")
+	case config.CredentialsFilePath != "":
+		return &auth{file: secrets.NewFile(config.CredentialsFilePath, secrets.DefaultMaxAge)}, nil
+	case config.AuthTokenFilePath != "":
+		tokenType := config.AuthTokenType
+		if tokenType == "" {
+			tokenType = AuthTokenTypeDcos
+		}
+		if tokenType != AuthTokenTypeDcos && tokenType != AuthTokenTypeBearer {
+			return nil, fmt.Errorf("invalid marathon auth token type %q, must be %s or %s", tokenType, AuthTokenTypeDcos, AuthTokenTypeBearer)
+		}
+		return &auth{file: secrets.NewFile(config.AuthTokenFilePath, secrets.DefaultMaxAge), tokenType: tokenType}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// apply sets the request's Authorization header from the current file contents
+func (a *auth) apply(req *http.Request) error {
+	contents, err := a.file.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	value := strings.TrimSpace(string(contents))
+
+	switch a.tokenType {
+	case AuthTokenTypeDcos:
+		req.Header.Set("Authorization", "token="+value)
+	case AuthTokenTypeBearer:
+		req.Header.Set("Authorization", "Bearer "+value)
+	default:
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid credentials format in %s", a.file.Path())
+		}
+		req.SetBasicAuth(parts[0], parts[1])
+	}
+	return nil
+}
+
 func LoadConfig(ctx context.Context, config Config, aggregator *discovery.DiscoveredServiceAggregator) error {
+	return poll(ctx, config, aggregator, nil)
+}
+
+// poll loads the apps every Interval, or follows the event stream, until the context is cancelled.
+// A signal on reload loads them right away.
+func poll(ctx context.Context, config Config, aggregator *discovery.DiscoveredServiceAggregator, reload discovery.ReloadSignal) error {
 	timer := time.NewTimer(0)
 	defer timer.Stop()
 
+	creds, err := newAuth(config)
+	if err != nil {
+		return err
+	}
+
+	if config.UseEventStream {
+		return watchEvents(ctx, config, creds, aggregator, reload)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-reload:
+			slog.Info("Reloading Marathon config")
 		case <-timer.C:
-			slog.Debug("loading Marathon config")
-			err := loadConfig(config, aggregator)
-			if err != nil {
-				slog.Error("failed to load Marathon config", "error", err)
-				return err
-			}
-			timer.Reset(config.Interval)
 		}
+		slog.Debug("loading Marathon config")
+		if err := loadConfig(ctx, config, creds, aggregator); err != nil {
+			aggregator.ReportError("marathon_loader", fmt.Errorf("failed to load Marathon config: %w", err))
+		}
+		timer.Reset(config.Interval)
 	}
 }
 
-func loadConfig(config Config, aggregator *discovery.DiscoveredServiceAggregator) error {
-
-	var creds string
-	httpClient := http.Client{Timeout: 10 * time.Second}
+// loadConfig fetches the apps from Marathon and pushes their services to the aggregator
+func loadConfig(ctx context.Context, config Config, creds *auth, aggregator *discovery.DiscoveredServiceAggregator) error {
+	apps, err := fetchApps(ctx, config, creds)
+	if err != nil {
+		return err
+	}
+	discoveredServices := convertToDiscoveredServices(apps, config.RequireHealthCheck)
+	return aggregator.UpdateServices("marathon_loader", discoveredServices)
+}
 
-	url := fmt.Sprintf("%s/v2/apps?embed=apps.tasks", config.URL)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+// newRequest creates a GET request for a Marathon API path, authenticating when configured
+func newRequest(ctx context.Context, config Config, creds *auth, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.URL+path, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request in marathon loader: %w", err)
+		return nil, fmt.Errorf("failed to create request in marathon loader: %w", err)
 	}
 
-	if config.CredentialsFilePath != "" {
-		credsBytes, err := os.ReadFile(config.CredentialsFilePath)
-		if err != nil {
-			return fmt.Errorf("failed to read credentials file: %w", err)
-		}
-		creds = string(credsBytes)
-		parts := strings.SplitN(strings.TrimSpace(creds), ":", 2)
-		if len(parts) == 2 {
-			req.SetBasicAuth(parts[0], parts[1])
-		} else {
-			return fmt.Errorf("invalid credentials format in %s", config.CredentialsFilePath)
+	if creds != nil {
+		if err := creds.apply(req); err != nil {
+			return nil, err
 		}
 	}
+	return req, nil
+}
+
+// getJSON fetches a Marathon API path and decodes its JSON response into out. It reports whether the
+// resource exists, a 404 not being an error.
+func getJSON(ctx context.Context, config Config, creds *auth, path string, out any) (bool, error) {
+	httpClient := http.Client{Timeout: 10 * time.Second}
+
+	req, err := newRequest(ctx, config, creds, path)
+	if err != nil {
+		return false, err
+	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to fetch from Marathon API: %w", err)
+		return false, fmt.Errorf("failed to fetch from Marathon API: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("marathon API returned status %d", resp.StatusCode)
+		return false, fmt.Errorf("marathon API returned status %d", resp.StatusCode)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return false, fmt.Errorf("failed to read response body: %w", err)
 	}
 
+	if err := json.Unmarshal(body, out); err != nil {
+		slog.Error("failed to parse Marathon response", "error", err, "url", req.URL.String(), "body", string(body))
+		return false, fmt.Errorf("failed to parse Marathon response: %w", err)
+	}
+	return true, nil
+}
+
+// fetchApps fetches every app along with its tasks
+func fetchApps(ctx context.Context, config Config, creds *auth) ([]marathonApp, error) {
 	var marathonResp marathonResponse
-	if err := json.Unmarshal(body, &marathonResp); err != nil {
-		slog.Error("failed to parse Marathon response", "error", err, "url", url, "body", string(body))
-		return fmt.Errorf("failed to parse Marathon response: %w", err)
+	found, err := getJSON(ctx, config, creds, "/v2/apps?embed=apps.tasks", &marathonResp)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("marathon API returned status %d", http.StatusNotFound)
 	}
+	return marathonResp.Apps, nil
+}
 
-	discoveredServices := convertToDiscoveredServices(marathonResp.Apps)
-	return aggregator.UpdateServices("marathon_loader", discoveredServices)
+// fetchApp fetches a single app along with its tasks, returning nil when the app no longer exists
+func fetchApp(ctx context.Context, config Config, creds *auth, appId string) (*marathonApp, error) {
+	var appResp marathonAppResponse
+	found, err := getJSON(ctx, config, creds, "/v2/apps"+appId+"?embed=app.tasks", &appResp)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &appResp.App, nil
 }
 
-func convertToDiscoveredServices(apps []marathonApp) []*types.DiscoveredService {
+func convertToDiscoveredServices(apps []marathonApp, requireHealthCheck bool) []*types.DiscoveredService {
 	var serviceLen int
 	for _, app := range apps {
-		serviceLen += len(app.PortDefinitions)
+		serviceLen += len(app.servicePorts())
 	}
 
 	services := make([]*types.DiscoveredService, 0, serviceLen)
@@ -152,7 +430,7 @@ func convertToDiscoveredServices(apps []marathonApp) []*types.DiscoveredService
 		// Filter to healthy tasks only
 		healthyTasks := make([]marathonTask, 0, len(app.Tasks))
 		for _, task := range app.Tasks {
-			if task.IsHealthy() {
+			if task.IsHealthy(len(app.HealthChecks) > 0, requireHealthCheck) {
 				healthyTasks = append(healthyTasks, task)
 			}
 		}
@@ -160,20 +438,41 @@ func convertToDiscoveredServices(apps []marathonApp) []*types.DiscoveredService
 			continue
 		}
 
-		for portIndex, portDef := range app.PortDefinitions {
+		for portIndex, portDef := range app.servicePorts() {
 
 			sanitizedAppId := strings.NewReplacer("/", "_", "-", "_").Replace(app.ID[1:])
 			serviceName := fmt.Sprintf("mesos_%s_%s", sanitizedAppId, portDef.Name)
+			// Host ports are assigned per task, so the health check port is given as a port index
+			healthCheckPortIndex := -1
+			if val, ok := portDef.Labels["health_check_port_index"]; ok {
+				if parsed, ok := metadata.ParseUint32(serviceName, "health_check_port_index", val); ok {
+					healthCheckPortIndex = int(parsed)
+				}
+			}
+
+			taskPortIndex := app.taskPortIndex(portIndex, portDef.Name)
+
 			instances := make([]types.ServiceInstance, 0, len(healthyTasks))
 			for _, task := range healthyTasks {
+				address, port, ok := app.taskEndpoint(task, taskPortIndex)
+				if !ok {
+					slog.Warn("Skipping task without the service's port", "service", serviceName, "task", task.ID, "portIndex", taskPortIndex, "ports", len(task.Ports))
+					continue
+				}
 
-				address := getTaskAddress(task)
-				port := task.Ports[portIndex]
-
-				instances = append(instances, types.ServiceInstance{
+				inst := types.ServiceInstance{
 					Address: address,
 					Port:    port,
-				})
+					Region:  task.Region,
+					Zone:    task.Zone,
+				}
+				if healthCheckPortIndex >= 0 && healthCheckPortIndex < len(task.Ports) {
+					inst.HealthCheckPort = uint32(task.Ports[healthCheckPortIndex])
+				}
+				instances = append(instances, inst)
+			}
+			if len(instances) == 0 {
+				continue
 			}
 
 			ds := &types.DiscoveredService{
@@ -182,9 +481,10 @@ func convertToDiscoveredServices(apps []marathonApp) []*types.DiscoveredService
 				Routes:    buildRoutes(serviceName, portDef.Labels),
 			}
 
-			if portDef.Name == "grpc" || portDef.Labels["http2"] == "true" {
+			if portDef.Name == "grpc" {
 				ds.EnableHTTP2 = true
 			}
+			metadata.ApplyServiceOptions(ds, portDef.Labels)
 
 			services = append(services, ds)
 		}
@@ -194,12 +494,20 @@ func convertToDiscoveredServices(apps []marathonApp) []*types.DiscoveredService
 }
 
 func getTaskAddress(task marathonTask) string {
+	if ip := taskIPv4(task); ip != "" {
+		return ip
+	}
+	return task.Host
+}
+
+// taskIPv4 returns the task's first IPv4 address, empty when it reports none
+func taskIPv4(task marathonTask) string {
 	for _, ip := range task.IPAddresses {
 		if ip.Protocol == "IPv4" && ip.IPAddress != "" {
 			return ip.IPAddress
 		}
 	}
-	return task.Host
+	return ""
 }
 
 func buildRoutes(serviceName string, labels map[string]string) []types.RoutePattern {
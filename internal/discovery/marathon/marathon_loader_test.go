@@ -0,0 +1,132 @@
+package marathon
+
+import "testing"
+
+func TestAppWithoutHealthChecksIsDiscovered(t *testing.T) {
+	apps := []marathonApp{{
+		ID:              "/orders",
+		PortDefinitions: []marathonPortDefinition{{Name: "http"}},
+		Tasks: []marathonTask{
+			{ID: "orders.1", Host: "agent-1", Ports: []int{31001}, State: "TASK_RUNNING"},
+			{ID: "orders.2", Host: "agent-2", Ports: []int{31002}, State: "TASK_STAGING"},
+		},
+	}}
+
+	services := convertToDiscoveredServices(apps, false)
+	if len(services) != 1 || services[0].Name != "mesos_orders_http" {
+		t.Fatalf("got services %+v, want mesos_orders_http", services)
+	}
+	if instances := services[0].Instances; len(instances) != 1 || instances[0].Address != "agent-1" || instances[0].Port != 31001 {
+		t.Errorf("got instances %+v, want only the running task agent-1:31001", instances)
+	}
+
+	if services := convertToDiscoveredServices(apps, true); len(services) != 0 {
+		t.Errorf("got services %+v requiring health checks, want none", services)
+	}
+}
+
+func TestTaskWithFewerPortsThanPortDefinitions(t *testing.T) {
+	apps := []marathonApp{{
+		ID:              "/orders",
+		PortDefinitions: []marathonPortDefinition{{Name: "http"}, {Name: "admin"}},
+		Tasks: []marathonTask{
+			{ID: "orders.1", Host: "agent-1", Ports: []int{31001}, State: "TASK_RUNNING"},
+			{ID: "orders.2", Host: "agent-2", Ports: []int{31002, 31003}, State: "TASK_RUNNING"},
+		},
+	}}
+
+	services := convertToDiscoveredServices(apps, false)
+	if len(services) != 2 {
+		t.Fatalf("got %d services, want http and admin", len(services))
+	}
+	if http := services[0]; http.Name != "mesos_orders_http" || len(http.Instances) != 2 {
+		t.Errorf("got %s with %d instances, want mesos_orders_http with both tasks", http.Name, len(http.Instances))
+	}
+	admin := services[1]
+	if admin.Name != "mesos_orders_admin" || len(admin.Instances) != 1 || admin.Instances[0].Port != 31003 {
+		t.Errorf("got %s with instances %+v, want mesos_orders_admin with only agent-2:31003", admin.Name, admin.Instances)
+	}
+}
+
+func TestTaskPortMatchedByName(t *testing.T) {
+	// The port mappings assign the task's ports in a different order than the port definitions list them
+	apps := []marathonApp{{
+		ID:              "/orders",
+		PortDefinitions: []marathonPortDefinition{{Name: "http"}, {Name: "admin"}},
+		Container:       &marathonContainer{PortMappings: []marathonPortMapping{{Name: "admin"}, {Name: "http"}}},
+		Tasks:           []marathonTask{{ID: "orders.1", Host: "agent-1", Ports: []int{31001, 31002}, State: "TASK_RUNNING"}},
+	}}
+
+	ports := make(map[string]int)
+	for _, svc := range convertToDiscoveredServices(apps, false) {
+		ports[svc.Name] = svc.Instances[0].Port
+	}
+	if ports["mesos_orders_http"] != 31002 || ports["mesos_orders_admin"] != 31001 {
+		t.Errorf("got ports %v, want http on 31002 and admin on 31001", ports)
+	}
+}
+
+func TestTaskEndpointByNetworkMode(t *testing.T) {
+	task := marathonTask{
+		ID:          "orders.1",
+		Host:        "agent-1",
+		IPAddresses: []marathonIPAddress{{IPAddress: "fd00::5", Protocol: "IPv6"}, {IPAddress: "10.1.0.5", Protocol: "IPv4"}},
+		Ports:       []int{31001},
+		State:       "TASK_RUNNING",
+	}
+	mappings := []marathonPortMapping{{Name: "http", ContainerPort: 8080}}
+
+	tests := []struct {
+		name        string
+		app         marathonApp
+		task        marathonTask
+		wantAddress string
+		wantPort    int
+	}{
+		{
+			name:        "host",
+			app:         marathonApp{Networks: []marathonNetwork{{Mode: networkModeHost}}, PortDefinitions: []marathonPortDefinition{{Name: "http"}}},
+			task:        task,
+			wantAddress: "10.1.0.5",
+			wantPort:    31001,
+		},
+		{
+			name:        "bridge",
+			app:         marathonApp{Networks: []marathonNetwork{{Mode: networkModeBridge}}, Container: &marathonContainer{PortMappings: mappings}},
+			task:        task,
+			wantAddress: "agent-1",
+			wantPort:    31001,
+		},
+		{
+			name:        "container",
+			app:         marathonApp{Networks: []marathonNetwork{{Mode: networkModeContainer}}, Container: &marathonContainer{PortMappings: mappings}},
+			task:        marathonTask{ID: task.ID, Host: task.Host, IPAddresses: task.IPAddresses, State: task.State},
+			wantAddress: "10.1.0.5",
+			wantPort:    8080,
+		},
+		{
+			name: "pre-1.5 docker bridge",
+			app: marathonApp{Container: &marathonContainer{Docker: &struct {
+				Network      string                `json:"network"`
+				PortMappings []marathonPortMapping `json:"portMappings"`
+			}{Network: "BRIDGE", PortMappings: mappings}}},
+			task:        task,
+			wantAddress: "agent-1",
+			wantPort:    31001,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.app.ID = "/orders"
+			tt.app.Tasks = []marathonTask{tt.task}
+
+			services := convertToDiscoveredServices([]marathonApp{tt.app}, false)
+			if len(services) != 1 || len(services[0].Instances) != 1 {
+				t.Fatalf("got services %+v, want one instance", services)
+			}
+			if inst := services[0].Instances[0]; inst.Address != tt.wantAddress || inst.Port != tt.wantPort {
+				t.Errorf("got %s:%d, want %s:%d", inst.Address, inst.Port, tt.wantAddress, tt.wantPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+// Package metadata parses service-level options from the string key/value metadata
+// carried by Consul service meta and Marathon labels.
+package metadata
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	"github.com/moonkev/flexds/internal/common/types"
+)
+
+// ApplyServiceOptions sets the service-level options found in meta on svc.
+// Invalid values are logged and ignored so a single bad key doesn't drop the service.
+func ApplyServiceOptions(svc *types.DiscoveredService, meta map[string]string) {
+	if val, ok := meta["protocol"]; ok {
+		switch strings.ToLower(val) {
+		case "http":
+			svc.Protocol = ""
+		case types.ProtocolTCP:
+			svc.Protocol = types.ProtocolTCP
+		default:
+			slog.Warn("Invalid protocol, must be http or tcp", "service", svc.Name, "value", val, telemetry.InvalidConfigKey, "metadata")
+		}
+	}
+	if val, ok := meta["http2"]; ok && val == "true" {
+		svc.EnableHTTP2 = true
+	}
+	// gRPC-Web requests reach the upstream as gRPC, which requires HTTP/2
+	if val, ok := meta["grpc_web"]; ok && val == "true" {
+		svc.GrpcWeb = true
+		svc.EnableHTTP2 = true
+	}
+	if val, ok := meta["grpc_json_descriptor"]; ok && val != "" {
+		svc.GrpcJson = &types.GrpcJsonTranscoder{
+			DescriptorFile: val,
+			Services:       SplitList(meta["grpc_json_services"]),
+		}
+		svc.EnableHTTP2 = true
+	}
+	if meta["jwt_jwks_uri"] != "" || meta["jwt_local_jwks"] != "" {
+		svc.Jwt = &types.JwtProvider{
+			Issuer:    meta["jwt_issuer"],
+			Audiences: SplitList(meta["jwt_audiences"]),
+			JwksUri:   meta["jwt_jwks_uri"],
+			LocalJwks: meta["jwt_local_jwks"],
+		}
+	}
+	if val, ok := meta["tls"]; ok && val == "true" {
+		svc.EnableTLS = true
+	}
+	if val, ok := meta["tls_ca_file"]; ok {
+		svc.TlsCaFile = val
+	}
+	if val, ok := meta["tls_ca_pem"]; ok {
+		svc.TlsCaPem = val
+	}
+	if val, ok := meta["tls_subject_alt_names"]; ok {
+		svc.TlsSubjectAltNames = SplitList(val)
+	}
+	if val, ok := meta["tls_sni"]; ok {
+		svc.Sni = val
+	}
+	if val, ok := meta["tls_client_cert_file"]; ok {
+		svc.TlsClientCertFile = val
+	}
+	if val, ok := meta["tls_client_key_file"]; ok {
+		svc.TlsClientKeyFile = val
+	}
+	if val, ok := meta["tls_insecure"]; ok && val == "true" {
+		svc.TlsInsecure = true
+	}
+	if val, ok := meta["drain"]; ok && val == "true" {
+		svc.Draining = true
+	}
+	if val, ok := meta["node_ids"]; ok {
+		svc.NodeIds = SplitList(val)
+	}
+	if val, ok := meta["route_scope"]; ok {
+		svc.RouteScope = val
+	}
+	if val, ok := meta["listener_ports"]; ok {
+		svc.ListenerPorts = nil
+		for _, port := range SplitList(val) {
+			if parsed, ok := ParseUint32(svc.Name, "listener_ports", port); ok {
+				svc.ListenerPorts = append(svc.ListenerPorts, parsed)
+			}
+		}
+	}
+	if val, ok := meta["dns_refresh_rate"]; ok {
+		if parsed, ok := ParseDuration(svc.Name, "dns_refresh_rate", val); ok {
+			svc.DnsRefreshRate = parsed
+		}
+	}
+	if val, ok := meta["dns_lookup_family"]; ok {
+		svc.DnsLookupFamily = val
+	}
+	if val, ok := meta["connect_timeout"]; ok {
+		if parsed, ok := ParseDuration(svc.Name, "connect_timeout", val); ok {
+			svc.ConnectTimeout = parsed
+		}
+	}
+	if val, ok := meta["ignore_endpoint_weights"]; ok && val == "true" {
+		svc.IgnoreEndpointWeights = true
+	}
+	if val, ok := meta["all_addresses_in_single_endpoint"]; ok && val == "true" {
+		svc.AllAddressesInSingleEndpoint = true
+	}
+	if val, ok := meta["lb_policy"]; ok {
+		svc.LbPolicy = val
+	}
+	if val, ok := meta["healthy_panic_threshold"]; ok {
+		if parsed, ok := ParsePercent(svc.Name, "healthy_panic_threshold", val); ok {
+			svc.HealthyPanicThreshold = &parsed
+		}
+	}
+	if val, ok := meta["health_check"]; ok && val == "true" {
+		svc.HealthCheck = parseHealthCheck(svc.Name, meta)
+	}
+	svc.Outlier = parseOutlierDetection(svc.Name, meta)
+	svc.TcpKeepalive = parseTcpKeepalive(svc.Name, meta)
+}
+
+// ApplyInstanceOptions sets the instance-level options found in meta on inst
+func ApplyInstanceOptions(service string, inst *types.ServiceInstance, meta map[string]string) {
+	if val, ok := meta["region"]; ok {
+		inst.Region = val
+	}
+	if val, ok := meta["zone"]; ok {
+		inst.Zone = val
+	}
+	if val, ok := meta["priority"]; ok {
+		if parsed, ok := ParseUint32(service, "priority", val); ok {
+			inst.Priority = parsed
+		}
+	}
+	if val, ok := meta["health_check_port"]; ok {
+		if parsed, ok := ParseUint32(service, "health_check_port", val); ok {
+			inst.HealthCheckPort = parsed
+		}
+	}
+}
+
+// parseTcpKeepalive reads the tcp_keepalive_* keys, returning nil when none are set
+func parseTcpKeepalive(service string, meta map[string]string) *types.TcpKeepalive {
+	ka := &types.TcpKeepalive{}
+	if val, ok := meta["tcp_keepalive_probes"]; ok {
+		if parsed, ok := ParseUint32(service, "tcp_keepalive_probes", val); ok {
+			ka.Probes = parsed
+		}
+	}
+	if val, ok := meta["tcp_keepalive_time"]; ok {
+		if parsed, ok := ParseDuration(service, "tcp_keepalive_time", val); ok {
+			ka.Time = parsed
+		}
+	}
+	if val, ok := meta["tcp_keepalive_interval"]; ok {
+		if parsed, ok := ParseDuration(service, "tcp_keepalive_interval", val); ok {
+			ka.Interval = parsed
+		}
+	}
+	if *ka == (types.TcpKeepalive{}) {
+		return nil
+	}
+	return ka
+}
+
+// parseOutlierDetection reads the outlier_* keys, returning nil when none are set
+func parseOutlierDetection(service string, meta map[string]string) *types.OutlierDetection {
+	od := &types.OutlierDetection{}
+	if val, ok := meta["outlier_consecutive_5xx"]; ok {
+		if parsed, ok := ParseUint32(service, "outlier_consecutive_5xx", val); ok {
+			od.Consecutive5xx = parsed
+		}
+	}
+	if val, ok := meta["outlier_interval"]; ok {
+		if parsed, ok := ParseDuration(service, "outlier_interval", val); ok {
+			od.Interval = parsed
+		}
+	}
+	if val, ok := meta["outlier_base_ejection_time"]; ok {
+		if parsed, ok := ParseDuration(service, "outlier_base_ejection_time", val); ok {
+			od.BaseEjectionTime = parsed
+		}
+	}
+	if val, ok := meta["outlier_max_ejection_percent"]; ok {
+		if parsed, ok := ParseUint32(service, "outlier_max_ejection_percent", val); ok {
+			od.MaxEjectionPercent = parsed
+		}
+	}
+	if *od == (types.OutlierDetection{}) {
+		return nil
+	}
+	return od
+}
+
+// parseHealthCheck reads the health_check_* keys, leaving unset fields for the snapshot manager to default
+func parseHealthCheck(service string, meta map[string]string) *types.HealthCheck {
+	hc := &types.HealthCheck{}
+	if val, ok := meta["health_check_path"]; ok {
+		hc.Path = val
+	}
+	if val, ok := meta["health_check_interval"]; ok {
+		if parsed, ok := ParseDuration(service, "health_check_interval", val); ok {
+			hc.Interval = parsed
+		}
+	}
+	if val, ok := meta["health_check_timeout"]; ok {
+		if parsed, ok := ParseDuration(service, "health_check_timeout", val); ok {
+			hc.Timeout = parsed
+		}
+	}
+	if val, ok := meta["health_check_unhealthy_threshold"]; ok {
+		if parsed, ok := ParseUint32(service, "health_check_unhealthy_threshold", val); ok {
+			hc.UnhealthyThreshold = parsed
+		}
+	}
+	return hc
+}
+
+// SplitList splits a comma-separated metadata value, dropping empty entries
+func SplitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseDuration parses a positive duration value, logging and rejecting invalid ones
+func ParseDuration(service string, key string, value string) (time.Duration, bool) {
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		slog.Warn("Invalid duration metadata value, using default", "service", service, "key", key, "value", value, "error", err, telemetry.InvalidConfigKey, "metadata")
+		return 0, false
+	}
+	return parsed, true
+}
+
+// ParsePercent parses a percentage between 0 and 100, logging and rejecting invalid ones
+func ParsePercent(service string, key string, value string) (float64, bool) {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(parsed) || parsed < 0 || parsed > 100 {
+		slog.Warn("Invalid percentage metadata value, using default", "service", service, "key", key, "value", value, "error", err, telemetry.InvalidConfigKey, "metadata")
+		return 0, false
+	}
+	return parsed, true
+}
+
+// ParseUint32 parses a non-negative integer value, logging and rejecting invalid ones
+func ParseUint32(service string, key string, value string) (uint32, bool) {
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		slog.Warn("Invalid integer metadata value, using default", "service", service, "key", key, "value", value, "error", err, telemetry.InvalidConfigKey, "metadata")
+		return 0, false
+	}
+	return uint32(parsed), true
+}
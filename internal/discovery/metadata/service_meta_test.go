@@ -0,0 +1,28 @@
+package metadata
+
+import "testing"
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   float64
+		wantOk bool
+	}{
+		{value: "0", want: 0, wantOk: true},
+		{value: "12.5", want: 12.5, wantOk: true},
+		{value: "100", want: 100, wantOk: true},
+		{value: "-1"},
+		{value: "100.1"},
+		{value: "NaN"},
+		{value: "nan"},
+		{value: "half"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := ParsePercent("orders", "healthy_panic_threshold", tt.value)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("ParsePercent(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
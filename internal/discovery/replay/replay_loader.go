@@ -0,0 +1,72 @@
+// Package replay loads a recorded discovery state, as served by the admin /services/raw endpoint,
+// so a snapshot can be rebuilt from it without live discovery when reproducing routing issues.
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+
+	"github.com/moonkev/flexds/internal/common/types"
+	"github.com/moonkev/flexds/internal/discovery"
+)
+
+type Config struct {
+	FilePath string
+}
+
+// Loader adapts the recorded state loader to the discovery.Loader interface
+type Loader struct {
+	cfg Config
+}
+
+func NewLoader(cfg Config) *Loader {
+	return &Loader{cfg: cfg}
+}
+
+func (l *Loader) Name() string {
+	return "replay"
+}
+
+// Start replays the recorded state once and returns
+func (l *Loader) Start(_ context.Context, aggregator *discovery.DiscoveredServiceAggregator) error {
+	return LoadState(l.cfg, aggregator)
+}
+
+// ParseState decodes a recorded discovery state: the services reported by each loader, keyed by loader id
+func ParseState(raw []byte) (map[string][]*types.DiscoveredService, error) {
+	var state map[string][]*types.DiscoveredService
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse recorded discovery state: %w", err)
+	}
+	return state, nil
+}
+
+// LoadState reports the recorded services of each loader to the aggregator under the original loader ids
+func LoadState(config Config, aggregator *discovery.DiscoveredServiceAggregator) error {
+	raw, err := os.ReadFile(config.FilePath)
+	if err != nil {
+		return err
+	}
+	state, err := ParseState(raw)
+	if err != nil {
+		return err
+	}
+
+	loaderIds := make([]string, 0, len(state))
+	for loaderId := range state {
+		loaderIds = append(loaderIds, loaderId)
+	}
+	sort.Strings(loaderIds)
+
+	for _, loaderId := range loaderIds {
+		slog.Info("Replaying recorded services", "loader", loaderId, "count", len(state[loaderId]), "file", config.FilePath)
+		if err := aggregator.UpdateServices(loaderId, state[loaderId]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package replay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/moonkev/flexds/internal/common/types"
+	"github.com/moonkev/flexds/internal/discovery"
+	"github.com/moonkev/flexds/internal/xds"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestAggregator() (*discovery.DiscoveredServiceAggregator, cachev3.SnapshotCache) {
+	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
+	snapshots := xds.NewSnapshotManager(xds.Config{Cache: cache, ListenerPorts: []uint32{18080}})
+	return discovery.NewDiscoveredServiceAggregator(snapshots), cache
+}
+
+func TestLoadStateRebuildsRecordedSnapshot(t *testing.T) {
+	live, liveCache := newTestAggregator()
+	if err := live.UpdateServices("consul", []*types.DiscoveredService{{
+		Name:        "orders",
+		Instances:   []types.ServiceInstance{{Address: "10.0.0.1", Port: 8080, Weight: 3}, {Address: "10.0.0.2", Port: 8080}},
+		Routes:      []types.RoutePattern{{Name: "orders", PathPrefix: "/orders", Hosts: []string{"api.example.com"}}},
+		EnableHTTP2: true,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := live.UpdateServices("yaml", []*types.DiscoveredService{{
+		Name:      "users",
+		Instances: []types.ServiceInstance{{Address: "10.0.1.1", Port: 9090}},
+		Routes:    []types.RoutePattern{{Name: "users", PathPrefix: "/users", Hosts: []string{"*"}}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	discovery.NewRawServicesHandler(live).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/services/raw", nil))
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(statePath, rec.Body.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, replayedCache := newTestAggregator()
+	if err := LoadState(Config{FilePath: statePath}, replayed); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+
+	want, err := liveCache.GetSnapshot(xds.ReferenceNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := replayedCache.GetSnapshot(xds.ReferenceNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typeURL := range []string{resource.ClusterType, resource.RouteType, resource.ListenerType} {
+		wantResources, gotResources := want.GetResources(typeURL), got.GetResources(typeURL)
+		if len(gotResources) != len(wantResources) {
+			t.Errorf("%s: replayed %d resources, want %d", typeURL, len(gotResources), len(wantResources))
+		}
+		for name, res := range wantResources {
+			if !proto.Equal(gotResources[name], res) {
+				t.Errorf("%s %s: replayed %v, want %v", typeURL, name, gotResources[name], res)
+			}
+		}
+	}
+}
+
+func TestParseStateRejectsInvalidJson(t *testing.T) {
+	if _, err := ParseState([]byte(`[{"Name": "orders"}]`)); err == nil {
+		t.Error("ParseState accepted a service list without loader ids")
+	}
+}
@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// serviceSummary is the JSON view of a discovered service served by ServicesHandler
+type serviceSummary struct {
+	Name      string `json:"name"`
+	Instances int    `json:"instances"`
+	Routes    int    `json:"routes"`
+	HTTP2     bool   `json:"http2"`
+	TLS       bool   `json:"tls"`
+	Draining  bool   `json:"draining,omitempty"`
+	// Loaders are the ids of the loaders that reported the service, more than one when it was merged
+	Loaders []string `json:"loaders"`
+}
+
+// ServicesHandler serves the services of every loader as JSON, merged as they are pushed to the snapshot
+type ServicesHandler struct {
+	aggregator *DiscoveredServiceAggregator
+}
+
+func NewServicesHandler(aggregator *DiscoveredServiceAggregator) *ServicesHandler {
+	return &ServicesHandler{aggregator: aggregator}
+}
+
+func (h *ServicesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	byLoader := h.aggregator.Snapshot()
+	sources := make(map[string][]string)
+	for _, loaderId := range slices.Sorted(maps.Keys(byLoader)) {
+		for _, svc := range byLoader[loaderId] {
+			sources[svc.Name] = append(sources[svc.Name], loaderId)
+		}
+	}
+
+	merged := mergeServices(byLoader)
+	summaries := make([]serviceSummary, 0, len(merged))
+	for _, svc := range merged {
+		summaries = append(summaries, serviceSummary{
+			Name:      svc.Name,
+			Instances: len(svc.Instances),
+			Routes:    len(svc.Routes),
+			HTTP2:     svc.EnableHTTP2,
+			TLS:       svc.EnableTLS,
+			Draining:  svc.Draining,
+			Loaders:   slices.Compact(sources[svc.Name]),
+		})
+	}
+	slices.SortFunc(summaries, func(a, b serviceSummary) int { return strings.Compare(a.Name, b.Name) })
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summaries); err != nil {
+		slog.Debug("Failed to write services", "error", err)
+	}
+}
+
+// RawServicesHandler serves the complete services reported by each loader as JSON, keyed by loader id.
+// The output can be replayed with the replay loader to rebuild the same snapshot offline.
+type RawServicesHandler struct {
+	aggregator *DiscoveredServiceAggregator
+}
+
+func NewRawServicesHandler(aggregator *DiscoveredServiceAggregator) *RawServicesHandler {
+	return &RawServicesHandler{aggregator: aggregator}
+}
+
+func (h *RawServicesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(h.aggregator.Snapshot()); err != nil {
+		slog.Debug("Failed to write raw services", "error", err)
+	}
+}
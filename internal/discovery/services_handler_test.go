@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/moonkev/flexds/internal/common/types"
+)
+
+func TestServicesHandlerListsMergedInventory(t *testing.T) {
+	agg := newTestAggregator()
+	if err := agg.UpdateServices("consul", []*types.DiscoveredService{
+		testService("orders", "10.0.0.1", "10.0.0.2"),
+		testService("users", "10.0.1.1"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agg.UpdateServices("yaml", []*types.DiscoveredService{testService("orders", "10.0.2.1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewServicesHandler(agg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/services", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var summaries []serviceSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body, err)
+	}
+	want := []serviceSummary{
+		{Name: "orders", Instances: 3, Routes: 2, Loaders: []string{"consul", "yaml"}},
+		{Name: "users", Instances: 1, Routes: 1, Loaders: []string{"consul"}},
+	}
+	if !slices.EqualFunc(summaries, want, func(a, b serviceSummary) bool {
+		return a.Name == b.Name && a.Instances == b.Instances && a.Routes == b.Routes && slices.Equal(a.Loaders, b.Loaders)
+	}) {
+		t.Errorf("got %+v, want %+v", summaries, want)
+	}
+}
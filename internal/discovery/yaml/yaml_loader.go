@@ -1,11 +1,15 @@
 package yaml
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
+	"strings"
 
 	"github.com/moonkev/flexds/internal/common/config"
+	"github.com/moonkev/flexds/internal/common/telemetry"
 	"github.com/moonkev/flexds/internal/common/types"
 	"github.com/moonkev/flexds/internal/discovery"
 	"go.yaml.in/yaml/v2"
@@ -15,28 +19,162 @@ type Config struct {
 	ConfigPath string
 }
 
+// Loader adapts the YAML file loader to the discovery.Loader interface
+type Loader struct {
+	cfg    Config
+	reload discovery.ReloadSignal
+}
+
+func NewLoader(cfg Config) *Loader {
+	return &Loader{cfg: cfg, reload: discovery.NewReloadSignal()}
+}
+
+func (l *Loader) Name() string {
+	return "yaml"
+}
+
+// Start loads the YAML file, then reloads it on every Reload until the context is cancelled.
+// A failed reload keeps the services from the last good load.
+func (l *Loader) Start(ctx context.Context, aggregator *discovery.DiscoveredServiceAggregator) error {
+	if err := LoadConfig(l.cfg, aggregator); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-l.reload:
+			slog.Info("Reloading YAML config", "path", l.cfg.ConfigPath)
+			if err := LoadConfig(l.cfg, aggregator); err != nil {
+				slog.Error("failed to reload YAML config, keeping the previous services", "path", l.cfg.ConfigPath, "error", err)
+			}
+		}
+	}
+}
+
+// Reload re-reads the YAML file
+func (l *Loader) Reload() {
+	l.reload.Reload()
+}
+
 type Route struct {
-	MatchType        string `yaml:"match_type"`
-	PathPrefix       string `yaml:"path_prefix"`
-	PrefixRewrite    string `yaml:"prefix_rewrite"`
-	RegexRewrite     string `yaml:"regex_rewrite"`
-	RegexReplacement string `yaml:"regex_replacement"`
-	HeaderName       string `yaml:"header_name"`
-	HeaderValue      string `yaml:"header_value"`
-	Http2            bool   `yaml:"http2"`
-	Tls              bool   `yaml:"tls"`
+	Action           string   `yaml:"action"`
+	MatchType        string   `yaml:"match_type"`
+	PathPrefix       string   `yaml:"path_prefix"`
+	PathRegex        string   `yaml:"path_regex"`
+	PrefixRewrite    string   `yaml:"prefix_rewrite"`
+	RegexRewrite     string   `yaml:"regex_rewrite"`
+	RegexReplacement string   `yaml:"regex_replacement"`
+	HostRewrite      string   `yaml:"host_rewrite"`
+	AutoHostRewrite  bool     `yaml:"auto_host_rewrite"`
+	HeaderName       string   `yaml:"header_name"`
+	HeaderValue      string   `yaml:"header_value"`
+	HeaderMatchType  string   `yaml:"header_match_type"`
+	Hosts            []string `yaml:"hosts"`
+	HashHeader       string   `yaml:"hash_header"`
+	Clusters         []struct {
+		Name   string `yaml:"name"`
+		Weight uint32 `yaml:"weight"`
+	} `yaml:"clusters"`
+	TotalWeight   uint32          `yaml:"total_weight"`
+	ClusterHeader string          `yaml:"cluster_header"`
+	MirrorCluster string          `yaml:"mirror_cluster"`
+	MirrorPercent uint32          `yaml:"mirror_percent"`
+	Timeout       config.Duration `yaml:"timeout"`
+	IdleTimeout   config.Duration `yaml:"idle_timeout"`
+
+	MaxStreamDuration    config.Duration `yaml:"max_stream_duration"`
+	GrpcTimeoutHeaderMax config.Duration `yaml:"grpc_timeout_header_max"`
+
+	UnauthorizedRedirect string `yaml:"unauthorized_redirect"`
+
+	RedirectScheme string `yaml:"redirect_scheme"`
+	RedirectHost   string `yaml:"redirect_host"`
+	RedirectPort   uint32 `yaml:"redirect_port"`
+	RedirectPath   string `yaml:"redirect_path"`
+	RedirectCode   uint32 `yaml:"redirect_code"`
+
+	DirectResponseStatus uint32 `yaml:"direct_response_status"`
+	DirectResponseBody   string `yaml:"direct_response_body"`
+
+	Cors *Cors `yaml:"cors"`
+
+	RetryOn          string          `yaml:"retry_on"`
+	NumRetries       uint32          `yaml:"num_retries"`
+	PerTryTimeout    config.Duration `yaml:"per_try_timeout"`
+	RetryBackOffBase config.Duration `yaml:"retry_backoff_base"`
+	RetryBackOffMax  config.Duration `yaml:"retry_backoff_max"`
+	Http2            bool            `yaml:"http2"`
+	Tls              bool            `yaml:"tls"`
+}
+
+type Cors struct {
+	AllowOrigins       []string `yaml:"allow_origins"`
+	AllowOriginRegexes []string `yaml:"allow_origin_regexes"`
+	AllowMethods       string   `yaml:"allow_methods"`
+	AllowHeaders       string   `yaml:"allow_headers"`
+	ExposeHeaders      string   `yaml:"expose_headers"`
+	MaxAge             string   `yaml:"max_age"`
+	AllowCredentials   bool     `yaml:"allow_credentials"`
 }
 
 type Service struct {
 	Name      string `yaml:"name"`
 	Instances []struct {
-		Host string `yaml:"host"`
-		Port int    `yaml:"port"`
+		Host            string `yaml:"host"`
+		Port            int    `yaml:"port"`
+		Weight          uint32 `yaml:"weight"`
+		Region          string `yaml:"region"`
+		Zone            string `yaml:"zone"`
+		Priority        uint32 `yaml:"priority"`
+		HealthCheckPort uint32 `yaml:"health_check_port"`
 	} `yaml:"instances"`
-	Routes         []Route         `yaml:"routes"`
-	Http2          bool            `yaml:"http2"`
-	Tls            bool            `yaml:"tls"`
-	DnsRefreshRate config.Duration `yaml:"dns_refresh_rate"`
+	Routes             []Route         `yaml:"routes"`
+	Protocol           string          `yaml:"protocol"`
+	Http2              bool            `yaml:"http2"`
+	GrpcWeb            bool            `yaml:"grpc_web"`
+	GrpcJsonDescriptor string          `yaml:"grpc_json_descriptor"`
+	GrpcJsonServices   []string        `yaml:"grpc_json_services"`
+	JwtIssuer          string          `yaml:"jwt_issuer"`
+	JwtAudiences       []string        `yaml:"jwt_audiences"`
+	JwtJwksUri         string          `yaml:"jwt_jwks_uri"`
+	JwtLocalJwks       string          `yaml:"jwt_local_jwks"`
+	Tls                bool            `yaml:"tls"`
+	TlsCaFile          string          `yaml:"tls_ca_file"`
+	TlsCaPem           string          `yaml:"tls_ca_pem"`
+	TlsSubjectAltNames []string        `yaml:"tls_subject_alt_names"`
+	TlsInsecure        bool            `yaml:"tls_insecure"`
+	TlsSni             string          `yaml:"tls_sni"`
+	TlsClientCertFile  string          `yaml:"tls_client_cert_file"`
+	TlsClientKeyFile   string          `yaml:"tls_client_key_file"`
+	DnsRefreshRate     config.Duration `yaml:"dns_refresh_rate"`
+	DnsLookupFamily    string          `yaml:"dns_lookup_family"`
+	ConnectTimeout     config.Duration `yaml:"connect_timeout"`
+	Drain              bool            `yaml:"drain"`
+	NodeIds            []string        `yaml:"node_ids"`
+	ListenerPorts      []uint32        `yaml:"listener_ports"`
+	RouteScope         string          `yaml:"route_scope"`
+	LbPolicy           string          `yaml:"lb_policy"`
+
+	HealthyPanicThreshold *float64 `yaml:"healthy_panic_threshold"`
+
+	IgnoreEndpointWeights        bool `yaml:"ignore_endpoint_weights"`
+	AllAddressesInSingleEndpoint bool `yaml:"all_addresses_in_single_endpoint"`
+
+	HealthCheck                   bool            `yaml:"health_check"`
+	HealthCheckPath               string          `yaml:"health_check_path"`
+	HealthCheckInterval           config.Duration `yaml:"health_check_interval"`
+	HealthCheckTimeout            config.Duration `yaml:"health_check_timeout"`
+	HealthCheckUnhealthyThreshold uint32          `yaml:"health_check_unhealthy_threshold"`
+
+	OutlierConsecutive5xx     uint32          `yaml:"outlier_consecutive_5xx"`
+	OutlierInterval           config.Duration `yaml:"outlier_interval"`
+	OutlierBaseEjectionTime   config.Duration `yaml:"outlier_base_ejection_time"`
+	OutlierMaxEjectionPercent uint32          `yaml:"outlier_max_ejection_percent"`
+
+	TcpKeepaliveProbes   uint32          `yaml:"tcp_keepalive_probes"`
+	TcpKeepaliveTime     config.Duration `yaml:"tcp_keepalive_time"`
+	TcpKeepaliveInterval config.Duration `yaml:"tcp_keepalive_interval"`
 }
 
 func parseRoutes(service *Service) []types.RoutePattern {
@@ -46,14 +184,71 @@ func parseRoutes(service *Service) []types.RoutePattern {
 		slog.Debug("parsing route", "loader", "yaml", "service", service.Name, "route_num", routeNum)
 		rp := types.RoutePattern{
 			Name:             fmt.Sprintf("%s-route-%d", service.Name, routeNum),
+			Action:           route.Action,
 			MatchType:        route.MatchType,
 			PathPrefix:       route.PathPrefix,
+			PathRegex:        route.PathRegex,
 			PrefixRewrite:    route.PrefixRewrite,
 			RegexRewrite:     route.RegexRewrite,
 			RegexReplacement: route.RegexReplacement,
+			HostRewrite:      route.HostRewrite,
+			AutoHostRewrite:  route.AutoHostRewrite,
 			HeaderName:       route.HeaderName,
 			HeaderValue:      route.HeaderValue,
-			Hosts:            []string{"*"},
+			HeaderMatchType:  route.HeaderMatchType,
+			HashHeader:       route.HashHeader,
+			TotalWeight:      route.TotalWeight,
+			ClusterHeader:    route.ClusterHeader,
+			MirrorCluster:    route.MirrorCluster,
+			MirrorPercent:    route.MirrorPercent,
+			Timeout:          route.Timeout.ToDuration(),
+			IdleTimeout:      route.IdleTimeout.ToDuration(),
+
+			MaxStreamDuration:    route.MaxStreamDuration.ToDuration(),
+			GrpcTimeoutHeaderMax: route.GrpcTimeoutHeaderMax.ToDuration(),
+			UnauthorizedRedirect: route.UnauthorizedRedirect,
+			Hosts:                []string{"*"},
+		}
+		if len(route.Hosts) > 0 {
+			rp.Hosts = route.Hosts
+		}
+		for _, wc := range route.Clusters {
+			rp.WeightedClusters = append(rp.WeightedClusters, types.WeightedCluster{Name: wc.Name, Weight: wc.Weight})
+		}
+		if route.Action == "redirect" {
+			rp.Redirect = &types.RedirectAction{
+				Scheme:       route.RedirectScheme,
+				Host:         route.RedirectHost,
+				Port:         route.RedirectPort,
+				Path:         route.RedirectPath,
+				ResponseCode: route.RedirectCode,
+			}
+		}
+		if route.Action == "direct_response" {
+			rp.DirectResponse = &types.DirectResponse{
+				Status: route.DirectResponseStatus,
+				Body:   route.DirectResponseBody,
+			}
+		}
+		if route.Cors != nil {
+			rp.Cors = &types.CorsPolicy{
+				AllowOrigins:       route.Cors.AllowOrigins,
+				AllowOriginRegexes: route.Cors.AllowOriginRegexes,
+				AllowMethods:       route.Cors.AllowMethods,
+				AllowHeaders:       route.Cors.AllowHeaders,
+				ExposeHeaders:      route.Cors.ExposeHeaders,
+				MaxAge:             route.Cors.MaxAge,
+				AllowCredentials:   route.Cors.AllowCredentials,
+			}
+		}
+		if route.RetryOn != "" {
+			rp.Retry = &types.RetryPolicy{
+				RetryOn:       route.RetryOn,
+				NumRetries:    route.NumRetries,
+				PerTryTimeout: route.PerTryTimeout.ToDuration(),
+				BackOffBase:   route.RetryBackOffBase.ToDuration(),
+				BackOffMax:    route.RetryBackOffMax.ToDuration(),
+			}
 		}
 
 		routes = append(routes, rp)
@@ -65,46 +260,161 @@ func LoadConfig(config Config, aggregator *discovery.DiscoveredServiceAggregator
 
 	rawYaml, err := os.ReadFile(config.ConfigPath)
 	if err != nil {
+		telemetry.MetricDiscoveryErrors.WithLabelValues("yaml_loader").Inc()
+		return err
+	}
+
+	discoveredServices, err := ParseServices(rawYaml)
+	if err != nil {
+		telemetry.MetricDiscoveryErrors.WithLabelValues("yaml_loader").Inc()
 		return err
 	}
+	slog.Info("Loaded services from YAML config",
+		"count", len(discoveredServices))
+	for i, ds := range discoveredServices {
+		slog.Info("Discovered service",
+			"index", i,
+			"name", ds.Name,
+			"instances", ds.Instances,
+			"routes", ds.Routes,
+			"http2", ds.EnableHTTP2)
+	}
+	return aggregator.UpdateServices("yaml_loader", discoveredServices)
+}
+
+// ParseServices converts a YAML list of service definitions to discovered services
+func ParseServices(rawYaml []byte) ([]*types.DiscoveredService, error) {
 
 	var services []Service
 	var discoveredServices []*types.DiscoveredService
 
-	err = yaml.Unmarshal(rawYaml, &services)
+	err := yaml.Unmarshal(rawYaml, &services)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, svc := range services {
 		instances := make([]types.ServiceInstance, 0)
 		for _, inst := range svc.Instances {
 			instances = append(instances, types.ServiceInstance{
-				Address: inst.Host,
-				Port:    inst.Port,
+				Address:         inst.Host,
+				Port:            inst.Port,
+				Weight:          inst.Weight,
+				Region:          inst.Region,
+				Zone:            inst.Zone,
+				Priority:        inst.Priority,
+				HealthCheckPort: inst.HealthCheckPort,
 			})
 		}
 
 		routes := parseRoutes(&svc)
 
+		var protocol string
+		switch strings.ToLower(svc.Protocol) {
+		case "", "http":
+		case types.ProtocolTCP:
+			protocol = types.ProtocolTCP
+		default:
+			slog.Warn("Invalid protocol, must be http or tcp", "service", svc.Name, "value", svc.Protocol, telemetry.InvalidConfigKey, "setting")
+		}
+
+		// Metadata rejects non-positive durations when parsing them, YAML durations are checked here
+		connectTimeout := svc.ConnectTimeout.ToDuration()
+		if connectTimeout < 0 {
+			slog.Warn("Invalid connect_timeout, must be positive, using the default", "service", svc.Name, "value", connectTimeout, telemetry.InvalidConfigKey, "setting")
+			connectTimeout = 0
+		}
+
+		panicThreshold := svc.HealthyPanicThreshold
+		if panicThreshold != nil && (math.IsNaN(*panicThreshold) || *panicThreshold < 0 || *panicThreshold > 100) {
+			slog.Warn("Invalid healthy_panic_threshold, must be between 0 and 100, using Envoy's default", "service", svc.Name, "value", *panicThreshold, telemetry.InvalidConfigKey, "setting")
+			panicThreshold = nil
+		}
+
+		var healthCheck *types.HealthCheck
+		if svc.HealthCheck {
+			healthCheck = &types.HealthCheck{
+				Path:               svc.HealthCheckPath,
+				Interval:           svc.HealthCheckInterval.ToDuration(),
+				Timeout:            svc.HealthCheckTimeout.ToDuration(),
+				UnhealthyThreshold: svc.HealthCheckUnhealthyThreshold,
+			}
+		}
+
+		var outlier *types.OutlierDetection
+		od := types.OutlierDetection{
+			Consecutive5xx:     svc.OutlierConsecutive5xx,
+			Interval:           svc.OutlierInterval.ToDuration(),
+			BaseEjectionTime:   svc.OutlierBaseEjectionTime.ToDuration(),
+			MaxEjectionPercent: svc.OutlierMaxEjectionPercent,
+		}
+		if od != (types.OutlierDetection{}) {
+			outlier = &od
+		}
+
+		var tcpKeepalive *types.TcpKeepalive
+		ka := types.TcpKeepalive{
+			Probes:   svc.TcpKeepaliveProbes,
+			Time:     svc.TcpKeepaliveTime.ToDuration(),
+			Interval: svc.TcpKeepaliveInterval.ToDuration(),
+		}
+		if ka != (types.TcpKeepalive{}) {
+			tcpKeepalive = &ka
+		}
+
+		var grpcJson *types.GrpcJsonTranscoder
+		if svc.GrpcJsonDescriptor != "" {
+			grpcJson = &types.GrpcJsonTranscoder{
+				DescriptorFile: svc.GrpcJsonDescriptor,
+				Services:       svc.GrpcJsonServices,
+			}
+		}
+
+		var jwt *types.JwtProvider
+		if svc.JwtJwksUri != "" || svc.JwtLocalJwks != "" {
+			jwt = &types.JwtProvider{
+				Issuer:    svc.JwtIssuer,
+				Audiences: svc.JwtAudiences,
+				JwksUri:   svc.JwtJwksUri,
+				LocalJwks: svc.JwtLocalJwks,
+			}
+		}
+
 		discoveredServices = append(discoveredServices, &types.DiscoveredService{
-			Name:           svc.Name,
-			Instances:      instances,
-			Routes:         routes,
-			EnableHTTP2:    svc.Http2,
-			EnableTLS:      svc.Tls,
-			DnsRefreshRate: svc.DnsRefreshRate.ToDuration(),
+			Name:            svc.Name,
+			Protocol:        protocol,
+			Instances:       instances,
+			Routes:          routes,
+			EnableHTTP2:     svc.Http2 || svc.GrpcWeb || grpcJson != nil,
+			EnableTLS:       svc.Tls,
+			GrpcWeb:         svc.GrpcWeb,
+			GrpcJson:        grpcJson,
+			Jwt:             jwt,
+			DnsRefreshRate:  svc.DnsRefreshRate.ToDuration(),
+			DnsLookupFamily: svc.DnsLookupFamily,
+			ConnectTimeout:  connectTimeout,
+			Draining:        svc.Drain,
+			NodeIds:         svc.NodeIds,
+			ListenerPorts:   svc.ListenerPorts,
+			RouteScope:      svc.RouteScope,
+			HealthCheck:     healthCheck,
+			LbPolicy:        svc.LbPolicy,
+			Outlier:         outlier,
+			TcpKeepalive:    tcpKeepalive,
+
+			HealthyPanicThreshold: panicThreshold,
+
+			TlsCaFile:          svc.TlsCaFile,
+			TlsCaPem:           svc.TlsCaPem,
+			TlsSubjectAltNames: svc.TlsSubjectAltNames,
+			TlsInsecure:        svc.TlsInsecure,
+			Sni:                svc.TlsSni,
+			TlsClientCertFile:  svc.TlsClientCertFile,
+			TlsClientKeyFile:   svc.TlsClientKeyFile,
+
+			IgnoreEndpointWeights:        svc.IgnoreEndpointWeights,
+			AllAddressesInSingleEndpoint: svc.AllAddressesInSingleEndpoint,
 		})
 	}
-	slog.Info("Loaded services from YAML config",
-		"count", len(discoveredServices))
-	for i, ds := range discoveredServices {
-		slog.Info("Discovered service",
-			"index", i,
-			"name", ds.Name,
-			"instances", ds.Instances,
-			"routes", ds.Routes,
-			"http2", ds.EnableHTTP2)
-	}
-	return aggregator.UpdateServices("yaml_loader", discoveredServices)
+	return discoveredServices, nil
 }
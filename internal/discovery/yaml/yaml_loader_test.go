@@ -0,0 +1,35 @@
+package yaml
+
+import "testing"
+
+func TestHealthyPanicThresholdRange(t *testing.T) {
+	zero, quarter := 0.0, 25.0
+	tests := []struct {
+		value string
+		want  *float64
+	}{
+		{value: "0", want: &zero},
+		{value: "25", want: &quarter},
+		{value: "101"},
+		{value: "-5"},
+		{value: ".nan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			services, err := ParseServices([]byte(`
+- name: orders
+  healthy_panic_threshold: ` + tt.value + `
+  instances:
+    - host: 10.0.0.1
+      port: 8080
+`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := services[0].HealthyPanicThreshold
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("healthy_panic_threshold %s parsed as %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package xds
+
+import (
+	"fmt"
+	"strings"
+
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	filelog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	grpclog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	streamlog "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/stream/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// AccessLogOptions configures the access logs written by every HTTP listener. Access logging is disabled
+// when both Path and GrpcCluster are empty.
+type AccessLogOptions struct {
+	Path        string // "stdout", "stderr", or a file path on the Envoy host
+	Format      string // Envoy format string of Path's entries, Envoy's default format when empty
+	GrpcCluster string // Envoy cluster of a gRPC access log service, typically defined in the bootstrap
+}
+
+// buildAccessLogs returns the HCM access loggers, none when access logging is disabled
+func buildAccessLogs(opts AccessLogOptions) ([]*accesslog.AccessLog, error) {
+	var logs []*accesslog.AccessLog
+
+	if opts.Path != "" {
+		var logFormat *core.SubstitutionFormatString
+		if opts.Format != "" {
+			// Envoy writes text entries as is, so each needs its own trailing newline
+			format := opts.Format
+			if !strings.HasSuffix(format, "\n") {
+				format += "\n"
+			}
+			logFormat = &core.SubstitutionFormatString{
+				Format: &core.SubstitutionFormatString_TextFormatSource{
+					TextFormatSource: &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: format}},
+				},
+			}
+		}
+
+		var name string
+		var config proto.Message
+		switch opts.Path {
+		case "stdout":
+			name = "envoy.access_loggers.stdout"
+			stdout := &streamlog.StdoutAccessLog{}
+			if logFormat != nil {
+				stdout.AccessLogFormat = &streamlog.StdoutAccessLog_LogFormat{LogFormat: logFormat}
+			}
+			config = stdout
+		case "stderr":
+			name = "envoy.access_loggers.stderr"
+			stderr := &streamlog.StderrAccessLog{}
+			if logFormat != nil {
+				stderr.AccessLogFormat = &streamlog.StderrAccessLog_LogFormat{LogFormat: logFormat}
+			}
+			config = stderr
+		default:
+			name = "envoy.access_loggers.file"
+			file := &filelog.FileAccessLog{Path: opts.Path}
+			if logFormat != nil {
+				file.AccessLogFormat = &filelog.FileAccessLog_LogFormat{LogFormat: logFormat}
+			}
+			config = file
+		}
+		configAny, err := anypb.New(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal access log: %w", err)
+		}
+		logs = append(logs, &accesslog.AccessLog{
+			Name:       name,
+			ConfigType: &accesslog.AccessLog_TypedConfig{TypedConfig: configAny},
+		})
+	}
+
+	if opts.GrpcCluster != "" {
+		grpcAny, err := anypb.New(&grpclog.HttpGrpcAccessLogConfig{
+			CommonConfig: &grpclog.CommonGrpcAccessLogConfig{
+				LogName: "flexds",
+				GrpcService: &core.GrpcService{
+					TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: opts.GrpcCluster},
+					},
+				},
+				TransportApiVersion: core.ApiVersion_V3,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal gRPC access log: %w", err)
+		}
+		logs = append(logs, &accesslog.AccessLog{
+			Name:       "envoy.access_loggers.http_grpc",
+			ConfigType: &accesslog.AccessLog_TypedConfig{TypedConfig: grpcAny},
+		})
+	}
+
+	return logs, nil
+}
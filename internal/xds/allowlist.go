@@ -0,0 +1,63 @@
+package xds
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NodeAllowlist restricts which Envoy node ids may fetch configuration. It is loaded from a
+// file with one node id per line, blank lines and lines starting with # are ignored.
+type NodeAllowlist struct {
+	path string
+
+	mu      sync.RWMutex
+	nodeIDs map[string]bool
+}
+
+// NewNodeAllowlist loads the allowlist from path
+func NewNodeAllowlist(path string) (*NodeAllowlist, error) {
+	a := &NodeAllowlist{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the allowlist file, keeping the current allowlist if it can't be read
+func (a *NodeAllowlist) Reload() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("failed to read node allowlist %s: %w", a.path, err)
+	}
+
+	nodeIDs := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		nodeIDs[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse node allowlist %s: %w", a.path, err)
+	}
+
+	a.mu.Lock()
+	a.nodeIDs = nodeIDs
+	a.mu.Unlock()
+	slog.Info("Loaded node allowlist", "path", a.path, "nodes", len(nodeIDs))
+	return nil
+}
+
+// Allowed reports whether nodeID may receive configuration
+func (a *NodeAllowlist) Allowed(nodeID string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.nodeIDs[nodeID]
+}
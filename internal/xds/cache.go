@@ -0,0 +1,135 @@
+package xds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/log"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+// CacheLogger routes the logging of go-control-plane's caches through slog, so the log level controls it too.
+// The caches log every watch they open at info, which is logged at debug.
+var CacheLogger = log.LoggerFuncs{
+	DebugFunc: func(format string, args ...any) { slog.Debug(fmt.Sprintf(format, args...)) },
+	InfoFunc:  func(format string, args ...any) { slog.Debug(fmt.Sprintf(format, args...)) },
+	WarnFunc:  func(format string, args ...any) { slog.Warn(fmt.Sprintf(format, args...)) },
+	ErrorFunc: func(format string, args ...any) { slog.Error(fmt.Sprintf(format, args...)) },
+}
+
+// SnapshotCache is the cache the snapshot manager publishes to and the xDS server serves from.
+// It is satisfied by go-control-plane's snapshot cache and by LinearSnapshotCache.
+type SnapshotCache interface {
+	cachev3.Cache
+	SetSnapshot(ctx context.Context, node string, snapshot cachev3.ResourceSnapshot) error
+	GetSnapshot(node string) (cachev3.ResourceSnapshot, error)
+	GetStatusKeys() []string
+}
+
+// linearCacheTypes lists the resource types served by LinearSnapshotCache in the order they are updated,
+// clusters and endpoints before the listeners and routes referencing them
+var linearCacheTypes = []resource.Type{
+	resource.ClusterType,
+	resource.EndpointType,
+	resource.ListenerType,
+	resource.RouteType,
+	resource.ScopedRouteType,
+}
+
+// LinearSnapshotCache serves each resource type from its own linear cache, which only sends the
+// resources that changed instead of the whole snapshot. All nodes share the reference snapshot,
+// so per-node service selectors are not supported with this cache.
+type LinearSnapshotCache struct {
+	cachev3.MuxCache
+	linearCaches map[resource.Type]*cachev3.LinearCache
+
+	mu       sync.RWMutex
+	snapshot cachev3.ResourceSnapshot
+}
+
+func NewLinearSnapshotCache() *LinearSnapshotCache {
+	c := &LinearSnapshotCache{linearCaches: make(map[resource.Type]*cachev3.LinearCache)}
+	caches := make(map[string]cachev3.Cache, len(linearCacheTypes))
+	for _, typeURL := range linearCacheTypes {
+		linearCache := cachev3.NewLinearCache(typeURL, cachev3.WithLogger(CacheLogger))
+		c.linearCaches[typeURL] = linearCache
+		caches[typeURL] = linearCache
+	}
+	c.MuxCache = cachev3.MuxCache{
+		Classify:      func(req *cachev3.Request) string { return req.GetTypeUrl() },
+		ClassifyDelta: func(req *cachev3.DeltaRequest) string { return req.GetTypeUrl() },
+		Caches:        caches,
+	}
+	return c
+}
+
+// SetSnapshot replaces the resources of every linear cache with those of the reference snapshot.
+// Snapshots for individual nodes are ignored since every node is served the same resources.
+func (c *LinearSnapshotCache) SetSnapshot(_ context.Context, node string, snapshot cachev3.ResourceSnapshot) error {
+	if node != ReferenceNodeID {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, typeURL := range linearCacheTypes {
+		c.linearCaches[typeURL].SetResources(snapshot.GetResources(typeURL))
+	}
+	c.snapshot = snapshot
+	return nil
+}
+
+// GetSnapshot returns the last reference snapshot, which is what every node is served
+func (c *LinearSnapshotCache) GetSnapshot(_ string) (cachev3.ResourceSnapshot, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.snapshot == nil {
+		return nil, errors.New("no snapshot set")
+	}
+	return c.snapshot, nil
+}
+
+// GetStatusKeys returns no node ids since the linear caches don't track per-node state
+func (c *LinearSnapshotCache) GetStatusKeys() []string {
+	return nil
+}
+
+// hashedResourceTypes are the resource types included in resourcesHash
+var hashedResourceTypes = []resource.Type{
+	resource.ClusterType,
+	resource.EndpointType,
+	resource.ListenerType,
+	resource.RouteType,
+	resource.ScopedRouteType,
+}
+
+// resourcesHash returns a stable hash of a snapshot's resources, ignoring its version
+func resourcesHash(snap *cachev3.Snapshot) (string, error) {
+	h := sha256.New()
+	marshal := proto.MarshalOptions{Deterministic: true}
+	for _, typeURL := range hashedResourceTypes {
+		resources := snap.GetResources(typeURL)
+		names := slices.Sorted(maps.Keys(resources))
+		_, _ = fmt.Fprintf(h, "%s:%d\n", typeURL, len(names))
+		for _, name := range names {
+			data, err := marshal.Marshal(resources[name])
+			if err != nil {
+				return "", fmt.Errorf("failed to hash resource %s: %w", name, err)
+			}
+			_, _ = fmt.Fprintf(h, "%s:%d\n", name, len(data))
+			h.Write(data)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
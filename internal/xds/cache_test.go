@@ -0,0 +1,64 @@
+package xds
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+)
+
+func TestSnapshotManagerCacheBackends(t *testing.T) {
+	backends := map[string]SnapshotCache{
+		"snapshot": cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil),
+		"linear":   NewLinearSnapshotCache(),
+	}
+	for name, cache := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := newTestManager(Config{Cache: cache})
+
+			s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders")})
+			connectNode(t, s, "edge-1")
+			assertClusters(t, cache, "edge-1", "orders")
+
+			s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders"), testService("billing")})
+			assertClusters(t, cache, "edge-1", "billing", "orders")
+		})
+	}
+}
+
+// connectNode does what the ADS server does when an Envoy opens a CDS stream: it ensures the node has
+// a snapshot and opens a wildcard watch on the cache, which registers the node for later pushes
+func connectNode(t *testing.T, s *SnapshotManager, nodeID string) {
+	t.Helper()
+	node := &core.Node{Id: nodeID}
+	if err := s.EnsureNodeSnapshot(node); err != nil {
+		t.Fatalf("EnsureNodeSnapshot(%s): %v", nodeID, err)
+	}
+	request := &cachev3.Request{Node: node, TypeUrl: resource.ClusterType}
+	cancel, err := s.cache.CreateWatch(request, stream.NewSotwSubscription(nil, true), make(chan cachev3.Response, 1))
+	if err != nil {
+		t.Fatalf("CreateWatch(%s): %v", nodeID, err)
+	}
+	t.Cleanup(cancel)
+}
+
+// assertClusters checks the snapshot the cache serves a node holds exactly the named clusters
+func assertClusters(t *testing.T, cache SnapshotCache, nodeID string, names ...string) {
+	t.Helper()
+	snap, err := cache.GetSnapshot(nodeID)
+	if err != nil {
+		t.Fatalf("GetSnapshot(%s): %v", nodeID, err)
+	}
+	clusters := snap.GetResources(resource.ClusterType)
+	if len(clusters) != len(names) {
+		t.Fatalf("node %s has %d clusters, want %v", nodeID, len(clusters), names)
+	}
+	for _, name := range names {
+		if _, ok := clusters[name]; !ok {
+			t.Errorf("node %s has no cluster %s", nodeID, name)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package xds
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	commondns "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/common/dns/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Health check defaults used when a service enables health checking without tuning it
+const (
+	defaultHealthCheckPath               = "/healthz"
+	defaultHealthCheckInterval           = 5 * time.Second
+	defaultHealthCheckTimeout            = 2 * time.Second
+	defaultHealthCheckUnhealthyThreshold = 3
+	defaultHealthCheckHealthyThreshold   = 1
+)
+
+// ServiceDefaults holds the fleet-wide settings of services that leave them unset
+type ServiceDefaults struct {
+	ConnectTimeout time.Duration // Upstream connect timeout, 2s when zero
+	DnsRefreshRate time.Duration // Fixed DNS refresh interval, record TTLs are honored when zero
+	LbPolicy       string        // Load balancing policy, round_robin when empty
+}
+
+// defaultConnectTimeout is the connect timeout of services when ServiceDefaults doesn't set one
+const defaultConnectTimeout = 2 * time.Second
+
+// connectTimeout returns the service's connect timeout, falling back to the fleet-wide default
+func (d ServiceDefaults) connectTimeout(svc *types2.DiscoveredService) time.Duration {
+	switch {
+	case svc.ConnectTimeout > 0:
+		return svc.ConnectTimeout
+	case d.ConnectTimeout > 0:
+		return d.ConnectTimeout
+	default:
+		return defaultConnectTimeout
+	}
+}
+
+// dnsRefreshRate returns the service's fixed DNS refresh interval, falling back to the fleet-wide default
+func (d ServiceDefaults) dnsRefreshRate(svc *types2.DiscoveredService) time.Duration {
+	if svc.DnsRefreshRate > 0 {
+		return svc.DnsRefreshRate
+	}
+	return d.DnsRefreshRate
+}
+
+// dnsLookupFamily maps a service's configured DNS lookup family to the DNS cluster enum, IPv4 only by default
+func dnsLookupFamily(svc *types2.DiscoveredService) commondns.DnsLookupFamily {
+	switch strings.ToLower(svc.DnsLookupFamily) {
+	case "", "v4", "v4_only":
+		return commondns.DnsLookupFamily_V4_ONLY
+	case "v6", "v6_only":
+		return commondns.DnsLookupFamily_V6_ONLY
+	case "auto":
+		return commondns.DnsLookupFamily_AUTO
+	case "v4_preferred":
+		return commondns.DnsLookupFamily_V4_PREFERRED
+	case "all":
+		return commondns.DnsLookupFamily_ALL
+	default:
+		slog.Warn("Invalid dns_lookup_family, using v4", "service", svc.Name, "dnsLookupFamily", svc.DnsLookupFamily, telemetry.InvalidConfigKey, "setting")
+		return commondns.DnsLookupFamily_V4_ONLY
+	}
+}
+
+// lbPolicy maps a service's configured load balancing policy to the cluster enum, falling back to the
+// fleet-wide default and then to round robin
+func (d ServiceDefaults) lbPolicy(svc *types2.DiscoveredService) cluster.Cluster_LbPolicy {
+	policy := svc.LbPolicy
+	if policy == "" {
+		policy = d.LbPolicy
+	}
+	switch strings.ToLower(policy) {
+	case "", "round_robin":
+		return cluster.Cluster_ROUND_ROBIN
+	case "least_request":
+		return cluster.Cluster_LEAST_REQUEST
+	case "ring_hash":
+		return cluster.Cluster_RING_HASH
+	case "maglev":
+		return cluster.Cluster_MAGLEV
+	case "random":
+		return cluster.Cluster_RANDOM
+	default:
+		slog.Warn("Invalid lb_policy, using round_robin", "service", svc.Name, "lbPolicy", policy, telemetry.InvalidConfigKey, "setting")
+		return cluster.Cluster_ROUND_ROBIN
+	}
+}
+
+// buildHealthCheck creates an active HTTP health check for the service, using HTTP/2 when the service does
+func buildHealthCheck(svc *types2.DiscoveredService) *core.HealthCheck {
+	hc := svc.HealthCheck
+
+	path := hc.Path
+	if path == "" {
+		path = defaultHealthCheckPath
+	}
+	interval := hc.Interval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	unhealthyThreshold := hc.UnhealthyThreshold
+	if unhealthyThreshold == 0 {
+		unhealthyThreshold = defaultHealthCheckUnhealthyThreshold
+	}
+
+	healthCheck := &core.HealthCheck{
+		Interval:           durationpb.New(interval),
+		Timeout:            durationpb.New(timeout),
+		UnhealthyThreshold: wrapperspb.UInt32(unhealthyThreshold),
+		HealthyThreshold:   wrapperspb.UInt32(defaultHealthCheckHealthyThreshold),
+	}
+
+	// TCP services are checked by connecting, with no payload exchanged
+	if svc.Protocol == types2.ProtocolTCP {
+		healthCheck.HealthChecker = &core.HealthCheck_TcpHealthCheck_{
+			TcpHealthCheck: &core.HealthCheck_TcpHealthCheck{},
+		}
+		return healthCheck
+	}
+
+	httpHealthCheck := &core.HealthCheck_HttpHealthCheck{
+		Path: path,
+	}
+	if svc.EnableHTTP2 {
+		httpHealthCheck.CodecClientType = typev3.CodecClientType_HTTP2
+	}
+	healthCheck.HealthChecker = &core.HealthCheck_HttpHealthCheck_{
+		HttpHealthCheck: httpHealthCheck,
+	}
+	return healthCheck
+}
+
+// buildTcpKeepalive converts the keepalive settings, leaving unset fields to the operating system's defaults
+func buildTcpKeepalive(ka *types2.TcpKeepalive) *core.TcpKeepalive {
+	keepalive := &core.TcpKeepalive{}
+	if ka.Probes > 0 {
+		keepalive.KeepaliveProbes = wrapperspb.UInt32(ka.Probes)
+	}
+	if ka.Time > 0 {
+		keepalive.KeepaliveTime = wrapperspb.UInt32(uint32(ka.Time.Seconds()))
+	}
+	if ka.Interval > 0 {
+		keepalive.KeepaliveInterval = wrapperspb.UInt32(uint32(ka.Interval.Seconds()))
+	}
+	return keepalive
+}
+
+// buildOutlierDetection converts the service's outlier settings, leaving unset fields to Envoy's defaults
+func buildOutlierDetection(od *types2.OutlierDetection) *cluster.OutlierDetection {
+	outlier := &cluster.OutlierDetection{}
+	if od.Consecutive5xx > 0 {
+		outlier.Consecutive_5Xx = wrapperspb.UInt32(od.Consecutive5xx)
+	}
+	if od.Interval > 0 {
+		outlier.Interval = durationpb.New(od.Interval)
+	}
+	if od.BaseEjectionTime > 0 {
+		outlier.BaseEjectionTime = durationpb.New(od.BaseEjectionTime)
+	}
+	if od.MaxEjectionPercent > 0 {
+		outlier.MaxEjectionPercent = wrapperspb.UInt32(min(od.MaxEjectionPercent, 100))
+	}
+	return outlier
+}
+
+// buildUpstreamTlsContext creates the TLS context for a service's upstream connections.
+// The upstream certificate is verified against the service's CA (or defaultCaFile) and
+// SANs unless the service explicitly opts out with TlsInsecure.
+func buildUpstreamTlsContext(svc *types2.DiscoveredService, defaultCaFile string) *tls.UpstreamTlsContext {
+	// Set ALPN based on whether HTTP/2 is enabled
+	var alpnProtocols []string
+	if svc.EnableHTTP2 {
+		alpnProtocols = []string{"h2", "http/1.1"}
+	} else {
+		alpnProtocols = []string{"http/1.1"}
+	}
+
+	validation := &tls.CertificateValidationContext{}
+	switch {
+	case svc.TlsInsecure:
+		slog.Warn("Upstream TLS certificate verification disabled", "service", svc.Name)
+		validation.TrustChainVerification = tls.CertificateValidationContext_ACCEPT_UNTRUSTED
+	case svc.TlsCaPem != "":
+		validation.TrustedCa = &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: svc.TlsCaPem}}
+	case svc.TlsCaFile != "":
+		validation.TrustedCa = &core.DataSource{Specifier: &core.DataSource_Filename{Filename: svc.TlsCaFile}}
+	default:
+		validation.TrustedCa = &core.DataSource{Specifier: &core.DataSource_Filename{Filename: defaultCaFile}}
+	}
+	if !svc.TlsInsecure {
+		for _, san := range svc.TlsSubjectAltNames {
+			validation.MatchTypedSubjectAltNames = append(validation.MatchTypedSubjectAltNames, &tls.SubjectAltNameMatcher{
+				SanType: tls.SubjectAltNameMatcher_DNS,
+				Matcher: &matcherv3.StringMatcher{
+					MatchPattern: &matcherv3.StringMatcher_Exact{Exact: san},
+				},
+			})
+		}
+	}
+
+	commonTlsContext := &tls.CommonTlsContext{
+		AlpnProtocols: alpnProtocols,
+		ValidationContextType: &tls.CommonTlsContext_ValidationContext{
+			ValidationContext: validation,
+		},
+	}
+
+	// Present a client certificate for upstreams requiring mTLS
+	switch {
+	case svc.TlsClientCertFile != "" && svc.TlsClientKeyFile != "":
+		commonTlsContext.TlsCertificates = []*tls.TlsCertificate{{
+			CertificateChain: &core.DataSource{Specifier: &core.DataSource_Filename{Filename: svc.TlsClientCertFile}},
+			PrivateKey:       &core.DataSource{Specifier: &core.DataSource_Filename{Filename: svc.TlsClientKeyFile}},
+		}}
+	case svc.TlsClientCertFile != "" || svc.TlsClientKeyFile != "":
+		slog.Warn("Client certificate needs both tls_client_cert_file and tls_client_key_file, not presenting one", "service", svc.Name, telemetry.InvalidConfigKey, "setting")
+	}
+
+	return &tls.UpstreamTlsContext{
+		Sni:              upstreamSni(svc),
+		CommonTlsContext: commonTlsContext,
+	}
+}
+
+// upstreamSni returns the configured SNI, falling back to the instances' hostname when they all share
+// one (IP addresses can't be used as SNI) and to the service name otherwise
+func upstreamSni(svc *types2.DiscoveredService) string {
+	if svc.Sni != "" {
+		return svc.Sni
+	}
+	if len(svc.Instances) > 0 {
+		host := svc.Instances[0].Address
+		shared := net.ParseIP(host) == nil
+		for _, inst := range svc.Instances[1:] {
+			if inst.Address != host {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			return host
+		}
+	}
+	return svc.Name
+}
@@ -0,0 +1,134 @@
+package xds
+
+import (
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	dnscluster "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/dns/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+)
+
+// getDnsCluster unpacks the DNS cluster config of a cluster
+func getDnsCluster(t *testing.T, cl *cluster.Cluster) *dnscluster.DnsCluster {
+	t.Helper()
+	config := &dnscluster.DnsCluster{}
+	if err := cl.GetClusterType().GetTypedConfig().UnmarshalTo(config); err != nil {
+		t.Fatalf("cluster %s has no DNS cluster config: %v", cl.GetName(), err)
+	}
+	return config
+}
+
+func TestClusterAllAddressesInSingleEndpoint(t *testing.T) {
+	for _, single := range []bool{false, true} {
+		svc := testService("orders")
+		svc.AllAddressesInSingleEndpoint = single
+		snap := buildTestSnapshot(t, newTestManager(Config{}), svc)
+
+		if got := getDnsCluster(t, getCluster(snap, "orders")).GetAllAddressesInSingleEndpoint(); got != single {
+			t.Errorf("all addresses in single endpoint = %v, want %v", got, single)
+		}
+	}
+}
+
+func TestClusterOutlierDetection(t *testing.T) {
+	svc := testService("orders")
+	svc.Outlier = &types2.OutlierDetection{
+		Consecutive5xx:     5,
+		Interval:           10 * time.Second,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionPercent: 150,
+	}
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc, testService("billing"))
+
+	outlier := getCluster(snap, "orders").GetOutlierDetection()
+	if outlier.GetConsecutive_5Xx().GetValue() != 5 {
+		t.Errorf("consecutive 5xx = %v, want 5", outlier.GetConsecutive_5Xx())
+	}
+	if outlier.GetInterval().AsDuration() != 10*time.Second {
+		t.Errorf("interval = %v, want 10s", outlier.GetInterval())
+	}
+	if outlier.GetBaseEjectionTime().AsDuration() != 30*time.Second {
+		t.Errorf("base ejection time = %v, want 30s", outlier.GetBaseEjectionTime())
+	}
+	if outlier.GetMaxEjectionPercent().GetValue() != 100 {
+		t.Errorf("max ejection percent = %v, want it capped at 100", outlier.GetMaxEjectionPercent())
+	}
+	if outlier := getCluster(snap, "billing").GetOutlierDetection(); outlier != nil {
+		t.Errorf("service without outlier settings has outlier detection %v", outlier)
+	}
+}
+
+func TestClusterUpstreamTcpKeepalive(t *testing.T) {
+	svc := testService("orders")
+	svc.TcpKeepalive = &types2.TcpKeepalive{Probes: 3, Time: 2 * time.Minute, Interval: 15 * time.Second}
+	partial := testService("billing")
+	partial.TcpKeepalive = &types2.TcpKeepalive{Time: time.Minute}
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc, partial, testService("users"))
+
+	ka := getCluster(snap, "orders").GetUpstreamConnectionOptions().GetTcpKeepalive()
+	if ka.GetKeepaliveProbes().GetValue() != 3 || ka.GetKeepaliveTime().GetValue() != 120 || ka.GetKeepaliveInterval().GetValue() != 15 {
+		t.Errorf("orders keepalive = %v, want 3 probes after 120s every 15s", ka)
+	}
+	ka = getCluster(snap, "billing").GetUpstreamConnectionOptions().GetTcpKeepalive()
+	if ka.GetKeepaliveTime().GetValue() != 60 || ka.GetKeepaliveProbes() != nil || ka.GetKeepaliveInterval() != nil {
+		t.Errorf("billing keepalive = %v, want only a 60s time", ka)
+	}
+	if opts := getCluster(snap, "users").GetUpstreamConnectionOptions(); opts != nil {
+		t.Errorf("users upstream connection options = %v, want none", opts)
+	}
+}
+
+func TestServiceDefaults(t *testing.T) {
+	own := testService("orders")
+	own.ConnectTimeout = 500 * time.Millisecond
+	own.LbPolicy = "random"
+	unset := testService("users")
+
+	for _, tt := range []struct {
+		defaults    ServiceDefaults
+		wantTimeout time.Duration
+		wantPolicy  cluster.Cluster_LbPolicy
+	}{
+		{defaults: ServiceDefaults{}, wantTimeout: 2 * time.Second, wantPolicy: cluster.Cluster_ROUND_ROBIN},
+		{defaults: ServiceDefaults{ConnectTimeout: 7 * time.Second, LbPolicy: "least_request"}, wantTimeout: 7 * time.Second, wantPolicy: cluster.Cluster_LEAST_REQUEST},
+	} {
+		snap := buildTestSnapshot(t, newTestManager(Config{Defaults: tt.defaults}), own, unset)
+
+		users := getCluster(snap, "users")
+		if got := users.GetConnectTimeout().AsDuration(); got != tt.wantTimeout {
+			t.Errorf("defaults %+v: users connect timeout = %v, want %v", tt.defaults, got, tt.wantTimeout)
+		}
+		if got := users.GetLbPolicy(); got != tt.wantPolicy {
+			t.Errorf("defaults %+v: users lb policy = %v, want %v", tt.defaults, got, tt.wantPolicy)
+		}
+		orders := getCluster(snap, "orders")
+		if got := orders.GetConnectTimeout().AsDuration(); got != 500*time.Millisecond {
+			t.Errorf("defaults %+v: orders connect timeout = %v, want its own 500ms", tt.defaults, got)
+		}
+		if got := orders.GetLbPolicy(); got != cluster.Cluster_RANDOM {
+			t.Errorf("defaults %+v: orders lb policy = %v, want its own RANDOM", tt.defaults, got)
+		}
+	}
+}
+
+func TestClusterHealthyPanicThreshold(t *testing.T) {
+	threshold := func(percent float64) *float64 { return &percent }
+	partial := testService("orders")
+	partial.HealthyPanicThreshold = threshold(35.5)
+	disabled := testService("billing")
+	disabled.HealthyPanicThreshold = threshold(0)
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), partial, disabled, testService("users"))
+
+	for name, want := range map[string]float64{"orders": 35.5, "billing": 0} {
+		got := getCluster(snap, name).GetCommonLbConfig().GetHealthyPanicThreshold()
+		if got == nil || got.GetValue() != want {
+			t.Errorf("%s healthy panic threshold = %v, want %v%%", name, got, want)
+		}
+	}
+	if lbConfig := getCluster(snap, "users").GetCommonLbConfig(); lbConfig != nil {
+		t.Errorf("users common lb config = %v, want Envoy's default", lbConfig)
+	}
+}
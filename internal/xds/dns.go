@@ -0,0 +1,75 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	appledns "github.com/envoyproxy/go-control-plane/envoy/extensions/network/dns_resolver/apple/v3"
+	caresdns "github.com/envoyproxy/go-control-plane/envoy/extensions/network/dns_resolver/cares/v3"
+	getaddrinfodns "github.com/envoyproxy/go-control-plane/envoy/extensions/network/dns_resolver/getaddrinfo/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// BuildDnsResolverConfig creates the typed DNS resolver config used by every DNS cluster.
+// resolverType is cares, getaddrinfo or apple; an empty type leaves Envoy's default resolver.
+// Resolvers are nameserver addresses (host or host:port), only supported by c-ares.
+func BuildDnsResolverConfig(resolverType string, resolvers []string) (*core.TypedExtensionConfig, error) {
+	if len(resolvers) > 0 && resolverType != "cares" {
+		return nil, fmt.Errorf("dns resolvers can only be set with the cares resolver")
+	}
+
+	var name string
+	var config proto.Message
+	switch resolverType {
+	case "":
+		return nil, nil
+	case "cares":
+		cares := &caresdns.CaresDnsResolverConfig{}
+		for _, resolver := range resolvers {
+			address, err := parseResolverAddress(resolver)
+			if err != nil {
+				return nil, err
+			}
+			cares.Resolvers = append(cares.Resolvers, address)
+		}
+		name, config = "envoy.network.dns_resolver.cares", cares
+	case "getaddrinfo":
+		name, config = "envoy.network.dns_resolver.getaddrinfo", &getaddrinfodns.GetAddrInfoDnsResolverConfig{}
+	case "apple":
+		name, config = "envoy.network.dns_resolver.apple", &appledns.AppleDnsResolverConfig{}
+	default:
+		return nil, fmt.Errorf("invalid dns resolver %q, must be cares, getaddrinfo, or apple", resolverType)
+	}
+
+	typedConfig, err := anypb.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return &core.TypedExtensionConfig{Name: name, TypedConfig: typedConfig}, nil
+}
+
+// parseResolverAddress converts a nameserver address, defaulting to port 53
+func parseResolverAddress(resolver string) (*core.Address, error) {
+	host, portStr, err := net.SplitHostPort(resolver)
+	if err != nil {
+		host, portStr = resolver, "53"
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid dns resolver address %q, must be an IP address", resolver)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns resolver port in %q: %w", resolver, err)
+	}
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Address:       host,
+				PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+			},
+		},
+	}, nil
+}
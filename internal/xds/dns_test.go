@@ -0,0 +1,51 @@
+package xds
+
+import (
+	"testing"
+
+	caresdns "github.com/envoyproxy/go-control-plane/envoy/extensions/network/dns_resolver/cares/v3"
+)
+
+func TestClusterTypedDnsResolverConfig(t *testing.T) {
+	resolver, err := BuildDnsResolverConfig("cares", []string{"10.0.0.53", "10.0.1.53:5353"})
+	if err != nil {
+		t.Fatalf("BuildDnsResolverConfig: %v", err)
+	}
+	snap := buildTestSnapshot(t, newTestManager(Config{DnsResolver: resolver}), testService("orders"))
+
+	typed := getDnsCluster(t, getCluster(snap, "orders")).GetTypedDnsResolverConfig()
+	if typed.GetName() != "envoy.network.dns_resolver.cares" {
+		t.Fatalf("DNS resolver = %q, want c-ares", typed.GetName())
+	}
+	cares := &caresdns.CaresDnsResolverConfig{}
+	if err := typed.GetTypedConfig().UnmarshalTo(cares); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		address string
+		port    uint32
+	}{{"10.0.0.53", 53}, {"10.0.1.53", 5353}} {
+		got := cares.GetResolvers()[i].GetSocketAddress()
+		if got.GetAddress() != want.address || got.GetPortValue() != want.port {
+			t.Errorf("resolver %d = %s:%d, want %s:%d", i, got.GetAddress(), got.GetPortValue(), want.address, want.port)
+		}
+	}
+}
+
+func TestBuildDnsResolverConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		resolverType string
+		resolvers    []string
+	}{
+		{"getaddrinfo", []string{"10.0.0.53"}},
+		{"cares", []string{"dns.internal"}},
+		{"bind", nil},
+	} {
+		if _, err := BuildDnsResolverConfig(tc.resolverType, tc.resolvers); err == nil {
+			t.Errorf("BuildDnsResolverConfig(%q, %v) succeeded", tc.resolverType, tc.resolvers)
+		}
+	}
+	if config, err := BuildDnsResolverConfig("", nil); config != nil || err != nil {
+		t.Errorf("BuildDnsResolverConfig without a type = %v, %v, want Envoy's default", config, err)
+	}
+}
@@ -0,0 +1,101 @@
+package xds
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// dumpTypes maps the JSON keys of a snapshot dump to the resource types they hold
+var dumpTypes = []struct {
+	key     string
+	typeURL resource.Type
+}{
+	{"listeners", resource.ListenerType},
+	{"routes", resource.RouteType},
+	{"scopedRoutes", resource.ScopedRouteType},
+	{"clusters", resource.ClusterType},
+	{"endpoints", resource.EndpointType},
+}
+
+// SnapshotDumpHandler serves the snapshot held for a node as JSON, similar to Envoy's /config_dump.
+// The node is selected with the "node" query parameter, defaulting to the reference snapshot.
+type SnapshotDumpHandler struct {
+	cache SnapshotCache
+}
+
+func NewSnapshotDumpHandler(cache SnapshotCache) *SnapshotDumpHandler {
+	return &SnapshotDumpHandler{cache: cache}
+}
+
+func (h *SnapshotDumpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nodeID := r.URL.Query().Get("node")
+	if nodeID == "" {
+		nodeID = ReferenceNodeID
+	}
+
+	snap, err := h.cache.GetSnapshot(nodeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	dump, err := snapshotDump(nodeID, snap)
+	if err != nil {
+		slog.Error("Failed to marshal snapshot resource", "node", nodeID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := encodeDump(w, dump); err != nil {
+		slog.Debug("Failed to write snapshot dump", "error", err)
+	}
+}
+
+// WriteSnapshotDump writes a snapshot as JSON in the format served by SnapshotDumpHandler
+func WriteSnapshotDump(w io.Writer, nodeID string, snap cachev3.ResourceSnapshot) error {
+	dump, err := snapshotDump(nodeID, snap)
+	if err != nil {
+		return err
+	}
+	return encodeDump(w, dump)
+}
+
+// snapshotDump converts the resources of a snapshot to their protojson form, keyed by dumpTypes. The
+// resources of each type are sorted by name, so dumps of the same snapshot can be diffed.
+func snapshotDump(nodeID string, snap cachev3.ResourceSnapshot) (map[string]any, error) {
+	versions := make(map[string]string, len(dumpTypes))
+	dump := map[string]any{
+		"node":     nodeID,
+		"versions": versions,
+	}
+	for _, t := range dumpTypes {
+		versions[t.key] = snap.GetVersion(t.typeURL)
+		resources := make([]json.RawMessage, 0)
+		byName := snap.GetResources(t.typeURL)
+		for _, name := range slices.Sorted(maps.Keys(byName)) {
+			data, err := protojson.Marshal(byName[name])
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal %s resource: %w", t.typeURL, err)
+			}
+			resources = append(resources, data)
+		}
+		dump[t.key] = resources
+	}
+	return dump, nil
+}
+
+func encodeDump(w io.Writer, dump map[string]any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
@@ -0,0 +1,46 @@
+package xds
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestSnapshotDumpSortsResourcesByName(t *testing.T) {
+	snap := buildTestSnapshot(t, newTestManager(Config{}),
+		testService("users"), testService("orders"), testService("payments"), testService("billing"))
+
+	var first bytes.Buffer
+	if err := WriteSnapshotDump(&first, ReferenceNodeID, snap); err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Clusters  []struct{ Name string }
+		Endpoints []struct{ ClusterName string }
+	}
+	if err := json.Unmarshal(first.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+	var clusters, endpoints []string
+	for _, c := range dump.Clusters {
+		clusters = append(clusters, c.Name)
+	}
+	for _, e := range dump.Endpoints {
+		endpoints = append(endpoints, e.ClusterName)
+	}
+	want := []string{"billing", "orders", "payments", "users"}
+	if !slices.Equal(clusters, want) || !slices.Equal(endpoints, want) {
+		t.Errorf("dumped clusters %v and endpoints %v, want both in order %v", clusters, endpoints, want)
+	}
+
+	for range 10 {
+		var again bytes.Buffer
+		if err := WriteSnapshotDump(&again, ReferenceNodeID, snap); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first.Bytes(), again.Bytes()) {
+			t.Fatal("dumps of the same snapshot differ")
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package xds
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// localityKey identifies a group of instances sharing a locality and failover priority
+type localityKey struct {
+	region   string
+	zone     string
+	priority uint32
+}
+
+// buildLocalityEndpoints groups the service's instances by locality and priority, ordered by priority.
+// Envoy only sends traffic to a priority when the priorities before it are unhealthy.
+func buildLocalityEndpoints(svc *types2.DiscoveredService) []*endpoint.LocalityLbEndpoints {
+	var keys []localityKey
+	groups := make(map[localityKey][]*endpoint.LbEndpoint)
+
+	for _, inst := range svc.Instances {
+		if inst.Address == "" {
+			continue
+		}
+		slog.Debug("Adding endpoint", "service", svc.Name, "address", inst.Address, "listenerPorts", inst.Port)
+		lb := &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Address:       inst.Address,
+								PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(inst.Port)},
+							},
+						},
+					},
+				},
+			},
+		}
+		// Envoy only uses the health check port for active health checks
+		if svc.HealthCheck != nil && inst.HealthCheckPort > 0 && inst.HealthCheckPort != uint32(inst.Port) {
+			lb.GetEndpoint().HealthCheckConfig = &endpoint.Endpoint_HealthCheckConfig{PortValue: inst.HealthCheckPort}
+		}
+		if inst.Weight > 0 && !svc.IgnoreEndpointWeights {
+			lb.LoadBalancingWeight = wrapperspb.UInt32(inst.Weight)
+		}
+
+		key := localityKey{region: inst.Region, zone: inst.Zone, priority: inst.Priority}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], lb)
+	}
+
+	// Stable sort keeps discovery order within a priority so snapshots don't churn
+	slices.SortStableFunc(keys, func(a, b localityKey) int {
+		return cmp.Compare(a.priority, b.priority)
+	})
+
+	localities := make([]*endpoint.LocalityLbEndpoints, 0, len(keys))
+	var expectedPriority uint32
+	for _, key := range keys {
+		if key.priority > expectedPriority {
+			slog.Warn("Endpoint priorities should be contiguous from 0", "service", svc.Name, "priority", key.priority)
+		}
+		expectedPriority = key.priority + 1
+
+		lle := &endpoint.LocalityLbEndpoints{
+			LbEndpoints: groups[key],
+			Priority:    key.priority,
+		}
+		if key.region != "" || key.zone != "" {
+			lle.Locality = &core.Locality{Region: key.region, Zone: key.zone}
+		}
+		localities = append(localities, lle)
+	}
+	return localities
+}
@@ -0,0 +1,80 @@
+package xds
+
+import (
+	"testing"
+
+	types2 "github.com/moonkev/flexds/internal/common/types"
+)
+
+func TestEndpointWeights(t *testing.T) {
+	svc := testService("orders")
+	svc.Instances = []types2.ServiceInstance{
+		{Address: "10.0.0.1", Port: 8080, Weight: 3},
+		{Address: "10.0.0.2", Port: 8080, Weight: 1},
+	}
+
+	for _, ignore := range []bool{false, true} {
+		svc.IgnoreEndpointWeights = ignore
+		lbEndpoints := buildLocalityEndpoints(svc)[0].GetLbEndpoints()
+		for i, want := range []uint32{3, 1} {
+			got := lbEndpoints[i].GetLoadBalancingWeight()
+			if ignore && got != nil {
+				t.Errorf("endpoint %d weight = %v with weights ignored, want none", i, got)
+			}
+			if !ignore && got.GetValue() != want {
+				t.Errorf("endpoint %d weight = %v, want %d", i, got, want)
+			}
+		}
+	}
+}
+
+func TestEndpointLocalityPriorities(t *testing.T) {
+	svc := testService("orders")
+	svc.Instances = []types2.ServiceInstance{
+		{Address: "10.1.0.1", Port: 8080, Region: "us-west-2", Zone: "us-west-2a", Priority: 1},
+		{Address: "10.0.0.1", Port: 8080, Region: "us-east-1", Zone: "us-east-1a"},
+		{Address: "10.0.0.2", Port: 8080, Region: "us-east-1", Zone: "us-east-1a"},
+	}
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc)
+
+	localities := getCluster(snap, "orders").GetLoadAssignment().GetEndpoints()
+	if len(localities) != 2 {
+		t.Fatalf("got %d localities, want 2", len(localities))
+	}
+	for i, want := range []struct {
+		region    string
+		priority  uint32
+		endpoints int
+	}{{"us-east-1", 0, 2}, {"us-west-2", 1, 1}} {
+		locality := localities[i]
+		if locality.GetLocality().GetRegion() != want.region || locality.GetPriority() != want.priority || len(locality.GetLbEndpoints()) != want.endpoints {
+			t.Errorf("locality %d = %s at priority %d with %d endpoints, want %s at priority %d with %d",
+				i, locality.GetLocality().GetRegion(), locality.GetPriority(), len(locality.GetLbEndpoints()),
+				want.region, want.priority, want.endpoints)
+		}
+	}
+}
+
+func TestEndpointHealthCheckPort(t *testing.T) {
+	svc := testService("orders")
+	svc.Instances = []types2.ServiceInstance{
+		{Address: "10.0.0.1", Port: 8080, HealthCheckPort: 9901},
+		{Address: "10.0.0.2", Port: 8080, HealthCheckPort: 8080},
+		{Address: "10.0.0.3", Port: 8080},
+	}
+
+	for _, lb := range buildLocalityEndpoints(svc)[0].GetLbEndpoints() {
+		if hc := lb.GetEndpoint().GetHealthCheckConfig(); hc != nil {
+			t.Errorf("endpoint %v health check config = %v without active health checks, want none", lb.GetEndpoint().GetAddress(), hc)
+		}
+	}
+
+	svc.HealthCheck = &types2.HealthCheck{Path: "/health"}
+	lbEndpoints := buildLocalityEndpoints(svc)[0].GetLbEndpoints()
+	for i, want := range []uint32{9901, 0, 0} {
+		if got := lbEndpoints[i].GetEndpoint().GetHealthCheckConfig().GetPortValue(); got != want {
+			t.Errorf("endpoint %d health check port = %d, want %d", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package xds
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	corsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	grpcjsonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_json_transcoder/v3"
+	grpcwebv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/grpc_web/v3"
+	jwtv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	corsFilterName               = "envoy.filters.http.cors"
+	grpcWebFilterName            = "envoy.filters.http.grpc_web"
+	grpcJsonTranscoderFilterName = "envoy.filters.http.grpc_json_transcoder"
+	routerFilterName             = "envoy.filters.http.router"
+)
+
+// httpFilterSet records which optional HTTP filters and local replies the routes of a snapshot rely on
+type httpFilterSet struct {
+	cors              bool
+	grpcWeb           bool
+	grpcJson          *anypb.Any                    // filter-level transcoder config, nil when no route transcodes
+	jwtProviders      map[string]*jwtv3.JwtProvider // JWT providers required by routes, by name
+	localReplyMappers []*hcm.ResponseMapper
+}
+
+// buildHttpFilters returns the HCM filter chain, optional filters first and the router last.
+// grpc_web comes first so CORS and the router see the translated gRPC request, as in Envoy's examples,
+// and JWT authentication and the JSON transcoder run after CORS so preflight requests are answered untouched.
+func buildHttpFilters(filters httpFilterSet) ([]*hcm.HttpFilter, error) {
+	httpFilters := make([]*hcm.HttpFilter, 0, 5)
+
+	if filters.grpcWeb {
+		grpcWebAny, err := anypb.New(&grpcwebv3.GrpcWeb{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal gRPC-Web filter: %w", err)
+		}
+		httpFilters = append(httpFilters, &hcm.HttpFilter{
+			Name:       grpcWebFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: grpcWebAny},
+		})
+	}
+
+	if filters.cors {
+		corsAny, err := anypb.New(&corsv3.Cors{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal CORS filter: %w", err)
+		}
+		httpFilters = append(httpFilters, &hcm.HttpFilter{
+			Name:       corsFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: corsAny},
+		})
+	}
+
+	if len(filters.jwtProviders) > 0 {
+		jwtAny, err := anypb.New(buildJwtAuthentication(filters.jwtProviders))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JWT authentication filter: %w", err)
+		}
+		httpFilters = append(httpFilters, &hcm.HttpFilter{
+			Name:       jwtAuthnFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: jwtAny},
+		})
+	}
+
+	// The transcoder is disabled by default and enabled by the per-route config of the services using it,
+	// so routes of other services are never transcoded
+	if filters.grpcJson != nil {
+		httpFilters = append(httpFilters, &hcm.HttpFilter{
+			Name:       grpcJsonTranscoderFilterName,
+			ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: filters.grpcJson},
+			Disabled:   true,
+		})
+	}
+
+	routerAny, err := anypb.New(&routerv3.Router{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal router filter: %w", err)
+	}
+	httpFilters = append(httpFilters, &hcm.HttpFilter{
+		Name:       routerFilterName,
+		ConfigType: &hcm.HttpFilter_TypedConfig{TypedConfig: routerAny},
+	})
+	return httpFilters, nil
+}
+
+// buildCorsPolicy converts a CORS policy into the per-filter config consumed by the CORS filter
+func buildCorsPolicy(cors *types2.CorsPolicy) (*anypb.Any, error) {
+	for _, originRegex := range cors.AllowOriginRegexes {
+		if _, err := regexp.Compile(originRegex); err != nil {
+			return nil, fmt.Errorf("invalid CORS origin regex %q: %w", originRegex, err)
+		}
+	}
+
+	policy := &corsv3.CorsPolicy{
+		AllowMethods:  cors.AllowMethods,
+		AllowHeaders:  cors.AllowHeaders,
+		ExposeHeaders: cors.ExposeHeaders,
+		MaxAge:        cors.MaxAge,
+	}
+	for _, origin := range cors.AllowOrigins {
+		policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_Exact{Exact: origin},
+		})
+	}
+	for _, originRegex := range cors.AllowOriginRegexes {
+		policy.AllowOriginStringMatch = append(policy.AllowOriginStringMatch, &matcher.StringMatcher{
+			MatchPattern: &matcher.StringMatcher_SafeRegex{
+				SafeRegex: &matcher.RegexMatcher{Regex: originRegex},
+			},
+		})
+	}
+	if cors.AllowCredentials {
+		policy.AllowCredentials = wrapperspb.Bool(true)
+	}
+	return anypb.New(policy)
+}
+
+// buildGrpcJsonTranscoder reads the service's proto descriptor set and converts it into the transcoder config,
+// checking that every listed gRPC service is described by it
+func buildGrpcJsonTranscoder(grpcJson *types2.GrpcJsonTranscoder) (*anypb.Any, error) {
+	if len(grpcJson.Services) == 0 {
+		return nil, fmt.Errorf("gRPC-JSON transcoding requires at least one service name")
+	}
+	descriptorBin, err := os.ReadFile(grpcJson.DescriptorFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proto descriptor set: %w", err)
+	}
+	var descriptorSet descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorBin, &descriptorSet); err != nil {
+		return nil, fmt.Errorf("invalid proto descriptor set %s: %w", grpcJson.DescriptorFile, err)
+	}
+	described := make(map[string]bool)
+	for _, file := range descriptorSet.GetFile() {
+		for _, service := range file.GetService() {
+			name := service.GetName()
+			if file.GetPackage() != "" {
+				name = file.GetPackage() + "." + name
+			}
+			described[name] = true
+		}
+	}
+	for _, service := range grpcJson.Services {
+		if !described[service] {
+			return nil, fmt.Errorf("gRPC service %s is not in proto descriptor set %s", service, grpcJson.DescriptorFile)
+		}
+	}
+	return anypb.New(&grpcjsonv3.GrpcJsonTranscoder{
+		DescriptorSet: &grpcjsonv3.GrpcJsonTranscoder_ProtoDescriptorBin{ProtoDescriptorBin: descriptorBin},
+		Services:      grpcJson.Services,
+	})
+}
+
+// addJwtProvider records a JWT provider some of the set's routes require
+func (f *httpFilterSet) addJwtProvider(name string, provider *jwtv3.JwtProvider) {
+	if f.jwtProviders == nil {
+		f.jwtProviders = make(map[string]*jwtv3.JwtProvider)
+	}
+	f.jwtProviders[name] = provider
+}
@@ -0,0 +1,63 @@
+package xds
+
+import (
+	"slices"
+	"testing"
+
+	corsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/cors/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+)
+
+// hasHttpFilter reports whether the HCM's filter chain includes the named filter
+func hasHttpFilter(manager *hcm.HttpConnectionManager, name string) bool {
+	return slices.ContainsFunc(manager.GetHttpFilters(), func(f *hcm.HttpFilter) bool { return f.GetName() == name })
+}
+
+func TestRouteCorsOrigins(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes[0].Cors = &types2.CorsPolicy{
+		AllowOrigins:       []string{"https://shop.example.com"},
+		AllowOriginRegexes: []string{`https://.*\.example\.org`},
+		AllowMethods:       "GET,POST",
+		AllowCredentials:   true,
+	}
+	invalid := testService("billing")
+	invalid.Routes[0].Cors = &types2.CorsPolicy{AllowOriginRegexes: []string{"https://(unclosed"}}
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc, invalid)
+
+	var policy corsv3.CorsPolicy
+	if err := getRoute(t, snap, "/orders").GetTypedPerFilterConfig()[corsFilterName].UnmarshalTo(&policy); err != nil {
+		t.Fatalf("route CORS policy: %v", err)
+	}
+	origins := policy.GetAllowOriginStringMatch()
+	if len(origins) != 2 {
+		t.Fatalf("got %d allowed origins, want an exact origin and a regex: %v", len(origins), origins)
+	}
+	if origins[0].GetExact() != "https://shop.example.com" || origins[0].GetSafeRegex() != nil {
+		t.Errorf("first allowed origin = %v, want exact https://shop.example.com", origins[0])
+	}
+	if origins[1].GetSafeRegex().GetRegex() != `https://.*\.example\.org` || origins[1].GetExact() != "" {
+		t.Errorf("second allowed origin = %v, want the origin regex", origins[1])
+	}
+	if policy.GetAllowMethods() != "GET,POST" || !policy.GetAllowCredentials().GetValue() {
+		t.Errorf("CORS policy = %v, want GET,POST with credentials", &policy)
+	}
+
+	for _, vh := range getRouteConfig(t, snap, defaultRouteConfigName).GetVirtualHosts() {
+		for _, r := range vh.GetRoutes() {
+			if r.GetMatch().GetPrefix() == "/billing" {
+				t.Errorf("route with an invalid CORS origin regex was not skipped: %v", r)
+			}
+		}
+	}
+	if !hasHttpFilter(getHCM(t, getListener(t, snap, "listener_18080")), corsFilterName) {
+		t.Error("CORS filter missing from the HCM of a route with a CORS policy")
+	}
+
+	withoutCors := buildTestSnapshot(t, newTestManager(Config{}), testService("users"))
+	if hasHttpFilter(getHCM(t, getListener(t, withoutCors, "listener_18080")), corsFilterName) {
+		t.Error("CORS filter added without any route requesting it")
+	}
+}
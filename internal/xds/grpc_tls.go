@@ -0,0 +1,93 @@
+package xds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/moonkev/flexds/internal/common/secrets"
+)
+
+// TLSConfig holds the files used to serve the ADS gRPC server over TLS. The server stays
+// plaintext when CertFile is empty; setting ClientCAFile additionally requires Envoy to
+// present a client certificate signed by that CA (mTLS).
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// Enabled reports whether the ADS server should serve TLS
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// buildServerTLSConfig creates the server TLS configuration. The certificate, key and client CA
+// are re-read through secrets.File on each handshake, so rotated files are picked up without a restart.
+func buildServerTLSConfig(c TLSConfig) (*tls.Config, error) {
+	if c.KeyFile == "" {
+		return nil, errors.New("a TLS key file is required with the certificate file")
+	}
+	certFile := secrets.NewFile(c.CertFile, secrets.DefaultMaxAge)
+	keyFile := secrets.NewFile(c.KeyFile, secrets.DefaultMaxAge)
+
+	loadCertificate := func() (*tls.Certificate, error) {
+		certPEM, err := certFile.Read()
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := keyFile.Read()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ADS TLS key pair: %w", err)
+		}
+		return &cert, nil
+	}
+	// Fail at startup rather than on the first handshake
+	if _, err := loadCertificate(); err != nil {
+		return nil, err
+	}
+
+	baseConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return loadCertificate()
+		},
+	}
+	if c.ClientCAFile == "" {
+		return baseConfig, nil
+	}
+
+	clientCAFile := secrets.NewFile(c.ClientCAFile, secrets.DefaultMaxAge)
+	loadClientCAs := func() (*x509.CertPool, error) {
+		caPEM, err := clientCAFile.Read()
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in ADS client CA file %s", c.ClientCAFile)
+		}
+		return pool, nil
+	}
+	if _, err := loadClientCAs(); err != nil {
+		return nil, err
+	}
+
+	baseConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		pool, err := loadClientCAs()
+		if err != nil {
+			return nil, err
+		}
+		config := baseConfig.Clone()
+		config.GetConfigForClient = nil
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = pool
+		return config, nil
+	}
+	return baseConfig, nil
+}
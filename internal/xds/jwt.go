@@ -0,0 +1,163 @@
+package xds
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	commondns "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/common/dns/v3"
+	dnscluster "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/dns/v3"
+	jwtv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	jwtAuthnFilterName = "envoy.filters.http.jwt_authn"
+
+	// jwksFetchTimeout bounds each fetch of a remote JWKS
+	jwksFetchTimeout = 5 * time.Second
+)
+
+// jwtProviderName names the JWT provider of a service, also used as the name of its requirement
+func jwtProviderName(svc *types2.DiscoveredService) string {
+	return "jwt_" + svc.Name
+}
+
+// jwksClusterName names the cluster a service's remote JWKS is fetched through
+func jwksClusterName(svc *types2.DiscoveredService) string {
+	return "jwks_" + svc.Name
+}
+
+// jwksEndpoint returns the host and port of a remote JWKS URI
+func jwksEndpoint(jwksUri string) (*url.URL, string, uint32, error) {
+	u, err := url.Parse(jwksUri)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("invalid JWKS URI %q: %w", jwksUri, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, "", 0, fmt.Errorf("invalid JWKS URI %q, must be an absolute http or https URL", jwksUri)
+	}
+	port := uint32(80)
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if u.Port() != "" {
+		parsed, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("invalid JWKS URI port %q", u.Port())
+		}
+		port = uint32(parsed)
+	}
+	return u, u.Hostname(), port, nil
+}
+
+// buildJwtProvider converts a service's JWT settings into a provider verifying tokens against a
+// remote JWKS fetched through the service's JWKS cluster, or an inline one
+func buildJwtProvider(svc *types2.DiscoveredService) (*jwtv3.JwtProvider, error) {
+	jwt := svc.Jwt
+	provider := &jwtv3.JwtProvider{
+		Issuer:    jwt.Issuer,
+		Audiences: jwt.Audiences,
+	}
+	switch {
+	case jwt.JwksUri != "" && jwt.LocalJwks != "":
+		return nil, fmt.Errorf("JWKS URI and local JWKS are mutually exclusive")
+	case jwt.LocalJwks != "":
+		provider.JwksSourceSpecifier = &jwtv3.JwtProvider_LocalJwks{
+			LocalJwks: &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: jwt.LocalJwks}},
+		}
+	case jwt.JwksUri != "":
+		if _, _, _, err := jwksEndpoint(jwt.JwksUri); err != nil {
+			return nil, err
+		}
+		provider.JwksSourceSpecifier = &jwtv3.JwtProvider_RemoteJwks{
+			RemoteJwks: &jwtv3.RemoteJwks{
+				HttpUri: &core.HttpUri{
+					Uri:              jwt.JwksUri,
+					HttpUpstreamType: &core.HttpUri_Cluster{Cluster: jwksClusterName(svc)},
+					Timeout:          durationpb.New(jwksFetchTimeout),
+				},
+			},
+		}
+	default:
+		return nil, fmt.Errorf("JWT authentication requires a JWKS URI or a local JWKS")
+	}
+	return provider, nil
+}
+
+// buildJwtRequirement returns the per-route config requiring a valid token from the service's provider
+func buildJwtRequirement(svc *types2.DiscoveredService) (*anypb.Any, error) {
+	return anypb.New(&jwtv3.PerRouteConfig{
+		RequirementSpecifier: &jwtv3.PerRouteConfig_RequirementName{RequirementName: jwtProviderName(svc)},
+	})
+}
+
+// buildJwtAuthentication returns the filter config holding every provider and a requirement of the same
+// name for each. Routes select a requirement through their per-route config, routes without one are not checked.
+func buildJwtAuthentication(providers map[string]*jwtv3.JwtProvider) *jwtv3.JwtAuthentication {
+	authn := &jwtv3.JwtAuthentication{
+		Providers:      providers,
+		RequirementMap: make(map[string]*jwtv3.JwtRequirement, len(providers)),
+	}
+	for name := range providers {
+		authn.RequirementMap[name] = &jwtv3.JwtRequirement{
+			RequiresType: &jwtv3.JwtRequirement_ProviderName{ProviderName: name},
+		}
+	}
+	return authn
+}
+
+// buildJwksCluster creates the cluster a service's remote JWKS is fetched through, using TLS for https URIs
+func (s *SnapshotManager) buildJwksCluster(svc *types2.DiscoveredService) (*cluster.Cluster, error) {
+	u, host, port, err := jwksEndpoint(svc.Jwt.JwksUri)
+	if err != nil {
+		return nil, err
+	}
+	name := jwksClusterName(svc)
+	jwks := &types2.DiscoveredService{
+		Name:      name,
+		Instances: []types2.ServiceInstance{{Address: host, Port: int(port)}},
+	}
+
+	dnsClusterAny, err := anypb.New(&dnscluster.DnsCluster{
+		DnsLookupFamily:              commondns.DnsLookupFamily_V4_ONLY,
+		RespectDnsTtl:                true,
+		AllAddressesInSingleEndpoint: true,
+		TypedDnsResolverConfig:       s.dnsResolver,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JWKS DnsCluster config: %w", err)
+	}
+
+	cl := &cluster.Cluster{
+		Name:           name,
+		ConnectTimeout: durationpb.New(defaultConnectTimeout),
+		ClusterDiscoveryType: &cluster.Cluster_ClusterType{
+			ClusterType: &cluster.Cluster_CustomClusterType{
+				Name:        "envoy.clusters.dns",
+				TypedConfig: dnsClusterAny,
+			},
+		},
+		LoadAssignment: &endpoint.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints:   buildLocalityEndpoints(jwks),
+		},
+	}
+	if u.Scheme == "https" {
+		tlsContextAny, err := anypb.New(buildUpstreamTlsContext(jwks, s.upstreamCaFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JWKS TLS context: %w", err)
+		}
+		cl.TransportSocket = &core.TransportSocket{
+			Name:       "envoy.transport_sockets.tls",
+			ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: tlsContextAny},
+		}
+	}
+	return cl, nil
+}
@@ -0,0 +1,70 @@
+package xds
+
+import (
+	"testing"
+
+	jwtv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+)
+
+func TestJwtRemoteAndLocalJwks(t *testing.T) {
+	remote := testService("orders")
+	remote.Jwt = &types2.JwtProvider{Issuer: "https://idp.example.com", Audiences: []string{"orders"}, JwksUri: "https://idp.example.com/.well-known/jwks.json"}
+	local := testService("users")
+	local.Jwt = &types2.JwtProvider{LocalJwks: `{"keys":[]}`}
+	both := testService("billing")
+	both.Jwt = &types2.JwtProvider{JwksUri: "https://idp.example.com/jwks.json", LocalJwks: `{"keys":[]}`}
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), remote, local, both, testService("public"))
+
+	manager := getHCM(t, getListener(t, snap, "listener_18080"))
+	var authn jwtv3.JwtAuthentication
+	for _, filter := range manager.GetHttpFilters() {
+		if filter.GetName() == jwtAuthnFilterName {
+			if err := filter.GetTypedConfig().UnmarshalTo(&authn); err != nil {
+				t.Fatalf("JWT filter config: %v", err)
+			}
+		}
+	}
+
+	remoteProvider := authn.GetProviders()["jwt_orders"]
+	httpUri := remoteProvider.GetRemoteJwks().GetHttpUri()
+	if httpUri.GetUri() != remote.Jwt.JwksUri || httpUri.GetCluster() != "jwks_orders" {
+		t.Errorf("remote JWKS = %v, want %s through jwks_orders", httpUri, remote.Jwt.JwksUri)
+	}
+	if remoteProvider.GetIssuer() != "https://idp.example.com" || len(remoteProvider.GetAudiences()) != 1 {
+		t.Errorf("remote provider = %v, want its issuer and audience", remoteProvider)
+	}
+	jwksCluster := getCluster(snap, "jwks_orders")
+	if jwksCluster == nil || jwksCluster.GetTransportSocket() == nil {
+		t.Errorf("JWKS cluster = %v, want one fetching over TLS", jwksCluster)
+	}
+
+	localProvider := authn.GetProviders()["jwt_users"]
+	if got := localProvider.GetLocalJwks().GetInlineString(); got != `{"keys":[]}` || localProvider.GetRemoteJwks() != nil {
+		t.Errorf("local provider = %v, want the inline JWKS", localProvider)
+	}
+	if getCluster(snap, "jwks_users") != nil {
+		t.Error("local JWKS got a JWKS cluster")
+	}
+
+	if _, ok := authn.GetProviders()["jwt_billing"]; ok {
+		t.Error("provider with both a JWKS URI and a local JWKS was not rejected")
+	}
+	for prefix, want := range map[string]string{"/orders": "jwt_orders", "/users": "jwt_users", "/public": ""} {
+		var perRoute jwtv3.PerRouteConfig
+		if config, ok := getRoute(t, snap, prefix).GetTypedPerFilterConfig()[jwtAuthnFilterName]; ok {
+			if err := config.UnmarshalTo(&perRoute); err != nil {
+				t.Fatalf("route %s JWT requirement: %v", prefix, err)
+			}
+		}
+		if got := perRoute.GetRequirementName(); got != want {
+			t.Errorf("route %s JWT requirement = %q, want %q", prefix, got, want)
+		}
+	}
+
+	withoutJwt := buildTestSnapshot(t, newTestManager(Config{}), testService("public"))
+	if hasHttpFilter(getHCM(t, getListener(t, withoutJwt, "listener_18080")), jwtAuthnFilterName) {
+		t.Error("JWT filter added without any service configuring JWT")
+	}
+}
@@ -0,0 +1,223 @@
+package xds
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	uuidv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/request_id/uuid/v3"
+	xdstype "github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// ParsePathWithEscapedSlashesAction maps a flag value to the HCM escaped slashes action.
+// An empty value selects Envoy's default.
+func ParsePathWithEscapedSlashesAction(value string) (hcm.HttpConnectionManager_PathWithEscapedSlashesAction, error) {
+	switch strings.ToLower(value) {
+	case "", "default":
+		return hcm.HttpConnectionManager_IMPLEMENTATION_SPECIFIC_DEFAULT, nil
+	case "keep":
+		return hcm.HttpConnectionManager_KEEP_UNCHANGED, nil
+	case "reject":
+		return hcm.HttpConnectionManager_REJECT_REQUEST, nil
+	case "unescape-and-redirect":
+		return hcm.HttpConnectionManager_UNESCAPE_AND_REDIRECT, nil
+	case "unescape-and-forward":
+		return hcm.HttpConnectionManager_UNESCAPE_AND_FORWARD, nil
+	default:
+		return 0, fmt.Errorf("invalid escaped slashes action %q: must be keep, reject, unescape-and-redirect, or unescape-and-forward", value)
+	}
+}
+
+// defaultListenAddress is the address listeners bind to when none is configured, every IPv4 interface
+const defaultListenAddress = "0.0.0.0"
+
+// ParseListenAddress validates the IP address listeners bind to, accepting bracketed IPv6 literals.
+// An empty value selects every IPv4 interface.
+func ParseListenAddress(value string) (string, error) {
+	if value == "" {
+		return defaultListenAddress, nil
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if ip == nil {
+		return "", fmt.Errorf("invalid listen address %q: must be an IPv4 or IPv6 address", value)
+	}
+	return ip.String(), nil
+}
+
+// listenAddress returns the configured listener bind address, every IPv4 interface by default
+func (s *SnapshotManager) listenAddress() string {
+	if s.listenAddr == "" {
+		return defaultListenAddress
+	}
+	return s.listenAddr
+}
+
+// RequestIdOptions controls how every listener generates and propagates x-request-id.
+// Nil fields keep Envoy's defaults.
+type RequestIdOptions struct {
+	Generate            *bool // Generate an x-request-id for requests without one (Envoy default: true)
+	PreserveExternal    bool  // Keep the x-request-id sent by edge clients instead of replacing it
+	PackTraceReason     *bool // Encode the trace sampling decision in the UUID (Envoy default: true)
+	UseForTraceSampling *bool // Sample traces by the request id (Envoy default: true)
+}
+
+// buildRequestIdExtension returns the UUID request id extension, or nil when its defaults are kept
+func buildRequestIdExtension(opts RequestIdOptions) (*hcm.RequestIDExtension, error) {
+	if opts.PackTraceReason == nil && opts.UseForTraceSampling == nil {
+		return nil, nil
+	}
+	uuidConfig := &uuidv3.UuidRequestIdConfig{}
+	if opts.PackTraceReason != nil {
+		uuidConfig.PackTraceReason = wrapperspb.Bool(*opts.PackTraceReason)
+	}
+	if opts.UseForTraceSampling != nil {
+		uuidConfig.UseRequestIdForTraceSampling = wrapperspb.Bool(*opts.UseForTraceSampling)
+	}
+	uuidAny, err := anypb.New(uuidConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request id extension: %w", err)
+	}
+	return &hcm.RequestIDExtension{TypedConfig: uuidAny}, nil
+}
+
+// buildHttpConnectionManager creates the HCM for a listener, routing through RDS via ADS,
+// or through scoped routes when given scopedRoutesName as the route config name
+func (s *SnapshotManager) buildHttpConnectionManager(opts ListenerOptions, filters httpFilterSet, routeConfigName string) (*hcm.HttpConnectionManager, error) {
+	httpFilters, err := buildHttpFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	statPrefix := s.statPrefix
+	if statPrefix == "" {
+		statPrefix = "ingress_http"
+	}
+
+	hcmCfg := &hcm.HttpConnectionManager{
+		StatPrefix:                   statPrefix,
+		CodecType:                    hcm.HttpConnectionManager_AUTO,
+		Http2ProtocolOptions:         &core.Http2ProtocolOptions{},
+		PathWithEscapedSlashesAction: s.pathWithEscapedSlashesAction,
+		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
+			Rds: &hcm.Rds{
+				ConfigSource: &core.ConfigSource{
+					ResourceApiVersion: core.ApiVersion_V3,
+					ConfigSourceSpecifier: &core.ConfigSource_Ads{
+						Ads: &core.AggregatedConfigSource{},
+					},
+				},
+				RouteConfigName: routeConfigName,
+			},
+		},
+		HttpFilters: httpFilters,
+	}
+
+	if routeConfigName == scopedRoutesName && s.scopedRoutes != nil {
+		hcmCfg.RouteSpecifier = &hcm.HttpConnectionManager_ScopedRoutes{ScopedRoutes: buildScopedRoutes(s.scopedRoutes)}
+	}
+
+	if len(filters.localReplyMappers) > 0 {
+		hcmCfg.LocalReplyConfig = &hcm.LocalReplyConfig{Mappers: filters.localReplyMappers}
+	}
+
+	hcmCfg.AccessLog, err = buildAccessLogs(s.accessLog)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.requestId.Generate != nil {
+		hcmCfg.GenerateRequestId = wrapperspb.Bool(*s.requestId.Generate)
+	}
+	hcmCfg.PreserveExternalRequestId = s.requestId.PreserveExternal
+	hcmCfg.RequestIdExtension, err = buildRequestIdExtension(s.requestId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only set HTTP/1.1 options when something deviates from Envoy's defaults
+	if opts.AcceptHttp10 || opts.AllowAbsoluteUrl {
+		http1Opts := &core.Http1ProtocolOptions{
+			AcceptHttp_10:         opts.AcceptHttp10,
+			DefaultHostForHttp_10: opts.DefaultHostForHttp10,
+		}
+		if opts.AllowAbsoluteUrl {
+			http1Opts.AllowAbsoluteUrl = wrapperspb.Bool(true)
+		}
+		hcmCfg.HttpProtocolOptions = http1Opts
+	}
+
+	return hcmCfg, nil
+}
+
+// buildFilterChainMatch converts the match spec, failing on invalid CIDRs
+func buildFilterChainMatch(spec *FilterChainMatch) (*listener.FilterChainMatch, error) {
+	match := &listener.FilterChainMatch{
+		TransportProtocol: spec.TransportProtocol,
+		ServerNames:       spec.ServerNames,
+	}
+	if spec.DestinationPort > 0 {
+		match.DestinationPort = wrapperspb.UInt32(spec.DestinationPort)
+	}
+	for _, cidr := range spec.SourcePrefixRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source prefix range %q: %w", cidr, err)
+		}
+		prefixLen, _ := ipNet.Mask.Size()
+		match.SourcePrefixRanges = append(match.SourcePrefixRanges, &core.CidrRange{
+			AddressPrefix: ipNet.IP.String(),
+			PrefixLen:     wrapperspb.UInt32(uint32(prefixLen)),
+		})
+	}
+	return match, nil
+}
+
+// buildListener creates a listener on the given port with a single HCM filter chain
+func (s *SnapshotManager) buildListener(port uint32, filters httpFilterSet, routeConfigName string) (*listener.Listener, error) {
+	opts := s.listenerOptions[port]
+	hcmCfg, err := s.buildHttpConnectionManager(opts, filters, routeConfigName)
+	if err != nil {
+		return nil, err
+	}
+	hcmAny, err := anypb.New(hcmCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal HCM: %w", err)
+	}
+
+	filterChain := &listener.FilterChain{
+		Filters: []*listener.Filter{{
+			Name:       xdstype.HTTPConnectionManager,
+			ConfigType: &listener.Filter_TypedConfig{TypedConfig: hcmAny},
+		}},
+	}
+
+	ln := &listener.Listener{
+		Name: fmt.Sprintf("listener_%d", port),
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Address:       s.listenAddress(),
+					PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+				},
+			},
+		},
+		FilterChains: []*listener.FilterChain{filterChain},
+	}
+
+	if opts.FilterChainMatch != nil {
+		filterChain.FilterChainMatch, err = buildFilterChainMatch(opts.FilterChainMatch)
+		if err != nil {
+			return nil, err
+		}
+		if opts.UseDefaultFilterChain {
+			ln.DefaultFilterChain = &listener.FilterChain{Filters: filterChain.Filters}
+		}
+	}
+
+	return ln, nil
+}
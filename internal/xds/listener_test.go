@@ -0,0 +1,96 @@
+package xds
+
+import (
+	"testing"
+
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	uuidv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/request_id/uuid/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+)
+
+func TestListenerHttp1Options(t *testing.T) {
+	s := newTestManager(Config{
+		ListenerPorts: []uint32{18080, 18081},
+		ListenerOptions: map[uint32]ListenerOptions{
+			18080: {AcceptHttp10: true, DefaultHostForHttp10: "legacy.example.com", AllowAbsoluteUrl: true},
+		},
+	})
+	snap := buildTestSnapshot(t, s, testService("orders"))
+
+	opts := getHCM(t, getListener(t, snap, "listener_18080")).GetHttpProtocolOptions()
+	if !opts.GetAcceptHttp_10() || opts.GetDefaultHostForHttp_10() != "legacy.example.com" || !opts.GetAllowAbsoluteUrl().GetValue() {
+		t.Errorf("listener_18080 HTTP/1 options = %v, want HTTP/1.0 with a default host and absolute URLs", opts)
+	}
+	if opts := getHCM(t, getListener(t, snap, "listener_18081")).GetHttpProtocolOptions(); opts != nil {
+		t.Errorf("listener_18081 HTTP/1 options = %v, want Envoy's defaults", opts)
+	}
+}
+
+func TestListenerPathWithEscapedSlashesAction(t *testing.T) {
+	action, err := ParsePathWithEscapedSlashesAction("unescape-and-redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := buildTestSnapshot(t, newTestManager(Config{PathWithEscapedSlashesAction: action}), testService("orders"))
+
+	if got := getHCM(t, getListener(t, snap, "listener_18080")).GetPathWithEscapedSlashesAction(); got != hcm.HttpConnectionManager_UNESCAPE_AND_REDIRECT {
+		t.Errorf("escaped slashes action = %v, want UNESCAPE_AND_REDIRECT", got)
+	}
+	if _, err := ParsePathWithEscapedSlashesAction("drop"); err == nil {
+		t.Error("invalid action accepted")
+	}
+}
+
+func TestListenerFilterChainSourceIpMatch(t *testing.T) {
+	s := newTestManager(Config{
+		ListenerOptions: map[uint32]ListenerOptions{
+			18080: {
+				FilterChainMatch:      &FilterChainMatch{SourcePrefixRanges: []string{"10.1.0.0/16"}},
+				UseDefaultFilterChain: true,
+			},
+		},
+	})
+	ln := getListener(t, buildTestSnapshot(t, s, testService("orders")), "listener_18080")
+
+	ranges := ln.GetFilterChains()[0].GetFilterChainMatch().GetSourcePrefixRanges()
+	if len(ranges) != 1 || ranges[0].GetAddressPrefix() != "10.1.0.0" || ranges[0].GetPrefixLen().GetValue() != 16 {
+		t.Errorf("source prefix ranges = %v, want 10.1.0.0/16", ranges)
+	}
+	if ln.GetDefaultFilterChain() == nil {
+		t.Error("listener has no default filter chain")
+	}
+
+	s = newTestManager(Config{
+		ListenerOptions: map[uint32]ListenerOptions{18080: {FilterChainMatch: &FilterChainMatch{SourcePrefixRanges: []string{"10.1.0.0"}}}},
+	})
+	if _, err := s.BuildSnapshot([]*types2.DiscoveredService{testService("orders")}); err == nil {
+		t.Error("snapshot with an invalid CIDR built")
+	}
+}
+
+func TestListenerRequestIdOptions(t *testing.T) {
+	generate, packTraceReason := false, false
+	snap := buildTestSnapshot(t, newTestManager(Config{
+		RequestId: RequestIdOptions{Generate: &generate, PreserveExternal: true, PackTraceReason: &packTraceReason},
+	}), testService("orders"))
+
+	hcmCfg := getHCM(t, getListener(t, snap, "listener_18080"))
+	if got := hcmCfg.GetGenerateRequestId(); got == nil || got.GetValue() {
+		t.Errorf("generate request id = %v, want false", got)
+	}
+	if !hcmCfg.GetPreserveExternalRequestId() {
+		t.Error("external request id not preserved")
+	}
+	var uuidConfig uuidv3.UuidRequestIdConfig
+	if err := hcmCfg.GetRequestIdExtension().GetTypedConfig().UnmarshalTo(&uuidConfig); err != nil {
+		t.Fatalf("request id extension: %v", err)
+	}
+	if got := uuidConfig.GetPackTraceReason(); got == nil || got.GetValue() {
+		t.Errorf("pack trace reason = %v, want false", got)
+	}
+
+	defaults := getHCM(t, getListener(t, buildTestSnapshot(t, newTestManager(Config{}), testService("orders")), "listener_18080"))
+	if defaults.GetGenerateRequestId() != nil || defaults.GetRequestIdExtension() != nil {
+		t.Errorf("default HCM request id settings = %v, %v, want Envoy's defaults", defaults.GetGenerateRequestId(), defaults.GetRequestIdExtension())
+	}
+}
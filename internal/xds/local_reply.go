@@ -0,0 +1,105 @@
+package xds
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// pathMatcher matches the :path header like the route matches the path. The header includes the query
+// string, which regex and exact matches have to allow for.
+func pathMatcher(rp *types2.RoutePattern) *matcher.StringMatcher {
+	regex := pathRegex(rp)
+	if rp.MatchType == "exact" {
+		regex = regexp.QuoteMeta(rp.PathPrefix)
+	}
+	if regex != "" {
+		return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{Regex: "(?:" + regex + `)(?:\?.*)?`},
+		}}
+	}
+	return &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: rp.PathPrefix}}
+}
+
+// buildUnauthorizedRedirect creates a local reply mapper turning the 401s Envoy generates itself
+// (for example from an auth filter) into a redirect to the route's login URL. Local replies are
+// configured on the connection manager, so the mapper is scoped to the route by matching the
+// request's path, header and hosts the same way the route does.
+func buildUnauthorizedRedirect(rp *types2.RoutePattern) (*hcm.ResponseMapper, error) {
+	location, err := url.Parse(rp.UnauthorizedRedirect)
+	if err != nil || (!location.IsAbs() && !(len(location.Path) > 0 && location.Path[0] == '/')) {
+		return nil, fmt.Errorf("invalid unauthorized redirect %q, must be an absolute URL or path", rp.UnauthorizedRedirect)
+	}
+
+	filters := []*accesslog.AccessLogFilter{
+		{
+			FilterSpecifier: &accesslog.AccessLogFilter_StatusCodeFilter{
+				StatusCodeFilter: &accesslog.StatusCodeFilter{
+					Comparison: &accesslog.ComparisonFilter{
+						Op:    accesslog.ComparisonFilter_EQ,
+						Value: &core.RuntimeUInt32{DefaultValue: 401, RuntimeKey: "flexds.unauthorized_status"},
+					},
+				},
+			},
+		},
+		headerFilter(":path", pathMatcher(rp)),
+	}
+	if matchesHeader(rp) {
+		headerMatcher, err := buildHeaderMatcher(rp)
+		if err != nil {
+			return nil, err
+		}
+		if headerMatcher != nil {
+			filters = append(filters, &accesslog.AccessLogFilter{
+				FilterSpecifier: &accesslog.AccessLogFilter_HeaderFilter{HeaderFilter: &accesslog.HeaderFilter{Header: headerMatcher}},
+			})
+		}
+	}
+	if len(rp.Hosts) > 0 && !slices.Contains(rp.Hosts, "*") {
+		hostFilters := make([]*accesslog.AccessLogFilter, 0, len(rp.Hosts))
+		for _, host := range rp.Hosts {
+			hostFilters = append(hostFilters, headerFilter(":authority", &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: host}}))
+		}
+		if len(hostFilters) == 1 {
+			filters = append(filters, hostFilters[0])
+		} else {
+			filters = append(filters, &accesslog.AccessLogFilter{
+				FilterSpecifier: &accesslog.AccessLogFilter_OrFilter{OrFilter: &accesslog.OrFilter{Filters: hostFilters}},
+			})
+		}
+	}
+
+	return &hcm.ResponseMapper{
+		Filter: &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_AndFilter{AndFilter: &accesslog.AndFilter{Filters: filters}},
+		},
+		StatusCode: wrapperspb.UInt32(302),
+		HeadersToAdd: []*core.HeaderValueOption{{
+			Header:       &core.HeaderValue{Key: "location", Value: rp.UnauthorizedRedirect},
+			AppendAction: core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		}},
+	}, nil
+}
+
+// headerFilter matches requests whose header matches value
+func headerFilter(name string, value *matcher.StringMatcher) *accesslog.AccessLogFilter {
+	return &accesslog.AccessLogFilter{
+		FilterSpecifier: &accesslog.AccessLogFilter_HeaderFilter{
+			HeaderFilter: &accesslog.HeaderFilter{
+				Header: &route.HeaderMatcher{
+					Name:                 name,
+					HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{StringMatch: value},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,48 @@
+package xds
+
+import (
+	"testing"
+)
+
+func TestUnauthorizedRedirectLocalReply(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes[0].UnauthorizedRedirect = "https://login.example.com/"
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc)
+
+	manager := getHCM(t, getListener(t, snap, "listener_18080"))
+	if err := manager.ValidateAll(); err != nil {
+		t.Fatalf("invalid HTTP connection manager: %v", err)
+	}
+	mappers := manager.GetLocalReplyConfig().GetMappers()
+	if len(mappers) != 1 {
+		t.Fatalf("got %d local reply mappers, want 1", len(mappers))
+	}
+	mapper := mappers[0]
+	if mapper.GetStatusCode().GetValue() != 302 {
+		t.Errorf("mapped status = %v, want 302", mapper.GetStatusCode())
+	}
+	if h := mapper.GetHeadersToAdd(); len(h) != 1 || h[0].GetHeader().GetKey() != "location" || h[0].GetHeader().GetValue() != "https://login.example.com/" {
+		t.Errorf("mapped headers = %v, want the login location", h)
+	}
+
+	filters := mapper.GetFilter().GetAndFilter().GetFilters()
+	if len(filters) != 2 {
+		t.Fatalf("got %d mapper filters, want the status and the route's path", len(filters))
+	}
+	if status := filters[0].GetStatusCodeFilter().GetComparison(); status.GetValue().GetDefaultValue() != 401 {
+		t.Errorf("status filter = %v, want 401", status)
+	}
+	if path := filters[1].GetHeaderFilter().GetHeader(); path.GetName() != ":path" || path.GetStringMatch().GetPrefix() != "/orders" {
+		t.Errorf("path filter = %v, want the /orders prefix", path)
+	}
+}
+
+func TestUnauthorizedRedirectRejectsRelativeLocation(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes[0].UnauthorizedRedirect = "login"
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc)
+
+	if getRoute(t, snap, "/orders") != nil {
+		t.Error("route with an invalid unauthorized redirect was kept")
+	}
+}
@@ -0,0 +1,48 @@
+package xds
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ClusterNamePolicy controls how service names are turned into Envoy cluster names. Service names
+// from Consul or Marathon can contain characters such as '/' and '.' that are legal in cluster
+// names but split or clutter Envoy's stats. When the name changes, the original service name is kept
+// in the cluster's metadata under the "flexds" filter metadata key.
+type ClusterNamePolicy struct {
+	ReplaceInvalid bool // Replace every character other than letters, digits, '_' and '-' with '_'
+	Lowercase      bool // Lowercase the name
+}
+
+// ParseClusterNamePolicy maps a flag value to a cluster name policy: none (the default),
+// sanitize to replace unsafe characters, or sanitize-lowercase to also lowercase the name
+func ParseClusterNamePolicy(value string) (ClusterNamePolicy, error) {
+	switch strings.ToLower(value) {
+	case "", "none":
+		return ClusterNamePolicy{}, nil
+	case "sanitize":
+		return ClusterNamePolicy{ReplaceInvalid: true}, nil
+	case "sanitize-lowercase":
+		return ClusterNamePolicy{ReplaceInvalid: true, Lowercase: true}, nil
+	default:
+		return ClusterNamePolicy{}, fmt.Errorf("invalid cluster name policy %q, must be none, sanitize, or sanitize-lowercase", value)
+	}
+}
+
+// Apply returns the cluster name for a service name
+func (p ClusterNamePolicy) Apply(name string) string {
+	if p.Lowercase {
+		name = strings.ToLower(name)
+	}
+	if p.ReplaceInvalid {
+		name = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+				return r
+			default:
+				return '_'
+			}
+		}, name)
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+package xds
+
+import "testing"
+
+func TestClusterNamePolicyApply(t *testing.T) {
+	tests := []struct {
+		policy string
+		name   string
+		want   string
+	}{
+		{policy: "none", name: "payments/API.v2", want: "payments/API.v2"},
+		{policy: "sanitize", name: "payments/API.v2", want: "payments_API_v2"},
+		{policy: "sanitize", name: "team:orders@eu-west 1", want: "team_orders_eu-west_1"},
+		{policy: "sanitize-lowercase", name: "payments/API.v2", want: "payments_api_v2"},
+		{policy: "sanitize-lowercase", name: "Already_Safe-1", want: "already_safe-1"},
+	}
+	for _, tt := range tests {
+		policy, err := ParseClusterNamePolicy(tt.policy)
+		if err != nil {
+			t.Fatalf("ParseClusterNamePolicy(%q): %v", tt.policy, err)
+		}
+		if got := policy.Apply(tt.name); got != tt.want {
+			t.Errorf("%s.Apply(%q) = %q, want %q", tt.policy, tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := ParseClusterNamePolicy("strip"); err == nil {
+		t.Error("ParseClusterNamePolicy(strip) succeeded, want an error")
+	}
+}
+
+func TestSanitizedClusterKeepsServiceName(t *testing.T) {
+	policy, err := ParseClusterNamePolicy("sanitize-lowercase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := testService("payments/API.v2")
+	svc.Routes[0].PathPrefix = "/payments"
+
+	snap := buildTestSnapshot(t, newTestManager(Config{ClusterNamePolicy: policy}), svc, testService("orders"))
+
+	cl := getCluster(snap, "payments_api_v2")
+	if cl == nil {
+		t.Fatal("no payments_api_v2 cluster")
+	}
+	if got := cl.GetMetadata().GetFilterMetadata()["flexds"].GetFields()["service"].GetStringValue(); got != "payments/API.v2" {
+		t.Errorf("cluster metadata service = %q, want payments/API.v2", got)
+	}
+	if got := getRoute(t, snap, "/payments").GetRoute().GetCluster(); got != "payments_api_v2" {
+		t.Errorf("route cluster = %q, want payments_api_v2", got)
+	}
+	if md := getCluster(snap, "orders").GetMetadata(); md != nil {
+		t.Errorf("unchanged cluster name has metadata %v, want none", md)
+	}
+}
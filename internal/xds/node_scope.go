@@ -0,0 +1,76 @@
+package xds
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// nodeServicesKey is the node metadata field scoping a node to a subset of services, given as a list
+// or a comma-separated string of service names
+const nodeServicesKey = "flexds_services"
+
+// nodeServiceScope returns the sorted service names a node's metadata scopes it to, nil for all services
+func nodeServiceScope(node *core.Node) []string {
+	value, ok := node.GetMetadata().GetFields()[nodeServicesKey]
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	switch kind := value.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		for _, name := range strings.Split(kind.StringValue, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	case *structpb.Value_ListValue:
+		for _, item := range kind.ListValue.GetValues() {
+			if name := strings.TrimSpace(item.GetStringValue()); name != "" {
+				names = append(names, name)
+			}
+		}
+	default:
+		slog.Warn("Ignoring node metadata, expected a list or comma-separated string of service names",
+			"nodeID", node.GetId(), "key", nodeServicesKey)
+		return nil
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// scopedServices returns the services in scope, along with the services their weighted routes and
+// mirrors send traffic to, so the routes of a scoped node don't point at missing clusters
+func scopedServices(services []*types2.DiscoveredService, scope []string) []*types2.DiscoveredService {
+	included := make(map[string]bool, len(scope))
+	for _, svc := range services {
+		if !slices.Contains(scope, svc.Name) {
+			continue
+		}
+		included[svc.Name] = true
+		for _, rp := range svc.Routes {
+			for _, wc := range rp.WeightedClusters {
+				included[wc.Name] = true
+			}
+			if rp.MirrorCluster != "" {
+				included[rp.MirrorCluster] = true
+			}
+		}
+	}
+
+	selected := make([]*types2.DiscoveredService, 0, len(included))
+	for _, svc := range services {
+		if included[svc.Name] {
+			selected = append(selected, svc)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,87 @@
+package xds
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// scopedNode returns a node whose metadata scopes it to services, unscoped when services is nil
+func scopedNode(t *testing.T, id string, services any) *core.Node {
+	t.Helper()
+	node := &core.Node{Id: id}
+	if services != nil {
+		metadata, err := structpb.NewStruct(map[string]any{nodeServicesKey: services})
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Metadata = metadata
+	}
+	return node
+}
+
+func TestNodeServiceScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		services any
+		want     []string
+	}{
+		{"unscoped", nil, nil},
+		{"list", []any{"payments", "orders", "payments"}, []string{"orders", "payments"}},
+		{"comma-separated", " payments, orders,, ", []string{"orders", "payments"}},
+		{"empty", "", nil},
+		{"unsupported type", 3.0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nodeServiceScope(scopedNode(t, "envoy", tt.services)); !slices.Equal(got, tt.want) {
+				t.Errorf("got scope %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScopedNodeSnapshot(t *testing.T) {
+	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
+	s := newTestManager(Config{Cache: cache})
+	payments := testService("payments")
+	payments.Routes[0].MirrorCluster = "payments-shadow"
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders"), payments, testService("payments-shadow"), testService("users")})
+
+	clustersOf := func(nodeID string) []string {
+		t.Helper()
+		snap, err := cache.GetSnapshot(nodeID)
+		if err != nil {
+			t.Fatalf("no snapshot for %s: %v", nodeID, err)
+		}
+		return slices.Sorted(maps.Keys(snap.GetResources(resource.ClusterType)))
+	}
+
+	// A scoped node also gets the clusters its services' routes mirror to
+	if err := s.EnsureNodeSnapshot(scopedNode(t, "payments-envoy", []any{"payments"})); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clustersOf("payments-envoy"), []string{"payments", "payments-shadow"}; !slices.Equal(got, want) {
+		t.Errorf("scoped node got clusters %v, want %v", got, want)
+	}
+	if err := s.EnsureNodeSnapshot(scopedNode(t, "edge-envoy", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got := clustersOf("edge-envoy"); len(got) != 4 {
+		t.Errorf("unscoped node got clusters %v, want all 4", got)
+	}
+
+	// A node reconnecting with a different scope gets a new snapshot
+	if err := s.EnsureNodeSnapshot(scopedNode(t, "payments-envoy", "users")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clustersOf("payments-envoy"), []string{"users"}; !slices.Equal(got, want) {
+		t.Errorf("rescoped node got clusters %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+package xds
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+)
+
+// RESTPaths are the REST-JSON discovery endpoints polled by Envoys using the REST API type
+var RESTPaths = []string{
+	resource.FetchClusters,
+	resource.FetchEndpoints,
+	resource.FetchListeners,
+	resource.FetchRoutes,
+}
+
+// RESTHandler serves xDS over REST-JSON from the same cache as the gRPC server
+type RESTHandler struct {
+	gateway serverv3.HTTPGateway
+}
+
+func NewRESTHandler(adsServer serverv3.Server) *RESTHandler {
+	return &RESTHandler{gateway: serverv3.HTTPGateway{Server: adsServer}}
+}
+
+func (h *RESTHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, status, err := h.gateway.ServeHTTP(r)
+	if err != nil {
+		slog.Debug("REST xDS request failed", "path", r.URL.Path, "status", status, "error", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
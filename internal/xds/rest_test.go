@@ -0,0 +1,50 @@
+package xds
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestRESTHandlerServesClusters(t *testing.T) {
+	s := newTestManager(Config{})
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders")})
+	adsServer := serverv3.NewServer(context.Background(), s.cache, &ServerCallbacks{Snapshots: s})
+	server := httptest.NewServer(NewRESTHandler(adsServer))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+resource.FetchClusters, "application/json", strings.NewReader(`{"node": {"id": "edge-1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d with content type %q, want a JSON 200", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response discovery.DiscoveryResponse
+	if err := protojson.Unmarshal(body, &response); err != nil {
+		t.Fatalf("response is not a JSON discovery response: %v", err)
+	}
+	if response.GetTypeUrl() != resource.ClusterType || len(response.GetResources()) != 1 {
+		t.Fatalf("got %d resources of type %s, want one cluster", len(response.GetResources()), response.GetTypeUrl())
+	}
+	var cl cluster.Cluster
+	if err := response.GetResources()[0].UnmarshalTo(&cl); err != nil || cl.GetName() != "orders" {
+		t.Errorf("got cluster %q (%v), want orders", cl.GetName(), err)
+	}
+}
@@ -0,0 +1,554 @@
+package xds
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const defaultVirtualHostName = "default"
+
+// virtualHostBuilder groups routes into one virtual host per domain.
+// Envoy rejects a route configuration where the same domain appears in more than one
+// virtual host, so a route listing several hosts is added to the virtual host of each.
+type virtualHostBuilder struct {
+	order []string
+	hosts map[string]*route.VirtualHost
+
+	// Policies shared by every virtual host
+	retryPolicy          *route.RetryPolicy
+	typedPerFilterConfig map[string]*anypb.Any
+}
+
+// newVirtualHostBuilder creates a builder applying the configured virtual host retry and CORS policies
+func (s *SnapshotManager) newVirtualHostBuilder() (*virtualHostBuilder, error) {
+	b := &virtualHostBuilder{hosts: make(map[string]*route.VirtualHost)}
+	if s.virtualHostRetry != nil {
+		b.retryPolicy = buildRetryPolicy("virtual-host", s.virtualHostRetry)
+	}
+	if s.virtualHostCors != nil {
+		corsAny, err := buildCorsPolicy(s.virtualHostCors)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal virtual host CORS policy: %w", err)
+		}
+		b.typedPerFilterConfig = map[string]*anypb.Any{corsFilterName: corsAny}
+	}
+	return b, nil
+}
+
+// defaultRouteConfigName is the route configuration shared by every listener when no service selects listener ports
+const defaultRouteConfigName = "local_route"
+
+// routeTable collects the routes of one route configuration and the HCM settings they rely on
+type routeTable struct {
+	name      string
+	port      uint32 // listener port served by the table, zero when shared by every listener
+	scope     string // scope key selecting the table when scoped routes are in use
+	vhBuilder *virtualHostBuilder
+	filters   httpFilterSet
+}
+
+// newRouteTables returns a single route table shared by all listeners, or one per listener port
+// ordered like the listener ports when any service is restricted to specific ports.
+// With scoped routes enabled and services declaring scopes, it returns one table per scope instead.
+func (s *SnapshotManager) newRouteTables(services []*types2.DiscoveredService) ([]*routeTable, error) {
+	if s.scopedRoutes != nil {
+		if scopes := routeScopes(services); len(scopes) > 0 {
+			return s.newScopedRouteTables(services, scopes)
+		}
+	}
+
+	ports := []uint32{0}
+	if hasListenerPortSelectors(services) {
+		ports = s.listenerPorts
+		for _, svc := range services {
+			if svc.Protocol == types2.ProtocolTCP {
+				continue
+			}
+			for _, port := range svc.ListenerPorts {
+				if !slices.Contains(s.listenerPorts, port) {
+					slog.Warn("Service selects a listener port that is not configured", "service", svc.Name, "port", port, telemetry.InvalidConfigKey, "setting")
+				}
+			}
+		}
+	}
+
+	tables := make([]*routeTable, 0, len(ports))
+	for _, port := range ports {
+		vhBuilder, err := s.newVirtualHostBuilder()
+		if err != nil {
+			return nil, err
+		}
+		name := defaultRouteConfigName
+		if port != 0 {
+			name = fmt.Sprintf("%s_%d", defaultRouteConfigName, port)
+		}
+		tables = append(tables, &routeTable{
+			name:      name,
+			port:      port,
+			vhBuilder: vhBuilder,
+			filters:   httpFilterSet{cors: s.virtualHostCors != nil, grpcWeb: s.grpcWeb},
+		})
+	}
+	return tables, nil
+}
+
+// newScopedRouteTables returns one route table per scope, shared by every listener
+func (s *SnapshotManager) newScopedRouteTables(services []*types2.DiscoveredService, scopes []string) ([]*routeTable, error) {
+	if hasListenerPortSelectors(services) {
+		slog.Warn("Listener port selection is not supported with scoped routes, every listener serves every scope")
+	}
+
+	tables := make([]*routeTable, 0, len(scopes))
+	for _, scope := range scopes {
+		vhBuilder, err := s.newVirtualHostBuilder()
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, &routeTable{
+			name:      fmt.Sprintf("%s_scope_%s", defaultRouteConfigName, scope),
+			scope:     scope,
+			vhBuilder: vhBuilder,
+			filters:   httpFilterSet{cors: s.virtualHostCors != nil, grpcWeb: s.grpcWeb},
+		})
+	}
+	return tables, nil
+}
+
+// serves reports whether the service's routes belong in this table
+func (t *routeTable) serves(svc *types2.DiscoveredService) bool {
+	if t.scope != "" {
+		return svc.RouteScope == "" || svc.RouteScope == t.scope
+	}
+	return t.port == 0 || len(svc.ListenerPorts) == 0 || slices.Contains(svc.ListenerPorts, t.port)
+}
+
+// add appends the route, and its local reply mapper when it has one, to the table
+func (t *routeTable) add(domains []string, r *route.Route, mapper *hcm.ResponseMapper) {
+	t.vhBuilder.add(domains, r)
+	if _, ok := r.TypedPerFilterConfig[corsFilterName]; ok {
+		t.filters.cors = true
+	}
+	// Any route's transcoder config will do at the filter level, which is disabled by default
+	if grpcJson, ok := r.TypedPerFilterConfig[grpcJsonTranscoderFilterName]; ok && t.filters.grpcJson == nil {
+		t.filters.grpcJson = grpcJson
+	}
+	if mapper != nil {
+		t.filters.localReplyMappers = append(t.filters.localReplyMappers, mapper)
+	}
+}
+
+// hasListenerPortSelectors reports whether any HTTP service is restricted to specific listener ports
+func hasListenerPortSelectors(services []*types2.DiscoveredService) bool {
+	for _, svc := range services {
+		if len(svc.ListenerPorts) > 0 && svc.Protocol != types2.ProtocolTCP {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends the route to the virtual host of every domain, falling back to "*" when none are given
+func (b *virtualHostBuilder) add(domains []string, r *route.Route) {
+	if len(domains) == 0 {
+		domains = []string{"*"}
+	}
+	for _, domain := range domains {
+		vh, ok := b.hosts[domain]
+		if !ok {
+			name := domain
+			if domain == "*" {
+				name = defaultVirtualHostName
+			}
+			vh = &route.VirtualHost{
+				Name:                 name,
+				Domains:              []string{domain},
+				RetryPolicy:          b.retryPolicy,
+				TypedPerFilterConfig: b.typedPerFilterConfig,
+			}
+			b.hosts[domain] = vh
+			b.order = append(b.order, domain)
+		}
+		vh.Routes = append(vh.Routes, r)
+	}
+}
+
+// build returns the virtual hosts in the order their domains were first seen
+func (b *virtualHostBuilder) build() []*route.VirtualHost {
+	virtualHosts := make([]*route.VirtualHost, 0, len(b.order))
+	for _, domain := range b.order {
+		virtualHosts = append(virtualHosts, b.hosts[domain])
+	}
+	return virtualHosts
+}
+
+// buildRetryPolicy converts a route's retry settings, dropping a back-off whose base exceeds its max
+func buildRetryPolicy(routeName string, retry *types2.RetryPolicy) *route.RetryPolicy {
+	policy := &route.RetryPolicy{
+		RetryOn: retry.RetryOn,
+	}
+	if retry.NumRetries > 0 {
+		policy.NumRetries = wrapperspb.UInt32(retry.NumRetries)
+	}
+	if retry.PerTryTimeout > 0 {
+		policy.PerTryTimeout = durationpb.New(retry.PerTryTimeout)
+	}
+
+	if retry.BackOffBase > 0 {
+		if retry.BackOffMax > 0 && retry.BackOffBase > retry.BackOffMax {
+			slog.Warn("Retry back-off base exceeds max, ignoring back-off",
+				"route", routeName, "base", retry.BackOffBase, "max", retry.BackOffMax, telemetry.InvalidConfigKey, "setting")
+		} else {
+			policy.RetryBackOff = &route.RetryPolicy_RetryBackOff{
+				BaseInterval: durationpb.New(retry.BackOffBase),
+			}
+			if retry.BackOffMax > 0 {
+				policy.RetryBackOff.MaxInterval = durationpb.New(retry.BackOffMax)
+			}
+		}
+	} else if retry.BackOffMax > 0 {
+		slog.Warn("Retry back-off max set without a base interval, ignoring back-off", "route", routeName, telemetry.InvalidConfigKey, "setting")
+	}
+
+	return policy
+}
+
+// redirectResponseCodes maps the supported redirect status codes to Envoy's enum
+var redirectResponseCodes = map[uint32]route.RedirectAction_RedirectResponseCode{
+	301: route.RedirectAction_MOVED_PERMANENTLY,
+	302: route.RedirectAction_FOUND,
+	303: route.RedirectAction_SEE_OTHER,
+	307: route.RedirectAction_TEMPORARY_REDIRECT,
+	308: route.RedirectAction_PERMANENT_REDIRECT,
+}
+
+// buildRedirectAction converts a route's redirect settings, requiring at least one part of the URL to change
+func buildRedirectAction(redirect *types2.RedirectAction) (*route.RedirectAction, error) {
+	if redirect == nil || (redirect.Scheme == "" && redirect.Host == "" && redirect.Port == 0 && redirect.Path == "") {
+		return nil, fmt.Errorf("redirect action requires a scheme, host, port, or path")
+	}
+
+	action := &route.RedirectAction{HostRedirect: redirect.Host, PortRedirect: redirect.Port}
+	if redirect.Scheme != "" {
+		action.SchemeRewriteSpecifier = &route.RedirectAction_SchemeRedirect{SchemeRedirect: redirect.Scheme}
+	}
+	if redirect.Path != "" {
+		action.PathRewriteSpecifier = &route.RedirectAction_PathRedirect{PathRedirect: redirect.Path}
+	}
+	if redirect.ResponseCode != 0 {
+		code, ok := redirectResponseCodes[redirect.ResponseCode]
+		if !ok {
+			return nil, fmt.Errorf("invalid redirect response code %d", redirect.ResponseCode)
+		}
+		action.ResponseCode = code
+	}
+	return action, nil
+}
+
+// routeNeedsCluster reports whether the route proxies to an upstream, rather than answering by itself
+func routeNeedsCluster(rp *types2.RoutePattern) bool {
+	return rp.Action != "redirect" && rp.Action != "direct_response"
+}
+
+// buildDirectResponseAction converts a route's fixed response
+func buildDirectResponseAction(response *types2.DirectResponse) (*route.DirectResponseAction, error) {
+	if response == nil || response.Status < 200 || response.Status > 599 {
+		return nil, fmt.Errorf("direct response action requires a status between 200 and 599")
+	}
+	action := &route.DirectResponseAction{Status: response.Status}
+	if response.Body != "" {
+		action.Body = &core.DataSource{Specifier: &core.DataSource_InlineString{InlineString: response.Body}}
+	}
+	return action, nil
+}
+
+// buildRoute converts a route pattern into a route targeting the given cluster, or answering by itself
+// for the "redirect" and "direct_response" actions
+func buildRoute(clusterName string, rp *types2.RoutePattern, clusterSet map[string]string) (*route.Route, error) {
+	switch rp.Action {
+	case "", "route":
+	case "direct_response":
+		routeMatch, err := buildRouteMatch(rp)
+		if err != nil {
+			return nil, err
+		}
+		response, err := buildDirectResponseAction(rp.DirectResponse)
+		if err != nil {
+			return nil, err
+		}
+		return &route.Route{
+			Match:  routeMatch,
+			Action: &route.Route_DirectResponse{DirectResponse: response},
+		}, nil
+	case "redirect":
+		routeMatch, err := buildRouteMatch(rp)
+		if err != nil {
+			return nil, err
+		}
+		redirect, err := buildRedirectAction(rp.Redirect)
+		if err != nil {
+			return nil, err
+		}
+		return &route.Route{
+			Match:  routeMatch,
+			Action: &route.Route_Redirect{Redirect: redirect},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid route action %q", rp.Action)
+	}
+
+	ra := &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_Cluster{Cluster: clusterName},
+	}
+
+	if rp.ClusterHeader != "" {
+		if len(rp.WeightedClusters) > 0 {
+			return nil, fmt.Errorf("cluster header and weighted clusters are mutually exclusive")
+		}
+		ra.ClusterSpecifier = &route.RouteAction_ClusterHeader{ClusterHeader: rp.ClusterHeader}
+	} else if len(rp.WeightedClusters) > 0 {
+		weighted, err := buildWeightedClusters(rp.WeightedClusters, rp.TotalWeight, clusterSet)
+		if err != nil {
+			return nil, err
+		}
+		ra.ClusterSpecifier = &route.RouteAction_WeightedClusters{WeightedClusters: weighted}
+	}
+
+	// Apply rewrite: regex_rewrite takes priority, then legacy prefix_rewrite
+	if rp.RegexRewrite != "" {
+		ra.RegexRewrite = &matcher.RegexMatchAndSubstitute{
+			Pattern: &matcher.RegexMatcher{
+				Regex: rp.RegexRewrite,
+			},
+			Substitution: rp.RegexReplacement,
+		}
+		slog.Debug("configuring regex rewrite", "route", rp.Name, "pattern", rp.RegexRewrite, "substitution", rp.RegexReplacement)
+	} else if rp.PrefixRewrite != "" {
+		ra.PrefixRewrite = rp.PrefixRewrite
+		slog.Debug("configuring prefix rewrite", "route", rp.Name, "prefixRewrite", rp.PrefixRewrite)
+	}
+
+	if rp.HostRewrite != "" && rp.AutoHostRewrite {
+		return nil, fmt.Errorf("host rewrite and auto host rewrite are mutually exclusive")
+	}
+	if rp.HostRewrite != "" {
+		ra.HostRewriteSpecifier = &route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: rp.HostRewrite}
+	} else if rp.AutoHostRewrite {
+		ra.HostRewriteSpecifier = &route.RouteAction_AutoHostRewrite{AutoHostRewrite: wrapperspb.Bool(true)}
+	}
+
+	if rp.MirrorCluster != "" {
+		if mirror := buildRequestMirrorPolicy(rp, clusterSet); mirror != nil {
+			ra.RequestMirrorPolicies = []*route.RouteAction_RequestMirrorPolicy{mirror}
+		}
+	}
+
+	if rp.HashHeader != "" {
+		ra.HashPolicy = []*route.RouteAction_HashPolicy{{
+			PolicySpecifier: &route.RouteAction_HashPolicy_Header_{
+				Header: &route.RouteAction_HashPolicy_Header{HeaderName: rp.HashHeader},
+			},
+		}}
+	}
+
+	if rp.Timeout > 0 {
+		ra.Timeout = durationpb.New(rp.Timeout)
+	}
+	if rp.IdleTimeout > 0 {
+		ra.IdleTimeout = durationpb.New(rp.IdleTimeout)
+	}
+	if rp.MaxStreamDuration > 0 || rp.GrpcTimeoutHeaderMax > 0 {
+		msd := &route.RouteAction_MaxStreamDuration{}
+		if rp.MaxStreamDuration > 0 {
+			msd.MaxStreamDuration = durationpb.New(rp.MaxStreamDuration)
+		}
+		if rp.GrpcTimeoutHeaderMax > 0 {
+			msd.GrpcTimeoutHeaderMax = durationpb.New(rp.GrpcTimeoutHeaderMax)
+		}
+		ra.MaxStreamDuration = msd
+	}
+
+	if rp.Retry != nil {
+		ra.RetryPolicy = buildRetryPolicy(rp.Name, rp.Retry)
+	}
+
+	routeMatch, err := buildRouteMatch(rp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &route.Route{
+		Match:  routeMatch,
+		Action: &route.Route_Route{Route: ra},
+	}, nil
+}
+
+// buildRequestMirrorPolicy shadows the route's requests to the mirror service's cluster. The mirror is
+// dropped with a warning, rather than the route skipped, when the service has no cluster or the
+// percentage is invalid, since mirroring never affects responses.
+func buildRequestMirrorPolicy(rp *types2.RoutePattern, clusterSet map[string]string) *route.RouteAction_RequestMirrorPolicy {
+	mirrorCluster, ok := clusterSet[rp.MirrorCluster]
+	if !ok {
+		slog.Warn("Mirror service has no cluster, not mirroring", "route", rp.Name, "mirror", rp.MirrorCluster, telemetry.InvalidConfigKey, "setting")
+		return nil
+	}
+	if rp.MirrorPercent > 100 {
+		slog.Warn("Mirror percentage above 100, not mirroring", "route", rp.Name, "mirror", rp.MirrorCluster, "percent", rp.MirrorPercent, telemetry.InvalidConfigKey, "setting")
+		return nil
+	}
+	percent := rp.MirrorPercent
+	if percent == 0 {
+		percent = 100
+	}
+	return &route.RouteAction_RequestMirrorPolicy{
+		Cluster: mirrorCluster,
+		RuntimeFraction: &core.RuntimeFractionalPercent{
+			DefaultValue: &typev3.FractionalPercent{Numerator: percent, Denominator: typev3.FractionalPercent_HUNDRED},
+		},
+	}
+}
+
+// pathRegex returns the regex of a route using the "regex" match type, empty for other match types
+func pathRegex(rp *types2.RoutePattern) string {
+	if rp.MatchType != "regex" {
+		return ""
+	}
+	if rp.PathRegex != "" {
+		return rp.PathRegex
+	}
+	return rp.PathPrefix
+}
+
+// matchesHeader reports whether the route also matches its header: always with the "header" and "both"
+// match types, and with the "exact" match type when a header is configured
+func matchesHeader(rp *types2.RoutePattern) bool {
+	switch rp.MatchType {
+	case "header", "both":
+		return true
+	case "exact":
+		return rp.HeaderName != ""
+	default:
+		return false
+	}
+}
+
+// buildRouteMatch matches the route's path by prefix, exactly with the "exact" match type, or by regex
+// with the "regex" match type, plus its header when matchesHeader
+func buildRouteMatch(rp *types2.RoutePattern) (*route.RouteMatch, error) {
+	routeMatch := &route.RouteMatch{
+		PathSpecifier: &route.RouteMatch_Prefix{Prefix: rp.PathPrefix},
+	}
+
+	if rp.MatchType == "exact" {
+		if rp.PathPrefix == "" {
+			return nil, fmt.Errorf("exact match type requires a path")
+		}
+		routeMatch.PathSpecifier = &route.RouteMatch_Path{Path: rp.PathPrefix}
+	} else if regex := pathRegex(rp); regex != "" {
+		// Envoy uses RE2, whose syntax Go's regexp implements, so a regex Envoy would reject doesn't
+		// make it into the snapshot
+		if _, err := regexp.Compile(regex); err != nil {
+			return nil, fmt.Errorf("invalid path regex %q: %w", regex, err)
+		}
+		routeMatch.PathSpecifier = &route.RouteMatch_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{Regex: regex},
+		}
+	} else if rp.MatchType == "regex" {
+		return nil, fmt.Errorf("regex match type requires a path regex")
+	}
+
+	if matchesHeader(rp) {
+		headerMatcher, err := buildHeaderMatcher(rp)
+		if err != nil {
+			return nil, err
+		}
+		if headerMatcher != nil {
+			routeMatch.Headers = []*route.HeaderMatcher{headerMatcher}
+		}
+	}
+
+	return routeMatch, nil
+}
+
+// buildHeaderMatcher matches the route's header according to its header match type, returning nil when
+// the route doesn't name a header and value to match
+func buildHeaderMatcher(rp *types2.RoutePattern) (*route.HeaderMatcher, error) {
+	if rp.HeaderName == "" || (rp.HeaderValue == "" && rp.HeaderMatchType != "present") {
+		return nil, nil
+	}
+
+	var pattern *matcher.StringMatcher
+	switch rp.HeaderMatchType {
+	case "", "exact":
+		pattern = &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Exact{Exact: rp.HeaderValue}}
+	case "prefix":
+		pattern = &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Prefix{Prefix: rp.HeaderValue}}
+	case "suffix":
+		pattern = &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_Suffix{Suffix: rp.HeaderValue}}
+	case "regex":
+		if _, err := regexp.Compile(rp.HeaderValue); err != nil {
+			return nil, fmt.Errorf("invalid header regex %q: %w", rp.HeaderValue, err)
+		}
+		pattern = &matcher.StringMatcher{MatchPattern: &matcher.StringMatcher_SafeRegex{
+			SafeRegex: &matcher.RegexMatcher{Regex: rp.HeaderValue},
+		}}
+	case "present":
+		return &route.HeaderMatcher{
+			Name:                 rp.HeaderName,
+			HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{PresentMatch: true},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid header match type %q", rp.HeaderMatchType)
+	}
+
+	return &route.HeaderMatcher{
+		Name:                 rp.HeaderName,
+		HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{StringMatch: pattern},
+	}, nil
+}
+
+// buildWeightedClusters splits traffic across clusters by weight. Every weight must be positive and
+// every cluster must exist in the snapshot, otherwise Envoy would reject the route configuration.
+// Without an explicit total the weights are relative to their sum.
+func buildWeightedClusters(entries []types2.WeightedCluster, totalWeight uint32, clusterSet map[string]string) (*route.WeightedCluster, error) {
+	weighted := &route.WeightedCluster{}
+	var weightSum uint64
+	for _, wc := range entries {
+		if wc.Weight == 0 {
+			return nil, fmt.Errorf("weighted cluster %q must have a positive weight", wc.Name)
+		}
+		clusterName, ok := clusterSet[wc.Name]
+		if !ok {
+			return nil, fmt.Errorf("weighted cluster %q has no healthy instances", wc.Name)
+		}
+		weightSum += uint64(wc.Weight)
+		weighted.Clusters = append(weighted.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   clusterName,
+			Weight: wrapperspb.UInt32(wc.Weight),
+		})
+	}
+	if weightSum > math.MaxUint32 {
+		return nil, fmt.Errorf("weighted cluster weights sum to %d, exceeding the maximum of %d", weightSum, uint32(math.MaxUint32))
+	}
+	if totalWeight > 0 {
+		if weightSum != uint64(totalWeight) {
+			return nil, fmt.Errorf("weighted cluster weights sum to %d, but the total weight is %d", weightSum, totalWeight)
+		}
+		// Deprecated in Envoy, which uses the sum of the weights; set so the configured total is visible in config dumps
+		weighted.TotalWeight = wrapperspb.UInt32(totalWeight)
+	}
+	return weighted, nil
+}
@@ -0,0 +1,218 @@
+package xds
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRoutesGroupedIntoVirtualHostsByHost(t *testing.T) {
+	api := testService("api")
+	api.Routes[0].Hosts = []string{"api.example.com"}
+	web := testService("web")
+	web.Routes[0].Hosts = []string{"www.example.com"}
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), api, web)
+
+	virtualHosts := getRouteConfig(t, snap, defaultRouteConfigName).GetVirtualHosts()
+	if len(virtualHosts) != 2 {
+		t.Fatalf("got %d virtual hosts, want 2: %v", len(virtualHosts), virtualHosts)
+	}
+	for i, want := range []struct{ domain, cluster string }{{"api.example.com", "api"}, {"www.example.com", "web"}} {
+		vh := virtualHosts[i]
+		if len(vh.GetDomains()) != 1 || vh.GetDomains()[0] != want.domain {
+			t.Errorf("virtual host %d domains = %v, want [%s]", i, vh.GetDomains(), want.domain)
+		}
+		if len(vh.GetRoutes()) != 1 || vh.GetRoutes()[0].GetRoute().GetCluster() != want.cluster {
+			t.Errorf("virtual host %s routes = %v, want one route to %s", want.domain, vh.GetRoutes(), want.cluster)
+		}
+	}
+}
+
+func TestRouteRetryBackOff(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes[0].Retry = &types2.RetryPolicy{RetryOn: "5xx", NumRetries: 3, BackOffBase: 250 * time.Millisecond, BackOffMax: 2 * time.Second}
+	misconfigured := testService("billing")
+	misconfigured.Routes[0].Retry = &types2.RetryPolicy{RetryOn: "5xx", BackOffBase: 3 * time.Second, BackOffMax: time.Second}
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc, misconfigured)
+
+	policy := getRoute(t, snap, "/orders").GetRoute().GetRetryPolicy()
+	if policy.GetRetryOn() != "5xx" || policy.GetNumRetries().GetValue() != 3 {
+		t.Errorf("retry policy = %v, want 3 retries on 5xx", policy)
+	}
+	backOff := policy.GetRetryBackOff()
+	if backOff.GetBaseInterval().AsDuration() != 250*time.Millisecond || backOff.GetMaxInterval().AsDuration() != 2*time.Second {
+		t.Errorf("retry back-off = %v, want 250ms base and 2s max", backOff)
+	}
+	if backOff := getRoute(t, snap, "/billing").GetRoute().GetRetryPolicy().GetRetryBackOff(); backOff != nil {
+		t.Errorf("back-off with a base above its max = %v, want it dropped", backOff)
+	}
+}
+
+func TestVirtualHostRetryPolicy(t *testing.T) {
+	s := newTestManager(Config{VirtualHostRetry: &types2.RetryPolicy{RetryOn: "connect-failure", NumRetries: 2}})
+	snap := buildTestSnapshot(t, s, testService("orders"))
+
+	for _, vh := range getRouteConfig(t, snap, defaultRouteConfigName).GetVirtualHosts() {
+		policy := vh.GetRetryPolicy()
+		if policy.GetRetryOn() != "connect-failure" || policy.GetNumRetries().GetValue() != 2 {
+			t.Errorf("virtual host %s retry policy = %v, want 2 retries on connect-failure", vh.GetName(), policy)
+		}
+	}
+}
+
+func TestWeightedClustersTotalWeight(t *testing.T) {
+	clusterSet := map[string]string{"orders": "orders", "orders-canary": "orders-canary"}
+	tests := []struct {
+		name        string
+		weights     []uint32
+		totalWeight uint32
+		wantTotal   uint32
+		wantErr     bool
+	}{
+		{name: "sum of weights", weights: []uint32{3, 1}, wantTotal: 0},
+		{name: "explicit total", weights: []uint32{900, 100}, totalWeight: 1000, wantTotal: 1000},
+		{name: "exceeds total", weights: []uint32{90, 20}, totalWeight: 100, wantErr: true},
+		{name: "short of total", weights: []uint32{50, 20}, totalWeight: 100, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := []types2.WeightedCluster{{Name: "orders", Weight: tt.weights[0]}, {Name: "orders-canary", Weight: tt.weights[1]}}
+			weighted, err := buildWeightedClusters(entries, tt.totalWeight, clusterSet)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", weighted)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if weighted.GetTotalWeight().GetValue() != tt.wantTotal {
+				t.Errorf("total weight = %v, want %d", weighted.GetTotalWeight(), tt.wantTotal)
+			}
+			for i, cw := range weighted.GetClusters() {
+				if cw.GetWeight().GetValue() != tt.weights[i] {
+					t.Errorf("cluster %s weight = %v, want %d", cw.GetName(), cw.GetWeight(), tt.weights[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRouteWeightedClustersWithTotalWeight(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes[0].WeightedClusters = []types2.WeightedCluster{{Name: "orders", Weight: 90}, {Name: "orders-canary", Weight: 10}}
+	svc.Routes[0].TotalWeight = 100
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc, testService("orders-canary"))
+
+	weighted := getRoute(t, snap, "/orders").GetRoute().GetWeightedClusters()
+	if weighted.GetTotalWeight().GetValue() != 100 || len(weighted.GetClusters()) != 2 {
+		t.Errorf("weighted clusters = %v, want two clusters out of 100", weighted)
+	}
+}
+
+func TestRouteClusterHeader(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes[0].ClusterHeader = "x-target-cluster"
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc)
+
+	specifier := getRoute(t, snap, "/orders").GetRoute().GetClusterSpecifier()
+	if header, ok := specifier.(*route.RouteAction_ClusterHeader); !ok || header.ClusterHeader != "x-target-cluster" {
+		t.Errorf("cluster specifier = %v, want the x-target-cluster header", specifier)
+	}
+}
+
+func TestRouteClusterHeaderExcludesWeightedClusters(t *testing.T) {
+	rp := &types2.RoutePattern{
+		Name:             "orders",
+		PathPrefix:       "/orders",
+		ClusterHeader:    "x-target-cluster",
+		WeightedClusters: []types2.WeightedCluster{{Name: "orders", Weight: 90}, {Name: "orders-canary", Weight: 10}},
+	}
+	clusterSet := map[string]string{"orders": "orders", "orders-canary": "orders-canary"}
+	if r, err := buildRoute("orders", rp, clusterSet); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Errorf("got route %v and error %v, want the mutual exclusion error", r, err)
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes[0].Timeout = 30 * time.Second
+	svc.Routes[0].IdleTimeout = 5 * time.Minute
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc, testService("users"))
+
+	ra := getRoute(t, snap, "/orders").GetRoute()
+	if ra.GetTimeout().AsDuration() != 30*time.Second || ra.GetIdleTimeout().AsDuration() != 5*time.Minute {
+		t.Errorf("orders timeout = %v, idle timeout = %v, want 30s and 5m", ra.GetTimeout(), ra.GetIdleTimeout())
+	}
+	if ra := getRoute(t, snap, "/users").GetRoute(); ra.GetTimeout() != nil || ra.GetIdleTimeout() != nil {
+		t.Errorf("users timeout = %v, idle timeout = %v, want Envoy's defaults", ra.GetTimeout(), ra.GetIdleTimeout())
+	}
+}
+
+func TestRouteMaxStreamDuration(t *testing.T) {
+	streaming := testService("events")
+	streaming.Routes[0].MaxStreamDuration = 30 * time.Minute
+	streaming.Routes[0].GrpcTimeoutHeaderMax = 10 * time.Second
+	headerOnly := testService("orders")
+	headerOnly.Routes[0].GrpcTimeoutHeaderMax = 5 * time.Second
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), streaming, headerOnly, testService("users"))
+
+	msd := getRoute(t, snap, "/events").GetRoute().GetMaxStreamDuration()
+	if msd.GetMaxStreamDuration().AsDuration() != 30*time.Minute || msd.GetGrpcTimeoutHeaderMax().AsDuration() != 10*time.Second {
+		t.Errorf("events max stream duration = %v, want 30m with a 10s grpc-timeout cap", msd)
+	}
+	msd = getRoute(t, snap, "/orders").GetRoute().GetMaxStreamDuration()
+	if msd.GetMaxStreamDuration() != nil || msd.GetGrpcTimeoutHeaderMax().AsDuration() != 5*time.Second {
+		t.Errorf("orders max stream duration = %v, want only a 5s grpc-timeout cap", msd)
+	}
+	if msd := getRoute(t, snap, "/users").GetRoute().GetMaxStreamDuration(); msd != nil {
+		t.Errorf("users max stream duration = %v, want none", msd)
+	}
+}
+
+func TestRedirectRoute(t *testing.T) {
+	svc := testService("orders")
+	svc.Routes = append(svc.Routes,
+		types2.RoutePattern{Name: "old", PathPrefix: "/old-orders", Hosts: []string{"*"}, Action: "redirect",
+			Redirect: &types2.RedirectAction{Scheme: "https", Host: "shop.example.com", Path: "/orders", ResponseCode: 308}},
+		types2.RoutePattern{Name: "invalid", PathPrefix: "/legacy", Hosts: []string{"*"}, Action: "redirect",
+			Redirect: &types2.RedirectAction{Host: "shop.example.com", ResponseCode: 200}},
+	)
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), svc)
+
+	r := getRoute(t, snap, "/old-orders")
+	if r.GetRoute() != nil {
+		t.Fatalf("redirect route proxies to %q", r.GetRoute().GetCluster())
+	}
+	want := &route.RedirectAction{
+		SchemeRewriteSpecifier: &route.RedirectAction_SchemeRedirect{SchemeRedirect: "https"},
+		HostRedirect:           "shop.example.com",
+		PathRewriteSpecifier:   &route.RedirectAction_PathRedirect{PathRedirect: "/orders"},
+		ResponseCode:           route.RedirectAction_PERMANENT_REDIRECT,
+	}
+	if !proto.Equal(r.GetRedirect(), want) {
+		t.Errorf("redirect = %v, want %v", r.GetRedirect(), want)
+	}
+	for _, vh := range getRouteConfig(t, snap, defaultRouteConfigName).GetVirtualHosts() {
+		for _, r := range vh.GetRoutes() {
+			if r.GetMatch().GetPrefix() == "/legacy" {
+				t.Errorf("redirect with an invalid response code was not skipped: %v", r)
+			}
+		}
+	}
+	if _, err := buildRedirectAction(&types2.RedirectAction{ResponseCode: 302}); err == nil {
+		t.Error("redirect changing no part of the URL was accepted")
+	}
+}
@@ -0,0 +1,93 @@
+package xds
+
+import (
+	"fmt"
+	"slices"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+)
+
+// scopedRoutesName names the set of scoped route configurations every listener's HCM subscribes to
+const scopedRoutesName = "scoped_routes"
+
+// ScopedRoutesOptions enables scoped routes (SRDS): each scope gets its own route configuration,
+// selected per request by the value of a header
+type ScopedRoutesOptions struct {
+	Header string // request header whose whole value is the scope key, e.g. "x-tenant"
+}
+
+// routeScopes returns the sorted scope keys of the HTTP services
+func routeScopes(services []*types2.DiscoveredService) []string {
+	var scopes []string
+	for _, svc := range services {
+		if svc.RouteScope != "" && svc.Protocol != types2.ProtocolTCP && !slices.Contains(scopes, svc.RouteScope) {
+			scopes = append(scopes, svc.RouteScope)
+		}
+	}
+	slices.Sort(scopes)
+	return scopes
+}
+
+// buildScopedRouteConfiguration maps the table's scope key to its route configuration
+func buildScopedRouteConfiguration(table *routeTable) *route.ScopedRouteConfiguration {
+	return &route.ScopedRouteConfiguration{
+		Name:                   fmt.Sprintf("scope_%s", table.scope),
+		RouteConfigurationName: table.name,
+		Key: &route.ScopedRouteConfiguration_Key{
+			Fragments: []*route.ScopedRouteConfiguration_Key_Fragment{{
+				Type: &route.ScopedRouteConfiguration_Key_Fragment_StringKey{StringKey: table.scope},
+			}},
+		},
+	}
+}
+
+// buildScopedRoutes configures an HCM to pick the route configuration of the scope named by the header,
+// fetching both the scopes and their route configurations over ADS
+func buildScopedRoutes(opts *ScopedRoutesOptions) *hcm.ScopedRoutes {
+	adsSource := &core.ConfigSource{
+		ResourceApiVersion:    core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+	}
+	return &hcm.ScopedRoutes{
+		Name: scopedRoutesName,
+		ScopeKeyBuilder: &hcm.ScopedRoutes_ScopeKeyBuilder{
+			Fragments: []*hcm.ScopedRoutes_ScopeKeyBuilder_FragmentBuilder{{
+				Type: &hcm.ScopedRoutes_ScopeKeyBuilder_FragmentBuilder_HeaderValueExtractor_{
+					HeaderValueExtractor: &hcm.ScopedRoutes_ScopeKeyBuilder_FragmentBuilder_HeaderValueExtractor{
+						Name:        opts.Header,
+						ExtractType: &hcm.ScopedRoutes_ScopeKeyBuilder_FragmentBuilder_HeaderValueExtractor_Index{Index: 0},
+					},
+				},
+			}},
+		},
+		RdsConfigSource: adsSource,
+		ConfigSpecifier: &hcm.ScopedRoutes_ScopedRds{
+			ScopedRds: &hcm.ScopedRds{ScopedRdsConfigSource: adsSource},
+		},
+	}
+}
+
+// mergedFilters combines the HTTP filter needs of every scope's table, since all scopes share the listeners
+func mergedFilters(tables []*routeTable) httpFilterSet {
+	var merged httpFilterSet
+	for _, table := range tables {
+		merged.cors = merged.cors || table.filters.cors
+		merged.grpcWeb = merged.grpcWeb || table.filters.grpcWeb
+		if merged.grpcJson == nil {
+			merged.grpcJson = table.filters.grpcJson
+		}
+		for name, provider := range table.filters.jwtProviders {
+			merged.addJwtProvider(name, provider)
+		}
+		for _, mapper := range table.filters.localReplyMappers {
+			// Routes of services without a scope are added to every table with the same mapper
+			if !slices.Contains(merged.localReplyMappers, mapper) {
+				merged.localReplyMappers = append(merged.localReplyMappers, mapper)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,47 @@
+package xds
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+)
+
+func TestScopedRoutes(t *testing.T) {
+	acme := testService("orders")
+	acme.RouteScope = "acme"
+	globex := testService("users")
+	globex.RouteScope = "globex"
+
+	snap := buildTestSnapshot(t, newTestManager(Config{ScopedRoutes: &ScopedRoutesOptions{Header: "x-tenant"}}), acme, globex)
+
+	scopes := snap.GetResources(resource.ScopedRouteType)
+	if got, want := slices.Sorted(maps.Keys(scopes)), []string{"scope_acme", "scope_globex"}; !slices.Equal(got, want) {
+		t.Fatalf("got scoped route configurations %v, want %v", got, want)
+	}
+	for scope, prefix := range map[string]string{"acme": "/orders", "globex": "/users"} {
+		scoped := scopes["scope_"+scope].(*route.ScopedRouteConfiguration)
+		if key := scoped.GetKey().GetFragments(); len(key) != 1 || key[0].GetStringKey() != scope {
+			t.Errorf("scope_%s key = %v, want %q", scope, key, scope)
+		}
+		rc := getRouteConfig(t, snap, scoped.GetRouteConfigurationName())
+		if routes := rc.GetVirtualHosts()[0].GetRoutes(); len(routes) != 1 || routes[0].GetMatch().GetPrefix() != prefix {
+			t.Errorf("scope_%s points at %s with routes %v, want only %s", scope, rc.GetName(), routes, prefix)
+		}
+	}
+
+	manager := getHCM(t, getListener(t, snap, "listener_18080"))
+	if manager.GetRds() != nil {
+		t.Errorf("listener uses RDS %v, want scoped routes", manager.GetRds())
+	}
+	scoped := manager.GetScopedRoutes()
+	if scoped.GetScopedRds() == nil {
+		t.Fatalf("listener scoped routes = %v, want scopes fetched over SRDS", scoped)
+	}
+	fragments := scoped.GetScopeKeyBuilder().GetFragments()
+	if len(fragments) != 1 || fragments[0].GetHeaderValueExtractor().GetName() != "x-tenant" {
+		t.Errorf("scope key built from %v, want the x-tenant header", fragments)
+	}
+}
@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
-	"os"
+	"slices"
+	"strings"
 
-	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
 	"time"
 
@@ -19,15 +23,18 @@ import (
 	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
 	listenerservice "github.com/envoyproxy/go-control-plane/envoy/service/listener/v3"
 	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
 )
 
-// RunGRPC starts the gRPC XDS server
-func RunGRPC(ctx context.Context, adsServer serverv3.Server, port int) {
+// RunGRPC starts the gRPC XDS server, serving TLS when tlsConfig is enabled.
+// Server reflection is only registered when enableReflection is set.
+// It blocks until the context is cancelled, returning an error if the server can't start or fails.
+func RunGRPC(ctx context.Context, adsServer serverv3.Server, port int, tlsConfig TLSConfig, enableReflection bool) error {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		slog.Error("Failed to listen", "port", port, "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to listen on ADS port %d: %w", port, err)
 	}
 
 	// gRPC server options for better streaming support
@@ -43,6 +50,16 @@ func RunGRPC(ctx context.Context, adsServer serverv3.Server, port int) {
 		}),
 	}
 
+	if tlsConfig.Enabled() {
+		serverTLS, err := buildServerTLSConfig(tlsConfig)
+		if err != nil {
+			_ = lis.Close()
+			return fmt.Errorf("failed to configure ADS TLS: %w", err)
+		}
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(serverTLS)))
+		slog.Info("ADS server using TLS", "mtls", tlsConfig.ClientCAFile != "")
+	}
+
 	grpcServer := grpc.NewServer(grpcOptions...)
 
 	// Register all the discovery service servers on the gRPC server
@@ -52,6 +69,11 @@ func RunGRPC(ctx context.Context, adsServer serverv3.Server, port int) {
 	listenerservice.RegisterListenerDiscoveryServiceServer(grpcServer, adsServer)
 	routeservice.RegisterRouteDiscoveryServiceServer(grpcServer, adsServer)
 
+	if enableReflection {
+		reflection.Register(grpcServer)
+		slog.Warn("gRPC reflection enabled on the ADS server", "port", port)
+	}
+
 	slog.Info("registered all discovery services with keepalive", "port", port)
 
 	serveErr := make(chan error, 1)
@@ -67,25 +89,37 @@ func RunGRPC(ctx context.Context, adsServer serverv3.Server, port int) {
 		slog.Info("waiting for server to stop")
 		<-serveErr
 		slog.Info("gRPC server stopped via context")
+		return nil
 	case err := <-serveErr:
-		slog.Error("serve error", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("ADS server failed: %w", err)
 	}
 }
 
 // ServerCallbacks implements the Callbacks interface for logging client events
 type ServerCallbacks struct {
 	serverv3.CallbackFuncs
-	Cache cachev3.SnapshotCache
+	Snapshots *SnapshotManager
+	Allowlist *NodeAllowlist // Node ids permitted to fetch configuration, all nodes when nil
+}
+
+// authorize rejects nodes missing from the allowlist with PermissionDenied, which closes their stream
+func (cb *ServerCallbacks) authorize(node *core.Node) error {
+	if cb.Allowlist == nil || cb.Allowlist.Allowed(node.GetId()) {
+		return nil
+	}
+	slog.Warn("Rejecting xDS request from node not in allowlist", "nodeID", node.GetId())
+	return status.Errorf(codes.PermissionDenied, "node %q is not permitted to fetch configuration", node.GetId())
 }
 
 func (cb *ServerCallbacks) OnStreamOpen(ctx context.Context, streamID int64, typeURL string) error {
 	slog.Debug("OnStreamOpen", "streamID", streamID, "typeURL", typeURL)
+	telemetry.MetricActiveStreams.WithLabelValues("sotw").Inc()
 	return nil
 }
 
 func (cb *ServerCallbacks) OnStreamClosed(streamID int64, node *core.Node) {
-	slog.Debug("OnStreamClosed", "streamID", streamID, "nodeID", node.Id)
+	slog.Debug("OnStreamClosed", "streamID", streamID, "nodeID", node.GetId())
+	telemetry.MetricActiveStreams.WithLabelValues("sotw").Dec()
 }
 
 func (cb *ServerCallbacks) OnStreamRequest(streamID int64, req *discovery.DiscoveryRequest) error {
@@ -96,19 +130,36 @@ func (cb *ServerCallbacks) OnStreamRequest(streamID int64, req *discovery.Discov
 		"resourceNames", req.ResourceNames,
 		"responseNonce", req.ResponseNonce,
 		"versionInfo", req.VersionInfo)
-	snapshot, err := cb.Cache.GetSnapshot("__REFERENCE_SNAPSHOT__")
-	if err != nil {
-		slog.Error("error fetching reference snapshot", "error", err)
+	telemetry.MetricStreamRequests.WithLabelValues(req.TypeUrl).Inc()
+	if err := cb.authorize(req.Node); err != nil {
 		return err
 	}
-	err = cb.Cache.SetSnapshot(context.Background(), req.Node.Id, snapshot)
-	if err != nil {
+	if req.ErrorDetail != nil {
+		cb.handleNack(req)
+	}
+	if err := cb.Snapshots.EnsureNodeSnapshot(req.Node); err != nil {
 		slog.Error("error setting snapshot for node", "nodeID", req.Node.Id, "error", err)
 		return err
 	}
 	return nil
 }
 
+// OnFetchRequest makes sure REST-JSON clients, which never open a stream, have a snapshot to fetch
+func (cb *ServerCallbacks) OnFetchRequest(ctx context.Context, req *discovery.DiscoveryRequest) error {
+	slog.Debug("OnFetchRequest", "nodeID", req.Node.GetId(), "typeURL", req.TypeUrl, "versionInfo", req.VersionInfo)
+	if err := cb.authorize(req.Node); err != nil {
+		return err
+	}
+	if req.ErrorDetail != nil {
+		cb.handleNack(req)
+	}
+	if err := cb.Snapshots.EnsureNodeSnapshot(req.Node); err != nil {
+		slog.Error("error setting snapshot for node", "nodeID", req.Node.GetId(), "error", err)
+		return err
+	}
+	return nil
+}
+
 func (cb *ServerCallbacks) OnStreamResponse(ctx context.Context, streamID int64, req *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
 	if resp != nil {
 		slog.Debug("OnStreamResponse",
@@ -125,18 +176,101 @@ func (cb *ServerCallbacks) OnStreamResponse(ctx context.Context, streamID int64,
 
 func (cb *ServerCallbacks) OnDeltaStreamOpen(ctx context.Context, streamID int64, typeURL string) error {
 	slog.Debug("OnDeltaStreamOpen", "streamID", streamID, "typeURL", typeURL)
+	telemetry.MetricActiveStreams.WithLabelValues("delta").Inc()
 	return nil
 }
 
 func (cb *ServerCallbacks) OnDeltaStreamClosed(streamID int64, node *core.Node) {
-	slog.Debug("OnDeltaStreamClosed", "streamID", streamID, "nodeID", node.Id)
+	slog.Debug("OnDeltaStreamClosed", "streamID", streamID, "nodeID", node.GetId())
+	telemetry.MetricActiveStreams.WithLabelValues("delta").Dec()
 }
 
 func (cb *ServerCallbacks) OnStreamDeltaRequest(streamID int64, req *discovery.DeltaDiscoveryRequest) error {
 	slog.Debug("OnStreamDeltaRequest", "streamID", streamID, "nodeID", req.Node.Id, "typeURL", req.TypeUrl)
-	return nil
+	telemetry.MetricStreamRequests.WithLabelValues(req.TypeUrl).Inc()
+	return cb.authorize(req.Node)
 }
 
 func (cb *ServerCallbacks) OnStreamDeltaResponse(streamID int64, req *discovery.DeltaDiscoveryRequest, resp *discovery.DeltaDiscoveryResponse) {
 	slog.Debug("OnStreamDeltaResponse", "streamID", streamID, "nodeID", req.Node.Id, "typeURL", resp.TypeUrl)
 }
+
+// cdsNackPrefix starts the error detail of a rejected CDS update. It is followed by a "<cluster>: <reason>"
+// entry for each rejected cluster, joined by ", ".
+const cdsNackPrefix = "Error adding/updating cluster(s) "
+
+// dnsErrorText starts the reason Envoy rejects a cluster with when an address it can't resolve is used as an IP:
+// "malformed IP address: <host>. Consider setting resolver_name or setting cluster type to 'STRICT_DNS' or 'LOGICAL_DNS'"
+const dnsErrorText = "malformed IP address: "
+
+// handleNack records a rejected configuration update, flagging clusters whose hostnames Envoy could not resolve
+func (cb *ServerCallbacks) handleNack(req *discovery.DiscoveryRequest) {
+	message := req.ErrorDetail.GetMessage()
+	slog.Warn("Envoy rejected configuration",
+		"nodeID", req.Node.GetId(),
+		"typeURL", req.TypeUrl,
+		"version", req.VersionInfo,
+		"error", message)
+	telemetry.MetricNacks.WithLabelValues(req.TypeUrl).Inc()
+
+	if req.TypeUrl != resource.ClusterType {
+		return
+	}
+	for clusterName, reason := range rejectedClusters(message, cb.Snapshots.pushedClusterNames()) {
+		hostname, ok := unresolvedHostname(reason)
+		if !ok {
+			continue
+		}
+		slog.Warn("DNS resolution failed for cluster", "cluster", clusterName, "hostname", hostname)
+		telemetry.MetricDnsClusterErrors.WithLabelValues(clusterName).Inc()
+	}
+}
+
+// rejectedClusters returns the reason of each of the given clusters rejected by a CDS NACK message.
+// Reasons can contain ", " themselves, so the entries are split at the known cluster names.
+func rejectedClusters(message string, clusterNames []string) map[string]string {
+	entries, ok := strings.CutPrefix(message, cdsNackPrefix)
+	if !ok {
+		return nil
+	}
+
+	type entry struct {
+		start int
+		name  string
+	}
+	var found []entry
+	for _, name := range clusterNames {
+		for offset := 0; ; {
+			i := strings.Index(entries[offset:], name+": ")
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			if start == 0 || strings.HasSuffix(entries[:start], ", ") {
+				found = append(found, entry{start: start, name: name})
+			}
+			offset = start + len(name)
+		}
+	}
+	slices.SortFunc(found, func(a, b entry) int { return a.start - b.start })
+
+	reasons := make(map[string]string, len(found))
+	for i, e := range found {
+		end := len(entries)
+		if i+1 < len(found) {
+			end = found[i+1].start - len(", ")
+		}
+		reasons[e.name] = entries[e.start+len(e.name)+len(": ") : end]
+	}
+	return reasons
+}
+
+// unresolvedHostname returns the hostname a cluster rejection reason says Envoy could not resolve
+func unresolvedHostname(reason string) (string, bool) {
+	_, hostname, ok := strings.Cut(reason, dnsErrorText)
+	if !ok {
+		return "", false
+	}
+	hostname, _, _ = strings.Cut(hostname, ". ")
+	return strings.TrimSuffix(hostname, "."), true
+}
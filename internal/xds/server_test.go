@@ -0,0 +1,54 @@
+package xds
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+func TestNackCountsDnsClusterErrors(t *testing.T) {
+	s := newTestManager(Config{})
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders"), testService("orders-v2"), testService("billing")})
+	cb := &ServerCallbacks{Snapshots: s}
+
+	dnsErrors := func(cluster string) float64 {
+		return testutil.ToFloat64(telemetry.MetricDnsClusterErrors.WithLabelValues(cluster))
+	}
+	before := map[string]float64{"orders": dnsErrors("orders"), "orders-v2": dnsErrors("orders-v2"), "billing": dnsErrors("billing")}
+
+	nack := func(typeURL, message string) {
+		cb.handleNack(&discovery.DiscoveryRequest{
+			Node:        &core.Node{Id: "edge-1"},
+			TypeUrl:     typeURL,
+			ErrorDetail: &status.Status{Message: message},
+		})
+	}
+	nack(resource.ClusterType, "Error adding/updating cluster(s) orders-v2: malformed IP address: ordrs.internal. "+
+		"Consider setting resolver_name or setting cluster type to 'STRICT_DNS' or 'LOGICAL_DNS', "+
+		"billing: Proto constraint validation failed (ClusterValidationError.ConnectTimeout: value must be greater than 0s)")
+	// Errors mentioning DNS that aren't resolution failures, or not about clusters, are not counted
+	nack(resource.ClusterType, "Error adding/updating cluster(s) orders: dns_lookup_family V4_PREFERRED is not supported")
+	nack(resource.ListenerType, "Error adding/updating listener(s) listener_18080: malformed IP address: orders")
+
+	for cluster, want := range map[string]float64{"orders": 0, "orders-v2": 1, "billing": 0} {
+		if got := dnsErrors(cluster) - before[cluster]; got != want {
+			t.Errorf("DNS errors of %s increased by %v, want %v", cluster, got, want)
+		}
+	}
+}
+
+func TestUnresolvedHostname(t *testing.T) {
+	reason := "malformed IP address: ordrs.internal. Consider setting resolver_name or setting cluster type to 'STRICT_DNS' or 'LOGICAL_DNS'"
+	if hostname, ok := unresolvedHostname(reason); !ok || hostname != "ordrs.internal" {
+		t.Errorf("unresolvedHostname = %q, %v, want ordrs.internal", hostname, ok)
+	}
+	if hostname, ok := unresolvedHostname("Proto constraint validation failed"); ok {
+		t.Errorf("unresolvedHostname found %q in a non-DNS reason", hostname)
+	}
+}
@@ -4,111 +4,578 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
-	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
-	commondns "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/common/dns/v3"
 	dnscluster "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/dns/v3"
+	jwtv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/jwt_authn/v3"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
-	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
-	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
-	xdstype "github.com/envoyproxy/go-control-plane/pkg/wellknown"
 	"github.com/moonkev/flexds/internal/common/telemetry"
 	types2 "github.com/moonkev/flexds/internal/common/types"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 var version uint64 = 1
 
 type Config struct {
-	Cache         cachev3.SnapshotCache
-	ListenerPorts []uint32
+	Cache           SnapshotCache
+	ListenerPorts   []uint32
+	ListenerOptions map[uint32]ListenerOptions // Optional per-port listener settings
+	ListenAddress   string                     // IP address every listener binds to, 0.0.0.0 when empty
+
+	// PathWithEscapedSlashesAction controls how the HCM treats %2F and %5C in request paths
+	PathWithEscapedSlashesAction hcm.HttpConnectionManager_PathWithEscapedSlashesAction
+
+	// Policies applied to every virtual host. A retry policy on a route replaces the virtual host one
+	// entirely, and a CORS policy on a route takes precedence over the virtual host one.
+	VirtualHostRetry *types2.RetryPolicy
+	VirtualHostCors  *types2.CorsPolicy
+
+	// GrpcWeb adds the grpc_web filter to every listener, not only those serving services that enable it
+	GrpcWeb bool
+
+	// UpstreamCaFile is the CA bundle used to verify TLS upstreams that don't configure their own
+	UpstreamCaFile string
+
+	// ClusterNamePolicy derives cluster names from service names, which are used as is by default
+	ClusterNamePolicy ClusterNamePolicy
+
+	// StatPrefix is the HCM stat prefix of every listener, "ingress_http" when empty
+	StatPrefix string
+
+	// RequestId controls x-request-id generation on every listener
+	RequestId RequestIdOptions
+
+	// AccessLog configures the access logs of every HTTP listener, none by default
+	AccessLog AccessLogOptions
+
+	// Defaults applies to every service that leaves the corresponding setting unset
+	Defaults ServiceDefaults
+
+	// ScopedRoutes serves one route configuration per service route scope through SRDS. Disabled when nil.
+	ScopedRoutes *ScopedRoutesOptions
+
+	// MinPushInterval is the minimum time between snapshot pushes. Updates arriving sooner are
+	// coalesced into a single push once the interval has elapsed. Disabled when zero.
+	MinPushInterval time.Duration
+
+	// ResourceTTL is set on every resource, Envoy removes resources not refreshed within it. The cache
+	// must send heartbeats more often, see cachev3.NewSnapshotCacheWithHeartbeating. Disabled when zero.
+	ResourceTTL time.Duration
+
+	// Marshaled size, in bytes, of the largest resource type of a snapshot at which a warning is logged,
+	// and above which the snapshot is rejected and the previous one kept. Disabled when zero.
+	SnapshotSizeWarn  int
+	SnapshotSizeLimit int
+
+	// DNS settings applied to every cluster, all default to Envoy's behavior when unset
+	DnsResolver           *core.TypedExtensionConfig // See BuildDnsResolverConfig
+	DnsFailureRefreshBase time.Duration              // Initial refresh interval after a failed resolution
+	DnsFailureRefreshMax  time.Duration              // Maximum refresh interval after repeated failures
+	DnsJitter             time.Duration              // Random jitter added to each refresh
+}
+
+// ListenerOptions holds settings that apply to a single listener port
+type ListenerOptions struct {
+	// HTTP/1.1 options, all default to Envoy's strict behavior
+	AcceptHttp10         bool
+	DefaultHostForHttp10 string
+	AllowAbsoluteUrl     bool
+
+	// FilterChainMatch restricts which connections the listener's filter chain accepts, all when nil
+	FilterChainMatch *FilterChainMatch
+	// UseDefaultFilterChain serves connections not matching FilterChainMatch instead of closing them
+	UseDefaultFilterChain bool
 }
 
+// FilterChainMatch selects connections by L4 properties, unset fields match everything
+type FilterChainMatch struct {
+	DestinationPort    uint32
+	SourcePrefixRanges []string // CIDRs such as "10.0.0.0/8"
+	TransportProtocol  string   // "raw_buffer" or "tls"
+	ServerNames        []string // SNI names, only meaningful with the "tls" transport protocol
+}
+
+// ReferenceNodeID is the cache key holding the snapshot served to nodes not targeted by any node selector
+const ReferenceNodeID = "__REFERENCE_SNAPSHOT__"
+
 type SnapshotManager struct {
-	cache         cachev3.SnapshotCache
-	listenerPorts []uint32
+	mu              sync.Mutex
+	cache           SnapshotCache
+	listenerPorts   []uint32
+	listenerOptions map[uint32]ListenerOptions
+	listenAddr      string
+
+	pathWithEscapedSlashesAction hcm.HttpConnectionManager_PathWithEscapedSlashesAction
+	virtualHostRetry             *types2.RetryPolicy
+	virtualHostCors              *types2.CorsPolicy
+	grpcWeb                      bool
+	upstreamCaFile               string
+	minPushInterval              time.Duration
+	resourceTTL                  time.Duration
+	snapshotSizeWarn             int
+	snapshotSizeLimit            int
+	clusterNamePolicy            ClusterNamePolicy
+	statPrefix                   string
+	requestId                    RequestIdOptions
+	accessLog                    AccessLogOptions
+	scopedRoutes                 *ScopedRoutesOptions
+	defaults                     ServiceDefaults
+	dnsResolver                  *core.TypedExtensionConfig
+	dnsFailureRefreshBase        time.Duration
+	dnsFailureRefreshMax         time.Duration
+	dnsJitter                    time.Duration
+
+	// State of the last push, used to build snapshots for nodes that connect afterward
+	services        []*types2.DiscoveredService
+	snapVersion     string
+	defaultSnapshot *cachev3.Snapshot
+
+	// Rate limiting of pushes, the latest services received during the cooldown are pushed when it ends
+	lastPush     time.Time
+	pending      []*types2.DiscoveredService
+	pendingTimer *time.Timer
+
+	// Hash of the resources last set for each node id, used to skip no-op pushes
+	nodeHashes map[string]string
+
+	// Services each node is scoped to by its metadata, nodes without a scope get every service
+	nodeScopes map[string][]string
 }
 
 func NewSnapshotManager(config Config) *SnapshotManager {
 	return &SnapshotManager{
-		cache:         config.Cache,
-		listenerPorts: config.ListenerPorts,
+		cache:           config.Cache,
+		listenerPorts:   config.ListenerPorts,
+		listenerOptions: config.ListenerOptions,
+		listenAddr:      config.ListenAddress,
+
+		pathWithEscapedSlashesAction: config.PathWithEscapedSlashesAction,
+		virtualHostRetry:             config.VirtualHostRetry,
+		virtualHostCors:              config.VirtualHostCors,
+		grpcWeb:                      config.GrpcWeb,
+		upstreamCaFile:               config.UpstreamCaFile,
+		minPushInterval:              config.MinPushInterval,
+		resourceTTL:                  config.ResourceTTL,
+		snapshotSizeWarn:             config.SnapshotSizeWarn,
+		snapshotSizeLimit:            config.SnapshotSizeLimit,
+		clusterNamePolicy:            config.ClusterNamePolicy,
+		statPrefix:                   config.StatPrefix,
+		requestId:                    config.RequestId,
+		accessLog:                    config.AccessLog,
+		scopedRoutes:                 config.ScopedRoutes,
+		defaults:                     config.Defaults,
+		dnsResolver:                  config.DnsResolver,
+		dnsFailureRefreshBase:        config.DnsFailureRefreshBase,
+		dnsFailureRefreshMax:         config.DnsFailureRefreshMax,
+		dnsJitter:                    config.DnsJitter,
+
+		nodeHashes: make(map[string]string),
+		nodeScopes: make(map[string][]string),
 	}
 }
 
-// BuildAndPushSnapshot constructs XDS configuration from discovered services and pushes to Cache
+// BuildAndPushSnapshot constructs XDS configuration from discovered services and pushes to Cache.
+// Every known node gets a snapshot containing the services whose node selector matches it;
+// when no service has a node selector, all nodes share the same snapshot.
+// Pushes are rate limited to one per MinPushInterval, coalescing the updates in between.
 func (s *SnapshotManager) BuildAndPushSnapshot(services []*types2.DiscoveredService) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.minPushInterval > 0 {
+		if wait := s.minPushInterval - time.Since(s.lastPush); wait > 0 {
+			s.pending = services
+			if s.pendingTimer == nil {
+				slog.Debug("Deferring snapshot push", "wait", wait)
+				s.pendingTimer = time.AfterFunc(wait, s.pushPending)
+			}
+			return
+		}
+	}
+	s.cancelPending()
+	s.pushSnapshot(services)
+}
+
+// pushPending pushes the services received during the cooldown, unless a direct push already
+// replaced them while the timer was firing
+func (s *SnapshotManager) pushPending() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pendingTimer == nil {
+		return
+	}
+	services := s.pending
+	s.cancelPending()
+	s.pushSnapshot(services)
+}
+
+// cancelPending drops the services waiting for the cooldown to end, s.mu must be held
+func (s *SnapshotManager) cancelPending() {
+	if s.pendingTimer != nil {
+		s.pendingTimer.Stop()
+		s.pendingTimer = nil
+	}
+	s.pending = nil
+}
+
+// pushSnapshot builds the snapshots for services and sets them in the cache, s.mu must be held
+func (s *SnapshotManager) pushSnapshot(services []*types2.DiscoveredService) {
+	s.lastPush = time.Now()
+	defer func() {
+		telemetry.MetricSnapshotBuildSeconds.Observe(time.Since(s.lastPush).Seconds())
+	}()
+
+	// Build with the next version, which is only used up if some node's resources changed
+	snapVer := fmt.Sprintf("%d", atomic.LoadUint64(&version)+1)
+	snap, err := s.buildSnapshot(snapVer, servicesForNode(services, ""))
+	if err != nil {
+		slog.Error("Failed to create snapshot", "error", err)
+		return
+	}
+	telemetry.MetricResources.WithLabelValues("cluster").Set(float64(len(snap.GetResources(resource.ClusterType))))
+	telemetry.MetricResources.WithLabelValues("listener").Set(float64(len(snap.GetResources(resource.ListenerType))))
+	telemetry.MetricResources.WithLabelValues("route").Set(float64(len(snap.GetResources(resource.RouteType))))
+	telemetry.MetricResources.WithLabelValues("scoped_route").Set(float64(len(snap.GetResources(resource.ScopedRouteType))))
+	telemetry.MetricResources.WithLabelValues("endpoint").Set(float64(len(snap.GetResources(resource.EndpointType))))
+	if err := s.checkSnapshotSize(ReferenceNodeID, snap); err != nil {
+		return
+	}
+
+	prevVersion := s.snapVersion
+	s.services = services
+	s.snapVersion = snapVer
+
+	changed, err := s.setSnapshotIfChanged(ReferenceNodeID, snap)
+	if err != nil {
+		slog.Error("Failed setting reference snapshot", "error", err)
+	}
+	if changed {
+		s.defaultSnapshot = snap
+	}
+	nodeIDs := s.cache.GetStatusKeys()
+	slog.Debug("node IDs", "nodeIDs", nodeIDs)
+
+	for _, nodeID := range nodeIDs {
+		if nodeID == ReferenceNodeID {
+			continue
+		}
+		nodeChanged, err := s.setNodeSnapshot(nodeID)
+		if err != nil {
+			slog.Error("Failed setting snapshot", "nodeID", nodeID, "error", err)
+		}
+		changed = changed || nodeChanged
+	}
+
+	if !changed {
+		s.snapVersion = prevVersion
+		slog.Debug("Snapshot unchanged, skipping push", "version", prevVersion)
+		telemetry.MetricSnapshotsSkipped.Inc()
+		return
+	}
+	atomic.AddUint64(&version, 1)
+	slog.Info("Snapshot pushed",
+		"version", snapVer,
+		"listeners", len(snap.GetResources(resource.ListenerType)),
+		"clusters", len(snap.GetResources(resource.ClusterType)),
+		"endpoints", len(snap.GetResources(resource.EndpointType)),
+		"routes", len(snap.GetResources(resource.RouteType)))
+	telemetry.MetricSnapshotsPushed.Inc()
+}
+
+// EnsureNodeSnapshot sets a snapshot for a node that does not have one yet, such as a newly connected Envoy,
+// limited to the services its metadata scopes it to. Nodes that already have a snapshot are left untouched
+// unless their scope changed, they are kept current by BuildAndPushSnapshot.
+func (s *SnapshotManager) EnsureNodeSnapshot(node *core.Node) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodeID := node.GetId()
+	scope := nodeServiceScope(node)
+	scopeChanged := !slices.Equal(scope, s.nodeScopes[nodeID])
+	if scope == nil {
+		delete(s.nodeScopes, nodeID)
+	} else {
+		s.nodeScopes[nodeID] = scope
+	}
+
+	if _, err := s.cache.GetSnapshot(nodeID); err == nil && !scopeChanged {
+		return nil
+	}
+	if s.defaultSnapshot == nil {
+		// Nothing discovered yet, the node will be picked up by the first push
+		return nil
+	}
+	_, err := s.setNodeSnapshot(nodeID)
+	return err
+}
+
+// pushedClusterNames returns the names of the service clusters in the last push
+func (s *SnapshotManager) pushedClusterNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Collect(maps.Values(clusterNames(s.services, s.clusterNamePolicy)))
+}
+
+// setNodeSnapshot sets the snapshot for a single node, building a dedicated one only when node selectors
+// are in use or the node is scoped to a subset of services. It reports whether the node's resources changed.
+func (s *SnapshotManager) setNodeSnapshot(nodeID string) (bool, error) {
+	snap := s.defaultSnapshot
+	scope := s.nodeScopes[nodeID]
+	if hasNodeSelectors(s.services) || scope != nil {
+		services := servicesForNode(s.services, nodeID)
+		if scope != nil {
+			services = scopedServices(services, scope)
+		}
+		var err error
+		snap, err = s.buildSnapshot(s.snapVersion, services)
+		if err != nil {
+			return false, err
+		}
+		if err := s.checkSnapshotSize(nodeID, snap); err != nil {
+			return false, err
+		}
+	}
+	return s.setSnapshotIfChanged(nodeID, snap)
+}
+
+// setSnapshotIfChanged sets the snapshot for a node unless its resources are identical to the last
+// snapshot set for that node, so Envoy isn't sent a new version with the same configuration
+func (s *SnapshotManager) setSnapshotIfChanged(nodeID string, snap *cachev3.Snapshot) (bool, error) {
+	hash, err := resourcesHash(snap)
+	if err != nil {
+		return false, err
+	}
+	if s.nodeHashes[nodeID] == hash {
+		return false, nil
+	}
+	if err := s.cache.SetSnapshot(context.Background(), nodeID, snap); err != nil {
+		return false, err
+	}
+	s.nodeHashes[nodeID] = hash
+	return true, nil
+}
+
+// hasNodeSelectors reports whether any service is restricted to specific nodes
+func hasNodeSelectors(services []*types2.DiscoveredService) bool {
+	for _, svc := range services {
+		if len(svc.NodeIds) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// servicesForNode returns the services visible to a node: those without a node selector plus those selecting it
+func servicesForNode(services []*types2.DiscoveredService, nodeID string) []*types2.DiscoveredService {
+	if !hasNodeSelectors(services) {
+		return services
+	}
+	selected := make([]*types2.DiscoveredService, 0, len(services))
+	for _, svc := range services {
+		if len(svc.NodeIds) == 0 || slices.Contains(svc.NodeIds, nodeID) {
+			selected = append(selected, svc)
+		}
+	}
+	return selected
+}
+
+// clusterNames maps the services that get a cluster to their cluster name: those with instances that
+// have routes, are draining, are proxied over TCP, or are the target of another service's weighted route or mirror. A service whose
+// cluster name collides with an earlier service's under the naming policy gets no cluster.
+func clusterNames(services []*types2.DiscoveredService, policy ClusterNamePolicy) map[string]string {
+	referenced := make(map[string]bool)
+	for _, svc := range services {
+		for _, rp := range svc.Routes {
+			for _, wc := range rp.WeightedClusters {
+				referenced[wc.Name] = true
+			}
+			if rp.MirrorCluster != "" {
+				referenced[rp.MirrorCluster] = true
+			}
+		}
+	}
+
+	names := make(map[string]string, len(services))
+	owners := make(map[string]string, len(services))
+	for _, svc := range services {
+		if len(svc.Instances) > 0 && (len(svc.Routes) > 0 || svc.Draining || referenced[svc.Name] || svc.Protocol == types2.ProtocolTCP) {
+			name := policy.Apply(svc.Name)
+			if owner, ok := owners[name]; ok && owner != svc.Name {
+				slog.Warn("Cluster name collides with another service, skipping", "service", svc.Name, "cluster", name, "otherService", owner, telemetry.InvalidConfigKey, "cluster")
+				continue
+			}
+			owners[name] = svc.Name
+			names[svc.Name] = name
+		}
+	}
+	return names
+}
+
+// addServiceRoutes converts the service's route patterns to routes in the route tables serving it,
+// returning how many were added. Without a cluster, only routes that need no upstream are added.
+func addServiceRoutes(svc *types2.DiscoveredService, clusterName string, clusterSet map[string]string, tables []*routeTable) int {
+	var grpcJsonAny *anypb.Any
+	if svc.GrpcJson != nil {
+		var err error
+		grpcJsonAny, err = buildGrpcJsonTranscoder(svc.GrpcJson)
+		if err != nil {
+			slog.Error("Failed to configure gRPC-JSON transcoding, serving routes without it", "service", svc.Name, "descriptor", svc.GrpcJson.DescriptorFile, "error", err)
+		}
+	}
+
+	// Without its JWT provider the service's routes would be served unauthenticated, so they're left out instead
+	var jwtProvider *jwtv3.JwtProvider
+	var jwtRequirementAny *anypb.Any
+	if svc.Jwt != nil {
+		var err error
+		jwtProvider, err = buildJwtProvider(svc)
+		if err == nil {
+			jwtRequirementAny, err = buildJwtRequirement(svc)
+		}
+		if err != nil {
+			slog.Error("Failed to configure JWT authentication, omitting routes", "service", svc.Name, "error", err)
+			return 0
+		}
+	}
+
+	added := 0
+	for i := range svc.Routes {
+		rp := &svc.Routes[i]
+		if clusterName == "" && routeNeedsCluster(rp) {
+			slog.Debug("Skipping route without an upstream cluster", "service", svc.Name, "route", rp.Name)
+			continue
+		}
+		routeObj, err := buildRoute(clusterName, rp, clusterSet)
+		if err != nil {
+			slog.Warn("Skipping misconfigured route", "service", svc.Name, "route", rp.Name, "error", err, telemetry.InvalidConfigKey, "route")
+			continue
+		}
+		if rp.Cors != nil {
+			corsAny, err := buildCorsPolicy(rp.Cors)
+			if err != nil {
+				slog.Warn("Skipping misconfigured route", "service", svc.Name, "route", rp.Name, "error", err, telemetry.InvalidConfigKey, "route")
+				continue
+			}
+			routeObj.TypedPerFilterConfig = map[string]*anypb.Any{corsFilterName: corsAny}
+		}
+		if grpcJsonAny != nil && routeNeedsCluster(rp) {
+			if routeObj.TypedPerFilterConfig == nil {
+				routeObj.TypedPerFilterConfig = make(map[string]*anypb.Any)
+			}
+			routeObj.TypedPerFilterConfig[grpcJsonTranscoderFilterName] = grpcJsonAny
+		}
+		requiresJwt := jwtRequirementAny != nil && routeNeedsCluster(rp)
+		if requiresJwt {
+			if routeObj.TypedPerFilterConfig == nil {
+				routeObj.TypedPerFilterConfig = make(map[string]*anypb.Any)
+			}
+			routeObj.TypedPerFilterConfig[jwtAuthnFilterName] = jwtRequirementAny
+		}
+		var mapper *hcm.ResponseMapper
+		if rp.UnauthorizedRedirect != "" {
+			mapper, err = buildUnauthorizedRedirect(rp)
+			if err != nil {
+				slog.Warn("Skipping misconfigured route", "service", svc.Name, "route", rp.Name, "error", err, telemetry.InvalidConfigKey, "route")
+				continue
+			}
+		}
+		for _, table := range tables {
+			if table.serves(svc) {
+				table.add(rp.Hosts, routeObj, mapper)
+				table.filters.grpcWeb = table.filters.grpcWeb || svc.GrpcWeb
+				if requiresJwt {
+					table.filters.addJwtProvider(jwtProviderName(svc), jwtProvider)
+				}
+				added++
+			}
+		}
+	}
+	return added
+}
+
+// buildSnapshot constructs the XDS resources for the given services
+func (s *SnapshotManager) buildSnapshot(snapVer string, services []*types2.DiscoveredService) (*cachev3.Snapshot, error) {
 	var clusters []types.Resource
 	var endpoints []types.Resource
 	var routes []types.Resource
+	var scopedRoutes []types.Resource
 	var listeners []types.Resource
-	allRoutes := make([]*route.Route, 0)
+	var tcpListeners []types.Resource
+	tcpPorts := make(map[uint32]string)
+	routeCount := 0
+	tables, err := s.newRouteTables(services)
+	if err != nil {
+		return nil, err
+	}
 
 	slog.Info("Building snapshot", "count", len(services))
 
+	clusterSet := clusterNames(services, s.clusterNamePolicy)
+
 	for _, svc := range services {
-		if len(svc.Instances) == 0 || len(svc.Routes) == 0 {
+		clusterName, ok := clusterSet[svc.Name]
+		if !ok {
+			// Redirect and direct response routes answer by themselves, so they're served without a cluster
+			if !svc.Draining && svc.Protocol != types2.ProtocolTCP && slices.ContainsFunc(svc.Routes, func(rp types2.RoutePattern) bool {
+				return !routeNeedsCluster(&rp)
+			}) {
+				slog.Info("Service has no healthy instances, serving only routes that need no upstream", "service", svc.Name)
+				routeCount += addServiceRoutes(svc, "", clusterSet, tables)
+				continue
+			}
 			slog.Info("Service has no healthy instances or configured routes", "service", svc.Name)
 			continue
 		}
 
 		slog.Debug("Adding service", "service", svc.Name, "instances", len(svc.Instances))
 
-		clusterName := svc.Name
-
-		// Endpoints - build load assignment with hostname and listenerPorts
-		lbs := make([]*endpoint.LbEndpoint, 0, len(svc.Instances))
-
-		for _, inst := range svc.Instances {
-			if inst.Address == "" {
-				continue
-			}
-			slog.Debug("Adding endpoint", "service", svc.Name, "address", inst.Address, "listenerPorts", inst.Port)
-			lb := &endpoint.LbEndpoint{
-				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-					Endpoint: &endpoint.Endpoint{
-						Address: &core.Address{
-							Address: &core.Address_SocketAddress{
-								SocketAddress: &core.SocketAddress{
-									Address:       inst.Address,
-									PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(inst.Port)},
-								},
-							},
-						},
-					},
-				},
-			}
-			lbs = append(lbs, lb)
-		}
-
 		cla := &endpoint.ClusterLoadAssignment{
 			ClusterName: clusterName,
-			Endpoints:   []*endpoint.LocalityLbEndpoints{{LbEndpoints: lbs}},
+			Endpoints:   buildLocalityEndpoints(svc),
 		}
 		endpoints = append(endpoints, cla)
 
 		// Create DnsCluster configuration
-		// AllAddressesInSingleEndpoint=false gives STRICT_DNS semantics (each address is a separate endpoint)
+		// AllAddressesInSingleEndpoint=false gives STRICT_DNS semantics (each address is a separate endpoint),
+		// true gives LOGICAL_DNS semantics (connect to the first resolved address)
 		dnsClusterConfig := &dnscluster.DnsCluster{
-			DnsLookupFamily:              commondns.DnsLookupFamily_V4_ONLY,
+			DnsLookupFamily:              dnsLookupFamily(svc),
 			RespectDnsTtl:                true,
-			AllAddressesInSingleEndpoint: false,
+			AllAddressesInSingleEndpoint: svc.AllAddressesInSingleEndpoint,
+			TypedDnsResolverConfig:       s.dnsResolver,
 		}
-		if svc.DnsRefreshRate > 0 {
-			dnsClusterConfig.DnsRefreshRate = durationpb.New(svc.DnsRefreshRate)
+		if refreshRate := s.defaults.dnsRefreshRate(svc); refreshRate > 0 {
+			dnsClusterConfig.DnsRefreshRate = durationpb.New(refreshRate)
 			dnsClusterConfig.RespectDnsTtl = false
 		}
+		if s.dnsFailureRefreshBase > 0 {
+			dnsClusterConfig.DnsFailureRefreshRate = &dnscluster.DnsCluster_RefreshRate{
+				BaseInterval: durationpb.New(s.dnsFailureRefreshBase),
+			}
+			if s.dnsFailureRefreshMax > 0 {
+				dnsClusterConfig.DnsFailureRefreshRate.MaxInterval = durationpb.New(s.dnsFailureRefreshMax)
+			}
+		}
+		if s.dnsJitter > 0 {
+			dnsClusterConfig.DnsJitter = durationpb.New(s.dnsJitter)
+		}
 		dnsClusterAny, err := anypb.New(dnsClusterConfig)
 		if err != nil {
 			slog.Error("Failed to marshal DnsCluster config", "error", err)
@@ -118,7 +585,7 @@ func (s *SnapshotManager) BuildAndPushSnapshot(services []*types2.DiscoveredServ
 		// Cluster using ClusterType extension point with DnsCluster
 		cl := &cluster.Cluster{
 			Name:           clusterName,
-			ConnectTimeout: durationpb.New(2 * time.Second),
+			ConnectTimeout: durationpb.New(s.defaults.connectTimeout(svc)),
 			ClusterDiscoveryType: &cluster.Cluster_ClusterType{
 				ClusterType: &cluster.Cluster_CustomClusterType{
 					Name:        "envoy.clusters.dns",
@@ -126,11 +593,41 @@ func (s *SnapshotManager) BuildAndPushSnapshot(services []*types2.DiscoveredServ
 				},
 			},
 			LoadAssignment: cla,
-			LbPolicy:       cluster.Cluster_ROUND_ROBIN,
+			LbPolicy:       s.defaults.lbPolicy(svc),
+		}
+		if clusterName != svc.Name {
+			cl.Metadata = &core.Metadata{
+				FilterMetadata: map[string]*structpb.Struct{
+					"flexds": {Fields: map[string]*structpb.Value{"service": structpb.NewStringValue(svc.Name)}},
+				},
+			}
+		}
+
+		if svc.HealthCheck != nil {
+			slog.Debug("configuring active health check", "service", svc.Name)
+			cl.HealthChecks = []*core.HealthCheck{buildHealthCheck(svc)}
+		}
+
+		if svc.HealthyPanicThreshold != nil {
+			cl.CommonLbConfig = &cluster.Cluster_CommonLbConfig{
+				HealthyPanicThreshold: &typev3.Percent{Value: *svc.HealthyPanicThreshold},
+			}
+		}
+
+		if svc.Outlier != nil {
+			slog.Debug("configuring outlier detection", "service", svc.Name)
+			cl.OutlierDetection = buildOutlierDetection(svc.Outlier)
+		}
+
+		if svc.TcpKeepalive != nil {
+			slog.Debug("configuring upstream TCP keepalive", "service", svc.Name)
+			cl.UpstreamConnectionOptions = &cluster.UpstreamConnectionOptions{
+				TcpKeepalive: buildTcpKeepalive(svc.TcpKeepalive),
+			}
 		}
 
 		// Add HTTP/2 protocol options if the service specifies http2 metadata or is detected as gRPC
-		if svc.EnableHTTP2 {
+		if svc.EnableHTTP2 && svc.Protocol != types2.ProtocolTCP {
 			slog.Debug("configuring HTTP/2 support", "service", svc.Name)
 			httpOpts := &upstreamhttp.HttpProtocolOptions{
 				UpstreamProtocolOptions: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
@@ -153,25 +650,7 @@ func (s *SnapshotManager) BuildAndPushSnapshot(services []*types2.DiscoveredServ
 		if svc.EnableTLS {
 			slog.Debug("configuring TLS support", "service", svc.Name)
 
-			// Set ALPN based on whether HTTP/2 is enabled
-			var alpnProtocols []string
-			if svc.EnableHTTP2 {
-				alpnProtocols = []string{"h2", "http/1.1"}
-			} else {
-				alpnProtocols = []string{"http/1.1"}
-			}
-
-			tlsContext := &tls.UpstreamTlsContext{
-				CommonTlsContext: &tls.CommonTlsContext{
-					AlpnProtocols: alpnProtocols,
-					ValidationContextType: &tls.CommonTlsContext_ValidationContext{
-						ValidationContext: &tls.CertificateValidationContext{
-							TrustChainVerification: tls.CertificateValidationContext_ACCEPT_UNTRUSTED,
-						},
-					},
-				},
-			}
-			tlsContextAny, err := anypb.New(tlsContext)
+			tlsContextAny, err := anypb.New(buildUpstreamTlsContext(svc, s.upstreamCaFile))
 			if err != nil {
 				panic(err)
 			}
@@ -185,185 +664,137 @@ func (s *SnapshotManager) BuildAndPushSnapshot(services []*types2.DiscoveredServ
 
 		clusters = append(clusters, cl)
 
-		// Convert route patterns to routes
-		for _, rp := range svc.Routes {
-			pathPrefix := rp.PathPrefix
-			matchType := rp.MatchType
-			headerName := rp.HeaderName
-			headerValue := rp.HeaderValue
-			prefixRewrite := rp.PrefixRewrite
-			regexRewrite := rp.RegexRewrite
-			regexReplacement := rp.RegexReplacement
-
-			ra := &route.RouteAction{
-				ClusterSpecifier: &route.RouteAction_Cluster{Cluster: clusterName},
-			}
-
-			// Apply rewrite: regex_rewrite takes priority, then legacy prefix_rewrite
-			if regexRewrite != "" {
-				ra.RegexRewrite = &matcher.RegexMatchAndSubstitute{
-					Pattern: &matcher.RegexMatcher{
-						Regex: regexRewrite,
-					},
-					Substitution: regexReplacement,
-				}
-				slog.Debug("configuring regex rewrite", "service", svc.Name, "pattern", regexRewrite, "substitution", regexReplacement)
-			} else if prefixRewrite != "" {
-				ra.PrefixRewrite = prefixRewrite
-				slog.Debug("configuring prefix rewrite", "service", svc.Name, "prefixRewrite", prefixRewrite)
-			}
+		// Draining services keep their cluster so in-flight requests can finish, but get no routes
+		if svc.Draining {
+			slog.Info("Service is draining, omitting routes", "service", svc.Name)
+			continue
+		}
 
-			routeMatch := &route.RouteMatch{
-				PathSpecifier: &route.RouteMatch_Prefix{Prefix: pathPrefix},
+		// TCP services get their own listeners instead of routes
+		if svc.Protocol == types2.ProtocolTCP {
+			if len(svc.ListenerPorts) == 0 {
+				slog.Warn("TCP service has no listener ports, it is not exposed", "service", svc.Name)
 			}
-
-			if matchType == "header" || matchType == "both" {
-				if headerName != "" && headerValue != "" {
-					routeMatch.Headers = []*route.HeaderMatcher{{
-						Name: headerName,
-						HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
-							StringMatch: &matcher.StringMatcher{
-								MatchPattern: &matcher.StringMatcher_Exact{Exact: headerValue},
-							},
-						},
-					}}
+			for _, port := range svc.ListenerPorts {
+				if slices.Contains(s.listenerPorts, port) {
+					slog.Warn("TCP service listener port is an HTTP listener port, skipping", "service", svc.Name, "port", port, telemetry.InvalidConfigKey, "listener")
+					continue
 				}
+				if owner, ok := tcpPorts[port]; ok {
+					slog.Warn("TCP service listener port is used by another service, skipping", "service", svc.Name, "port", port, "otherService", owner, telemetry.InvalidConfigKey, "listener")
+					continue
+				}
+				ln, err := buildTcpListener(s.listenAddress(), port, clusterName)
+				if err != nil {
+					slog.Error("Failed to build TCP listener", "service", svc.Name, "port", port, "error", err)
+					continue
+				}
+				tcpPorts[port] = svc.Name
+				tcpListeners = append(tcpListeners, ln)
 			}
-
-			routeObj := &route.Route{
-				Match:  routeMatch,
-				Action: &route.Route_Route{Route: ra},
-			}
-			allRoutes = append(allRoutes, routeObj)
+			continue
 		}
-	}
 
-	// Create a single virtual host
-	var virtualHosts []*route.VirtualHost
-	if len(allRoutes) > 0 {
-		vhHost := &route.VirtualHost{
-			Name:    "default",
-			Domains: []string{"*"},
-			Routes:  allRoutes,
-		}
-		virtualHosts = append(virtualHosts, vhHost)
+		routeCount += addServiceRoutes(svc, clusterName, clusterSet, tables)
 	}
 
-	// If no services, push an empty snapshot
-	if len(clusters) == 0 {
-		slog.Warn("No services with healthy instances, pushing empty snapshot")
-		snap, err := cachev3.NewSnapshot(fmt.Sprintf("%d", atomic.AddUint64(&version, 1)), map[resource.Type][]types.Resource{})
-		if err != nil {
-			slog.Error("Failed creating empty snapshot", "error", err)
-			return
+	// Clusters remote JWKS are fetched through, for the JWT providers some route requires
+	for _, svc := range services {
+		if svc.Jwt == nil || svc.Jwt.JwksUri == "" || !slices.ContainsFunc(tables, func(table *routeTable) bool {
+			return table.filters.jwtProviders[jwtProviderName(svc)] != nil
+		}) {
+			continue
 		}
-		err = s.cache.SetSnapshot(context.Background(), "__REFERENCE_SNAPSHOT__", snap)
+		cl, err := s.buildJwksCluster(svc)
 		if err != nil {
-			slog.Error("Failed setting empty reference snapshot", "error", err)
-		}
-		nodeIDs := s.cache.GetStatusKeys()
-		for _, nodeID := range nodeIDs {
-			if err := s.cache.SetSnapshot(context.Background(), nodeID, snap); err != nil {
-				slog.Error("Failed setting empty snapshot", "nodeID", nodeID, "error", err)
-			}
+			slog.Error("Failed to build JWKS cluster", "service", svc.Name, "error", err)
+			continue
 		}
-		slog.Info("Empty snapshot pushed")
-		return
+		clusters = append(clusters, cl)
 	}
 
-	// Route config
-	routeCfg := &route.RouteConfiguration{
-		Name:         "local_route",
-		VirtualHosts: virtualHosts,
-	}
-	routes = append(routes, routeCfg)
-
-	// Listener
-	hcmCfg := &hcm.HttpConnectionManager{
-		StatPrefix:           "ingress_http",
-		CodecType:            hcm.HttpConnectionManager_AUTO,
-		Http2ProtocolOptions: &core.Http2ProtocolOptions{},
-		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
-			Rds: &hcm.Rds{
-				ConfigSource: &core.ConfigSource{
-					ResourceApiVersion: core.ApiVersion_V3,
-					ConfigSourceSpecifier: &core.ConfigSource_Ads{
-						Ads: &core.AggregatedConfigSource{},
-					},
-				},
-				RouteConfigName: "local_route",
-			},
-		},
-		HttpFilters: []*hcm.HttpFilter{{
-			Name: "envoy.filters.http.router",
-			ConfigType: &hcm.HttpFilter_TypedConfig{
-				TypedConfig: &anypb.Any{
-					TypeUrl: "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router",
-				},
-			},
-		}},
+	// If no services, build an empty snapshot
+	if len(clusters) == 0 && routeCount == 0 {
+		slog.Warn("No services with healthy instances, building empty snapshot")
+		return cachev3.NewSnapshot(snapVer, map[resource.Type][]types.Resource{})
 	}
 
-	hcmAny, err := anypb.New(hcmCfg)
-	if err != nil {
-		slog.Error("Failed to marshal HCM", "error", err)
-		return
+	// Route configs, grouping routes into virtual hosts by their configured hosts
+	for _, table := range tables {
+		routes = append(routes, &route.RouteConfiguration{
+			Name:         table.name,
+			VirtualHosts: table.vhBuilder.build(),
+		})
+		if table.scope != "" {
+			scopedRoutes = append(scopedRoutes, buildScopedRouteConfiguration(table))
+		}
 	}
 
-	for _, listenerPort := range s.listenerPorts {
-		ln := &listener.Listener{
-			Name: fmt.Sprintf("listener_%d", listenerPort),
-			Address: &core.Address{
-				Address: &core.Address_SocketAddress{
-					SocketAddress: &core.SocketAddress{
-						Address:       "0.0.0.0",
-						PortSpecifier: &core.SocketAddress_PortValue{PortValue: listenerPort},
-					},
-				},
-			},
-			FilterChains: []*listener.FilterChain{{
-				Filters: []*listener.Filter{{
-					Name:       xdstype.HTTPConnectionManager,
-					ConfigType: &listener.Filter_TypedConfig{TypedConfig: hcmAny},
-				}},
-			}},
+	for i, listenerPort := range s.listenerPorts {
+		// Every listener serves every scope, otherwise tables are either shared or one per listener port
+		filters, routeConfigName := mergedFilters(tables), scopedRoutesName
+		if len(scopedRoutes) == 0 {
+			table := tables[0]
+			if len(tables) > 1 {
+				table = tables[i]
+			}
+			filters, routeConfigName = table.filters, table.name
+		}
+		ln, err := s.buildListener(listenerPort, filters, routeConfigName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build listener for port %d: %w", listenerPort, err)
 		}
 		listeners = append(listeners, ln)
 	}
-
-	// Build snapshot
-	snapVer := fmt.Sprintf("%d", atomic.AddUint64(&version, 1))
-	snap, err := cachev3.NewSnapshot(snapVer, map[resource.Type][]types.Resource{
-		resource.ClusterType:  clusters,
-		resource.EndpointType: endpoints,
-		resource.RouteType:    routes,
-		resource.ListenerType: listeners,
-	})
-
-	if err != nil {
-		slog.Error("Failed to create snapshot", "error", err)
-		return
+	listeners = append(listeners, tcpListeners...)
+
+	resources := map[resource.Type][]types.Resource{
+		resource.ClusterType:     clusters,
+		resource.EndpointType:    endpoints,
+		resource.RouteType:       routes,
+		resource.ScopedRouteType: scopedRoutes,
+		resource.ListenerType:    listeners,
 	}
+	if err := checkUniqueNames(resources); err != nil {
+		return nil, err
+	}
+	slog.Debug("Snapshot built", "version", snapVer, "routeConfigs", len(tables))
+	if s.resourceTTL > 0 {
+		return newSnapshotWithTTL(snapVer, resources, s.resourceTTL)
+	}
+	return cachev3.NewSnapshot(snapVer, resources)
+}
 
-	err = s.cache.SetSnapshot(context.Background(), "__REFERENCE_SNAPSHOT__", snap)
-	if err != nil {
-		slog.Error("Failed setting reference snapshot", "error", err)
+// newSnapshotWithTTL builds a snapshot whose resources expire after ttl unless refreshed by a heartbeat
+func newSnapshotWithTTL(snapVer string, resources map[resource.Type][]types.Resource, ttl time.Duration) (*cachev3.Snapshot, error) {
+	withTTL := make(map[resource.Type][]types.ResourceWithTTL, len(resources))
+	for typeURL, list := range resources {
+		for _, res := range list {
+			withTTL[typeURL] = append(withTTL[typeURL], types.ResourceWithTTL{Resource: res, TTL: &ttl})
+		}
 	}
-	nodeIDs := s.cache.GetStatusKeys()
-	slog.Debug("node IDs", "nodeIDs", nodeIDs)
+	return cachev3.NewSnapshotWithTTLs(snapVer, withTTL)
+}
 
-	for _, nodeID := range nodeIDs {
-		err = s.cache.SetSnapshot(context.Background(), nodeID, snap)
-		if err != nil {
-			slog.Error("Failed setting snapshot", "nodeID", nodeID, "error", err)
+// checkUniqueNames fails if two resources of a type share a name, the snapshot would silently keep only one
+func checkUniqueNames(resources map[resource.Type][]types.Resource) error {
+	for typeURL, list := range resources {
+		seen := make(map[string]bool, len(list))
+		for _, res := range list {
+			name := cachev3.GetResourceName(res)
+			if seen[name] {
+				return fmt.Errorf("duplicate %s resource %q", typeURL, name)
+			}
+			seen[name] = true
 		}
 	}
-	slog.Info("Snapshot pushed",
-		"version", snapVer,
-		"listeners", len(listeners),
-		"clusters", len(clusters),
-		"endpoints", len(endpoints),
-		"routes", len(routes),
-		"virtualHosts", len(virtualHosts))
-	telemetry.MetricSnapshotsPushed.Inc()
+	return nil
+}
+
+// BuildSnapshot builds the reference snapshot of services without setting it in the cache,
+// for validating a configuration offline
+func (s *SnapshotManager) BuildSnapshot(services []*types2.DiscoveredService) (*cachev3.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buildSnapshot(fmt.Sprintf("%d", atomic.LoadUint64(&version)), servicesForNode(services, ""))
 }
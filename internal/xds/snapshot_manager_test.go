@@ -0,0 +1,170 @@
+package xds
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestManager returns a manager over a fresh snapshot cache, listening on 18080 unless config sets ports
+func newTestManager(config Config) *SnapshotManager {
+	if config.Cache == nil {
+		config.Cache = cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
+	}
+	if config.ListenerPorts == nil {
+		config.ListenerPorts = []uint32{18080}
+	}
+	return NewSnapshotManager(config)
+}
+
+// testService returns a service with one instance and a path prefix route of the same name
+func testService(name string) *types2.DiscoveredService {
+	return &types2.DiscoveredService{
+		Name:      name,
+		Instances: []types2.ServiceInstance{{Address: name + ".internal", Port: 8080}},
+		Routes:    []types2.RoutePattern{{Name: name, PathPrefix: "/" + name, Hosts: []string{"*"}}},
+	}
+}
+
+// buildTestSnapshot builds the reference snapshot of services, failing the test on error
+func buildTestSnapshot(t *testing.T, s *SnapshotManager, services ...*types2.DiscoveredService) *cachev3.Snapshot {
+	t.Helper()
+	snap, err := s.BuildSnapshot(services)
+	if err != nil {
+		t.Fatalf("BuildSnapshot: %v", err)
+	}
+	return snap
+}
+
+// getCluster returns the named cluster of the snapshot, nil when it has none
+func getCluster(snap *cachev3.Snapshot, name string) *cluster.Cluster {
+	cl, _ := snap.GetResources(resource.ClusterType)[name].(*cluster.Cluster)
+	return cl
+}
+
+// getRouteConfig returns the named route configuration of the snapshot, failing the test when it has none
+func getRouteConfig(t *testing.T, snap *cachev3.Snapshot, name string) *route.RouteConfiguration {
+	t.Helper()
+	rc, ok := snap.GetResources(resource.RouteType)[name].(*route.RouteConfiguration)
+	if !ok {
+		t.Fatalf("snapshot has no route configuration %q", name)
+	}
+	return rc
+}
+
+// getRoute returns the route of the default route configuration matching the path prefix, nil when it has none
+func getRoute(t *testing.T, snap *cachev3.Snapshot, prefix string) *route.Route {
+	t.Helper()
+	for _, vh := range getRouteConfig(t, snap, defaultRouteConfigName).GetVirtualHosts() {
+		for _, r := range vh.GetRoutes() {
+			if r.GetMatch().GetPrefix() == prefix {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// getListener returns the named listener, failing the test when the snapshot has none
+func getListener(t *testing.T, snap *cachev3.Snapshot, name string) *listener.Listener {
+	t.Helper()
+	ln, ok := snap.GetResources(resource.ListenerType)[name].(*listener.Listener)
+	if !ok {
+		t.Fatalf("snapshot has no listener %q", name)
+	}
+	return ln
+}
+
+// getHCM unpacks the HTTP connection manager of a listener's first filter chain
+func getHCM(t *testing.T, ln *listener.Listener) *hcm.HttpConnectionManager {
+	t.Helper()
+	manager := &hcm.HttpConnectionManager{}
+	if err := ln.GetFilterChains()[0].GetFilters()[0].GetTypedConfig().UnmarshalTo(manager); err != nil {
+		t.Fatalf("listener %s has no HTTP connection manager: %v", ln.GetName(), err)
+	}
+	return manager
+}
+
+func TestDrainingServiceKeepsClusterWithoutRoutes(t *testing.T) {
+	draining := testService("billing")
+	draining.Draining = true
+
+	snap := buildTestSnapshot(t, newTestManager(Config{}), draining, testService("orders"))
+
+	if getCluster(snap, "billing") == nil {
+		t.Error("draining service has no cluster")
+	}
+	if _, ok := snap.GetResources(resource.EndpointType)["billing"]; !ok {
+		t.Error("draining service has no endpoints")
+	}
+	if r := getRoute(t, snap, "/billing"); r != nil {
+		t.Errorf("draining service still has route %v", r)
+	}
+	if getRoute(t, snap, "/orders") == nil {
+		t.Error("other services lost their routes")
+	}
+}
+
+func TestMinPushIntervalCoalescesUpdates(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	s := newTestManager(Config{MinPushInterval: interval})
+	pushes := func() float64 { return testutil.ToFloat64(telemetry.MetricSnapshotsPushed) }
+
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders")})
+	start := pushes()
+	for _, name := range []string{"billing", "payments", "shipping"} {
+		s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders"), testService(name)})
+	}
+	if got := pushes() - start; got != 0 {
+		t.Fatalf("%v pushes during the cooldown, want none", got)
+	}
+
+	time.Sleep(2 * interval)
+	if got := pushes() - start; got != 1 {
+		t.Fatalf("%v pushes after the cooldown, want a single coalesced one", got)
+	}
+	snap, err := s.cache.GetSnapshot(ReferenceNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snap.GetResources(resource.ClusterType)["shipping"]; !ok {
+		t.Error("coalesced push is missing the latest update")
+	}
+}
+
+func TestDirectPushCancelsPendingPush(t *testing.T) {
+	s := newTestManager(Config{MinPushInterval: time.Hour})
+
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders")})
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("stale")})
+
+	// The cooldown ends and a newer update is pushed directly before the pending timer gets the lock
+	s.mu.Lock()
+	s.lastPush = time.Now().Add(-2 * time.Hour)
+	s.mu.Unlock()
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("latest")})
+	s.pushPending()
+
+	snap, err := s.cache.GetSnapshot(ReferenceNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := snap.GetResources(resource.ClusterType)
+	if _, ok := clusters["latest"]; !ok || len(clusters) != 1 {
+		t.Errorf("snapshot has clusters %v, want only the latest update", slices.Collect(maps.Keys(clusters)))
+	}
+	if s.pendingTimer != nil || s.pending != nil {
+		t.Error("direct push left an update pending")
+	}
+}
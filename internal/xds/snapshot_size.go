@@ -0,0 +1,61 @@
+package xds
+
+import (
+	"fmt"
+	"log/slog"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	"google.golang.org/protobuf/proto"
+)
+
+// snapshotSizes returns the marshaled size of the resources of each type in the snapshot.
+// Each type is sent to Envoy as a single discovery response, so the largest type is the one
+// that runs into gRPC message limits.
+func snapshotSizes(snap *cachev3.Snapshot) map[string]int {
+	sizes := make(map[string]int, len(hashedResourceTypes))
+	for _, typeURL := range hashedResourceTypes {
+		for _, res := range snap.GetResources(typeURL) {
+			sizes[typeURL] += proto.Size(res)
+		}
+	}
+	return sizes
+}
+
+// checkSnapshotSize warns when the largest resource type of the snapshot exceeds the warning
+// threshold and rejects the snapshot when it exceeds the hard limit. Either check is disabled when zero.
+func (s *SnapshotManager) checkSnapshotSize(nodeID string, snap *cachev3.Snapshot) error {
+	if s.snapshotSizeWarn <= 0 && s.snapshotSizeLimit <= 0 {
+		return nil
+	}
+
+	sizes := snapshotSizes(snap)
+	var largestType string
+	for typeURL, size := range sizes {
+		if largestType == "" || size > sizes[largestType] {
+			largestType = typeURL
+		}
+	}
+	largest := sizes[largestType]
+
+	attrs := []any{
+		"nodeID", nodeID,
+		"type", largestType,
+		"bytes", largest,
+		"listeners", len(snap.GetResources(resource.ListenerType)),
+		"clusters", len(snap.GetResources(resource.ClusterType)),
+		"endpoints", len(snap.GetResources(resource.EndpointType)),
+		"routes", len(snap.GetResources(resource.RouteType)),
+	}
+
+	if s.snapshotSizeLimit > 0 && largest > s.snapshotSizeLimit {
+		slog.Error("Snapshot exceeds the size limit, keeping the previous snapshot", append(attrs, "limit", s.snapshotSizeLimit)...)
+		telemetry.MetricSnapshotsTooLarge.Inc()
+		return fmt.Errorf("snapshot %s resources are %d bytes, exceeding the limit of %d", largestType, largest, s.snapshotSizeLimit)
+	}
+	if s.snapshotSizeWarn > 0 && largest > s.snapshotSizeWarn {
+		slog.Warn("Snapshot is approaching the size limit", append(attrs, "threshold", s.snapshotSizeWarn)...)
+	}
+	return nil
+}
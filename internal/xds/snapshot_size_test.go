@@ -0,0 +1,50 @@
+package xds
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	types2 "github.com/moonkev/flexds/internal/common/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSnapshotSizeLimitKeepsPreviousSnapshot(t *testing.T) {
+	s := newTestManager(Config{SnapshotSizeLimit: 64 << 10})
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders")})
+
+	var huge []*types2.DiscoveredService
+	for i := range 2000 {
+		huge = append(huge, testService(fmt.Sprintf("svc-%d", i)))
+	}
+	if _, err := s.BuildSnapshot(huge); err != nil {
+		t.Fatalf("BuildSnapshot: %v", err)
+	}
+	tooLarge := testutil.ToFloat64(telemetry.MetricSnapshotsTooLarge)
+	s.BuildAndPushSnapshot(huge)
+
+	if got := testutil.ToFloat64(telemetry.MetricSnapshotsTooLarge) - tooLarge; got != 1 {
+		t.Errorf("oversized snapshots counted = %v, want 1", got)
+	}
+	snap, err := s.cache.GetSnapshot(ReferenceNodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusters := snap.GetResources(resource.ClusterType); len(clusters) != 1 || clusters["orders"] == nil {
+		t.Errorf("pushed clusters = %d, want the previous snapshot with only orders", len(clusters))
+	}
+}
+
+func TestSnapshotSizeWarningStillPushes(t *testing.T) {
+	s := newTestManager(Config{SnapshotSizeWarn: 1})
+	tooLarge := testutil.ToFloat64(telemetry.MetricSnapshotsTooLarge)
+	s.BuildAndPushSnapshot([]*types2.DiscoveredService{testService("orders")})
+
+	if got := testutil.ToFloat64(telemetry.MetricSnapshotsTooLarge) - tooLarge; got != 0 {
+		t.Errorf("oversized snapshots counted = %v below the hard limit, want 0", got)
+	}
+	if _, err := s.cache.GetSnapshot(ReferenceNodeID); err != nil {
+		t.Errorf("snapshot over the warning threshold was not pushed: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package xds
+
+import (
+	"fmt"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tcpproxy "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	xdstype "github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// buildTcpListener creates a listener on the given address and port passing every connection through to the cluster
+func buildTcpListener(address string, port uint32, clusterName string) (*listener.Listener, error) {
+	tcpProxyAny, err := anypb.New(&tcpproxy.TcpProxy{
+		StatPrefix:       fmt.Sprintf("tcp_%s", clusterName),
+		ClusterSpecifier: &tcpproxy.TcpProxy_Cluster{Cluster: clusterName},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal tcp proxy: %w", err)
+	}
+
+	return &listener.Listener{
+		Name: fmt.Sprintf("listener_%d", port),
+		Address: &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Address:       address,
+					PortSpecifier: &core.SocketAddress_PortValue{PortValue: port},
+				},
+			},
+		},
+		FilterChains: []*listener.FilterChain{{
+			Filters: []*listener.Filter{{
+				Name:       xdstype.TCPProxy,
+				ConfigType: &listener.Filter_TypedConfig{TypedConfig: tcpProxyAny},
+			}},
+		}},
+	}, nil
+}
@@ -0,0 +1,398 @@
+// Package flexds runs the flexds control plane in-process: the xDS snapshot cache, the discovery
+// aggregator, the ADS gRPC server, the admin HTTP server and a set of discovery loaders.
+// The flexds command is a thin wrapper around it.
+package flexds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/moonkev/flexds/internal/common/httputil"
+	"github.com/moonkev/flexds/internal/common/telemetry"
+	"github.com/moonkev/flexds/internal/common/types"
+	"github.com/moonkev/flexds/internal/discovery"
+	"github.com/moonkev/flexds/internal/xds"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Aliases of the types used to configure the control plane, so every field of Config can be set from outside this module
+type (
+	XdsConfig           = xds.Config
+	TLSConfig           = xds.TLSConfig
+	SnapshotCache       = xds.SnapshotCache // Satisfied by go-control-plane's snapshot caches and LinearSnapshotCache
+	LinearSnapshotCache = xds.LinearSnapshotCache
+	ListenerOptions     = xds.ListenerOptions
+	FilterChainMatch    = xds.FilterChainMatch
+	ServiceDefaults     = xds.ServiceDefaults
+	ClusterNamePolicy   = xds.ClusterNamePolicy
+	RequestIdOptions    = xds.RequestIdOptions
+	AccessLogOptions    = xds.AccessLogOptions
+	ScopedRoutesOptions = xds.ScopedRoutesOptions
+)
+
+// Aliases of the types used to write discovery loaders and the services they report
+type (
+	Loader             = discovery.Loader
+	Reloader           = discovery.Reloader
+	Aggregator         = discovery.DiscoveredServiceAggregator
+	DiscoveredService  = types.DiscoveredService
+	ServiceInstance    = types.ServiceInstance
+	RoutePattern       = types.RoutePattern
+	HealthCheck        = types.HealthCheck
+	OutlierDetection   = types.OutlierDetection
+	TcpKeepalive       = types.TcpKeepalive
+	CorsPolicy         = types.CorsPolicy
+	RetryPolicy        = types.RetryPolicy
+	WeightedCluster    = types.WeightedCluster
+	RedirectAction     = types.RedirectAction
+	DirectResponse     = types.DirectResponse
+	JwtProvider        = types.JwtProvider
+	GrpcJsonTranscoder = types.GrpcJsonTranscoder
+)
+
+// ProtocolTCP is the DiscoveredService protocol of services proxied over TCP instead of HTTP
+const ProtocolTCP = types.ProtocolTCP
+
+// ReferenceNodeID is the cache key of the snapshot served to nodes not targeted by a node selector or scope
+const ReferenceNodeID = xds.ReferenceNodeID
+
+var (
+	// NewLoaderFunc returns a Loader with the given name that runs a start function
+	NewLoaderFunc = discovery.NewLoaderFunc
+
+	// Constructors and parsers of XdsConfig settings, as used by the flexds command's flags
+	NewLinearSnapshotCache            = xds.NewLinearSnapshotCache
+	ParseClusterNamePolicy            = xds.ParseClusterNamePolicy
+	ParsePathWithEscapedSlashesAction = xds.ParsePathWithEscapedSlashesAction
+	ParseListenAddress                = xds.ParseListenAddress
+	BuildDnsResolverConfig            = xds.BuildDnsResolverConfig
+)
+
+const (
+	CacheModeSnapshot = "snapshot"
+	CacheModeLinear   = "linear" // Sends only changed resources, serving every node the same services
+
+	// shutdownTimeout bounds how long Run waits for the servers and loaders to stop
+	shutdownTimeout = 5 * time.Second
+
+	// heartbeatsPerTTL is how many heartbeats refresh resources within their TTL, so a lost one doesn't expire them
+	heartbeatsPerTTL = 3
+
+	// dryRunSettle is how long DryRun waits for further updates once every loader has reported
+	dryRunSettle = time.Second
+)
+
+// Config configures a control plane
+type Config struct {
+	Xds       XdsConfig // Snapshot settings, Xds.Cache is created from CacheMode when nil
+	CacheMode string    // CacheModeSnapshot or CacheModeLinear, snapshot when empty
+
+	AdsPort           int
+	AdsTLS            TLSConfig
+	GrpcReflection    bool
+	NodeAllowlistFile string // Node ids allowed to fetch configuration, one per line, all nodes when empty
+
+	AdminAddress string // host:port of the admin HTTP server, no admin server when empty
+	AdminGzip    bool   // gzip the JSON responses of the admin endpoints
+	RestXds      bool   // also serve xDS as REST-JSON on the admin server, requires the snapshot cache
+
+	AggregatorDebounce time.Duration
+	Loaders            []Loader // Discovery loaders started by Run
+}
+
+// ControlPlane is a configured control plane, started by Run
+type ControlPlane struct {
+	config     Config
+	cache      xds.SnapshotCache
+	heartbeats context.CancelFunc // Stops the cache's heartbeats, nil without a resource TTL
+	snapshots  *xds.SnapshotManager
+	aggregator *discovery.DiscoveredServiceAggregator
+	allowlist  *xds.NodeAllowlist
+	adsServer  serverv3.Server
+	admin      *http.Server
+}
+
+// New builds a control plane from the config without starting it
+func New(config Config) (*ControlPlane, error) {
+	switch config.CacheMode {
+	case "":
+		config.CacheMode = CacheModeSnapshot
+	case CacheModeSnapshot, CacheModeLinear:
+	default:
+		return nil, fmt.Errorf("cache mode must be %s or %s, got %q", CacheModeSnapshot, CacheModeLinear, config.CacheMode)
+	}
+	if config.RestXds && config.CacheMode == CacheModeLinear {
+		return nil, fmt.Errorf("REST-JSON xDS requires the snapshot cache mode")
+	}
+	if config.Xds.ResourceTTL > 0 && config.CacheMode == CacheModeLinear {
+		return nil, fmt.Errorf("resource TTLs require the snapshot cache mode")
+	}
+	names := make(map[string]bool, len(config.Loaders))
+	for _, loader := range config.Loaders {
+		if names[loader.Name()] {
+			return nil, fmt.Errorf("discovery loader %q is configured more than once", loader.Name())
+		}
+		names[loader.Name()] = true
+	}
+
+	telemetry.InitMetrics()
+
+	cp := &ControlPlane{config: config}
+
+	cp.cache = config.Xds.Cache
+	if cp.cache == nil {
+		switch {
+		case config.CacheMode == CacheModeLinear:
+			cp.cache = xds.NewLinearSnapshotCache()
+		case config.Xds.ResourceTTL > 0:
+			var heartbeatCtx context.Context
+			heartbeatCtx, cp.heartbeats = context.WithCancel(context.Background())
+			cp.cache = cachev3.NewSnapshotCacheWithHeartbeating(heartbeatCtx, true, cachev3.IDHash{}, xds.CacheLogger, config.Xds.ResourceTTL/heartbeatsPerTTL)
+		default:
+			cp.cache = cachev3.NewSnapshotCache(true, cachev3.IDHash{}, xds.CacheLogger)
+		}
+		config.Xds.Cache = cp.cache
+	}
+	cp.snapshots = xds.NewSnapshotManager(config.Xds)
+	cp.aggregator = discovery.NewDiscoveredServiceAggregator(cp.snapshots, discovery.WithDebounce(config.AggregatorDebounce))
+
+	callbacks := &xds.ServerCallbacks{Snapshots: cp.snapshots}
+	if config.NodeAllowlistFile != "" {
+		allowlist, err := xds.NewNodeAllowlist(config.NodeAllowlistFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load node allowlist: %w", err)
+		}
+		cp.allowlist = allowlist
+		callbacks.Allowlist = allowlist
+	}
+	cp.adsServer = serverv3.NewServer(context.Background(), cp.cache, callbacks)
+
+	if config.AdminAddress != "" {
+		cp.admin = &http.Server{Addr: config.AdminAddress, Handler: cp.adminHandler()}
+	}
+	return cp, nil
+}
+
+// adminHandler serves metrics, health and the debug endpoints, plus REST-JSON xDS when enabled
+func (cp *ControlPlane) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("ok")) })
+	jsonHandler := func(h http.Handler) http.Handler { return h }
+	if cp.config.AdminGzip {
+		jsonHandler = httputil.Gzip
+	}
+	mux.Handle("GET /snapshot", jsonHandler(xds.NewSnapshotDumpHandler(cp.cache)))
+	mux.Handle("GET /services", jsonHandler(discovery.NewServicesHandler(cp.aggregator)))
+	mux.Handle("GET /services/raw", jsonHandler(discovery.NewRawServicesHandler(cp.aggregator)))
+	if cp.config.RestXds {
+		restHandler := xds.NewRESTHandler(cp.adsServer)
+		for _, path := range xds.RESTPaths {
+			mux.Handle("POST "+path, restHandler)
+		}
+		slog.Info("serving REST-JSON xDS on the admin port", "paths", xds.RESTPaths)
+	}
+	return mux
+}
+
+// Aggregator returns the aggregator loaders report services to, letting callers push services directly
+func (cp *ControlPlane) Aggregator() *Aggregator {
+	return cp.aggregator
+}
+
+// ReloadNodeAllowlist re-reads the node allowlist file, keeping the previous allowlist on error.
+// It does nothing when no allowlist is configured.
+func (cp *ControlPlane) ReloadNodeAllowlist() error {
+	if cp.allowlist == nil {
+		return nil
+	}
+	return cp.allowlist.Reload()
+}
+
+// Reload asks every loader that implements Reloader to re-read its source, such as the YAML file,
+// without waiting for the reloads. Watch-based loaders like Consul's are always current and ignore it.
+func (cp *ControlPlane) Reload() {
+	for _, loader := range cp.config.Loaders {
+		if reloader, ok := loader.(Reloader); ok {
+			slog.Info("reloading discovery loader", "loader", loader.Name())
+			reloader.Reload()
+		}
+	}
+}
+
+// Run starts the ADS server, the admin server and the discovery loaders, blocking until the context
+// is cancelled or one of them fails. It then stops the rest and returns the failure, if any.
+func (cp *ControlPlane) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2+len(cp.config.Loaders))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := xds.RunGRPC(ctx, cp.adsServer, cp.config.AdsPort, cp.config.AdsTLS, cp.config.GrpcReflection); err != nil {
+			errs <- err
+		}
+	}()
+
+	if cp.admin != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.Info("starting admin http server", "address", cp.admin.Addr)
+			if err := cp.admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("admin server failed: %w", err)
+			}
+		}()
+	}
+
+	for _, loader := range cp.config.Loaders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.Info("starting discovery loader", "loader", loader.Name())
+			if err := loader.Start(ctx, cp.aggregator); err != nil {
+				errs <- fmt.Errorf("discovery loader %q failed: %w", loader.Name(), err)
+			}
+		}()
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down services")
+	case runErr = <-errs:
+		slog.Error("shutting down services after a failure", "error", runErr)
+	}
+	cancel()
+
+	// Wait for all goroutines with a timeout
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if cp.admin != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelShutdown()
+		if err := cp.admin.Shutdown(shutdownCtx); err != nil {
+			slog.Error("admin server shutdown error", "error", err)
+		}
+	}
+	select {
+	case <-done:
+		slog.Info("all services stopped gracefully")
+	case <-time.After(shutdownTimeout):
+		slog.Warn("shutdown timeout exceeded, abandoning remaining services")
+	}
+	if cp.heartbeats != nil {
+		cp.heartbeats()
+	}
+	return runErr
+}
+
+// DryRun runs the discovery loaders until each has reported its services, builds the snapshot they
+// produce and writes it to w as JSON, without starting the ADS or admin servers. It fails if a loader
+// fails or reports an error, the context ends before every loader has reported, or the snapshot can't
+// be built.
+func (cp *ControlPlane) DryRun(ctx context.Context, w io.Writer) error {
+	loaderCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// A loader may report under several ids, such as one per Consul datacenter, so each gets an aggregator
+	// of its own to tell which loaders have completed their first update
+	var mu sync.Mutex
+	pending := len(cp.config.Loaders)
+	var failed error
+	complete := func(err error, done *bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil && failed == nil {
+			failed = err
+		}
+		if !*done {
+			*done = true
+			pending--
+		}
+	}
+
+	loaderAggregators := make([]*discovery.DiscoveredServiceAggregator, len(cp.config.Loaders))
+	for i, loader := range cp.config.Loaders {
+		name := loader.Name()
+		var done bool
+		loaderAggregators[i] = discovery.NewDiscoveredServiceAggregator(nil, discovery.WithReportHook(func(loaderId string, err error) {
+			if err != nil {
+				err = fmt.Errorf("discovery loader %q reported an error for %s: %w", name, loaderId, err)
+			}
+			complete(err, &done)
+		}))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slog.Info("starting discovery loader", "loader", name)
+			err := loader.Start(loaderCtx, loaderAggregators[i])
+			if err != nil {
+				err = fmt.Errorf("discovery loader %q failed: %w", name, err)
+			}
+			// A loader returning without reporting has nothing to wait for
+			complete(err, &done)
+		}()
+	}
+
+	// Wait for the first update of every loader and for further updates to settle
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		mu.Lock()
+		remaining, err := pending, failed
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		var lastUpdate time.Time
+		for _, aggregator := range loaderAggregators {
+			if update := aggregator.LastUpdate(); update.After(lastUpdate) {
+				lastUpdate = update
+			}
+		}
+		if remaining == 0 && time.Since(lastUpdate) >= dryRunSettle {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			if remaining > 0 {
+				return fmt.Errorf("%d of %d discovery loaders did not report their services in time: %w", remaining, len(loaderAggregators), ctx.Err())
+			}
+			return fmt.Errorf("discovery updates did not settle in time: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	for _, aggregator := range loaderAggregators {
+		for loaderId, services := range aggregator.Snapshot() {
+			if err := cp.aggregator.UpdateServices(loaderId, services); err != nil {
+				return err
+			}
+		}
+	}
+	snap, err := cp.snapshots.BuildSnapshot(cp.aggregator.Services())
+	if err != nil {
+		return fmt.Errorf("failed to build snapshot: %w", err)
+	}
+	return xds.WriteSnapshotDump(w, xds.ReferenceNodeID, snap)
+}
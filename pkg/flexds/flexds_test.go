@@ -0,0 +1,230 @@
+package flexds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// freePort returns a port that was free on the loopback interface
+func freePort(t *testing.T) int {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+// startControlPlane runs the control plane until the test ends, failing the test if Run fails
+func startControlPlane(t *testing.T, config Config) *ControlPlane {
+	t.Helper()
+	cp, err := New(config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- cp.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+	return cp
+}
+
+// waitForHTTP polls url until it answers 200 OK
+func waitForHTTP(t *testing.T, url string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not answer in time: %v", url, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAdminServerBindsConfiguredAddress(t *testing.T) {
+	port := strconv.Itoa(freePort(t))
+	startControlPlane(t, Config{AdsPort: freePort(t), AdminAddress: net.JoinHostPort("127.0.0.1", port)})
+
+	waitForHTTP(t, "http://"+net.JoinHostPort("127.0.0.1", port)+"/healthz")
+
+	// Linux routes all of 127.0.0.0/8 to the loopback interface, a server bound to every interface answers there too
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.2", port), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("admin server bound to 127.0.0.1 accepted a connection on 127.0.0.2")
+	}
+}
+
+func TestEmbeddedControlPlaneServesLoaderServices(t *testing.T) {
+	policy, err := ParseClusterNamePolicy("sanitize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader := NewLoaderFunc("embedded", func(ctx context.Context, aggregator *Aggregator) error {
+		err := aggregator.UpdateServices("embedded", []*DiscoveredService{{
+			Name:      "shop/orders",
+			Instances: []ServiceInstance{{Address: "10.0.0.1", Port: 8080}},
+			Routes: []RoutePattern{{
+				Name:       "orders",
+				PathPrefix: "/orders",
+				Hosts:      []string{"*"},
+				Retry:      &RetryPolicy{RetryOn: "5xx", NumRetries: 2},
+			}},
+			TcpKeepalive: &TcpKeepalive{Probes: 3},
+		}})
+		if err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return nil
+	})
+
+	adsAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	adminAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	_, adsPort, _ := net.SplitHostPort(adsAddress)
+	port, _ := strconv.Atoi(adsPort)
+	startControlPlane(t, Config{
+		Xds: XdsConfig{
+			ListenerPorts:     []uint32{18080},
+			ListenerOptions:   map[uint32]ListenerOptions{18080: {AcceptHttp10: true}},
+			Defaults:          ServiceDefaults{ConnectTimeout: 3 * time.Second},
+			ClusterNamePolicy: policy,
+		},
+		CacheMode:    CacheModeSnapshot,
+		AdsPort:      port,
+		AdminAddress: adminAddress,
+		Loaders:      []Loader{loader},
+	})
+	waitForHTTP(t, "http://"+adminAddress+"/healthz")
+
+	conn, err := grpc.NewClient(adsAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := clusterservice.NewClusterDiscoveryServiceClient(conn)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := client.FetchClusters(ctx, &discoveryv3.DiscoveryRequest{Node: &core.Node{Id: "embedded-test"}, TypeUrl: resource.ClusterType})
+		cancel()
+		if err == nil && len(resp.GetResources()) == 1 {
+			var cl cluster.Cluster
+			if err := resp.GetResources()[0].UnmarshalTo(&cl); err != nil {
+				t.Fatal(err)
+			}
+			if cl.GetName() != "shop_orders" || cl.GetConnectTimeout().AsDuration() != 3*time.Second {
+				t.Errorf("got cluster %s with a %v connect timeout, want shop_orders with the 3s default", cl.GetName(), cl.GetConnectTimeout().AsDuration())
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the loader's cluster was not served over ADS: %v, %v", resp, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// reportingLoader reports each of its services under its own id after delay, then blocks
+func reportingLoader(name string, delay time.Duration, services ...string) Loader {
+	return NewLoaderFunc(name, func(ctx context.Context, aggregator *Aggregator) error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		for _, service := range services {
+			err := aggregator.UpdateServices(name+"_"+service, []*DiscoveredService{{
+				Name:      service,
+				Instances: []ServiceInstance{{Address: "10.0.0.1", Port: 8080}},
+				Routes:    []RoutePattern{{Name: service, PathPrefix: "/" + service, Hosts: []string{"*"}}},
+			}})
+			if err != nil {
+				return err
+			}
+		}
+		<-ctx.Done()
+		return nil
+	})
+}
+
+func TestDryRunWaitsForEveryLoader(t *testing.T) {
+	// The first loader reports two ids, as Consul does for two datacenters, before the second reports at all
+	cp, err := New(Config{
+		Xds: XdsConfig{ListenerPorts: []uint32{18080}},
+		Loaders: []Loader{
+			reportingLoader("consul", 0, "orders", "payments"),
+			reportingLoader("yaml", 1500*time.Millisecond, "users"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var out bytes.Buffer
+	if err := cp.DryRun(ctx, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range []string{"orders", "payments", "users"} {
+		if !strings.Contains(out.String(), `"`+service+`"`) {
+			t.Errorf("the dry run output is missing the %s cluster", service)
+		}
+	}
+}
+
+func TestDryRunFailsOnReportedError(t *testing.T) {
+	reportErr := errors.New("registry unavailable")
+	failing := NewLoaderFunc("consul", func(ctx context.Context, aggregator *Aggregator) error {
+		aggregator.ReportError("consul_dc1", reportErr)
+		<-ctx.Done()
+		return nil
+	})
+	cp, err := New(Config{
+		Xds:     XdsConfig{ListenerPorts: []uint32{18080}},
+		Loaders: []Loader{failing, reportingLoader("yaml", 0, "users")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err = cp.DryRun(ctx, &bytes.Buffer{})
+	if !errors.Is(err, reportErr) {
+		t.Fatalf("got %v, want the reported error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the dry run failed after %v, want it to fail as soon as the error is reported", elapsed)
+	}
+}